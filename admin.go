@@ -0,0 +1,113 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Stats is a snapshot of the metrics counters of a Player for
+// quick checks.
+type Stats struct {
+	Streams int64 `json:"streams"`
+	// requests parsed per protocol and their sum
+	RequestsParsed map[string]uint64 `json:"requests_parsed"`
+	RequestsTotal  uint64            `json:"requests_total"`
+	QueueDepth     int64             `json:"queue_depth"`
+	BytesSent      uint64            `json:"bytes_sent"`
+	BytesReceived  uint64            `json:"bytes_received"`
+	// open tcp connections to targets
+	ActiveConns int64  `json:"active_conns"`
+	SendErrors  uint64 `json:"send_errors"`
+	Reconnects  uint64 `json:"reconnects"`
+	// circuit state by target address, empty without breakers
+	Breakers map[string]string `json:"breakers"`
+	// set if a deliver is paused
+	Paused bool `json:"paused"`
+	// requests per second allowed by the rate limit as raised
+	// by a ramp up, 0 for unlimited
+	MaxQPS int64 `json:"max_qps"`
+	// request copies queued to each deliver pipeline
+	Pipelines map[string]uint64 `json:"pipelines"`
+	// sizes of parsed requests in bytes, and their rate per
+	// second of capture time averaged over a minute and of the
+	// busiest second
+	RequestSize     *metrics.HistogramValue `json:"request_size"`
+	RequestRate     float64                 `json:"request_rate"`
+	RequestRatePeak uint64                  `json:"request_rate_peak"`
+}
+
+// ReadStats reads the current values of the metrics counters
+// of p.
+func (p *Player) ReadStats() *Stats {
+	m := p.metrics
+	s := &Stats{
+		Streams:        m.ActiveStreams.Value(),
+		RequestsParsed: m.RequestsParsed.Values(),
+		QueueDepth:     m.QueueDepth.Value(),
+		BytesSent:      m.BytesSent.Value(),
+		BytesReceived:  m.BytesReceived.Value(),
+		ActiveConns:    m.ActiveConns.Value(),
+		SendErrors:     m.SendErrors.Value(),
+		Reconnects:     m.Reconnects.Value(),
+		Breakers:       make(map[string]string),
+		Paused:         m.Paused.Value() > 0,
+		MaxQPS:         m.MaxQPS.Value(),
+		Pipelines:      m.PipelineQueued.Values(),
+		RequestSize:    m.RequestSize.Value(),
+	}
+	s.RequestRate, s.RequestRatePeak = m.RequestRate.Value()
+	for _, n := range s.RequestsParsed {
+		s.RequestsTotal += n
+	}
+	for addr, state := range m.BreakerState.Values() {
+		s.Breakers[addr] = deliver.BreakerState(state).String()
+	}
+	return s
+}
+
+func (p *Player) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p.ReadStats()); err != nil {
+		log.Errorf("write stats failed: %v", err)
+	}
+}
+
+// serveAdmin listens on addr and serves the Stats of p on /stats
+// in background until the returned server is closed.
+func (p *Player) serveAdmin(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen admin address %s failed: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", p.statsHandler)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("serve admin failed: %v", err)
+		}
+	}()
+	log.Infof("serve stats on %s/stats", ln.Addr())
+	return srv, nil
+}
@@ -0,0 +1,224 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// packets waiting to be written, capturing blocks when full
+	ArchiveQueueSize     int = 4096
+	DefaultArchivePrefix     = "capture"
+	archiveSnaplen           = 65535
+)
+
+// ArchiveConfig keeps captured packets in rotating pcap files.
+type ArchiveConfig struct {
+	// directory of the files, required
+	Dir string
+	// file names are Prefix-<capture time>-<seq>.pcap, default
+	// DefaultArchivePrefix
+	Prefix string
+	// a new file is started once the current one reaches
+	// MaxSize bytes or spans MaxAge of capture time, 0 for no
+	// limit
+	MaxSize int64
+	MaxAge  time.Duration
+	// files kept, older files of this run are removed, 0 keeps
+	// all
+	Keep int
+}
+
+// archive writes packets of all sources to rotating pcap files
+// in a goroutine, so disk writes do not stall capturing.
+type archive struct {
+	c  *ArchiveConfig
+	ch chan gopacket.Packet
+	// closed by close, later packets are dropped
+	stop chan struct{}
+	// closed when queued packets are written
+	done chan struct{}
+
+	f        *os.File
+	w        *bufio.Writer
+	pw       *pcapgo.Writer
+	linkType layers.LinkType
+	size     int64
+	opened   time.Time
+	seq      int
+	files    []string
+}
+
+// write queues packet, it blocks while the queue is full.
+func (a *archive) write(packet gopacket.Packet) {
+	if a == nil {
+		return
+	}
+	select {
+	case <-a.stop:
+	case a.ch <- packet:
+	}
+}
+
+// close writes queued packets and closes the current file, it
+// is safe while sources still write.
+func (a *archive) close() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+}
+
+func (a *archive) run() {
+	defer close(a.done)
+	defer a.closeFile()
+	for {
+		select {
+		case packet := <-a.ch:
+			a.writePacket(packet)
+		case <-a.stop:
+			for {
+				select {
+				case packet := <-a.ch:
+					a.writePacket(packet)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *archive) writePacket(packet gopacket.Packet) {
+	if err := a.writeFile(packet); err != nil {
+		log.Errorf("archive packet failed: %v", err)
+	}
+}
+
+func (a *archive) writeFile(packet gopacket.Packet) error {
+	ls := packet.Layers()
+	if len(ls) == 0 {
+		return nil
+	}
+	lt, ok := archiveLinkType(ls[0].LayerType())
+	if !ok {
+		log.Debugf("archive skip packet of %v", ls[0].LayerType())
+		return nil
+	}
+	ci := packet.Metadata().CaptureInfo
+	if a.f == nil || lt != a.linkType || a.full(ci.Timestamp) {
+		if err := a.rotate(lt, ci.Timestamp); err != nil {
+			return err
+		}
+	}
+	if err := a.pw.WritePacket(ci, packet.Data()); err != nil {
+		return err
+	}
+	a.size += int64(16 + len(packet.Data()))
+	return nil
+}
+
+func (a *archive) full(seen time.Time) bool {
+	return a.c.MaxSize > 0 && a.size >= a.c.MaxSize ||
+		a.c.MaxAge > 0 && seen.Sub(a.opened) >= a.c.MaxAge
+}
+
+// rotate closes the current file, opens a new one and removes
+// files beyond Keep.
+func (a *archive) rotate(lt layers.LinkType, seen time.Time) error {
+	a.closeFile()
+	a.seq++
+	name := fmt.Sprintf("%s-%s-%d.pcap", a.c.Prefix, seen.Format("20060102-150405"), a.seq)
+	path := filepath.Join(a.c.Dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create archive file failed: %v", err)
+	}
+	a.f, a.w = f, bufio.NewWriter(f)
+	a.pw = pcapgo.NewWriter(a.w)
+	if err := a.pw.WriteFileHeader(archiveSnaplen, lt); err != nil {
+		return fmt.Errorf("write archive file header failed: %v", err)
+	}
+	a.linkType, a.size, a.opened = lt, 24, seen
+	a.files = append(a.files, path)
+	log.Infof("archive captured packets to %s", path)
+	for a.c.Keep > 0 && len(a.files) > a.c.Keep {
+		if err := os.Remove(a.files[0]); err != nil {
+			log.Errorf("remove archive file failed: %v", err)
+		}
+		a.files = a.files[1:]
+	}
+	return nil
+}
+
+func (a *archive) closeFile() {
+	if a.f == nil {
+		return
+	}
+	if err := a.w.Flush(); err != nil {
+		log.Errorf("flush archive file %s failed: %v", a.f.Name(), err)
+	}
+	if err := a.f.Close(); err != nil {
+		log.Errorf("close archive file %s failed: %v", a.f.Name(), err)
+	}
+	a.f = nil
+}
+
+// archiveLinkType returns the pcap link type of packets whose
+// first layer is t.
+func archiveLinkType(t gopacket.LayerType) (layers.LinkType, bool) {
+	switch t {
+	case layers.LayerTypeEthernet:
+		return layers.LinkTypeEthernet, true
+	case layers.LayerTypeLinuxSLL:
+		return layers.LinkTypeLinuxSLL, true
+	case layers.LayerTypeLoopback:
+		return layers.LinkTypeNull, true
+	case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		return layers.LinkTypeRaw, true
+	}
+	return 0, false
+}
+
+func newArchive(c *ArchiveConfig) (*archive, error) {
+	if c.Dir == "" {
+		return nil, fmt.Errorf("archive dir is required")
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("create archive dir failed: %v", err)
+	}
+	ac := *c
+	if ac.Prefix == "" {
+		ac.Prefix = DefaultArchivePrefix
+	}
+	a := &archive{
+		c:    &ac,
+		ch:   make(chan gopacket.Packet, ArchiveQueueSize),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
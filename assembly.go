@@ -0,0 +1,129 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// assembly guards an assembler shared by sources, the
+// assembler is not safe for concurrent use.
+type assembly struct {
+	mu        sync.Mutex
+	assembler *tcpassembly.Assembler
+	// latest capture timestamp, flushing goes by capture time
+	// so that offline files are flushed like live traffic
+	latest time.Time
+	// packet being assembled, for directionFilter
+	current *layers.TCP
+}
+
+// assemble adds tcp of a packet with network flow net, the
+// streams are keyed by both flows.
+func (a *assembly) assemble(net gopacket.Flow, tcp *layers.TCP, seen time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if seen.After(a.latest) {
+		a.latest = seen
+	}
+	a.current = tcp
+	a.assembler.AssembleWithTimestamp(net, tcp, seen)
+	a.current = nil
+}
+
+// flush pushes data waiting longer than d for a missing
+// segment to the streams, and closes connections idle for d.
+func (a *assembly) flush(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.latest.IsZero() {
+		return
+	}
+	flushed, closed := a.assembler.FlushOlderThan(a.latest.Add(-d))
+	if flushed > 0 {
+		log.Infof("flushed %d streams, closed %d", flushed, closed)
+	}
+}
+
+// skipGaps pushes data waiting longer than d for a missing
+// segment to the streams, idle connections are left open.
+func (a *assembly) skipGaps(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.latest.IsZero() {
+		return
+	}
+	flushed, closed := a.assembler.FlushWithOptions(tcpassembly.FlushOptions{T: a.latest.Add(-d)})
+	if flushed > 0 {
+		log.Debugf("skipped gaps of %d streams, closed %d", flushed, closed)
+	}
+}
+
+// flushAll closes all streams so buffered requests get delivered.
+func (a *assembly) flushAll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.assembler.FlushAll()
+}
+
+// flushEvery flushes a every interval until ctx is done.
+func (a *assembly) flushEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			a.flush(interval)
+		}
+	}
+}
+
+// skipGapsEvery skips gaps older than timeout until ctx is
+// done, a gap is skipped within half a timeout after it is due.
+func (a *assembly) skipGapsEvery(ctx context.Context, timeout time.Duration) {
+	t := time.NewTicker(timeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			a.skipGaps(timeout)
+		}
+	}
+}
+
+// newAssembly creates an assembly of streams of direction by
+// f, DirectionBoth if empty.
+func newAssembly(f tcpassembly.StreamFactory, perConn, total int, direction string) *assembly {
+	a := &assembly{}
+	switch direction {
+	case DirectionC2S, DirectionS2C:
+		f = &directionFilter{f: f, a: a, c2s: direction == DirectionC2S}
+	}
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(f))
+	assembler.MaxBufferedPagesPerConnection = perConn
+	assembler.MaxBufferedPagesTotal = total
+	a.assembler = assembler
+	return a
+}
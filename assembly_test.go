@@ -0,0 +1,32 @@
+package tcplayer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFlushEveryPassesGap(t *testing.T) {
+	s := &dataStream{}
+	a := newAssembly(&clientFactory{s: s}, DefaultMaxBufferedPagesPerConn, 0, DirectionBoth)
+	gapConn(a)
+	// the gap waits 3 seconds of capture time
+	a.flush(5 * time.Second)
+	if data, _ := s.state(); data != "aaaa" {
+		t.Fatalf("got %q before FlushInterval passed, want %q", data, "aaaa")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.flushEvery(ctx, 100*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, _ := s.state()
+		if data == "aaaacccc" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q after FlushInterval passed, want %q", data, "aaaacccc")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
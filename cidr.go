@@ -0,0 +1,126 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// cidrSet matches addresses within an include network, or any
+// address if there is none, and within no exclude network.
+type cidrSet struct {
+	include []*net.IPNet
+	exclude []*net.IPNet
+}
+
+func (s *cidrSet) match(ip net.IP) bool {
+	if s == nil {
+		return true
+	}
+	for _, n := range s.exclude {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, n := range s.include {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses networks like 10.1.0.0/16, an address
+// without a mask is a single host and a leading ! excludes the
+// network. It returns nil for no networks.
+func parseCIDRs(cidrs []string) (*cidrSet, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	s := &cidrSet{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		exclude := strings.HasPrefix(c, "!")
+		c = strings.TrimPrefix(c, "!")
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("cidr %q not valid", c)
+		}
+		if exclude {
+			s.exclude = append(s.exclude, n)
+		} else {
+			s.include = append(s.include, n)
+		}
+	}
+	return s, nil
+}
+
+// addrFilter matches the network layer addresses of captured
+// packets, a nil addrFilter matches all.
+type addrFilter struct {
+	src *cidrSet
+	dst *cidrSet
+}
+
+func (a *addrFilter) match(flow gopacket.Flow) bool {
+	if a == nil {
+		return true
+	}
+	src, dst := flow.Endpoints()
+	return a.src.match(src.Raw()) && a.dst.match(dst.Raw())
+}
+
+func newAddrFilter(src, dst []string) (*addrFilter, error) {
+	s, err := parseCIDRs(src)
+	if err != nil {
+		return nil, fmt.Errorf("source %v", err)
+	}
+	d, err := parseCIDRs(dst)
+	if err != nil {
+		return nil, fmt.Errorf("dest %v", err)
+	}
+	if s == nil && d == nil {
+		return nil, nil
+	}
+	return &addrFilter{src: s, dst: d}, nil
+}
+
+// cidrFilter creates streams of matching addresses with the
+// factory, others are dropped like by directionFilter.
+type cidrFilter struct {
+	f     tcpassembly.StreamFactory
+	addrs *addrFilter
+}
+
+func (c *cidrFilter) New(l, r gopacket.Flow) tcpassembly.Stream {
+	if !c.addrs.match(l) {
+		return dropStream{}
+	}
+	return c.f.New(l, r)
+}
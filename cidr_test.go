@@ -0,0 +1,71 @@
+package tcplayer
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCIDRSetMatch(t *testing.T) {
+	for _, c := range []struct {
+		cidrs []string
+		ip    string
+		want  bool
+	}{
+		{nil, "10.1.0.5", true},
+		{[]string{"10.1.0.0/16"}, "10.1.0.5", true},
+		{[]string{"10.1.0.0/16"}, "10.2.0.5", false},
+		{[]string{"10.1.0.0/16", "10.2.0.0/16"}, "10.2.0.5", true},
+		{[]string{"!10.1.0.0/16"}, "10.1.0.5", false},
+		{[]string{"!10.1.0.0/16"}, "192.168.0.5", true},
+		// excludes win over includes
+		{[]string{"10.1.0.0/16", "!10.1.2.0/24"}, "10.1.2.3", false},
+		{[]string{"10.1.0.0/16", "!10.1.2.0/24"}, "10.1.3.3", true},
+		// a host without a mask
+		{[]string{"10.1.0.5"}, "10.1.0.5", true},
+		{[]string{"10.1.0.5"}, "10.1.0.6", false},
+		{[]string{"fd00::/8"}, "fd00::1", true},
+		{[]string{"fd00::/8"}, "10.1.0.5", false},
+	} {
+		s, err := parseCIDRs(c.cidrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.match(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("%v match %s got %v, want %v", c.cidrs, c.ip, got, c.want)
+		}
+	}
+	if _, err := parseCIDRs([]string{"10.1.0.0/33"}); err == nil {
+		t.Error("parsed a mask longer than the address")
+	}
+}
+
+func TestCIDRFilterStreams(t *testing.T) {
+	for _, c := range []struct {
+		src, dst []string
+		want     []string
+	}{
+		{[]string{"10.1.0.0/16"}, nil, []string{"10.1.0.5->10.0.0.1"}},
+		// responses to the excluded client come from the server
+		{[]string{"!10.1.0.0/16"}, nil, []string{"10.0.0.1->10.1.0.5", "10.2.0.5->10.0.0.1", "10.0.0.1->10.2.0.5"}},
+		{nil, []string{"10.0.0.1"}, []string{"10.1.0.5->10.0.0.1", "10.2.0.5->10.0.0.1"}},
+		{[]string{"10.2.0.0/16"}, []string{"10.0.0.1"}, []string{"10.2.0.5->10.0.0.1"}},
+	} {
+		addrs, err := newAddrFilter(c.src, c.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &flowFactory{}
+		a := newAssembly(&cidrFilter{f: f, addrs: addrs}, 0, 0, DirectionBoth)
+		for _, client := range []net.IP{net.IPv4(10, 1, 0, 5), net.IPv4(10, 2, 0, 5)} {
+			assembleConn(a, client, true)
+		}
+		a.flushAll()
+		f.mu.Lock()
+		got := f.nets
+		f.mu.Unlock()
+		if strings.Join(got, ", ") != strings.Join(c.want, ", ") {
+			t.Errorf("source %v dest %v created streams %v, want %v", c.src, c.dst, got, c.want)
+		}
+	}
+}
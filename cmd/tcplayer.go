@@ -18,14 +18,16 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/feilengcui008/tcplayer"
 	"github.com/feilengcui008/tcplayer/deliver"
 	"github.com/feilengcui008/tcplayer/factory"
 	"github.com/feilengcui008/tcplayer/source"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/tcpassembly"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -36,157 +38,484 @@ func init() {
 }
 
 var (
-	dev         = flag.String("dev", "eth0", "device to capture")
-	bpf         = flag.String("bpf", "", "bpf filter expr")
-	caplen      = flag.Int("caplen", 65535, "caplen")
+	config      = flag.String("config", "", "YAML or JSON config file, flags other than metrics are ignored if set")
+	dev         = flag.String("dev", "eth0", "device to capture, a comma separated list captures several devices into one pipeline")
+	bpf         = flag.String("bpf", "", "bpf filter expr applied before reassembly, e.g. \"tcp port 8080\"")
+	caplen      = flag.Int("caplen", 65535, "snapshot length of live capture, smaller than the largest segment corrupts reassembled payloads")
 	promisc     = flag.Bool("promisc", true, "turn on promisc mode")
-	file        = flag.String("file", "", "offline pcap file to read packetes")
+	file        = flag.String("file", "", "offline pcap/pcapng file to read packets instead of capturing from dev")
 	lport       = flag.String("lport", "", "local listening port to get traffic stream")
-	proto       = flag.Int("proto", 0, "proto type, 0 for VideoPacket, 1 for HTTP, 2 for GRPC, 3 for THRIFT")
-	raddr       = flag.String("raddr", "127.0.0.1:8886", "remote ip address and port")
+	protocol    = flag.String("protocol", "", "protocol name, overrides proto, one of "+strings.Join(factory.Names(), ", "))
+	proto       = flag.Int("proto", 0, "proto type, 0 for VideoPacket, 1 for HTTP, 2 for GRPC, 3 for THRIFT, 4 for REDIS, 5 for MYSQL, 6 for DNS over TCP, 7 for MEMCACHED, 8 for MONGO, 9 for KAFKA, 10 for HTTP2, 11 for POSTGRES, 12 for AMQP, 13 for WEBSOCKET, 14 for CQL, 15 for SMTP, 16 for SIP, 17 for STOMP, 18 for LDAP, 19 for DUBBO, 20 for NATS, 21 to detect the protocol of each stream, 22 for BEANSTALKD, 23 for MQTT, 24 for FTP, 25 for TDS, 26 for ZOOKEEPER, 27 for varint length delimited PROTOBUF, 28 for delimited LINE based text, 29 for GRAPHITE plaintext metrics")
+	transport   = flag.String("transport", "tcp", "tcp, or udp to replay each captured datagram as a request")
+	udpport     = flag.Int("udpport", 0, "only replay datagrams sent to this port with udp transport, 0 for all")
+	raddr       = flag.String("raddr", "127.0.0.1:8886", "remote ip address and port, comma separated for several targets")
+	balance     = flag.String("balance", "rr", "strategy balancing requests over targets, rr, weighted or leastconn")
+	weights     = flag.String("weights", "", "comma separated weights of targets in raddr order with -balance weighted, missing ones are 1")
 	clone       = flag.Int("clone", 0, "clone count for each request")
+	amplify     = flag.Int("amplify", 0, "send each request this many times in request mode, multiplies clone, 0 or 1 sends it once")
 	long        = flag.Bool("long", false, "establish long connections with remote host")
 	concurrency = flag.Int("concurrency", 1, "number of concurrent senders(clients)")
 	last        = flag.Int("last", 0, "number of ms for capturing and replaying requests")
 	mode        = flag.Int("mode", 0, "replay mode, 0 for application layer requests, 1 for raw tcp packets")
 	tprotocol   = flag.Int("tprotocol", 0, "thrft protocol type, 0 for TBinaryProtocol, 1 for TCompactProtocol")
+	maxqps      = flag.Int("maxqps", 0, "max requests per second sent to remote, 0 for unlimited")
+	rampup      = flag.Int("rampup", 0, "number of seconds to raise the rate linearly from rampfrom to rampto times maxqps, 0 for off")
+	rampfrom    = flag.Float64("rampfrom", 0.1, "share of maxqps to start a ramp up with")
+	rampto      = flag.Float64("rampto", 1, "share of maxqps to end a ramp up with")
+	maxbps      = flag.Int("maxbps", 0, "max bytes per second sent to remote, 0 for unlimited, the stricter of it and maxqps applies")
+	delay       = flag.Int("delay", 0, "number of ms to delay each request before it is written, per connection")
+	jitter      = flag.Int("jitter", 0, "max number of random ms added to delay")
+	timing      = flag.Bool("timing", false, "replay requests with the gaps between their capture timestamps")
+	speed       = flag.Float64("speed", 1, "replay speed multiplier when timing is on, 2 for twice as fast")
+	diff        = flag.Bool("diff", false, "compare target responses with captured ones, HTTP only")
+	rewritehost = flag.Bool("rewritehost", false, "rewrite Host header of HTTP requests to raddr, a single target only")
+	httpmethods = flag.String("httpmethods", "", "comma separated methods of HTTP requests to replay, e.g. GET,HEAD, all if empty")
+	httppaths   = flag.String("httppaths", "", "comma separated path prefixes of HTTP requests to replay, e.g. /api/, all if empty")
+	httpheaders = flag.String("httpheaders", "", "comma separated name:value headers HTTP requests must carry, an empty value matches any value")
+	queryonly   = flag.Bool("queryonly", false, "only replay query commands for MYSQL, POSTGRES and TDS, drop handshake and auth packets")
+	pgstartup   = flag.Bool("pgstartup", false, "replay SSLRequest and startup messages for POSTGRES, skipped by default")
+	mongofilter = flag.Int("mongofilter", 0, "messages replayed for MONGO, 0 for all, 1 for queries only, 2 for writes only")
+	kafkaapis   = flag.String("kafkaapis", "", "comma separated api keys replayed for KAFKA, e.g. 0 for produce only, all if empty")
+	grpcmethods = flag.String("grpcmethods", "", "comma separated method paths replayed for GRPC, e.g. /etcdserverpb.KV/Range, a path ending with / matches a whole service, all if empty")
+	cqlops      = flag.String("cqlops", "", "comma separated opcodes replayed for CQL, e.g. 1,7,9,10 for STARTUP, QUERY, PREPARE and EXECUTE, all if empty")
+	mqtttypes   = flag.String("mqtttypes", "", "comma separated control packet types replayed for MQTT, e.g. 1,3 for CONNECT and PUBLISH, all if empty")
+	ldapops     = flag.String("ldapops", "", "comma separated protocolOp tags replayed for LDAP, e.g. 0x60,0x63 for bind and search, all if empty")
+	flushpart   = flag.Bool("flushpartial", false, "deliver a VideoPacket frame missing only its tail byte at the end of a stream, completed with the tail")
+	maxframe    = flag.Int("maxframe", 0, "max data bytes of a VideoPacket frame, larger frames are dropped, 0 for 10MB")
+	dubbohb     = flag.Bool("dubbohb", false, "replay heartbeat events for DUBBO, skipped by default")
+	pbmaxsize   = flag.Int("pbmaxsize", 0, "max length of a PROTOBUF message, longer ones are taken as junk and skipped, 0 for 4MB")
+	linedelim   = flag.String("linedelim", "", "line delimiter for LINE with Go escapes like \\r\\n, \\n if empty which also ends \\r\\n lines")
+	maxline     = flag.Int("maxline", 0, "max length of a LINE line, longer ones are skipped, 0 for 64KB")
+	graphbatch  = flag.Int("graphitebatch", 1, "max GRAPHITE metric lines grouped into one request")
+	lineblocks  = flag.Bool("lineblocks", false, "group LINE lines up to a blank line into one request")
+	zkpings     = flag.Bool("zkpings", false, "replay ping requests for ZOOKEEPER, skipped by default")
+	autopeek    = flag.Int("autopeek", 0, "max bytes sniffed to detect the protocol of a stream with auto, unknown streams are relayed raw, 0 for 512")
+	wscontrol   = flag.Bool("wscontrol", false, "replay close, ping and pong frames for WEBSOCKET, skipped by default")
+	export      = flag.String("export", "", "write parsed requests to this record file instead of sending them")
+	sink        = flag.String("sink", "", "write parsed requests readably to file, stdout or discard instead of sending them, for checking parsing without a target")
+	sinkfile    = flag.String("sinkfile", "", "file written by the file sink")
+	analysis    = flag.String("analysis", "", "write the flow, offset, length and header fields of each parsed request to this file, CSV if it ends with .csv, JSON lines otherwise")
+	replay      = flag.String("replay", "", "replay requests of a record file written by -export instead of capturing")
+	reconnect   = flag.Bool("reconnect", false, "redial broken long connections with exponential backoff")
+	buffer      = flag.Int("buffer", 0, "max requests held per connection while reconnecting, 0 drops them")
+	strictorder = flag.Bool("strictorder", false, "deliver requests one by one in capture order across connections with one long connection, at the cost of throughput")
+	orderwindow = flag.Int("orderwindow", 200, "number of ms requests are held with strictorder for earlier ones of other connections")
+	maxrequests = flag.Int64("maxrequests", 0, "stop after delivering this many requests and exit, 0 for unlimited")
+	skipfirst   = flag.Int("skipfirst", 0, "drop the first N requests of each captured connection, e.g. its handshake and auth")
+	skiphs      = flag.Bool("skiphandshake", false, "drop handshake and auth requests told by the REDIS, MYSQL and POSTGRES factories")
+	handshake   = flag.String("handshake", "", "bytes with Go escapes written to each new connection to remote before any request, e.g. an AUTH command, captured handshakes are dropped")
+	verify      = flag.Bool("verify", false, "checksum requests when handed to senders and before they are written, mismatches mean reused buffers, for debugging")
+	affinity    = flag.Bool("affinity", false, "send requests of one captured connection to the same long connection, for stateful protocols")
+	cluster     = flag.Bool("rediscluster", false, "route REDIS commands to the cluster node of their key slot learned from raddr, following MOVED and ASK")
+	logformat   = flag.String("logformat", "text", "log format, text or json")
+	loglevel    = flag.String("loglevel", "", "log level like debug, info or error, info by default, debug if TCPLAYER_DEBUG is set")
+	breaker     = flag.Int("breaker", 0, "open the circuit of a target after this many consecutive failures, 0 for off")
+	cooldown    = flag.Int("cooldown", 5, "number of seconds an open circuit waits before probing the target")
+	breakerhold = flag.Bool("breakerhold", false, "hold requests while all circuits are open instead of dropping them")
+	dedup       = flag.Int("dedup", 0, "number of ms of capture time in which identical requests of a connection are dropped as duplicates, 0 for off")
+	dedupglobal = flag.Bool("dedupglobal", false, "also drop identical requests of different connections as duplicates with dedup")
+	queue       = flag.Int("queue", 0, "parsed requests buffered before delivery, parsers wait when it is full")
+	pool        = flag.Int("pool", 0, "max long connection senders shared by streams in raw mode, 0 for one per stream, or by as many workers in request mode instead of -concurrency clients per target")
+	usetls      = flag.Bool("tls", false, "connect to remote with TLS")
+	tlsname     = flag.String("tlsname", "", "server name to verify with TLS, host of raddr if empty")
+	tlscert     = flag.String("tlscert", "", "client certificate file for TLS")
+	tlskey      = flag.String("tlskey", "", "client key file for TLS")
+	tlsinsecure = flag.Bool("tlsinsecure", false, "skip verifying the remote certificate with TLS")
+	keepalive   = flag.Int("keepalive", 0, "number of seconds between tcp keepalive probes of remote connections, 0 for the Go default, -1 to disable")
+	linger      = flag.Int("linger", 0, "number of seconds to linger on close of remote connections, -1 to reset them instead, 0 for the system default")
+	proxyproto  = flag.String("proxyproto", "off", "PROXY protocol header with the captured client address written to each connection to remote, v1, v2 or off, needs -mode 1")
+	localaddr   = flag.String("localaddr", "", "local ip, or ip:port, to bind connections to remote targets to, e.g. the address of one interface")
+	ctimeout    = flag.Int("ctimeout", 0, "number of ms to connect to remote, also when reconnecting, 0 for no limit and 3s to reconnect")
+	wtimeout    = flag.Int("wtimeout", 0, "number of ms to write one request to remote, 0 for no limit")
+	idletimeout = flag.Int("idletimeout", 0, "number of seconds a long connection to remote writes nothing before it is closed, redialed on the next request, 0 keeps it")
+	wpolicy     = flag.Int("wpolicy", 0, "on write timeout, 0 to reconnect, 1 to drop the request and keep the connection if none of it was written")
+	samplerate  = flag.Float64("sample", 0, "fraction of traffic to replay, e.g. 0.1, 0 or 1 replays all")
+	sampleconn  = flag.Bool("sampleconn", false, "sample whole connections instead of single requests, always on in raw mode")
+	metricsaddr = flag.String("metrics", "", "address to serve Prometheus metrics on /metrics, e.g. :9100, off if empty")
+	adminaddr   = flag.String("admin", "", "address to serve JSON stats on /stats, e.g. :9101, off if empty")
+	sizebuckets = flag.String("sizebuckets", "", "comma separated upper bounds in bytes of the request size histogram, e.g. 100,1000,10000")
+	nopreflight = flag.Bool("nopreflight", false, "skip dialing remote targets before capturing")
+	dryrun      = flag.Bool("dryrun", false, "parse captured traffic without sending anything and print parser statistics, e.g. with -file to check a protocol")
+	drain       = flag.Int("drain", 5, "number of seconds to wait for pending requests to be delivered on exit")
+	flush       = flag.Int("flush", 120, "number of seconds to wait for a lost segment, idle connections are closed as well")
+	pages       = flag.Int("pages", 6, "max out of order pages buffered per connection")
+	totalpages  = flag.Int("totalpages", 0, "max out of order pages buffered for all connections, 0 for unlimited")
+	gappolicy   = flag.String("gappolicy", "skip", "what to do with a lost segment, skip it, wait -gaptimeout for the retransmit then skip it, or abort the stream")
+	gaptimeout  = flag.Int("gaptimeout", 2000, "number of milliseconds to wait for a lost segment with -gappolicy wait")
+	streamidle  = flag.Int("streamidle", 0, "number of seconds a captured stream gets no data before it is closed and its parser exits, 0 for off")
+	direction   = flag.String("direction", "both", "direction of streams reassembled, c2s, s2c or both, c2s saves parsing responses unless diffing")
+	srccidrs    = flag.String("srccidrs", "", "comma separated source networks of packets replayed, e.g. 10.1.0.0/16, !10.1.2.0/24 excludes, all if empty")
+	dstcidrs    = flag.String("dstcidrs", "", "comma separated destination networks of packets replayed, like srccidrs")
+	defrag      = flag.Bool("defrag", false, "reassemble fragmented IPv4 packets before tcp reassembly")
+	archivedir  = flag.String("archive", "", "also write captured packets to rotating pcap files in this directory, off if empty")
+	archivesize = flag.Int("archivesize", 0, "MB of an archive file before a new one is started, 0 for no limit")
+	archiveage  = flag.Int("archiveage", 0, "seconds of capture in an archive file before a new one is started, 0 for no limit")
+	archivekeep = flag.Int("archivekeep", 0, "number of archive files kept, older ones are removed, 0 keeps all")
 )
 
-func handleSource(ctx context.Context, assembler *tcpassembly.Assembler, pktSource *gopacket.PacketSource) {
-	var (
-		totalCnt int64
-		preCnt   int64
-		preTime  = time.Now()
-	)
-	for {
-		select {
-		case <-ctx.Done():
-			log.Infof("stop capturing from source")
+func main() {
+	flag.Parse()
+	name := *protocol
+	if name == "" {
+		name = factory.ProtoType(*proto).String()
+	}
+	c := &tcplayer.Config{
+		Protocol:  name,
+		Transport: *transport,
+		UDPPort:   *udpport,
+		Options: factory.Options{
+			RewriteHost:      *rewritehost,
+			QueryOnly:        *queryonly,
+			PostgresStartup:  *pgstartup,
+			MongoFilter:      factory.MongoFilter(*mongofilter),
+			WebSocketControl: *wscontrol,
+			DubboHeartbeats:  *dubbohb,
+			ZooKeeperPings:   *zkpings,
+			ProtobufMaxSize:  *pbmaxsize,
+			MaxFrameSize:     *maxframe,
+			AutoDetectPeek:   *autopeek,
+		},
+		// live source using libpcap, or offline source using
+		// pcap file, replay with -timing to mimic live speed
+		Source: source.SourceConfig{
+			Dev:      *dev,
+			Caplen:   int32(*caplen),
+			Bpf:      *bpf,
+			Promisc:  *promisc,
+			PcapFile: *file,
+		},
+		ReplayFile:    *replay,
+		AdminAddr:     *adminaddr,
+		SkipPreflight: *nopreflight,
+		DryRun:        *dryrun,
+		Deliver: deliver.DeliverConfig{
+			Clone:             *clone,
+			Amplify:           *amplify,
+			Concurrency:       *concurrency,
+			IsLong:            *long,
+			RemoteAddrs:       strings.Split(*raddr, ","),
+			Balance:           *balance,
+			Last:              *last,
+			ProtocolType:      *tprotocol,
+			Mode:              deliver.ModeType(*mode),
+			MaxQPS:            *maxqps,
+			MaxBytesPerSec:    *maxbps,
+			DeliveryDelay:     time.Millisecond * time.Duration(*delay),
+			DeliveryJitter:    time.Millisecond * time.Duration(*jitter),
+			PreserveTiming:    *timing,
+			Speed:             *speed,
+			Diff:              *diff,
+			ExportFile:        *export,
+			AnalysisFile:      *analysis,
+			Sink:              *sink,
+			SinkPath:          *sinkfile,
+			Reconnect:         *reconnect,
+			ReconnectBuffer:   *buffer,
+			PoolSize:          *pool,
+			Affinity:          *affinity,
+			QueueSize:         *queue,
+			DedupWindow:       time.Millisecond * time.Duration(*dedup),
+			BreakerThreshold:  *breaker,
+			BreakerCooldown:   time.Second * time.Duration(*cooldown),
+			BreakerHold:       *breakerhold,
+			KeepAliveInterval: time.Second * time.Duration(*keepalive),
+			Linger:            time.Second * time.Duration(*linger),
+			LocalAddr:         *localaddr,
+			ConnectTimeout:    time.Millisecond * time.Duration(*ctimeout),
+			WriteTimeout:      time.Millisecond * time.Duration(*wtimeout),
+			TimeoutPolicy:     deliver.TimeoutPolicy(*wpolicy),
+			SampleRate:        *samplerate,
+			SampleByConn:      *sampleconn,
+			RedisCluster:      *cluster,
+		},
+		DrainTimeout:            time.Second * time.Duration(*drain),
+		FlushInterval:           time.Second * time.Duration(*flush),
+		MaxBufferedPagesPerConn: *pages,
+		MaxBufferedPagesTotal:   *totalpages,
+		GapPolicy:               *gappolicy,
+		GapTimeout:              time.Millisecond * time.Duration(*gaptimeout),
+		StreamIdleTimeout:       time.Second * time.Duration(*streamidle),
+		CaptureDirection:        *direction,
+		Defragment:              *defrag,
+		LogFormat:               *logformat,
+		LogLevel:                *loglevel,
+	}
+	c.Deliver.BackendIdleTimeout = time.Second * time.Duration(*idletimeout)
+	c.Deliver.StrictOrder = *strictorder
+	c.Deliver.OrderWindow = time.Millisecond * time.Duration(*orderwindow)
+	c.Deliver.Verify = *verify
+	c.Deliver.MaxRequests = *maxrequests
+	c.Options.FlushPartialOnEOF = *flushpart
+	c.Options.GraphiteBatch = *graphbatch
+	c.Deliver.ProxyProtocol = *proxyproto
+	if *rampup > 0 {
+		c.Deliver.RampUp = &deliver.RampUp{
+			From:     *rampfrom,
+			To:       *rampto,
+			Duration: time.Second * time.Duration(*rampup),
+		}
+	}
+	c.Deliver.SkipFirst = *skipfirst
+	c.Deliver.SkipHandshake = *skiphs
+	if *handshake != "" {
+		hs, err := strconv.Unquote(`"` + *handshake + `"`)
+		if err != nil {
+			log.Errorf("handshake %q not valid: %v", *handshake, err)
 			return
-		case packet := <-pktSource.Packets():
-			if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-				totalCnt++
-				now := time.Now()
-				if now.After(preTime.Add(time.Second * 1)) {
-					log.Infof("total %d packets, %d packets/s", totalCnt, totalCnt-preCnt)
-					preCnt = totalCnt
-					preTime = now
-				}
-				tcp, _ := tcpLayer.(*layers.TCP)
-				assembler.Assemble(tcp.TransportFlow(), tcp)
-			}
 		}
+		c.Deliver.Handshake = []byte(hs)
 	}
-}
-
-func main() {
-	flag.Parse()
-	// HTTP 1.x only supports short connections and does not support ModeRaw
-	if factory.ProtoType(*proto) == factory.ProtoHTTP {
-		if *long || deliver.ModeType(*mode) == deliver.ModeRaw {
-			log.Errorf("ProtoHTTP does not support long connection or ModeRaw ")
+	if *linedelim != "" || *maxline > 0 || *lineblocks {
+		delim, err := strconv.Unquote(`"` + *linedelim + `"`)
+		if err != nil {
+			log.Errorf("line delimiter %q not valid: %v", *linedelim, err)
 			return
 		}
+		c.Options.Line = &factory.LineConfig{
+			Delimiter:   []byte(delim),
+			MaxLineSize: *maxline,
+			Blocks:      *lineblocks,
+		}
+	}
+	if *srccidrs != "" {
+		c.SourceCIDRs = strings.Split(*srccidrs, ",")
+	}
+	if *dstcidrs != "" {
+		c.DestCIDRs = strings.Split(*dstcidrs, ",")
+	}
+	if *httpmethods != "" {
+		c.Options.HTTPMethodAllow = strings.Split(*httpmethods, ",")
+	}
+	if *httppaths != "" {
+		c.Options.HTTPPathPrefix = strings.Split(*httppaths, ",")
 	}
-	// GRPC only supports long connections and does not support ModeRequest
-	if factory.ProtoType(*proto) == factory.ProtoGRPC {
-		if !*long || deliver.ModeType(*mode) == deliver.ModeRequest {
-			log.Errorf("ProtoGRPC does not support short connection or ModeRequest")
+	if *httpheaders != "" {
+		headers, err := parseHeaders(*httpheaders)
+		if err != nil {
+			log.Errorf("%v", err)
 			return
 		}
+		c.Options.HTTPHeaderMatch = headers
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	// create Deliver
-	dlc := &deliver.DeliverConfig{
-		Clone:        *clone,
-		Concurrency:  *concurrency,
-		IsLong:       *long,
-		RemoteAddr:   *raddr,
-		Last:         *last,
-		ProtocolType: *tprotocol,
-		Mode:         deliver.ModeType(*mode),
-	}
-	d, err := deliver.NewDeliver(ctx, dlc)
-	if err != nil {
-		log.Errorf("create deliver failed: %v", err)
-		return
+	if *kafkaapis != "" {
+		keys, err := parseAPIKeys(*kafkaapis)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+		c.Options.KafkaAPIKeys = keys
 	}
-	// create StreamFactory
-	var f tcpassembly.StreamFactory
-	switch ft := factory.ProtoType(*proto); ft {
-	case factory.ProtoVideoPacket:
-		f = factory.NewVideoPacketStreamFactory(d)
-	case factory.ProtoHTTP:
-		f = factory.NewHTTPStreamFactory(d)
-	case factory.ProtoGRPC:
-		f = factory.NewGrpcStreamFactory(d)
-	case factory.ProtoThrift:
-		f = factory.NewThriftStreamFactory(d)
-	default:
-		log.Errorf("do not support proto type %v", ft)
-		return
+	if *grpcmethods != "" {
+		c.Options.GRPCMethods = strings.Split(*grpcmethods, ",")
 	}
-	// create Assembler
-	var (
-		streamPool = tcpassembly.NewStreamPool(f)
-		assembler  = tcpassembly.NewAssembler(streamPool)
-	)
-	assembler.MaxBufferedPagesPerConnection = 6
-	// live source using libpcap
-	lsc := &source.LiveSourceConfig{
-		Dev:     *dev,
-		Caplen:  int32(*caplen),
-		Bpf:     *bpf,
-		Promisc: *promisc,
-	}
-	if s, err := source.NewLiveSource(lsc); err != nil {
-		log.Errorf("create live source failed: %v", err)
-		return
-	} else {
-		go handleSource(ctx, assembler, s)
+	if *cqlops != "" {
+		ops, err := parseOpcodes(*cqlops)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+		c.Options.CQLOpcodes = ops
 	}
-	// offline source using pcap file
-	if *file != "" {
-		osc := &source.OfflineSourceConfig{
-			FilePath: *file,
-			Bpf:      *bpf,
+	if *sizebuckets != "" {
+		b, err := parseBuckets(*sizebuckets)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+		c.SizeBuckets = b
+	}
+	if *weights != "" {
+		w, err := parseWeights(*weights)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
 		}
-		if s, err := source.NewOfflineSource(osc); err != nil {
-			log.Errorf("create OfflineSource failed: %v", err)
+		c.Deliver.Weights = w
+	}
+	if *mqtttypes != "" {
+		types, err := parseOpcodes(*mqtttypes)
+		if err != nil {
+			log.Errorf("%v", err)
 			return
-		} else {
-			go handleSource(ctx, assembler, s)
+		}
+		c.Options.MQTTPacketTypes = types
+	}
+	if *ldapops != "" {
+		ops, err := parseOpcodes(*ldapops)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+		c.Options.LDAPOps = ops
+	}
+	if devs := strings.Split(*dev, ","); len(devs) > 1 {
+		for _, d := range devs {
+			c.Interfaces = append(c.Interfaces, tcplayer.Interface{Dev: d})
+		}
+	}
+	if *archivedir != "" {
+		c.Archive = &tcplayer.ArchiveConfig{
+			Dir:     *archivedir,
+			MaxSize: int64(*archivesize) * 1024 * 1024,
+			MaxAge:  time.Second * time.Duration(*archiveage),
+			Keep:    *archivekeep,
 		}
 	}
-	// tcp source
 	if *lport != "" {
-		tsc := &source.TcpSourceConfig{
-			Address: fmt.Sprintf("::%s", *lport),
+		c.ListenAddr = fmt.Sprintf("::%s", *lport)
+	}
+	if *usetls {
+		c.Deliver.TLS = &deliver.TLSConfig{
+			ServerName:         *tlsname,
+			CertFile:           *tlscert,
+			KeyFile:            *tlskey,
+			InsecureSkipVerify: *tlsinsecure,
 		}
-		if sc, err := source.NewTcpSource(ctx, tsc); err != nil {
-			log.Errorf("create TcpSource failed: %v", err)
+	}
+	if *dedupglobal {
+		c.Deliver.DedupScope = deliver.DedupGlobal
+	}
+	if *config != "" {
+		fc, err := tcplayer.LoadConfig(*config)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+		c = fc
+	}
+	p, err := tcplayer.NewPlayer(c)
+	if err != nil {
+		log.Errorf("%v", err)
+		return
+	}
+	if *metricsaddr != "" {
+		if err := p.Metrics().Serve(*metricsaddr); err != nil {
+			log.Errorf("%v", err)
 			return
-		} else {
-			go func(ctx context.Context, ch chan *gopacket.PacketSource) {
-				for {
-					select {
-					case <-ctx.Done():
-						return
-					case s := <-sc:
-						go handleSource(ctx, assembler, s)
-					}
-				}
-			}(ctx, sc)
 		}
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		waitDone(c.Deliver.Last, sigs)
+		cancel()
+	}()
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go reload(p, hups)
+	if err := p.Run(ctx); err != nil {
+		log.Errorf("%v", err)
+	}
+	if d := p.Deliver(); d != nil && d.Differ != nil {
+		log.Info(d.Differ.Summary())
+	}
+	if c.DryRun {
+		log.Info(p.ParseSummary())
+	}
+}
+
+// parseAPIKeys parses a comma separated list of Kafka api keys.
+func parseAPIKeys(s string) ([]int16, error) {
+	var keys []int16
+	for _, k := range strings.Split(s, ",") {
+		v, err := strconv.ParseInt(strings.TrimSpace(k), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("kafka api key %q not valid: %v", k, err)
+		}
+		keys = append(keys, int16(v))
+	}
+	return keys, nil
+}
+
+// parseBuckets parses a comma separated list of histogram
+// bounds.
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, b := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %q not valid: %v", b, err)
+		}
+		buckets = append(buckets, v)
+	}
+	return buckets, nil
+}
+
+// parseWeights parses a comma separated list of target weights.
+func parseWeights(s string) ([]int, error) {
+	var weights []int
+	for _, w := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil {
+			return nil, fmt.Errorf("weight %q not valid: %v", w, err)
+		}
+		weights = append(weights, v)
+	}
+	return weights, nil
+}
+
+// parseHeaders parses a comma separated list of name:value
+// headers.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, h := range strings.Split(s, ",") {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("header %q not valid, want name:value", h)
+		}
+		headers[strings.TrimSpace(h[:i])] = strings.TrimSpace(h[i+1:])
+	}
+	return headers, nil
+}
+
+// parseOpcodes parses a comma separated list of CQL opcodes or
+// LDAP op tags, hex ones like 0x07 are accepted.
+func parseOpcodes(s string) ([]byte, error) {
+	var ops []byte
+	for _, op := range strings.Split(s, ",") {
+		v, err := strconv.ParseUint(strings.TrimSpace(op), 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("opcode %q not valid: %v", op, err)
+		}
+		ops = append(ops, byte(v))
+	}
+	return ops, nil
+}
+
+// reload re-reads the config file on each signal and applies
+// what can be changed live to p.
+func reload(p *tcplayer.Player, hups chan os.Signal) {
+	for range hups {
+		if *config == "" {
+			log.Warnf("got SIGHUP, reload needs -config, ignored")
+			continue
+		}
+		fc, err := tcplayer.LoadConfig(*config)
+		if err != nil {
+			log.Errorf("reload %v", err)
+			continue
+		}
+		if err := p.Reload(fc); err != nil {
+			log.Errorf("%v", err)
+			continue
+		}
+		log.Infof("config %s reloaded", *config)
+	}
+}
 
+// waitDone blocks for last seconds or until a signal is
+// received, last 0 means no time limit.
+func waitDone(last int, sigs chan os.Signal) {
 	var tc <-chan time.Time
-	if *last > 0 {
-		tc = time.After(time.Second * time.Duration(*last))
+	if last > 0 {
+		tc = time.After(time.Second * time.Duration(last))
 	}
 	select {
 	case <-tc:
-		return
+	case sig := <-sigs:
+		log.Infof("got signal %v, shutting down", sig)
 	}
 }
@@ -0,0 +1,533 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/factory"
+	"github.com/feilengcui008/tcplayer/source"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// duration is a time.Duration written like "5s" or "100ms".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration %s not valid, use a string like \"5s\"", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// rampUp of the deliver section, durations are strings
+type rampUp struct {
+	From     float64  `json:"from"`
+	To       float64  `json:"to"`
+	Duration duration `json:"duration"`
+}
+
+// filePipeline is a pipeline of the deliver section, fields
+// left out are zero, a zero concurrency is the one of deliver.
+type filePipeline struct {
+	Name           string   `json:"name"`
+	Remote         []string `json:"remote"`
+	Balance        string   `json:"balance"`
+	Long           bool     `json:"long"`
+	Concurrency    int      `json:"concurrency"`
+	Amplify        int      `json:"amplify"`
+	MaxQPS         int      `json:"max_qps"`
+	MaxBytesPerSec int      `json:"max_bytes_per_sec"`
+	SampleRate     float64  `json:"sample_rate"`
+	SampleByConn   bool     `json:"sample_by_conn"`
+	Sink           string   `json:"sink"`
+	SinkPath       string   `json:"sink_path"`
+	Queue          int      `json:"queue"`
+}
+
+// fileConfig is the layout of a config file, fields left out
+// keep the defaults of the command line flags.
+type fileConfig struct {
+	Protocol  string `json:"protocol"`
+	Transport string `json:"transport"`
+	UDPPort   int    `json:"udp_port"`
+	Options   struct {
+		RewriteHost      bool              `json:"rewrite_host"`
+		HTTPMethodAllow  []string          `json:"http_method_allow"`
+		HTTPPathPrefix   []string          `json:"http_path_prefix"`
+		HTTPHeaderMatch  map[string]string `json:"http_header_match"`
+		QueryOnly        bool              `json:"query_only"`
+		PostgresStartup  bool              `json:"postgres_startup"`
+		MongoFilter      int               `json:"mongo_filter"`
+		KafkaAPIKeys     []int16           `json:"kafka_api_keys"`
+		GRPCMethods      []string          `json:"grpc_methods"`
+		CQLOpcodes       []int             `json:"cql_opcodes"`
+		LDAPOps          []int             `json:"ldap_ops"`
+		MQTTPacketTypes  []int             `json:"mqtt_packet_types"`
+		WebSocketControl bool              `json:"websocket_control"`
+		DubboHeartbeats  bool              `json:"dubbo_heartbeats"`
+		ZooKeeperPings   bool              `json:"zookeeper_pings"`
+		ProtobufMaxSize  int               `json:"protobuf_max_size"`
+		MaxFrameSize     int               `json:"max_frame_size"`
+		FlushPartial     bool              `json:"flush_partial_on_eof"`
+		GraphiteBatch    int               `json:"graphite_batch"`
+		AutoDetectPeek   int               `json:"auto_detect_peek"`
+		Line             *struct {
+			Delimiter   string `json:"delimiter"`
+			MaxLineSize int    `json:"max_line_size"`
+			Blocks      bool   `json:"blocks"`
+		} `json:"line"`
+	} `json:"options"`
+	Source struct {
+		Dev     string `json:"dev"`
+		Caplen  int32  `json:"caplen"`
+		Promisc bool   `json:"promisc"`
+		Bpf     string `json:"bpf"`
+		File    string `json:"file"`
+		// capture from several devices instead of dev
+		Interfaces []struct {
+			Dev string `json:"dev"`
+			Bpf string `json:"bpf"`
+		} `json:"interfaces"`
+	} `json:"source"`
+	Listen  string `json:"listen"`
+	Replay  string `json:"replay"`
+	Deliver struct {
+		// required
+		Remote          []string `json:"remote"`
+		Balance         string   `json:"balance"`
+		Weights         []int    `json:"weights"`
+		Long            bool     `json:"long"`
+		Concurrency     int      `json:"concurrency"`
+		Clone           int      `json:"clone"`
+		Amplify         int      `json:"amplify"`
+		Last            duration `json:"last"`
+		Mode            string   `json:"mode"`
+		ThriftProtocol  int      `json:"thrift_protocol"`
+		MaxQPS          int      `json:"max_qps"`
+		MaxBytesPerSec  int      `json:"max_bytes_per_sec"`
+		RampUp          *rampUp  `json:"ramp_up"`
+		Delay           duration `json:"delay"`
+		Jitter          duration `json:"jitter"`
+		Timing          bool     `json:"timing"`
+		Speed           float64  `json:"speed"`
+		Diff            bool     `json:"diff"`
+		Export          string   `json:"export"`
+		Analysis        string   `json:"analysis_file"`
+		Sink            string   `json:"sink"`
+		SinkPath        string   `json:"sink_path"`
+		Reconnect       bool     `json:"reconnect"`
+		ReconnectBuffer int      `json:"reconnect_buffer"`
+		Pool            int      `json:"pool"`
+		Affinity        bool     `json:"affinity"`
+		StrictOrder     bool     `json:"strict_order"`
+		OrderWindow     duration `json:"order_window"`
+		RedisCluster    bool     `json:"redis_cluster"`
+		Verify          bool     `json:"verify"`
+		MaxRequests     int64    `json:"max_requests"`
+		SkipFirst       int      `json:"skip_first"`
+		SkipHandshake   bool     `json:"skip_handshake"`
+		Handshake       string   `json:"handshake"`
+		Queue           int      `json:"queue"`
+		Dedup           struct {
+			Window duration `json:"window"`
+			Global bool     `json:"global"`
+		} `json:"dedup"`
+		KeepAlive     duration `json:"keep_alive"`
+		Linger        duration `json:"linger"`
+		LocalAddr     string   `json:"local_addr"`
+		ProxyProtocol string   `json:"proxy_protocol"`
+		ConnTimeout   duration `json:"connect_timeout"`
+		WriteTimeout  duration `json:"write_timeout"`
+		TimeoutPolicy string   `json:"timeout_policy"`
+		IdleTimeout   duration `json:"idle_timeout"`
+		SampleRate    float64  `json:"sample_rate"`
+		SampleByConn  bool     `json:"sample_by_conn"`
+		Breaker       struct {
+			Threshold int      `json:"threshold"`
+			Cooldown  duration `json:"cooldown"`
+			Hold      bool     `json:"hold"`
+		} `json:"breaker"`
+		TLS *struct {
+			ServerName         string `json:"server_name"`
+			CertFile           string `json:"cert_file"`
+			KeyFile            string `json:"key_file"`
+			InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+		} `json:"tls"`
+		Pipelines []filePipeline `json:"pipelines"`
+	} `json:"deliver"`
+	Drain      duration `json:"drain"`
+	Flush      duration `json:"flush"`
+	Pages      int      `json:"pages"`
+	TotalPages int      `json:"total_pages"`
+	GapPolicy  string   `json:"gap_policy"`
+	GapTimeout duration `json:"gap_timeout"`
+	StreamIdle duration `json:"stream_idle_timeout"`
+	Defrag     bool     `json:"defrag"`
+	Direction  string   `json:"direction"`
+	LogFormat  string   `json:"log_format"`
+	LogLevel   string   `json:"log_level"`
+	Archive    *struct {
+		Dir     string   `json:"dir"`
+		Prefix  string   `json:"prefix"`
+		MaxSize int64    `json:"max_size"`
+		MaxAge  duration `json:"max_age"`
+		Keep    int      `json:"keep"`
+	} `json:"archive"`
+	Admin         string    `json:"admin"`
+	SkipPreflight bool      `json:"skip_preflight"`
+	DryRun        bool      `json:"dry_run"`
+	SizeBuckets   []float64 `json:"size_buckets"`
+	SourceCIDRs   []string  `json:"source_cidrs"`
+	DestCIDRs     []string  `json:"dest_cidrs"`
+}
+
+func newFileConfig() *fileConfig {
+	fc := &fileConfig{
+		Protocol:  factory.ProtoVideoPacket.String(),
+		Transport: deliver.TransportTCP,
+		Drain:     duration(DefaultDrainTimeout),
+		Flush:     duration(DefaultFlushInterval),
+		Pages:     DefaultMaxBufferedPagesPerConn,
+		LogFormat: LogText,
+	}
+	fc.Source.Dev = "eth0"
+	fc.Source.Caplen = source.DefaultCaplen
+	fc.Source.Promisc = true
+	fc.Deliver.Concurrency = 1
+	fc.Deliver.Mode = "request"
+	fc.Deliver.Speed = 1
+	fc.Deliver.TimeoutPolicy = "reconnect"
+	fc.Deliver.Breaker.Cooldown = duration(deliver.TargetCooldown)
+	return fc
+}
+
+// LoadConfig reads a YAML or JSON config file, JSON being valid
+// YAML. Fields left out get the defaults of the command line
+// flags, unknown fields are warned about and ignored, and
+// deliver.remote is required unless deliver.sink or dry_run is
+// set.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file failed: %v", err)
+	}
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse config file %s failed: %v", path, err)
+	}
+	raw = jsonValue(raw)
+	for _, name := range unknownFields(raw, reflect.TypeOf(fileConfig{}), "") {
+		log.Warnf("config file %s: unknown field %s ignored", path, name)
+	}
+	// the decoded YAML goes through encoding/json, so both
+	// formats share the json tags and their type checks
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s failed: %v", path, err)
+	}
+	fc := newFileConfig()
+	if err := json.Unmarshal(data, fc); err != nil {
+		return nil, fmt.Errorf("parse config file %s failed: %v", path, err)
+	}
+	c, err := fc.config()
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+func (fc *fileConfig) config() (*Config, error) {
+	fd := &fc.Deliver
+	if len(fd.Remote) == 0 && fd.Sink == "" && !fc.DryRun {
+		return nil, fmt.Errorf("deliver.remote is required")
+	}
+	var mode deliver.ModeType
+	switch fd.Mode {
+	case "request":
+		mode = deliver.ModeRequest
+	case "raw":
+		mode = deliver.ModeRaw
+	default:
+		return nil, fmt.Errorf("deliver.mode %q not valid, request or raw", fd.Mode)
+	}
+	var policy deliver.TimeoutPolicy
+	switch fd.TimeoutPolicy {
+	case "reconnect":
+		policy = deliver.TimeoutReconnect
+	case "drop":
+		policy = deliver.TimeoutDrop
+	default:
+		return nil, fmt.Errorf("deliver.timeout_policy %q not valid, reconnect or drop", fd.TimeoutPolicy)
+	}
+	if fd.Concurrency <= 0 {
+		return nil, fmt.Errorf("deliver.concurrency must be positive")
+	}
+	cqlOpcodes, err := opcodes("options.cql_opcodes", fc.Options.CQLOpcodes)
+	if err != nil {
+		return nil, err
+	}
+	ldapOps, err := opcodes("options.ldap_ops", fc.Options.LDAPOps)
+	if err != nil {
+		return nil, err
+	}
+	mqttTypes, err := opcodes("options.mqtt_packet_types", fc.Options.MQTTPacketTypes)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{
+		Protocol:  fc.Protocol,
+		Transport: fc.Transport,
+		UDPPort:   fc.UDPPort,
+		Options: factory.Options{
+			RewriteHost:      fc.Options.RewriteHost,
+			HTTPMethodAllow:  fc.Options.HTTPMethodAllow,
+			HTTPPathPrefix:   fc.Options.HTTPPathPrefix,
+			HTTPHeaderMatch:  fc.Options.HTTPHeaderMatch,
+			QueryOnly:        fc.Options.QueryOnly,
+			PostgresStartup:  fc.Options.PostgresStartup,
+			MongoFilter:      factory.MongoFilter(fc.Options.MongoFilter),
+			KafkaAPIKeys:     fc.Options.KafkaAPIKeys,
+			GRPCMethods:      fc.Options.GRPCMethods,
+			CQLOpcodes:       cqlOpcodes,
+			LDAPOps:          ldapOps,
+			MQTTPacketTypes:  mqttTypes,
+			WebSocketControl: fc.Options.WebSocketControl,
+			DubboHeartbeats:  fc.Options.DubboHeartbeats,
+			ZooKeeperPings:   fc.Options.ZooKeeperPings,
+			ProtobufMaxSize:  fc.Options.ProtobufMaxSize,
+			MaxFrameSize:     fc.Options.MaxFrameSize,
+			AutoDetectPeek:   fc.Options.AutoDetectPeek,
+		},
+		Source: source.SourceConfig{
+			Dev:      fc.Source.Dev,
+			Caplen:   fc.Source.Caplen,
+			Promisc:  fc.Source.Promisc,
+			Bpf:      fc.Source.Bpf,
+			PcapFile: fc.Source.File,
+		},
+		ListenAddr:    fc.Listen,
+		AdminAddr:     fc.Admin,
+		ReplayFile:    fc.Replay,
+		SkipPreflight: fc.SkipPreflight,
+		DryRun:        fc.DryRun,
+		SizeBuckets:   fc.SizeBuckets,
+		Deliver: deliver.DeliverConfig{
+			RemoteAddrs:       fd.Remote,
+			Balance:           fd.Balance,
+			Weights:           fd.Weights,
+			IsLong:            fd.Long,
+			Concurrency:       fd.Concurrency,
+			Clone:             fd.Clone,
+			Amplify:           fd.Amplify,
+			Last:              int(time.Duration(fd.Last) / time.Millisecond),
+			Mode:              mode,
+			ProtocolType:      fd.ThriftProtocol,
+			MaxQPS:            fd.MaxQPS,
+			MaxBytesPerSec:    fd.MaxBytesPerSec,
+			DeliveryDelay:     time.Duration(fd.Delay),
+			DeliveryJitter:    time.Duration(fd.Jitter),
+			PreserveTiming:    fd.Timing,
+			Speed:             fd.Speed,
+			Diff:              fd.Diff,
+			ExportFile:        fd.Export,
+			AnalysisFile:      fd.Analysis,
+			Sink:              fd.Sink,
+			SinkPath:          fd.SinkPath,
+			Reconnect:         fd.Reconnect,
+			ReconnectBuffer:   fd.ReconnectBuffer,
+			PoolSize:          fd.Pool,
+			Affinity:          fd.Affinity,
+			QueueSize:         fd.Queue,
+			DedupWindow:       time.Duration(fd.Dedup.Window),
+			KeepAliveInterval: time.Duration(fd.KeepAlive),
+			Linger:            time.Duration(fd.Linger),
+			LocalAddr:         fd.LocalAddr,
+			ConnectTimeout:    time.Duration(fd.ConnTimeout),
+			WriteTimeout:      time.Duration(fd.WriteTimeout),
+			TimeoutPolicy:     policy,
+			SampleRate:        fd.SampleRate,
+			SampleByConn:      fd.SampleByConn,
+			BreakerThreshold:  fd.Breaker.Threshold,
+			BreakerCooldown:   time.Duration(fd.Breaker.Cooldown),
+			BreakerHold:       fd.Breaker.Hold,
+			RedisCluster:      fd.RedisCluster,
+		},
+		DrainTimeout:            time.Duration(fc.Drain),
+		FlushInterval:           time.Duration(fc.Flush),
+		MaxBufferedPagesPerConn: fc.Pages,
+		MaxBufferedPagesTotal:   fc.TotalPages,
+		GapPolicy:               fc.GapPolicy,
+		GapTimeout:              time.Duration(fc.GapTimeout),
+		StreamIdleTimeout:       time.Duration(fc.StreamIdle),
+		CaptureDirection:        fc.Direction,
+		SourceCIDRs:             fc.SourceCIDRs,
+		DestCIDRs:               fc.DestCIDRs,
+		Defragment:              fc.Defrag,
+		LogFormat:               fc.LogFormat,
+		LogLevel:                fc.LogLevel,
+	}
+	c.Deliver.BackendIdleTimeout = time.Duration(fd.IdleTimeout)
+	c.Deliver.StrictOrder = fd.StrictOrder
+	c.Deliver.OrderWindow = time.Duration(fd.OrderWindow)
+	c.Deliver.Verify = fd.Verify
+	c.Deliver.MaxRequests = fd.MaxRequests
+	c.Options.FlushPartialOnEOF = fc.Options.FlushPartial
+	c.Options.GraphiteBatch = fc.Options.GraphiteBatch
+	c.Deliver.ProxyProtocol = fd.ProxyProtocol
+	if r := fd.RampUp; r != nil {
+		c.Deliver.RampUp = &deliver.RampUp{
+			From:     r.From,
+			To:       r.To,
+			Duration: time.Duration(r.Duration),
+		}
+	}
+	c.Deliver.SkipFirst = fd.SkipFirst
+	c.Deliver.SkipHandshake = fd.SkipHandshake
+	if fd.Handshake != "" {
+		c.Deliver.Handshake = []byte(fd.Handshake)
+	}
+	if l := fc.Options.Line; l != nil {
+		c.Options.Line = &factory.LineConfig{
+			Delimiter:   []byte(l.Delimiter),
+			MaxLineSize: l.MaxLineSize,
+			Blocks:      l.Blocks,
+		}
+	}
+	for _, p := range fd.Pipelines {
+		concurrency := p.Concurrency
+		if concurrency <= 0 {
+			concurrency = fd.Concurrency
+		}
+		c.Deliver.Pipelines = append(c.Deliver.Pipelines, deliver.Pipeline{
+			Name: p.Name,
+			Config: deliver.DeliverConfig{
+				RemoteAddrs:    p.Remote,
+				Balance:        p.Balance,
+				IsLong:         p.Long,
+				Concurrency:    concurrency,
+				Amplify:        p.Amplify,
+				MaxQPS:         p.MaxQPS,
+				MaxBytesPerSec: p.MaxBytesPerSec,
+				SampleRate:     p.SampleRate,
+				SampleByConn:   p.SampleByConn,
+				Sink:           p.Sink,
+				SinkPath:       p.SinkPath,
+				QueueSize:      p.Queue,
+			},
+		})
+	}
+	if fd.Dedup.Global {
+		c.Deliver.DedupScope = deliver.DedupGlobal
+	}
+	if t := fd.TLS; t != nil {
+		c.Deliver.TLS = &deliver.TLSConfig{
+			ServerName:         t.ServerName,
+			CertFile:           t.CertFile,
+			KeyFile:            t.KeyFile,
+			InsecureSkipVerify: t.InsecureSkipVerify,
+		}
+	}
+	for _, i := range fc.Source.Interfaces {
+		if i.Dev == "" {
+			return nil, fmt.Errorf("source.interfaces dev is required")
+		}
+		c.Interfaces = append(c.Interfaces, Interface{Dev: i.Dev, Bpf: i.Bpf})
+	}
+	if a := fc.Archive; a != nil {
+		c.Archive = &ArchiveConfig{
+			Dir:     a.Dir,
+			Prefix:  a.Prefix,
+			MaxSize: a.MaxSize,
+			MaxAge:  time.Duration(a.MaxAge),
+			Keep:    a.Keep,
+		}
+	}
+	return c, nil
+}
+
+// opcodes converts a list of byte sized numbers, the json
+// encoding of []byte would be a base64 string.
+func opcodes(name string, v []int) ([]byte, error) {
+	var ops []byte
+	for _, op := range v {
+		if op < 0 || op > 0xff {
+			return nil, fmt.Errorf("%s %d not valid", name, op)
+		}
+		ops = append(ops, byte(op))
+	}
+	return ops, nil
+}
+
+// jsonValue converts the maps decoded by yaml to ones with
+// string keys, so they can be encoded as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// unknownFields returns the keys of v not matching a json tag
+// of t, nested keys are joined with dots.
+func unknownFields(v interface{}, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok || t.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+			fields[name] = f.Type
+		}
+	}
+	var unknown []string
+	for k, e := range m {
+		ft, ok := fields[k]
+		if !ok {
+			unknown = append(unknown, prefix+k)
+			continue
+		}
+		unknown = append(unknown, unknownFields(e, ft, prefix+k+".")...)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,96 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long fragments of an incomplete datagram are kept, same
+// as the linux ipfrag_time default
+const FragmentTimeout = time.Second * 30
+
+// defragmenter reassembles IPv4 fragments of one source before
+// tcp assembly, a nil defragmenter passes packets through.
+type defragmenter struct {
+	d *ip4defrag.IPv4Defragmenter
+	// capture time of the last discard of stale fragments
+	discarded time.Time
+}
+
+// tcp returns the TCP layer of packet, fragments are held until
+// their datagram is complete and nil is returned meanwhile.
+func (df *defragmenter) tcp(packet gopacket.Packet) *layers.TCP {
+	if p := df.packet(packet); p != nil {
+		tcp, _ := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		return tcp
+	}
+	return nil
+}
+
+// udp is tcp for the UDP layer.
+func (df *defragmenter) udp(packet gopacket.Packet) *layers.UDP {
+	if p := df.packet(packet); p != nil {
+		udp, _ := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		return udp
+	}
+	return nil
+}
+
+// packet returns packet, or a packet decoded from the transport
+// layer of the reassembled datagram, nil if it is incomplete.
+func (df *defragmenter) packet(packet gopacket.Packet) gopacket.Packet {
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || df == nil {
+		return packet
+	}
+	seen := packet.Metadata().Timestamp
+	df.discard(seen)
+	out, err := df.d.DefragIPv4WithTimestamp(ip4, seen)
+	if err != nil {
+		log.Debugf("defragment packet failed: %v", err)
+		return nil
+	}
+	if out == nil {
+		return nil
+	}
+	if out != ip4 {
+		// the first fragment only held part of the datagram
+		return gopacket.NewPacket(out.Payload, out.NextLayerType(), gopacket.NoCopy)
+	}
+	return packet
+}
+
+// discard drops fragments older than FragmentTimeout, at most
+// once a second of capture time.
+func (df *defragmenter) discard(seen time.Time) {
+	if seen.Sub(df.discarded) < time.Second {
+		return
+	}
+	df.discarded = seen
+	if n := df.d.DiscardOlderThan(seen.Add(-FragmentTimeout)); n > 0 {
+		log.Debugf("discard %d incomplete datagrams", n)
+	}
+}
+
+func newDefragmenter() *defragmenter {
+	return &defragmenter{
+		d: ip4defrag.NewIPv4Defragmenter(),
+	}
+}
@@ -0,0 +1,64 @@
+package tcplayer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fragments returns the packets of tcp with payload from client
+// to testServer, split into fragments of size bytes.
+func fragments(client net.IP, tcp *layers.TCP, payload []byte, size int, seen time.Time) []gopacket.Packet {
+	seg := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(seg, gopacket.SerializeOptions{FixLengths: true}, tcp, gopacket.Payload(payload))
+	data := seg.Bytes()
+	var packets []gopacket.Packet
+	for off := 0; off < len(data); off += size {
+		end := off + size
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, Id: 7,
+			FragOffset: uint16(off / 8), SrcIP: client, DstIP: testServer}
+		if end < len(data) {
+			ip.Flags = layers.IPv4MoreFragments
+		} else {
+			end = len(data)
+		}
+		buf := gopacket.NewSerializeBuffer()
+		gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(data[off:end]))
+		p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+		p.Metadata().Timestamp = seen
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+func TestDefragmentRequest(t *testing.T) {
+	s := &dataStream{}
+	a := newAssembly(&clientFactory{s: s}, DefaultMaxBufferedPagesPerConn, 0, DirectionBoth)
+	client, seen := net.IPv4(10, 1, 0, 5), time.Unix(1500000000, 0)
+	assembleSegment(a, client, &layers.TCP{SrcPort: 40000, DstPort: 6379, Seq: 999, SYN: true, Window: 65535}, "", seen)
+	assembleSegment(a, client, &layers.TCP{SrcPort: 6379, DstPort: 40000, Seq: 4999, SYN: true, ACK: true, Window: 65535}, "", seen)
+	req := bytes.Repeat([]byte("*1\r\n$4\r\nPING\r\n"), 20)
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 6379, Seq: 1000, ACK: true, Window: 65535}
+	packets := fragments(client, tcp, req, 64, seen.Add(time.Millisecond))
+	if len(packets) < 3 {
+		t.Fatalf("request split into %d fragments, want more", len(packets))
+	}
+	df := newDefragmenter()
+	for i, p := range packets {
+		tcp := df.tcp(p)
+		if last := i == len(packets)-1; (tcp != nil) != last {
+			t.Fatalf("fragment %d of %d gave a tcp layer %v", i, len(packets), tcp != nil)
+		}
+		if tcp != nil {
+			a.assemble(p.NetworkLayer().NetworkFlow(), tcp, p.Metadata().Timestamp)
+		}
+	}
+	a.flushAll()
+	if data, _ := s.state(); data != string(req) {
+		t.Fatalf("got %q, want the whole request", data)
+	}
+}
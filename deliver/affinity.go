@@ -0,0 +1,96 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a captured connection idle this long loses its client, the
+// deliver is not told when captured connections end
+const AffinityIdle = time.Minute * 2
+
+// affinityKey is a copy of the requests of one captured
+// connection, clones of a connection go to different clients.
+type affinityKey struct {
+	conn  uint64
+	clone int
+}
+
+type affine struct {
+	t    *Target
+	idx  int
+	last time.Time
+}
+
+// affinity keeps requests of one captured connection on the
+// same client of the same target, so sessions of stateful
+// protocols are not split. It is only used by deliverRequest.
+type affinity struct {
+	conns map[affinityKey]*affine
+	// round robin over clients of a target
+	next  int
+	swept time.Time
+}
+
+// client returns the client bound to key, a new connection
+// or one whose client is gone is bound to the next target.
+func (a *affinity) client(b *balancer, key affinityKey) (*Target, *Client) {
+	now := time.Now()
+	a.sweep(now)
+	if e, ok := a.conns[key]; ok {
+		if c := e.t.clientAt(e.idx); c != nil && e.t.Available(now) {
+			e.last = now
+			return e.t, c
+		}
+		log.Debugf("client of connection %d is gone, rebind it", key.conn)
+		delete(a.conns, key)
+	}
+	for i := 0; i < len(b.targets); i++ {
+		t := b.pick()
+		if t == nil {
+			return nil, nil
+		}
+		a.next++
+		if idx, c := t.clientFrom(a.next); c != nil {
+			a.conns[key] = &affine{t: t, idx: idx, last: now}
+			return t, c
+		}
+		t.MarkDown()
+	}
+	return nil, nil
+}
+
+// sweep unbinds connections idle for AffinityIdle, at most
+// once per AffinityIdle.
+func (a *affinity) sweep(now time.Time) {
+	if now.Sub(a.swept) < AffinityIdle {
+		return
+	}
+	a.swept = now
+	for key, e := range a.conns {
+		if now.Sub(e.last) >= AffinityIdle {
+			delete(a.conns, key)
+		}
+	}
+}
+
+func newAffinity() *affinity {
+	return &affinity{
+		conns: make(map[affinityKey]*affine),
+		swept: time.Now(),
+	}
+}
@@ -0,0 +1,104 @@
+package deliver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineTarget records the accepted connections each line was
+// read from, and how often it was read.
+type lineTarget struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[string]map[int]bool
+	counts map[string]int
+	lines  int
+}
+
+func newLineTarget(t *testing.T) *lineTarget {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := &lineTarget{Listener: l, conns: make(map[string]map[int]bool), counts: make(map[string]int)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for idx := 0; ; idx++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(idx int) {
+				defer conn.Close()
+				sc := bufio.NewScanner(conn)
+				for sc.Scan() {
+					lt.mu.Lock()
+					if lt.conns[sc.Text()] == nil {
+						lt.conns[sc.Text()] = make(map[int]bool)
+					}
+					lt.conns[sc.Text()][idx] = true
+					lt.counts[sc.Text()]++
+					lt.lines++
+					lt.mu.Unlock()
+				}
+			}(idx)
+		}
+	}()
+	return lt
+}
+
+// read returns the number of lines read.
+func (lt *lineTarget) read() int {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.lines
+}
+
+func TestAffinityKeepsConnections(t *testing.T) {
+	lt := newLineTarget(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{lt.Addr().String()},
+		IsLong:      true,
+		Concurrency: 4,
+		Affinity:    true,
+	})
+	const n = 50
+	for i := 0; i < n; i++ {
+		for conn := uint64(1); conn <= 2; conn++ {
+			d.C <- &Request{Data: []byte(fmt.Sprintf("conn %d\n", conn)), Conn: conn}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for lt.read() < 2*n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if lt.lines != 2*n {
+		t.Fatalf("target read %d requests, want %d", lt.lines, 2*n)
+	}
+	var backends []int
+	for conn := 1; conn <= 2; conn++ {
+		seen := lt.conns[fmt.Sprintf("conn %d", conn)]
+		if len(seen) != 1 {
+			t.Fatalf("requests of connection %d went to %d backend connections", conn, len(seen))
+		}
+		for idx := range seen {
+			backends = append(backends, idx)
+		}
+	}
+	if backends[0] == backends[1] {
+		t.Fatal("both connections share a backend connection")
+	}
+}
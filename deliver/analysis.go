@@ -0,0 +1,173 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Analysis files keep the framing of parsed requests, not their
+// payload, to debug a factory against a packet capture.
+package deliver
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often buffered analysis records are written to the file
+const AnalysisFlushInterval = time.Second
+
+// AnalysisRecord describes one request parsed from a stream.
+type AnalysisRecord struct {
+	// captured src:port->dst:port and protocol of the stream
+	Flow  string `json:"flow"`
+	Proto string `json:"proto"`
+	// capture time of the request
+	Time time.Time `json:"time"`
+	// offset of the request in the stream and its length
+	Offset int64 `json:"offset"`
+	Len    int   `json:"len"`
+	// bytes read since the previous request which are not
+	// part of this one, junk skipped by a resync or requests
+	// dropped by a filter of the factory
+	Skipped int64 `json:"skipped"`
+	Resync  bool  `json:"resync"`
+	// protocol header fields like "cmd=GET", empty if the
+	// factory has none
+	Header string `json:"header,omitempty"`
+}
+
+// AnalysisWriter writes AnalysisRecords as CSV if its file name
+// ends with .csv, and as JSON lines otherwise. Records are
+// buffered and flushed every AnalysisFlushInterval, by Flush and
+// by Close. A nil AnalysisWriter does nothing.
+type AnalysisWriter struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	csv    *csv.Writer
+	enc    *json.Encoder
+	closed bool
+}
+
+// Write appends rec, errors are logged since parsers go on
+// anyway.
+func (w *AnalysisWriter) Write(rec *AnalysisRecord) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	var err error
+	if w.csv != nil {
+		err = w.csv.Write([]string{
+			rec.Flow,
+			rec.Proto,
+			strconv.FormatInt(rec.Time.UnixNano(), 10),
+			strconv.FormatInt(rec.Offset, 10),
+			strconv.Itoa(rec.Len),
+			strconv.FormatInt(rec.Skipped, 10),
+			strconv.FormatBool(rec.Resync),
+			rec.Header,
+		})
+	} else {
+		err = w.enc.Encode(rec)
+	}
+	if err != nil {
+		log.Errorf("write analysis record failed: %v", err)
+	}
+}
+
+// Flush writes buffered records to the file.
+func (w *AnalysisWriter) Flush() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+func (w *AnalysisWriter) flush() error {
+	if w.closed {
+		return nil
+	}
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.w.Flush()
+}
+
+// Close flushes and closes the file, later records are dropped.
+func (w *AnalysisWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.flush()
+	if w.closed {
+		return err
+	}
+	w.closed = true
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// flushEvery flushes w every AnalysisFlushInterval until ctx is
+// done.
+func (w *AnalysisWriter) flushEvery(ctx context.Context) {
+	ticker := time.NewTicker(AnalysisFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				log.Errorf("flush analysis file failed: %v", err)
+			}
+		}
+	}
+}
+
+func NewAnalysisWriter(path string) (*AnalysisWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &AnalysisWriter{f: f, w: bufio.NewWriter(f)}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w.csv = csv.NewWriter(w.w)
+		w.csv.Write([]string{"flow", "proto", "time", "offset", "len", "skipped", "resync", "header"})
+	} else {
+		w.enc = json.NewEncoder(w.w)
+		// flows like a:1->b:2 are kept readable
+		w.enc.SetEscapeHTML(false)
+	}
+	return w, nil
+}
@@ -0,0 +1,130 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// how often a request held by BreakerHold looks for a target
+const BreakerHoldInterval = time.Millisecond * 100
+
+type BreakerState int
+
+// values of the tcplayer_breaker_state metric
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half open"
+	}
+	return "unknown"
+}
+
+// breaker is the circuit breaker of a target. It opens after
+// threshold consecutive dial or write failures, an open target
+// is out of rotation for cooldown, then one request probes it
+// in half open state. A success closes it, a failure opens it
+// for another cooldown.
+type breaker struct {
+	addr      string
+	threshold int
+	cooldown  time.Duration
+	m         *metrics.Set
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	// when the next probe is allowed
+	retryAt time.Time
+}
+
+// allow reports whether a request may be sent to the target,
+// a nil breaker always allows.
+func (b *breaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerClosed {
+		return true
+	}
+	if now.Before(b.retryAt) {
+		return false
+	}
+	// one probe per cooldown, in case its result is never
+	// reported, e.g. it is dropped by a dead client
+	b.retryAt = now.Add(b.cooldown)
+	if b.state != BreakerHalfOpen {
+		b.set(BreakerHalfOpen)
+		log.Infof("circuit of target %s half open, probe it", b.addr)
+	}
+	return true
+}
+
+// report records the result of a dial or write.
+func (b *breaker) report(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.set(BreakerClosed)
+			log.Infof("circuit of target %s closed, target recovered", b.addr)
+		}
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.state == BreakerClosed && b.failures >= b.threshold {
+		b.retryAt = time.Now().Add(b.cooldown)
+		if b.state == BreakerClosed {
+			b.m.BreakerOpens.Inc()
+		}
+		b.set(BreakerOpen)
+		log.Warnf("circuit of target %s open after %d failures, last %v, retry in %v", b.addr, b.failures, err, b.cooldown)
+	}
+}
+
+func (b *breaker) set(s BreakerState) {
+	b.state = s
+	b.m.BreakerState.With(b.addr).Set(int64(s))
+}
+
+func newBreaker(addr string, threshold int, cooldown time.Duration, m *metrics.Set) *breaker {
+	b := &breaker{
+		addr:      addr,
+		threshold: threshold,
+		cooldown:  cooldown,
+		m:         m,
+	}
+	b.set(BreakerClosed)
+	return b
+}
@@ -0,0 +1,45 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"sync"
+)
+
+// size of buffers relayed as raw bytes
+const BufferSize int = 4096
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, BufferSize)
+		return &b
+	},
+}
+
+// GetBuffer returns a BufferSize buffer. A buffer sent to a
+// sender created by NewSender or LeaseSender belongs to it and
+// is put back once written, so it must not be used or sent to
+// another sender after that.
+func GetBuffer() []byte {
+	return *bufferPool.Get().(*[]byte)
+}
+
+// PutBuffer reuses b, buffers of other sizes are dropped.
+func PutBuffer(b []byte) {
+	if cap(b) != BufferSize {
+		return
+	}
+	b = b[:BufferSize]
+	bufferPool.Put(&b)
+}
@@ -0,0 +1,36 @@
+package deliver
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// benchmarkRelay hands buffers to a goroutine writing them like
+// a sender does, release is called once a buffer is written.
+func benchmarkRelay(b *testing.B, get func() []byte, release func([]byte)) {
+	c := make(chan []byte, 64)
+	done := make(chan struct{})
+	go func() {
+		for buf := range c {
+			ioutil.Discard.Write(buf)
+			release(buf)
+		}
+		close(done)
+	}()
+	b.ReportAllocs()
+	b.SetBytes(int64(BufferSize))
+	for i := 0; i < b.N; i++ {
+		c <- get()
+	}
+	close(c)
+	<-done
+}
+
+func BenchmarkRelayBuffer(b *testing.B) {
+	b.Run("make", func(b *testing.B) {
+		benchmarkRelay(b, func() []byte { return make([]byte, BufferSize) }, func([]byte) {})
+	})
+	b.Run("pool", func(b *testing.B) {
+		benchmarkRelay(b, GetBuffer, PutBuffer)
+	})
+}
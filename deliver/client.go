@@ -19,13 +19,41 @@ package deliver
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
 )
 
 type ClientConfig struct {
 	RemoteAddr string
-	IsLong     bool
-	Clone      int
+	// TransportTCP or TransportUDP, IsLong is ignored for udp
+	Transport   string
+	IsLong      bool
+	Clone       int
+	Limiter     *Limiter
+	ByteLimiter *Limiter
+	Delay       *Delay
+	Verifier    *Verifier
+	Reconnect   bool
+	BufferCap   int
+	TLS         *tls.Config
+	KeepAlive   time.Duration
+	Linger      time.Duration
+	LocalAddr   string
+	Handshake   []byte
+	// max time to dial, 0 for no limit
+	ConnectTimeout time.Duration
+	// write deadline of each request
+	WriteTimeout  time.Duration
+	TimeoutPolicy TimeoutPolicy
+	Responses     ResponseHandler
+	// called with the result of each dial and write
+	Report      func(error)
+	IdleTimeout time.Duration
+	Metrics     *metrics.Set
 }
 
 type Client struct {
@@ -34,6 +62,16 @@ type Client struct {
 	S      Sender
 	Ctx    context.Context
 	Stat   *Stat
+	// requests sent to S and not released yet
+	inflight int64
+	// stops S without closing its channel
+	cancel context.CancelFunc
+}
+
+// InFlight returns the requests sent to the client and not
+// written yet.
+func (c *Client) InFlight() int64 {
+	return atomic.LoadInt64(&c.inflight)
 }
 
 func NewClient(ctx context.Context, c *ClientConfig) (*Client, error) {
@@ -41,13 +79,63 @@ func NewClient(ctx context.Context, c *ClientConfig) (*Client, error) {
 		client  = &Client{Config: c}
 		creator = NewLongConnSender
 	)
-	if !c.IsLong {
+	client.Ctx, client.cancel = context.WithCancel(ctx)
+	if c.Transport == TransportUDP {
+		creator = NewUDPSender
+	} else if !c.IsLong {
 		creator = NewShortConnSender
 	}
-	s, err := creator(ctx, 1, c.RemoteAddr)
+	s, err := creator(client.Ctx, &SenderConfig{
+		RemoteAddr:     c.RemoteAddr,
+		ConnNum:        1,
+		Limiter:        c.Limiter,
+		ByteLimiter:    c.ByteLimiter,
+		Delay:          c.Delay,
+		Verifier:       c.Verifier,
+		Reconnect:      c.Reconnect,
+		BufferCap:      c.BufferCap,
+		TLS:            c.TLS,
+		KeepAlive:      c.KeepAlive,
+		Linger:         c.Linger,
+		LocalAddr:      c.LocalAddr,
+		Handshake:      c.Handshake,
+		ConnectTimeout: c.ConnectTimeout,
+		WriteTimeout:   c.WriteTimeout,
+		TimeoutPolicy:  c.TimeoutPolicy,
+		Responses:      c.Responses,
+		Report:         c.Report,
+		IdleTimeout:    c.IdleTimeout,
+		Metrics:        c.Metrics,
+		Release: func([]byte) {
+			atomic.AddInt64(&client.inflight, -1)
+		},
+	})
 	if err != nil {
+		client.cancel()
 		return nil, fmt.Errorf("create client failed: %s", err)
 	}
 	client.S = s
 	return client, nil
 }
+
+// prober is a sender which recovers by a dial of its remote
+// rather than by a new sender.
+type prober interface {
+	probe() error
+}
+
+// prober returns the sender of c if it recovers by a probe.
+func (c *Client) prober() (prober, bool) {
+	if c == nil {
+		return nil, false
+	}
+	p, ok := c.S.(prober)
+	return p, ok
+}
+
+// close stops the sender of a replaced client. Unlike stop it
+// does not close the channel of S, which deliverRequest may be
+// sending to, a send is aborted by the done Ctx instead.
+func (c *Client) close() {
+	c.cancel()
+}
@@ -0,0 +1,79 @@
+package deliver
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listen returns a target accepting connections and discarding
+// what they send, it is closed at the end of the test.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestClientCloseStopsSender(t *testing.T) {
+	l := listen(t)
+	c, err := NewClient(context.Background(), &ClientConfig{RemoteAddr: l.Addr().String(), IsLong: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.close()
+	select {
+	case <-c.S.(*LongConnSender).done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("sender of a closed client still runs")
+	}
+}
+
+func TestShortSenderProbe(t *testing.T) {
+	l := listen(t)
+	c, err := NewClient(context.Background(), &ClientConfig{RemoteAddr: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.S.stop()
+	s := c.S.(*ShortConnSender)
+	atomic.StoreInt32(&s.failed, 1)
+	p, ok := c.prober()
+	if !ok {
+		t.Fatal("short sender is not a prober")
+	}
+	if err := p.probe(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Alive() {
+		t.Fatal("short sender not alive after a successful probe")
+	}
+
+	l.Close()
+	atomic.StoreInt32(&s.failed, 1)
+	if err := p.probe(); err == nil {
+		t.Fatal("probe of a closed target succeeded")
+	}
+	if s.Alive() {
+		t.Fatal("short sender alive after a failed probe")
+	}
+}
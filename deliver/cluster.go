@@ -0,0 +1,498 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Redis Cluster routes each command by the hash slot of its
+// key to the node serving the slot, the slots are learned with
+// CLUSTER SLOTS from the targets, which act as seed nodes, and
+// MOVED and ASK redirects are followed.
+package deliver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RedisClusterSlots = 16384
+	// max MOVED and ASK redirects followed for one command
+	RedisMaxRedirects = 5
+	// max time to send one command and read its reply
+	RedisClusterTimeout = time.Second * 5
+	// min interval between two reloads of the slots
+	RedisRefreshInterval = time.Second
+)
+
+// redisError is an error reply of a node.
+type redisError string
+
+// redisCluster delivers requests with Concurrency workers, each
+// one keeps a connection to every node it talks to and waits
+// for the reply of a command before sending the next one.
+type redisCluster struct {
+	d *Deliver
+	// node of each slot, "" if unknown
+	mu    sync.RWMutex
+	slots [RedisClusterSlots]string
+	// unix nano of the last reload
+	refreshed int64
+	work      chan []byte
+	wg        sync.WaitGroup
+}
+
+// clusterConn is a connection of a worker to one node.
+type clusterConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	m    *metrics.Set
+}
+
+// clusterRequest hands requests to the workers until deliver
+// is stopped or drained.
+func (d *Deliver) clusterRequest() {
+	defer close(d.drained)
+	c := d.cluster
+	if err := c.refresh(); err != nil {
+		log.Warnf("load redis cluster slots failed, learn them by redirects: %v", err)
+	}
+	workers := d.Config.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		c.wg.Add(1)
+		go c.worker()
+	}
+	defer c.wg.Wait()
+	defer close(c.work)
+	for {
+		req := d.recv()
+		if req == nil {
+			return
+		}
+		if !d.transform(req) {
+			continue
+		}
+		if err := d.Pace(d.Ctx, req.Time); err != nil {
+			return
+		}
+		for i := 0; i < d.copies(); i++ {
+			d.Stat.TotalRequest++
+			d.Verifier.Track(req.Data)
+			select {
+			case <-d.Ctx.Done():
+				return
+			case c.work <- req.Data:
+			}
+		}
+		if d.delivered() {
+			return
+		}
+	}
+}
+
+func (c *redisCluster) worker() {
+	defer c.wg.Done()
+	conns := make(map[string]*clusterConn)
+	defer func() {
+		for _, cc := range conns {
+			cc.conn.Close()
+		}
+	}()
+	for data := range c.work {
+		d := c.d
+		if err := d.Limiter.Wait(d.Ctx); err != nil {
+			return
+		}
+		if err := d.ByteLimiter.WaitN(d.Ctx, len(data)); err != nil {
+			return
+		}
+		if err := d.Delay.Wait(d.Ctx); err != nil {
+			return
+		}
+		d.Verifier.Check(data)
+		if err := c.do(conns, data); err != nil {
+			log.Errorf("redis cluster send command failed: %v", err)
+			d.Metrics.SendErrors.Inc()
+		}
+	}
+}
+
+// do sends a command to the node of its slot and follows
+// redirects, error replies other than MOVED and ASK are left
+// to the replayed client as they would be.
+func (c *redisCluster) do(conns map[string]*clusterConn, data []byte) error {
+	slot, keyed := redisSlot(data)
+	addr := ""
+	if keyed {
+		addr = c.node(slot)
+	}
+	if addr == "" {
+		t := c.d.targets.pick()
+		if t == nil {
+			return fmt.Errorf("no target available")
+		}
+		addr = t.Addr
+	}
+	asking := false
+	for i := 0; ; i++ {
+		reply, err := c.send(conns, addr, data, asking)
+		if err != nil {
+			return err
+		}
+		e, ok := reply.(redisError)
+		if !ok {
+			return nil
+		}
+		kind, to, ok := parseRedirect(string(e), addr)
+		if !ok {
+			return nil
+		}
+		if i == RedisMaxRedirects {
+			return fmt.Errorf("too many redirects, last %s", e)
+		}
+		c.d.Metrics.Redirects.Inc()
+		log.Debugf("redis cluster %s from %s to %s", kind, addr, to)
+		if kind == "MOVED" {
+			c.setNode(slot, to)
+			c.refreshLater()
+		}
+		addr, asking = to, kind == "ASK"
+	}
+}
+
+// send writes data to node addr, preceded by ASKING if asking,
+// and returns the reply. A broken connection is closed and
+// redialed by the next command.
+func (c *redisCluster) send(conns map[string]*clusterConn, addr string, data []byte, asking bool) (interface{}, error) {
+	cc, ok := conns[addr]
+	if !ok {
+		var err error
+		if cc, err = c.dialNode(addr); err != nil {
+			return nil, fmt.Errorf("connect to node %s failed: %v", addr, err)
+		}
+		conns[addr] = cc
+	}
+	reply, err := cc.do(data, asking)
+	if err != nil {
+		cc.conn.Close()
+		delete(conns, addr)
+		return nil, fmt.Errorf("node %s: %v", addr, err)
+	}
+	return reply, nil
+}
+
+// dialNode connects to node addr, the handshake is sent first
+// if set and must not get an error reply, it can be one
+// command only.
+func (c *redisCluster) dialNode(addr string) (*clusterConn, error) {
+	d := c.d
+	conn, err := dial(addr, RedisClusterTimeout, d.tlsConfig, d.Config.KeepAliveInterval, d.Config.Linger, d.Config.LocalAddr, d.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	cc := &clusterConn{conn: conn, r: bufio.NewReader(conn), m: d.Metrics}
+	if len(d.Config.Handshake) != 0 {
+		reply, err := cc.do(d.Config.Handshake, false)
+		if e, ok := reply.(redisError); ok && err == nil {
+			err = fmt.Errorf("handshake: %s", e)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+func (cc *clusterConn) do(data []byte, asking bool) (interface{}, error) {
+	start := time.Now()
+	cc.conn.SetDeadline(start.Add(RedisClusterTimeout))
+	if asking {
+		n, err := cc.conn.Write([]byte("*1\r\n$6\r\nASKING\r\n"))
+		cc.m.BytesSent.Add(uint64(n))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := readRESP(cc.r); err != nil {
+			return nil, err
+		}
+	}
+	n, err := cc.conn.Write(data)
+	cc.m.BytesSent.Add(uint64(n))
+	if err != nil {
+		return nil, err
+	}
+	cc.m.SendLatency.Observe(time.Since(start).Seconds())
+	return readRESP(cc.r)
+}
+
+func (c *redisCluster) node(slot uint16) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[slot]
+}
+
+func (c *redisCluster) setNode(slot uint16, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slots[slot] = addr
+}
+
+// refreshLater reloads the slots in the background after a
+// MOVED, a resharding usually moves more than one slot.
+func (c *redisCluster) refreshLater() {
+	last := atomic.LoadInt64(&c.refreshed)
+	now := time.Now().UnixNano()
+	if now-last < int64(RedisRefreshInterval) || !atomic.CompareAndSwapInt64(&c.refreshed, last, now) {
+		return
+	}
+	go func() {
+		if err := c.refresh(); err != nil {
+			log.Debugf("reload redis cluster slots failed: %v", err)
+		}
+	}()
+}
+
+// refresh loads the slots from the first target answering
+// CLUSTER SLOTS.
+func (c *redisCluster) refresh() error {
+	atomic.StoreInt64(&c.refreshed, time.Now().UnixNano())
+	err := fmt.Errorf("no target")
+	for _, t := range c.d.targets.targets {
+		var slots []slotRange
+		if slots, err = c.loadSlots(t.Addr); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		for _, s := range slots {
+			for i := s.start; i <= s.end; i++ {
+				c.slots[i] = s.addr
+			}
+		}
+		c.mu.Unlock()
+		log.Infof("redis cluster slots loaded from %s, %d ranges", t.Addr, len(slots))
+		return nil
+	}
+	return err
+}
+
+// slotRange is served by the master at addr.
+type slotRange struct {
+	start, end int64
+	addr       string
+}
+
+// loadSlots returns the slot ranges of the cluster of seed.
+func (c *redisCluster) loadSlots(seed string) ([]slotRange, error) {
+	cc, err := c.dialNode(seed)
+	if err != nil {
+		return nil, err
+	}
+	defer cc.conn.Close()
+	reply, err := cc.do([]byte("*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n"), false)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, fmt.Errorf("CLUSTER SLOTS of %s: %s", seed, e)
+	}
+	ranges, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("CLUSTER SLOTS reply of %s not valid", seed)
+	}
+	seedHost, _, _ := net.SplitHostPort(seed)
+	var slots []slotRange
+	for _, r := range ranges {
+		// start, end, [host, port, id, ...], replicas...
+		fields, ok := r.([]interface{})
+		if !ok || len(fields) < 3 {
+			return nil, fmt.Errorf("CLUSTER SLOTS range of %s not valid", seed)
+		}
+		start, ok1 := fields[0].(int64)
+		end, ok2 := fields[1].(int64)
+		master, ok3 := fields[2].([]interface{})
+		if !ok1 || !ok2 || !ok3 || len(master) < 2 || start < 0 || end >= RedisClusterSlots || start > end {
+			return nil, fmt.Errorf("CLUSTER SLOTS range of %s not valid", seed)
+		}
+		host, _ := master[0].([]byte)
+		port, ok := master[1].(int64)
+		if !ok {
+			return nil, fmt.Errorf("CLUSTER SLOTS node of %s not valid", seed)
+		}
+		// an empty host is the host of the node asked
+		h := string(host)
+		if h == "" {
+			h = seedHost
+		}
+		slots = append(slots, slotRange{start, end, net.JoinHostPort(h, strconv.FormatInt(port, 10))})
+	}
+	return slots, nil
+}
+
+// parseRedirect parses "MOVED <slot> <host>:<port>" and "ASK
+// <slot> <host>:<port>" errors, a missing host is the host of
+// from.
+func parseRedirect(e, from string) (string, string, bool) {
+	fields := strings.Fields(e)
+	if len(fields) != 3 || fields[0] != "MOVED" && fields[0] != "ASK" {
+		return "", "", false
+	}
+	host, port, err := net.SplitHostPort(fields[2])
+	if err != nil {
+		return "", "", false
+	}
+	if host == "" {
+		host, _, _ = net.SplitHostPort(from)
+	}
+	return fields[0], net.JoinHostPort(host, port), true
+}
+
+// redisSlot returns the hash slot of the first key of a RESP
+// or inline command, which is the first argument for most
+// commands. Commands without arguments have no slot and go to
+// any node.
+func redisSlot(data []byte) (uint16, bool) {
+	var key []byte
+	if len(data) > 0 && data[0] == '*' {
+		args, err := readRESP(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return 0, false
+		}
+		argv, _ := args.([]interface{})
+		if len(argv) < 2 {
+			return 0, false
+		}
+		key, _ = argv[1].([]byte)
+	} else {
+		fields := bytes.Fields(data)
+		if len(fields) < 2 {
+			return 0, false
+		}
+		key = fields[1]
+	}
+	return keySlot(key), true
+}
+
+// keySlot hashes the part of key within the first {} if not
+// empty, so keys with the same hash tag share a slot.
+func keySlot(key []byte) uint16 {
+	if i := bytes.IndexByte(key, '{'); i >= 0 {
+		if j := bytes.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return crc16(key) % RedisClusterSlots
+}
+
+// crc16 is CRC16-CCITT (XMODEM) used by Redis Cluster.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// readRESP reads one RESP value, simple strings are strings,
+// errors redisError, integers int64, bulk strings []byte and
+// arrays []interface{}, nil bulks and arrays are nil. RESP3
+// maps, sets and pushes are read as arrays.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("reply line too long")
+		}
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("reply line %q not valid", line)
+	}
+	typ, body := line[0], string(line[1:len(line)-2])
+	switch typ {
+	case '+', ',', '(', '#':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case '_':
+		return nil, nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$', '=', '!':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil || n > 512*1024*1024 {
+			return nil, fmt.Errorf("bulk length %q not valid", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if typ == '!' {
+			return redisError(b[:n]), nil
+		}
+		return b[:n], nil
+	case '*', '%', '~', '>':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil || n > 1024*1024 {
+			return nil, fmt.Errorf("array length %q not valid", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if typ == '%' {
+			n *= 2
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readRESP(r); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("reply type %q not valid", typ)
+}
+
+func newRedisCluster(d *Deliver) *redisCluster {
+	return &redisCluster{
+		d:    d,
+		work: make(chan []byte),
+	}
+}
@@ -0,0 +1,130 @@
+package deliver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redisNode is a mock cluster node, reply returns the reply of
+// each command, commands are recorded with their arguments
+// joined by spaces.
+type redisNode struct {
+	net.Listener
+	reply func(cmd string) string
+	mu    sync.Mutex
+	cmds  []string
+}
+
+// newRedisNode returns a node replying with reply, OK to all
+// commands if nil.
+func newRedisNode(t *testing.T, reply func(cmd string) string) *redisNode {
+	t.Helper()
+	if reply == nil {
+		reply = func(string) string { return "+OK\r\n" }
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &redisNode{Listener: l, reply: reply}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	return n
+}
+
+func (n *redisNode) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range v.([]interface{}) {
+			args = append(args, string(a.([]byte)))
+		}
+		cmd := strings.Join(args, " ")
+		n.mu.Lock()
+		n.cmds = append(n.cmds, cmd)
+		n.mu.Unlock()
+		if _, err := conn.Write([]byte(n.reply(cmd))); err != nil {
+			return
+		}
+	}
+}
+
+func (n *redisNode) commands() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.cmds...)
+}
+
+func redisCommand(args ...string) []byte {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	return []byte(cmd)
+}
+
+func TestRedisClusterRedirects(t *testing.T) {
+	owner := newRedisNode(t, nil)
+	// the seed does not tell the slots, they are learned by
+	// redirects
+	seed := newRedisNode(t, func(cmd string) string {
+		switch cmd {
+		case "CLUSTER SLOTS":
+			return "-ERR This instance has cluster support disabled\r\n"
+		case "SET foo 1":
+			return fmt.Sprintf("-MOVED %d %s\r\n", keySlot([]byte("foo")), owner.Addr())
+		case "GET bar":
+			return fmt.Sprintf("-ASK %d %s\r\n", keySlot([]byte("bar")), owner.Addr())
+		}
+		return "+OK\r\n"
+	})
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs:  []string{seed.Addr().String()},
+		IsLong:       true,
+		Concurrency:  1,
+		RedisCluster: true,
+	})
+	for _, cmd := range [][]byte{
+		redisCommand("SET", "foo", "1"),
+		// goes to the owner learned by MOVED
+		redisCommand("SET", "foo", "1"),
+		// ASK does not change the slot of bar
+		redisCommand("GET", "bar"),
+		redisCommand("GET", "bar"),
+	} {
+		d.C <- NewRequest(cmd)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := map[*redisNode][]string{
+		seed:  {"CLUSTER SLOTS", "SET foo 1", "GET bar", "GET bar"},
+		owner: {"SET foo 1", "SET foo 1", "ASKING", "GET bar", "ASKING", "GET bar"},
+	}
+	for n, cmds := range want {
+		if got := n.commands(); strings.Join(got, ", ") != strings.Join(cmds, ", ") {
+			t.Errorf("node %s got %v, want %v", n.Addr(), got, cmds)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package deliver
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+)
+
+const testConnectTimeout = 200 * time.Millisecond
+
+// connectWithin fails unless connecting to addr fails within
+// testConnectTimeout, it reports false if the connect succeeded.
+func connectWithin(t *testing.T, addr string, tc *tls.Config) bool {
+	t.Helper()
+	start := time.Now()
+	s, err := NewLongConnSender(context.Background(), &SenderConfig{
+		RemoteAddr:     addr,
+		ConnNum:        1,
+		TLS:            tc,
+		ConnectTimeout: testConnectTimeout,
+	})
+	elapsed := time.Since(start)
+	if err == nil {
+		s.stop()
+		return false
+	}
+	if elapsed > testConnectTimeout+500*time.Millisecond {
+		t.Fatalf("connect to %s failed after %v, want within %v: %v", addr, elapsed, testConnectTimeout, err)
+	}
+	return true
+}
+
+func TestConnectTimeoutUnroutable(t *testing.T) {
+	if !connectWithin(t, "10.255.255.1:80", nil) {
+		t.Skip("unroutable address is reachable here")
+	}
+}
+
+func TestConnectTimeoutStalledHandshake(t *testing.T) {
+	// accepts and never answers the TLS client hello, like a
+	// host that does not answer the SYN
+	l, _ := listenStalled(t)
+	if !connectWithin(t, l.Addr().String(), &tls.Config{InsecureSkipVerify: true}) {
+		t.Fatal("connected to a stalled target")
+	}
+}
+
+func TestConnectTimeoutOpensBreaker(t *testing.T) {
+	l, _ := listenStalled(t)
+	m := metrics.NewSet()
+	newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs:      []string{l.Addr().String()},
+		IsLong:           true,
+		Concurrency:      1,
+		TLS:              &TLSConfig{InsecureSkipVerify: true},
+		ConnectTimeout:   testConnectTimeout,
+		BreakerThreshold: 1,
+		Metrics:          m,
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for m.BreakerOpens.Value() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out connect did not open the circuit breaker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+type DedupScope int
+
+const (
+	// requests are duplicates only within one captured
+	// connection, e.g. retransmissions
+	DedupConn DedupScope = iota
+	// identical requests of any connection are duplicates, e.g.
+	// packets mirrored twice by a span port
+	DedupGlobal
+)
+
+// dedup drops requests whose content was seen within window of
+// capture time, the first time of a content is kept, so
+// identical requests like health checks still pass once per
+// window.
+type dedup struct {
+	window time.Duration
+	scope  DedupScope
+
+	mu    sync.Mutex
+	seen  map[uint64]time.Time
+	swept time.Time
+}
+
+// duplicate reports whether req was seen within the window.
+func (d *dedup) duplicate(req *Request) bool {
+	at := req.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	key := d.key(req)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(at)
+	if first, ok := d.seen[key]; ok {
+		if dt := at.Sub(first); dt >= 0 && dt < d.window {
+			return true
+		}
+	}
+	d.seen[key] = at
+	return false
+}
+
+func (d *dedup) key(req *Request) uint64 {
+	h := fnv.New64a()
+	if d.scope == DedupConn {
+		var conn [8]byte
+		binary.BigEndian.PutUint64(conn[:], req.Conn)
+		h.Write(conn[:])
+	}
+	h.Write(req.Data)
+	return h.Sum64()
+}
+
+// sweep forgets contents older than the window, at most once
+// per window.
+func (d *dedup) sweep(now time.Time) {
+	if now.Sub(d.swept) < d.window {
+		return
+	}
+	d.swept = now
+	for key, first := range d.seen {
+		if now.Sub(first) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+func newDedup(window time.Duration, scope DedupScope) *dedup {
+	return &dedup{
+		window: window,
+		scope:  scope,
+		seen:   make(map[uint64]time.Time),
+	}
+}
@@ -0,0 +1,56 @@
+package deliver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+)
+
+func TestDedupDropsDuplicates(t *testing.T) {
+	for _, c := range []struct {
+		scope DedupScope
+		// requests kept of those below
+		want uint64
+	}{
+		{DedupConn, 4},
+		{DedupGlobal, 3},
+	} {
+		m := metrics.NewSet()
+		d := newTestDeliver(t, &DeliverConfig{
+			Sink:        SinkDiscard,
+			DedupWindow: time.Second,
+			DedupScope:  c.scope,
+			Metrics:     m,
+		})
+		at := time.Unix(1500000000, 0)
+		data := []byte("GET /health HTTP/1.1\r\n\r\n")
+		for _, req := range []*Request{
+			{Data: data, Conn: 1, Time: at},
+			// a retransmission of the same segment
+			{Data: data, Conn: 1, Time: at.Add(10 * time.Millisecond)},
+			// mirrored from another connection
+			{Data: data, Conn: 2, Time: at.Add(20 * time.Millisecond)},
+			// the same request after the window, like a health
+			// check
+			{Data: data, Conn: 1, Time: at.Add(2 * time.Second)},
+			{Data: []byte("GET / HTTP/1.1\r\n\r\n"), Conn: 1, Time: at.Add(2 * time.Second)},
+		} {
+			if err := d.Enqueue(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		if err := d.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := uint64(d.Stat.TotalRequest); got != c.want {
+			t.Errorf("scope %d delivered %d requests, want %d", c.scope, got, c.want)
+		}
+		if got := m.DedupDrops.Value(); got != 5-c.want {
+			t.Errorf("scope %d counted %d duplicates, want %d", c.scope, got, 5-c.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Delay injects latency before each request is written, like a
+// slow network between tcplayer and the target. It is shared by
+// senders, but each sender sleeps on its own, so a delayed
+// request only holds back later requests of the same sender.
+type Delay struct {
+	mu    sync.RWMutex
+	Fixed time.Duration
+	// a random duration in [0, Jitter) is added
+	Jitter time.Duration
+}
+
+// Wait sleeps for the delay or until ctx is done, a nil Delay
+// never sleeps.
+func (d *Delay) Wait(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.RLock()
+	wait, jitter := d.Fixed, d.Jitter
+	d.mu.RUnlock()
+	if jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Set changes the delay of a running Delay, zero for both
+// injects no latency.
+func (d *Delay) Set(fixed, jitter time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Fixed, d.Jitter = fixed, jitter
+}
+
+// NewDelay returns nil if there is no delay.
+func NewDelay(fixed, jitter time.Duration) *Delay {
+	if fixed <= 0 && jitter <= 0 {
+		return nil
+	}
+	return &Delay{Fixed: fixed, Jitter: jitter}
+}
@@ -0,0 +1,33 @@
+package deliver
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliveryDelay(t *testing.T) {
+	const delay, jitter = 100 * time.Millisecond, 100 * time.Millisecond
+	ot := newOpenTarget(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs:    []string{ot.Addr().String()},
+		IsLong:         true,
+		Concurrency:    1,
+		DeliveryDelay:  delay,
+		DeliveryJitter: jitter,
+	})
+	for i := 1; i <= 5; i++ {
+		start := time.Now()
+		d.C <- NewRequest([]byte("0123456789"))
+		for atomic.LoadInt64(&ot.bytes) < int64(10*i) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("request %d not delivered", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		// slack for scheduling and the loopback
+		if got := time.Since(start); got < delay || got > delay+jitter+50*time.Millisecond {
+			t.Fatalf("request %d delivered after %v, want within [%v, %v]", i, got, delay, delay+jitter)
+		}
+	}
+}
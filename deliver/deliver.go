@@ -11,15 +11,22 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Deliver stands for a remote host to send traffic to
+// Deliver stands for the remote hosts to send traffic to
 package deliver
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/feilengcui008/tcplayer/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -34,65 +41,903 @@ const (
 	TCompactProtocol
 )
 
+// after Shutdown, deliver is drained once C stays idle this long
+const DrainIdle = time.Millisecond * 500
+
 type DeliverConfig struct {
-	IsLong       bool
-	Concurrency  int
-	RemoteAddr   string
-	Last         int
-	Clone        int
+	IsLong      bool
+	Concurrency int
+	RemoteAddr  string
+	// several targets requests are balanced to, RemoteAddr is
+	// used if empty
+	RemoteAddrs []string
+	// BalanceRoundRobin, BalanceWeighted or BalanceLeastConn,
+	// default round robin. Weights[i] is the weight of
+	// RemoteAddrs[i] with BalanceWeighted, missing ones are 1.
+	// BalanceLeastConn picks the target with the fewest requests
+	// not written yet. With Affinity the strategy only binds new
+	// connections.
+	Balance string
+	Weights []int
+	// TransportTCP or TransportUDP, default TransportTCP, udp
+	// requests are sent as datagrams and ModeRaw is not supported
+	Transport string
+	Last      int
+	Clone     int
+	// send each request of ModeRequest Amplify times to
+	// simulate higher load, 0 or 1 sends it once. Every copy
+	// is balanced over targets and limited by MaxQPS and
+	// MaxBytesPerSec like the request, and has its own
+	// connection with Affinity. It multiplies the Clone copies.
+	Amplify      int
 	ProtocolType int
 	Mode         ModeType
+	// max requests per second written to remote, 0 for unlimited
+	MaxQPS int
+	// max bytes per second written to remote, 0 for unlimited,
+	// the stricter of it and MaxQPS applies
+	MaxBytesPerSec int
+	// raise the request rate gradually up to MaxQPS, starting
+	// with NewDeliver, nil for the full MaxQPS at once
+	RampUp *RampUp
+	// latency injected before each request is written, a random
+	// duration up to DeliveryJitter is added to DeliveryDelay
+	DeliveryDelay  time.Duration
+	DeliveryJitter time.Duration
+	// reproduce the gaps between capture timestamps, Speed
+	// scales the replay rate, 2 for twice as fast
+	PreserveTiming bool
+	Speed          float64
+	// read responses of replayed requests from the target
+	// and compare them with captured ones, only requests
+	// with an Exchange are compared. At most Concurrency
+	// requests are compared at a time, others are dropped and
+	// counted in Differ.Dropped.
+	Diff           bool
+	ResponseReader ResponseReader
+	// write requests to this record file instead of sending
+	// them, Proto is the tag stored with each record
+	ExportFile string
+	Proto      string
+	// write the flow, offset, length and header fields of each
+	// request parsed in ModeRequest to this file, CSV if it ends
+	// with .csv and JSON lines otherwise, to debug the framing
+	// of a factory. Payloads are not written.
+	AnalysisFile string
+	// write requests to SinkFile, SinkStdout or SinkDiscard in a
+	// readable form instead of sending them, no target is dialed
+	// and RemoteAddrs is not needed. SinkPath is the file of
+	// SinkFile. Only ModeRequest is supported.
+	Sink     string
+	SinkPath string
+	// redial broken long connections with backoff instead of
+	// recreating clients, up to ReconnectBuffer requests are
+	// held while disconnected, 0 drops them
+	Reconnect       bool
+	ReconnectBuffer int
+	// max long connection senders shared by ModeRaw streams,
+	// 0 creates senders for each stream. In ModeRequest requests
+	// are handed to PoolSize workers instead of clients of each
+	// target, each one owning a sender of the pool.
+	PoolSize int
+	// ProxyV1 or ProxyV2 writes a PROXY protocol header with
+	// the captured client and server addresses to each new
+	// connection, for targets behind a load balancer, default
+	// ProxyOff. Only ModeRaw without PoolSize and TLS is
+	// supported, other connections carry many clients.
+	ProxyProtocol string
+	// connect to targets with TLS if set
+	TLS *TLSConfig
+	// tcp keepalive period of connections to targets, 0 keeps
+	// the default of net.Dialer, negative disables keepalive
+	KeepAliveInterval time.Duration
+	// SO_LINGER of connections to targets, 0 keeps the system
+	// default, negative values like LingerReset reset connections
+	// on close instead of sending pending data, positive values
+	// linger at most that long, rounded up to seconds
+	Linger time.Duration
+	// bind connections to targets to this local ip, or ip:port
+	// which allows one connection at a time, so that replayed
+	// traffic comes from a chosen interface. The system picks
+	// it if empty.
+	LocalAddr string
+	// max time to connect to a target, also when reconnecting,
+	// so that an unreachable host fails fast and counts toward
+	// its circuit breaker. 0 dials initial connections without
+	// a limit and reconnects within ReconnectDialTimeout.
+	ConnectTimeout time.Duration
+	// max time to write one request, a stalled target makes the
+	// request dropped or the connection redialed by policy
+	WriteTimeout  time.Duration
+	TimeoutPolicy TimeoutPolicy
+	// close long connections to targets, of clients and of
+	// ModeRaw senders, after they have written nothing for this
+	// long, and redial them on the next request, 0 keeps them
+	BackendIdleTimeout time.Duration
+	// consumes responses of long connections instead of
+	// discarding them, e.g. to diff them in ModeRaw
+	Responses ResponseHandler
+	// fraction of traffic replayed, 0 or 1 replays all. Requests
+	// are sampled at random, or whole connections are kept or
+	// dropped with SampleByConn so sessions are not broken.
+	// ModeRaw streams are always sampled by connection.
+	SampleRate   float64
+	SampleByConn bool
+	// send requests of one captured connection to the same
+	// long connection of the same target, for stateful
+	// protocols like MySQL sessions or Redis MULTI
+	Affinity bool
+	// open the circuit of a target after BreakerThreshold
+	// consecutive dial or write failures, 0 disables it. An open
+	// target is out of rotation for BreakerCooldown, default
+	// TargetCooldown, then one request probes it. Requests are
+	// dropped while all targets are open, or held in C with
+	// BreakerHold.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	BreakerHold      bool
+	// drop requests whose content was already enqueued within
+	// DedupWindow of capture time, e.g. retransmissions or
+	// packets mirrored twice, 0 disables it. Identical requests
+	// of different connections are only dropped with DedupGlobal.
+	DedupWindow time.Duration
+	DedupScope  DedupScope
+	// capacity of C, requests buffered between parsers and
+	// clients, 0 makes parsers wait for clients
+	QueueSize int
+	// deliver requests of ModeRequest one by one in capture
+	// order, also across captured connections. Requests are held
+	// for OrderWindow, default DefaultOrderWindow, so earlier
+	// ones of other connections can catch up, and all of them
+	// are written by one long connection while it is alive.
+	// Throughput is bounded by that connection and every request
+	// is delayed by OrderWindow, use it with PreserveTiming to
+	// replay a stateful workload exactly, not for load testing.
+	StrictOrder bool
+	OrderWindow time.Duration
+	// route requests of ModeRequest to Redis Cluster nodes by
+	// the hash slot of their key, RemoteAddrs are seed nodes
+	// asked for the slots, and MOVED and ASK redirects are
+	// followed. Each of Concurrency workers waits for the reply
+	// of a command before sending the next one, IsLong and
+	// Balance are ignored except for commands without a key.
+	RedisCluster bool
+	// checksum each request when it is handed to a sender and
+	// again right before it is written, a mismatch is logged and
+	// counted in Metrics.IntegrityErrors. It catches buffers
+	// reused before they are written, at the cost of hashing
+	// every request twice.
+	Verify bool
+	// stop taking requests from C once this many were
+	// delivered, 0 for unlimited. Requests dropped by Transform
+	// or as no target is available are not counted, copies of
+	// Clone and Amplify are sent for each counted one. Finished
+	// is closed then, the caller is to Shutdown. ModeRaw is not
+	// supported.
+	MaxRequests int64
+	// drop the first SkipFirst requests parsed from each
+	// captured connection, e.g. an auth handshake whose
+	// credentials differ on the targets. It is a stopgap for
+	// protocols whose factory does not mark handshakes, HTTP
+	// and gRPC are not affected.
+	SkipFirst int
+	// drop requests marked Handshake by their factory, and
+	// write Handshake to each new connection to a target before
+	// any request instead, e.g. a Redis AUTH command with the
+	// credentials of the targets. Handshake implies
+	// SkipHandshake, ModeRaw and udp are not supported.
+	SkipHandshake bool
+	Handshake     []byte
+	// rewrites each request of ModeRequest before it is sent,
+	// e.g. to replace auth tokens, it runs on the hot path
+	// and should be cheap
+	Transform TransformFunc
+	// replay the requests to more environments with their own
+	// policies, each pipeline and this deliver sample them on
+	// their own. A pipeline falling behind drops its copies
+	// once its queue is full. ModeRaw is not supported.
+	Pipelines []Pipeline
+	// metrics of the deliver, its senders and pipelines,
+	// metrics.Default if nil
+	Metrics *metrics.Set
+}
+
+func (c *DeliverConfig) metrics() *metrics.Set {
+	if c.Metrics == nil {
+		return metrics.Default
+	}
+	return c.Metrics
 }
 
 type Deliver struct {
 	Config  *DeliverConfig
 	Stat    *Stat
-	Clients []*Client
+	Limiter *Limiter
+	// limits bytes written
+	ByteLimiter *Limiter
+	// set if Config.Verify
+	Verifier *Verifier
+	// injected latency, changed by Tune
+	Delay *Delay
+	// Config.Metrics or metrics.Default
+	Metrics *metrics.Set
 	Ctx     context.Context
-	C       chan []byte
+	C       chan *Request
+	pacer   *pacer
+	targets *balancer
+	// set in diff mode
+	Differ *Differ
+	// set if Config.AnalysisFile
+	Analysis *AnalysisWriter
+	// set in export mode
+	exporter *RecordWriter
+	// set if Sink is set
+	sink *sink
+	// set if PoolSize > 0
+	pool *senderPool
+	// set if Affinity
+	affinity *affinity
+	// set if DedupWindow > 0
+	dedup *dedup
+	// set if StrictOrder
+	order *order
+	// set if RedisCluster
+	cluster *redisCluster
+	pause   pause
+	// *Tunables in use, replaced by Tune
+	tunables atomic.Value
+	tuneMu   sync.Mutex
+	// built from Config.TLS
+	tlsConfig *tls.Config
+	cancel    context.CancelFunc
+	// closed by Shutdown, and when C is drained
+	draining     chan struct{}
+	drained      chan struct{}
+	shutdownOnce sync.Once
+	stopOnce     sync.Once
+	// requests delivered and closed on reaching MaxRequests
+	requests int64
+	finished chan struct{}
+	// unix nano of the last full queue warning
+	queueWarned int64
+	// start of Config.RampUp
+	rampStart time.Time
+	// created from Config.Pipelines
+	pipelines []*pipeline
+}
+
+func (d *Deliver) newClient(t *Target) (*Client, error) {
+	clientConfig := &ClientConfig{
+		RemoteAddr:     t.Addr,
+		Transport:      d.Config.Transport,
+		Clone:          d.Config.Clone,
+		IsLong:         d.Config.IsLong,
+		Limiter:        d.Limiter,
+		ByteLimiter:    d.ByteLimiter,
+		Delay:          d.Delay,
+		Verifier:       d.Verifier,
+		Reconnect:      d.Config.Reconnect,
+		BufferCap:      d.Config.ReconnectBuffer,
+		TLS:            d.tlsConfig,
+		KeepAlive:      d.Config.KeepAliveInterval,
+		Linger:         d.Config.Linger,
+		LocalAddr:      d.Config.LocalAddr,
+		Handshake:      d.Config.Handshake,
+		ConnectTimeout: d.Config.ConnectTimeout,
+		WriteTimeout:   d.Config.WriteTimeout,
+		TimeoutPolicy:  d.Config.TimeoutPolicy,
+		Responses:      d.Config.Responses,
+		Report:         t.report,
+		IdleTimeout:    d.Config.BackendIdleTimeout,
+		Metrics:        d.Metrics,
+	}
+	c, err := NewClient(d.Ctx, clientConfig)
+	if err != nil {
+		t.report(err)
+	}
+	return c, err
 }
 
 func (d *Deliver) startClient(ch chan struct{}) {
-	for i := 0; i < d.Config.Concurrency; i++ {
-		clientConfig := &ClientConfig{
-			RemoteAddr: d.Config.RemoteAddr,
-			Clone:      d.Config.Clone,
-			IsLong:     d.Config.IsLong,
-		}
-		client, err := NewClient(d.Ctx, clientConfig)
-		if err != nil {
-			log.Errorf("create client %d failed: %v", i, err)
-			continue
+	for _, t := range d.targets.targets {
+		t.clients = make([]*Client, d.Config.Concurrency)
+		for i := 0; i < d.Config.Concurrency; i++ {
+			client, err := d.newClient(t)
+			if err != nil {
+				log.Errorf("create client %d for %s failed: %v", i, t.Addr, err)
+				continue
+			}
+			client.Idx = i
+			t.clients[i] = client
 		}
-		d.Clients = append(d.Clients, client)
 	}
 	ch <- struct{}{}
 }
 
+// recoverClient recreates dead clients of targets, so a
+// recovered target gets back to rotation after cooldown.
+func (d *Deliver) recoverClient() {
+	ticker := time.NewTicker(TargetCooldown)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.Ctx.Done():
+			return
+		case <-d.draining:
+			return
+		case <-ticker.C:
+			for _, t := range d.targets.targets {
+				for i := 0; i < d.Config.Concurrency; i++ {
+					t.mu.RLock()
+					c := t.clients[i]
+					t.mu.RUnlock()
+					if c != nil && (c.S.Alive() || d.Config.Reconnect && d.Config.IsLong) {
+						// reconnecting senders recover by themselves
+						continue
+					}
+					if p, ok := c.prober(); ok {
+						if err := p.probe(); err != nil {
+							log.Debugf("probe client %d for %s failed: %v", i, t.Addr, err)
+							t.MarkDown()
+							break
+						}
+						continue
+					}
+					client, err := d.newClient(t)
+					if err != nil {
+						log.Debugf("recover client %d for %s failed: %v", i, t.Addr, err)
+						t.MarkDown()
+						break
+					}
+					client.Idx = i
+					t.setClient(i, client)
+					if c != nil {
+						// its run goroutine and connections
+						// are left otherwise
+						c.close()
+					}
+				}
+			}
+		}
+	}
+}
+
+// pickClient returns an alive client of an available target,
+// targets without alive clients are marked down.
+func (d *Deliver) pickClient() (*Target, *Client) {
+	for i := 0; i < len(d.targets.targets); i++ {
+		t := d.targets.pick()
+		if t == nil {
+			return nil, nil
+		}
+		if c := t.client(); c != nil {
+			return t, c
+		}
+		t.MarkDown()
+	}
+	return nil, nil
+}
+
+// pickClientFor returns the client of copy clone of req, it
+// is bound to the captured connection of req with Affinity,
+// and the same for all requests with StrictOrder.
+func (d *Deliver) pickClientFor(req *Request, clone int) (*Target, *Client) {
+	if d.order != nil {
+		return d.order.client(d)
+	}
+	if d.affinity == nil || req.Conn == 0 {
+		return d.pickClient()
+	}
+	return d.affinity.client(d.targets, affinityKey{conn: req.Conn, clone: clone})
+}
+
+// recv returns the next request of C, or nil if deliver is
+// stopped or C has been idle for DrainIdle after Shutdown. C
+// is not read while paused, and is not idle then.
+func (d *Deliver) recv() *Request {
+	req, _ := d.recvUntil(nil)
+	return req
+}
+
+// recvUntil is recv which also returns nil and true once
+// timeout fires.
+func (d *Deliver) recvUntil(timeout <-chan time.Time) (*Request, bool) {
+	var (
+		draining = d.draining
+		idle     <-chan time.Time
+	)
+	for {
+		c, resumed := d.C, d.pause.wait()
+		if resumed != nil {
+			c = nil
+		}
+		select {
+		case <-d.Ctx.Done():
+			return nil, false
+		case <-timeout:
+			return nil, true
+		case <-draining:
+			draining = nil
+			idle = time.After(DrainIdle)
+		case <-resumed:
+			if draining == nil {
+				idle = time.After(DrainIdle)
+			}
+		case <-idle:
+			if resumed != nil {
+				idle = nil
+				continue
+			}
+			return nil, false
+		case req := <-c:
+			d.Metrics.QueueDepth.Set(int64(len(d.C)))
+			return req, false
+		}
+	}
+}
+
+// next returns the next request to deliver, in capture order
+// with StrictOrder.
+func (d *Deliver) next() *Request {
+	if d.order != nil {
+		return d.order.next(d)
+	}
+	return d.recv()
+}
+
 func (d *Deliver) deliverRequest() {
+	defer close(d.drained)
 	d.Stat.StartTime = time.Now()
 	d.Stat.LastStatTime = time.Now()
 	for {
-		select {
-		case <-d.Ctx.Done():
+		req := d.next()
+		if req == nil {
+			return
+		}
+		if !d.transform(req) {
+			continue
+		}
+		if err := d.Pace(d.Ctx, req.Time); err != nil {
 			return
-		case req := <-d.C:
-			for i := 0; i < d.Config.Clone+1; i++ {
+		}
+		// a request dropped as no client is available does not
+		// count toward MaxRequests
+		handed := false
+		for i := 0; i < d.copies(); i++ {
+			if i == 0 && d.Differ != nil && req.Exchange != nil {
+				// the first copy is compared, the clones
+				// go through clients as usual
 				d.Stat.TotalRequest++
-				now := time.Now()
-				if now.After(d.Stat.LastStatTime.Add(time.Second * 1)) {
-					d.Stat.RequestPerSecond = d.Stat.TotalRequest - d.Stat.LastTotalRequest
-					d.Stat.LastTotalRequest = d.Stat.TotalRequest
-					d.Stat.LastStatTime = now
-					log.Infof("deliver total reqs %d, %d reqs/s", d.Stat.TotalRequest, d.Stat.RequestPerSecond)
+				handed = true
+				if d.Differ.acquire() {
+					go func() {
+						defer d.Differ.release()
+						d.diffRequest(req)
+					}()
 				}
-				// choose a random client
-				idx := rand.Int() % len(d.Clients)
-				d.Clients[idx].S.Data() <- req
-				log.Debugf("send packets to %s with connection %d", d.Config.RemoteAddr, idx)
+				continue
+			}
+			d.Stat.TotalRequest++
+			now := time.Now()
+			if now.After(d.Stat.LastStatTime.Add(time.Second * 1)) {
+				d.Stat.RequestPerSecond = d.Stat.TotalRequest - d.Stat.LastTotalRequest
+				d.Stat.LastTotalRequest = d.Stat.TotalRequest
+				d.Stat.LastStatTime = now
+				log.Infof("deliver total reqs %d, %d reqs/s", d.Stat.TotalRequest, d.Stat.RequestPerSecond)
+			}
+			// choose a random client of the next target, or
+			// the client bound to the captured connection
+			t, c := d.pickClientFor(req, i)
+			for c == nil && d.Config.BreakerHold {
+				select {
+				case <-d.Ctx.Done():
+					return
+				case <-time.After(BreakerHoldInterval):
+				}
+				t, c = d.pickClientFor(req, i)
+			}
+			if c == nil {
+				log.Debugf("no target available, drop request")
+				continue
+			}
+			atomic.AddInt64(&c.inflight, 1)
+			d.Verifier.Track(req.Data)
+			select {
+			case <-d.Ctx.Done():
+				return
+			case <-c.Ctx.Done():
+				// replaced by recoverClient after it was picked
+				atomic.AddInt64(&c.inflight, -1)
+				log.Debugf("client %d of %s closed, drop request", c.Idx, t.Addr)
+				continue
+			case c.S.Data() <- req.Data:
+			}
+			handed = true
+			log.Debugf("send packets to %s with connection %d", t.Addr, c.Idx)
+		}
+		if handed && d.delivered() {
+			return
+		}
+	}
+}
+
+// delivered counts a delivered request, it reports true and
+// closes finished once MaxRequests requests were delivered.
+// It is only called by the goroutine reading C.
+func (d *Deliver) delivered() bool {
+	if d.finished == nil {
+		return false
+	}
+	if d.requests++; d.requests < d.Config.MaxRequests {
+		return false
+	}
+	log.Infof("deliver reached max requests %d, stop taking requests", d.Config.MaxRequests)
+	close(d.finished)
+	return true
+}
+
+// Finished returns a channel closed once MaxRequests requests
+// were delivered, it is nil without MaxRequests.
+func (d *Deliver) Finished() <-chan struct{} {
+	return d.finished
+}
+
+// copies returns how many times each request is sent.
+func (d *Deliver) copies() int {
+	n := d.Config.Clone + 1
+	if amplify := d.tuned().Amplify; amplify > 1 {
+		n *= amplify
+	}
+	return n
+}
+
+// proto returns the protocol of req, Config.Proto if the
+// producer did not tell.
+func (d *Deliver) proto(req *Request) string {
+	if req.Proto != "" {
+		return req.Proto
+	}
+	return d.Config.Proto
+}
+
+// transform applies Config.Transform to req, it reports
+// whether req is still sent.
+func (d *Deliver) transform(req *Request) bool {
+	if d.Config.Transform == nil {
+		return true
+	}
+	data, err := d.Config.Transform(d.proto(req), req)
+	if err != nil {
+		log.Debugf("transform drop request: %v", err)
+		d.Metrics.TransformDrops.Inc()
+		return false
+	}
+	req.Data = data
+	return true
+}
+
+// diffRequest sends req with a new connection to the next
+// target and compares the response with the captured one.
+func (d *Deliver) diffRequest(req *Request) {
+	t := d.targets.pick()
+	if t == nil {
+		atomic.AddInt64(&d.Differ.Failed, 1)
+		return
+	}
+	if err := d.Limiter.Wait(d.Ctx); err != nil {
+		return
+	}
+	if err := d.ByteLimiter.WaitN(d.Ctx, len(req.Data)); err != nil {
+		return
+	}
+	if err := d.Delay.Wait(d.Ctx); err != nil {
+		return
+	}
+	start := time.Now()
+	conn, err := dial(t.Addr, DiffTimeout, d.tlsConfig, d.Config.KeepAliveInterval, d.Config.Linger, d.Config.LocalAddr, d.Metrics)
+	t.report(err)
+	if err != nil {
+		log.Errorf("diff connect to remote %s failed: %v", t.Addr, err)
+		d.Metrics.SendErrors.Inc()
+		atomic.AddInt64(&d.Differ.Failed, 1)
+		t.MarkDown()
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DiffTimeout))
+	n, err := conn.Write(req.Data)
+	d.Metrics.BytesSent.Add(uint64(n))
+	t.report(err)
+	if err != nil {
+		log.Errorf("diff write to remote %s failed: %v", t.Addr, err)
+		d.Metrics.SendErrors.Inc()
+		atomic.AddInt64(&d.Differ.Failed, 1)
+		return
+	}
+	d.Metrics.SendLatency.Observe(time.Since(start).Seconds())
+	got, err := d.Differ.Read(bufio.NewReader(conn))
+	if err != nil {
+		log.Errorf("diff read response from remote %s failed: %v", t.Addr, err)
+		atomic.AddInt64(&d.Differ.Failed, 1)
+		return
+	}
+	d.Differ.Compare(req.Exchange, got)
+}
+
+// exportRequest writes requests to the record file, the
+// capture timestamps are kept so they can be replayed later.
+func (d *Deliver) exportRequest() {
+	defer close(d.drained)
+	defer d.exporter.Close()
+	for {
+		req := d.next()
+		if req == nil {
+			return
+		}
+		if err := d.exporter.Write(d.Config.Proto, req); err != nil {
+			log.Errorf("export request failed: %v", err)
+			continue
+		}
+		d.Stat.TotalRequest++
+		if d.delivered() {
+			return
+		}
+	}
+}
+
+// sinkRequest writes requests to the sink until deliver is
+// stopped or drained.
+func (d *Deliver) sinkRequest() {
+	defer close(d.drained)
+	defer func() {
+		if err := d.sink.close(); err != nil {
+			log.Errorf("close sink failed: %v", err)
+		}
+	}()
+	for {
+		req := d.next()
+		if req == nil {
+			return
+		}
+		if !d.transform(req) {
+			continue
+		}
+		if err := d.sink.write(d.proto(req), req); err != nil {
+			log.Errorf("write request to sink failed: %v", err)
+			continue
+		}
+		d.Stat.TotalRequest++
+		if d.delivered() {
+			return
+		}
+	}
+}
+
+// Replay feeds requests of a record file to the deliver as
+// if they were captured, it returns nil at the end of file.
+func (d *Deliver) Replay(path string) error {
+	r, err := OpenRecordReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var total int
+	for {
+		proto, req, err := r.Read()
+		if err == io.EOF {
+			log.Infof("replay %s done, total %d requests", path, total)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read record file %s failed: %v", path, err)
+		}
+		if len(d.Config.Proto) != 0 && proto != d.Config.Proto {
+			log.Debugf("skip record of proto %s", proto)
+			continue
+		}
+		select {
+		case <-d.Ctx.Done():
+			return d.Ctx.Err()
+		case <-d.draining:
+			log.Infof("replay %s stopped by shutdown, total %d requests", path, total)
+			return nil
+		case d.C <- req:
+			d.Metrics.QueueDepth.Set(int64(len(d.C)))
+			total++
+		}
+	}
+}
+
+// NewSender creates a long connection sender with connNum
+// connections to the next available target, for streams
+// which relay traffic by themselves like ModeRaw ones. Data
+// sent to it is put back to the buffer pool once written.
+func (d *Deliver) NewSender(ctx context.Context, connNum int) (Sender, error) {
+	return d.newSender(ctx, connNum, d.Config.Handshake, PutBuffer)
+}
+
+// newSender is NewSender writing handshake to each new
+// connection and calling release with written data.
+func (d *Deliver) newSender(ctx context.Context, connNum int, handshake []byte, release func([]byte)) (Sender, error) {
+	err := fmt.Errorf("no target available")
+	for i := 0; i < len(d.targets.targets); i++ {
+		t := d.targets.pick()
+		if t == nil {
+			break
+		}
+		var s Sender
+		s, err = NewLongConnSender(ctx, &SenderConfig{
+			RemoteAddr:     t.Addr,
+			ConnNum:        connNum,
+			Limiter:        d.Limiter,
+			ByteLimiter:    d.ByteLimiter,
+			Delay:          d.Delay,
+			Verifier:       d.Verifier,
+			Reconnect:      d.Config.Reconnect,
+			BufferCap:      d.Config.ReconnectBuffer,
+			Release:        release,
+			TLS:            d.tlsConfig,
+			KeepAlive:      d.Config.KeepAliveInterval,
+			Linger:         d.Config.Linger,
+			LocalAddr:      d.Config.LocalAddr,
+			Handshake:      handshake,
+			ConnectTimeout: d.Config.ConnectTimeout,
+			WriteTimeout:   d.Config.WriteTimeout,
+			TimeoutPolicy:  d.Config.TimeoutPolicy,
+			Responses:      d.Config.Responses,
+			Report:         t.report,
+			IdleTimeout:    d.Config.BackendIdleTimeout,
+			Metrics:        d.Metrics,
+		})
+		if err == nil {
+			return s, nil
+		}
+		t.report(err)
+		t.MarkDown()
+	}
+	return nil, err
+}
+
+// stopClients waits for clients to write pending requests
+// and closes their connections.
+func (d *Deliver) stopClients() {
+	for _, t := range d.targets.targets {
+		t.mu.RLock()
+		clients := append([]*Client{}, t.clients...)
+		t.mu.RUnlock()
+		for _, c := range clients {
+			if c != nil {
+				c.S.stop()
 			}
 		}
 	}
+	if d.pool != nil {
+		d.pool.close()
+	}
+}
+
+// Shutdown stops deliver gracefully: requests still sent to C
+// are delivered until C is idle for DrainIdle, then clients
+// finish pending writes and close their connections. Callers
+// should stop feeding C first, e.g. by stopping capture and
+// flushing the assembler. Deliver is stopped when Shutdown
+// returns, ctx.Err() is returned if ctx expires before drained.
+// Pipelines are shut down after d.
+func (d *Deliver) Shutdown(ctx context.Context) error {
+	err := d.shutdown(ctx)
+	for _, p := range d.pipelines {
+		if perr := p.d.Shutdown(ctx); perr != nil && err == nil {
+			err = fmt.Errorf("shutdown pipeline %s failed: %v", p.name, perr)
+		}
+	}
+	return err
+}
+
+func (d *Deliver) shutdown(ctx context.Context) error {
+	defer d.cancel()
+	defer d.Analysis.Close()
+	d.shutdownOnce.Do(func() {
+		close(d.draining)
+	})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.drained:
+	}
+	done := make(chan struct{})
+	go func() {
+		d.stopOnce.Do(d.stopClients)
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		log.Infof("deliver drained, total reqs %d", d.Stat.TotalRequest)
+		return nil
+	}
+}
+
+func (d *Deliver) sampling() (float64, bool) {
+	rate := d.tuned().SampleRate
+	return rate, rate > 0 && rate < 1
+}
+
+// SampleRequest reports whether a parsed request is replayed
+// with per request sampling. With Pipelines requests are
+// sampled by Enqueue for each of them instead.
+func (d *Deliver) SampleRequest() bool {
+	if len(d.pipelines) > 0 {
+		return true
+	}
+	return d.sampleRequest()
+}
+
+func (d *Deliver) sampleRequest() bool {
+	rate, ok := d.sampling()
+	if !ok || d.Config.SampleByConn || d.Config.Mode == ModeRaw {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+// SampleConn reports whether a connection is replayed with per
+// connection sampling, hash must be the same for both directions
+// so requests and responses are kept together. The result is
+// deterministic for a connection. With Pipelines connections
+// are sampled by Enqueue for each of them instead.
+func (d *Deliver) SampleConn(hash uint64) bool {
+	if len(d.pipelines) > 0 {
+		return true
+	}
+	return d.sampleConn(hash)
+}
+
+func (d *Deliver) sampleConn(hash uint64) bool {
+	rate, ok := d.sampling()
+	if !ok || !d.Config.SampleByConn && d.Config.Mode != ModeRaw {
+		return true
+	}
+	return float64(hash%10000) < rate*10000
+}
+
+// sample reports whether req is kept by the sampling of d, for
+// requests sampled after parsing with Pipelines.
+func (d *Deliver) sample(req *Request) bool {
+	return d.sampleConn(req.Conn) && d.sampleRequest()
+}
+
+// LeaseSender returns a sender for a ModeRaw stream from src to
+// dst, release must be called once the stream ends. With
+// PoolSize set the sender is shared with later streams and it
+// waits while all senders are leased, otherwise a sender
+// stopped with ctx is created, which sends the PROXY protocol
+// header of src and dst if set. The addresses may be nil.
+// release is called with reuse false if the stream did not end
+// at a request boundary, a pooled sender is then stopped so the
+// next stream does not continue a partial request.
+func (d *Deliver) LeaseSender(ctx context.Context, src, dst *net.TCPAddr) (Sender, func(reuse bool), error) {
+	if d.pool == nil {
+		s, err := d.newSender(ctx, d.Config.Clone+1, proxyHeader(d.Config.ProxyProtocol, src, dst), PutBuffer)
+		return s, func(bool) {}, err
+	}
+	s, err := d.pool.get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, func(reuse bool) {
+		if reuse {
+			d.pool.put(s)
+		} else {
+			d.pool.discard(s)
+		}
+	}, nil
+}
+
+// Pace blocks until the request captured at t is due when
+// PreserveTiming is set, otherwise it returns immediately.
+func (d *Deliver) Pace(ctx context.Context, t time.Time) error {
+	return d.pacer.wait(ctx, t)
 }
 
 func (d *Deliver) Run() error {
@@ -100,12 +945,24 @@ func (d *Deliver) Run() error {
 		err := fmt.Errorf("deliver config is not set")
 		return err
 	}
-	// we start clients only with ModeRequest
-	if d.Config.Mode == ModeRequest {
+	if d.exporter != nil {
+		go d.exportRequest()
+	} else if d.sink != nil {
+		go d.sinkRequest()
+	} else if d.cluster != nil {
+		go d.clusterRequest()
+	} else if d.pool != nil && d.Config.Mode == ModeRequest {
+		go d.poolRequest()
+	} else if d.Config.Mode == ModeRequest {
+		// we start clients only with ModeRequest
 		ch := make(chan struct{})
 		go d.startClient(ch)
 		<-ch
+		go d.recoverClient()
 		go d.deliverRequest()
+	} else {
+		// nothing reads C, streams relay by themselves
+		close(d.drained)
 	}
 	select {
 	case <-d.Ctx.Done():
@@ -114,17 +971,218 @@ func (d *Deliver) Run() error {
 }
 
 func NewDeliver(ctx context.Context, config *DeliverConfig) (*Deliver, error) {
-	if len(config.RemoteAddr) == 0 {
+	addrs := config.RemoteAddrs
+	if len(addrs) == 0 && len(config.RemoteAddr) != 0 {
+		// a single address is a one target pool
+		addrs = []string{config.RemoteAddr}
+	}
+	if len(addrs) == 0 && len(config.Sink) == 0 {
 		err := fmt.Errorf("deliver config not set RemoteAddrs")
 		return nil, err
 	}
+	if len(config.RemoteAddr) == 0 && len(addrs) > 0 {
+		config.RemoteAddr = addrs[0]
+	}
+	if len(config.Sink) != 0 {
+		if config.Mode == ModeRaw || config.Diff || len(config.ExportFile) != 0 {
+			return nil, fmt.Errorf("deliver sink does not support ModeRaw, diff or export")
+		}
+	}
+	if config.Diff && config.ResponseReader == nil {
+		return nil, fmt.Errorf("deliver diff mode needs a ResponseReader")
+	}
+	switch config.Transport {
+	case "", TransportTCP:
+	case TransportUDP:
+		if config.Mode == ModeRaw || config.Diff || config.TLS != nil {
+			return nil, fmt.Errorf("deliver udp transport does not support ModeRaw, diff or TLS")
+		}
+	default:
+		return nil, fmt.Errorf("deliver transport %q not supported", config.Transport)
+	}
+	if config.BreakerThreshold < 0 {
+		return nil, fmt.Errorf("deliver breaker threshold must not be negative")
+	}
+	if config.DeliveryDelay < 0 || config.DeliveryJitter < 0 {
+		return nil, fmt.Errorf("deliver delay and jitter must not be negative")
+	}
+	if len(config.AnalysisFile) != 0 && config.Mode == ModeRaw {
+		return nil, fmt.Errorf("deliver analysis file does not support ModeRaw")
+	}
+	if config.ConnectTimeout < 0 {
+		return nil, fmt.Errorf("deliver connect timeout must not be negative")
+	}
+	if config.BackendIdleTimeout < 0 {
+		return nil, fmt.Errorf("deliver backend idle timeout must not be negative")
+	}
+	if config.Amplify < 0 {
+		return nil, fmt.Errorf("deliver amplify must not be negative")
+	}
+	if len(config.LocalAddr) != 0 {
+		if _, err := resolveLocal("tcp", config.LocalAddr); err != nil {
+			return nil, fmt.Errorf("deliver local address %q not valid: %v", config.LocalAddr, err)
+		}
+	}
+	if config.SkipFirst < 0 {
+		return nil, fmt.Errorf("deliver skip first must not be negative")
+	}
+	if (config.SkipHandshake || len(config.Handshake) != 0) && (config.Mode == ModeRaw || config.Transport == TransportUDP) {
+		return nil, fmt.Errorf("deliver handshake does not support ModeRaw or udp")
+	}
+	if config.RampUp != nil {
+		if err := config.RampUp.validate(config.MaxQPS); err != nil {
+			return nil, err
+		}
+	}
+	switch config.ProxyProtocol {
+	case "", ProxyOff:
+	case ProxyV1, ProxyV2:
+		if config.Mode != ModeRaw || config.PoolSize > 0 || config.TLS != nil {
+			return nil, fmt.Errorf("deliver proxy protocol needs ModeRaw without pool and TLS")
+		}
+	default:
+		return nil, fmt.Errorf("unknown deliver proxy protocol %q", config.ProxyProtocol)
+	}
+	if err := validatePipelines(config); err != nil {
+		return nil, err
+	}
+	if config.MaxRequests < 0 {
+		return nil, fmt.Errorf("deliver max requests must not be negative")
+	}
+	if config.MaxRequests > 0 && config.Mode == ModeRaw {
+		return nil, fmt.Errorf("deliver max requests does not support ModeRaw")
+	}
+	if config.Amplify > 1 && config.Mode == ModeRaw {
+		return nil, fmt.Errorf("deliver amplify does not support ModeRaw, use Clone")
+	}
+	if config.Affinity && !config.IsLong && config.Transport != TransportUDP {
+		return nil, fmt.Errorf("deliver affinity needs long connections")
+	}
+	if config.RedisCluster {
+		if config.Mode == ModeRaw || config.Diff || len(config.ExportFile) != 0 || len(config.Sink) != 0 ||
+			config.Transport == TransportUDP || config.Affinity {
+			return nil, fmt.Errorf("deliver redis cluster does not support ModeRaw, diff, export, sink, udp or affinity")
+		}
+	}
+	if config.PoolSize > 0 && config.Mode == ModeRequest {
+		if config.Transport == TransportUDP || config.Affinity || config.StrictOrder || config.RedisCluster {
+			return nil, fmt.Errorf("deliver pool does not support udp, affinity, strict order or redis cluster")
+		}
+	}
+	if config.StrictOrder {
+		if config.Mode == ModeRaw || config.Diff || config.Affinity || config.RedisCluster {
+			return nil, fmt.Errorf("deliver strict order does not support ModeRaw, diff, affinity or redis cluster")
+		}
+		if !config.IsLong && config.Transport != TransportUDP && len(config.Sink) == 0 && len(config.ExportFile) == 0 {
+			return nil, fmt.Errorf("deliver strict order needs long connections")
+		}
+	}
+	targets, err := newBalancer(addrs, config.Balance, config.Weights)
+	if err != nil {
+		return nil, fmt.Errorf("deliver %v", err)
+	}
 	log.Debugf("deliver config %#v", config)
+	var tc *tls.Config
+	if config.TLS != nil {
+		var err error
+		if tc, err = config.TLS.build(); err != nil {
+			return nil, err
+		}
+	}
+	m := config.metrics()
+	ctx, cancel := context.WithCancel(ctx)
 	d := &Deliver{
-		Config:  config,
-		C:       make(chan []byte),
-		Clients: []*Client{},
-		Stat:    &Stat{},
-		Ctx:     ctx,
+		Config:      config,
+		C:           make(chan *Request, config.QueueSize),
+		Stat:        &Stat{},
+		Limiter:     &Limiter{},
+		ByteLimiter: &Limiter{},
+		Delay:       &Delay{},
+		Verifier:    NewVerifier(config.Verify, m),
+		Metrics:     m,
+		Ctx:         ctx,
+		targets:     targets,
+		cancel:      cancel,
+		draining:    make(chan struct{}),
+		drained:     make(chan struct{}),
+		tlsConfig:   tc,
+		rampStart:   time.Now(),
+	}
+	d.setQPS(config.MaxQPS)
+	d.ByteLimiter.SetRate(config.MaxBytesPerSec)
+	d.Delay.Set(config.DeliveryDelay, config.DeliveryJitter)
+	d.tunables.Store(d.tuned())
+	if config.BreakerThreshold > 0 {
+		cooldown := config.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = TargetCooldown
+		}
+		for _, t := range d.targets.targets {
+			t.breaker = newBreaker(t.Addr, config.BreakerThreshold, cooldown, m)
+		}
+	}
+	if config.PreserveTiming {
+		d.pacer = newPacer(config.Speed)
+	}
+	if config.Diff {
+		d.Differ = NewDiffer(config.ResponseReader, config.Concurrency)
+	}
+	if config.Affinity {
+		d.affinity = newAffinity()
+	}
+	if config.DedupWindow > 0 {
+		d.dedup = newDedup(config.DedupWindow, config.DedupScope)
+	}
+	if config.RedisCluster {
+		d.cluster = newRedisCluster(d)
+	}
+	if config.StrictOrder {
+		d.order = newOrder(config.OrderWindow)
+	}
+	if config.MaxRequests > 0 {
+		d.finished = make(chan struct{})
+	}
+	if config.PoolSize > 0 {
+		d.pool = newSenderPool(config.PoolSize, func() (Sender, error) {
+			if config.Mode == ModeRequest {
+				// each copy is handed to a worker, request
+				// data is not a buffer of the pool
+				return d.newSender(d.Ctx, 1, config.Handshake, nil)
+			}
+			return d.NewSender(d.Ctx, config.Clone+1)
+		})
+	}
+	if len(config.ExportFile) != 0 {
+		w, err := NewRecordWriter(config.ExportFile)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("create record file failed: %v", err)
+		}
+		d.exporter = w
+	}
+	if len(config.AnalysisFile) != 0 {
+		w, err := NewAnalysisWriter(config.AnalysisFile)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("create analysis file failed: %v", err)
+		}
+		d.Analysis = w
+		go w.flushEvery(d.Ctx)
+	}
+	if len(config.Sink) != 0 {
+		s, err := newSink(config.Sink, config.SinkPath)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		d.sink = s
+	}
+	if err := d.newPipelines(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	if config.RampUp != nil {
+		go d.ramp()
 	}
 	go d.Run()
 	return d, nil
@@ -0,0 +1,213 @@
+package deliver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+)
+
+// newTestDeliver returns a deliver of c, it is shut down at the
+// end of the test.
+func newTestDeliver(t *testing.T, c *DeliverConfig) *Deliver {
+	t.Helper()
+	d, err := NewDeliver(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		d.Shutdown(ctx)
+	})
+	return d
+}
+
+func TestMaxRequests(t *testing.T) {
+	ct := newCountTarget(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{ct.Addr().String()},
+		IsLong:      true,
+		Concurrency: 2,
+		MaxRequests: 5,
+		QueueSize:   10,
+	})
+	for i := 0; i < 10; i++ {
+		d.C <- NewRequest([]byte("0123456789"))
+	}
+	select {
+	case <-d.Finished():
+	case <-time.After(3 * time.Second):
+		t.Fatal("not finished after max requests")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&ct.bytes) < 50 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// wait for more than expected
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt64(&ct.bytes); got != 50 {
+		t.Fatalf("target read %d bytes, want 5 requests of 10", got)
+	}
+}
+
+func TestMaxRequestsSkipsDropped(t *testing.T) {
+	// a closed port, requests are dropped without clients
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{addr},
+		IsLong:      true,
+		MaxRequests: 2,
+	})
+	for i := 0; i < 5; i++ {
+		select {
+		case d.C <- NewRequest([]byte("0123456789")):
+		case <-time.After(time.Second):
+			t.Fatal("request not taken, dropped requests counted toward max requests")
+		}
+	}
+	select {
+	case <-d.Finished():
+		t.Fatal("dropped requests counted toward max requests")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMetricsPerDeliver(t *testing.T) {
+	ct := newCountTarget(t)
+	addrs := []string{ct.Addr().String()}
+	m1, m2 := metrics.NewSet(), metrics.NewSet()
+	d1 := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: addrs,
+		IsLong:      true,
+		Concurrency: 1,
+		Metrics:     m1,
+		// counted in a Sub of the metrics of its parent
+		Pipelines: []Pipeline{{Name: "canary", Config: DeliverConfig{RemoteAddrs: addrs, IsLong: true, Concurrency: 1}}},
+	})
+	d2 := newTestDeliver(t, &DeliverConfig{RemoteAddrs: addrs, IsLong: true, Concurrency: 1, Metrics: m2})
+	for i := 0; i < 5; i++ {
+		if err := d1.Enqueue(context.Background(), NewRequest([]byte("0123456789"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d2.Enqueue(context.Background(), NewRequest([]byte("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*Deliver{d1, d2} {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		err := d.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	canary := m1.Sub("pipeline", "canary")
+	for m1.BytesSent.Value() < 50 || canary.BytesSent.Value() < 50 || m2.BytesSent.Value() < 10 {
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := m1.BytesSent.Value(); got != 50 {
+		t.Errorf("first deliver sent %d bytes, want 50 without its pipeline", got)
+	}
+	if got := canary.BytesSent.Value(); got != 50 {
+		t.Errorf("pipeline sent %d bytes, want 50", got)
+	}
+	if got := m1.PipelineQueued.Values()["canary"]; got != 5 {
+		t.Errorf("%d requests queued to the pipeline, want 5", got)
+	}
+	if got := m2.BytesSent.Value(); got != 10 {
+		t.Errorf("second deliver sent %d bytes, want 10", got)
+	}
+	if got := m2.PipelineQueued.Values(); len(got) != 0 {
+		t.Errorf("pipelines of the first deliver counted in the second: %v", got)
+	}
+}
+
+func TestShutdownDeliversQueued(t *testing.T) {
+	lt := newLineTarget(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{lt.Addr().String()},
+		IsLong:      true,
+		Concurrency: 4,
+		QueueSize:   1000,
+	})
+	const n = 500
+	for i := 0; i < n; i++ {
+		d.C <- NewRequest([]byte(fmt.Sprintf("request %d\n", i)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the target reads what was written before the close
+	deadline := time.Now().Add(2 * time.Second)
+	for lt.read() < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := lt.read(); got != n {
+		t.Fatalf("target read %d requests after shutdown, want %d", got, n)
+	}
+}
+
+func TestCloneAmplifyCopies(t *testing.T) {
+	for _, c := range []struct {
+		clone, amplify, copies int
+	}{
+		{0, 0, 1},
+		{2, 0, 3},
+		{0, 3, 3},
+		{1, 3, 6},
+	} {
+		lt := newLineTarget(t)
+		d := newTestDeliver(t, &DeliverConfig{
+			RemoteAddrs: []string{lt.Addr().String()},
+			IsLong:      true,
+			Concurrency: 1,
+			Clone:       c.clone,
+			Amplify:     c.amplify,
+		})
+		const n = 10
+		for i := 0; i < n; i++ {
+			d.C <- NewRequest([]byte(fmt.Sprintf("request %d\n", i)))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		err := d.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for lt.read() < n*c.copies && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// nothing more arrives
+		time.Sleep(50 * time.Millisecond)
+		lt.mu.Lock()
+		for i := 0; i < n; i++ {
+			line := fmt.Sprintf("request %d", i)
+			if got := lt.counts[line]; got != c.copies {
+				t.Errorf("clone %d amplify %d sent %q %d times, want %d", c.clone, c.amplify, line, got, c.copies)
+			}
+		}
+		lt.mu.Unlock()
+	}
+}
@@ -0,0 +1,65 @@
+package deliver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	"golang.org/x/sys/unix"
+)
+
+func TestDialSocketOptions(t *testing.T) {
+	l, accepted := listenStalled(t)
+	conn, err := dial(l.Addr().String(), time.Second, nil, 7*time.Second, 1500*time.Millisecond, "", metrics.NewSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer (<-accepted).Close()
+	raw, err := conn.(*countedConn).Conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keepAlive, idle int
+	var linger *unix.Linger
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if keepAlive, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE); sockErr != nil {
+			return
+		}
+		if idle, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE); sockErr != nil {
+			return
+		}
+		linger, sockErr = unix.GetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER)
+	})
+	if err != nil || sockErr != nil {
+		t.Fatal(err, sockErr)
+	}
+	if keepAlive == 0 || idle != 7 {
+		t.Errorf("keepalive %d after %ds idle, want on after 7s", keepAlive, idle)
+	}
+	// rounded up to whole seconds
+	if linger.Onoff == 0 || linger.Linger != 2 {
+		t.Errorf("linger %+v, want on with 2s", *linger)
+	}
+}
+
+func TestDeliverLocalAddr(t *testing.T) {
+	l, accepted := listenStalled(t)
+	newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{l.Addr().String()},
+		IsLong:      true,
+		Concurrency: 1,
+		LocalAddr:   "127.0.0.2",
+	})
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+			t.Fatalf("connection from %v, want 127.0.0.2", ip)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no connection to the target")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Differ reads the response of each replayed request from the
+// target and compares it with the captured production response,
+// the capture side pairs requests and responses of the same
+// connection through an Exchange.
+package deliver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how long to wait for the target and the captured response
+const DiffTimeout = time.Second * 5
+
+// ResponseReader reads one response from a target connection,
+// the result is compared byte by byte with the captured one,
+// so volatile fields like dates should be dropped.
+type ResponseReader func(r *bufio.Reader) ([]byte, error)
+
+// Exchange carries the captured response of a request.
+type Exchange struct {
+	captured chan []byte
+}
+
+// SetCaptured is called once by the capture side.
+func (e *Exchange) SetCaptured(resp []byte) {
+	e.captured <- resp
+}
+
+func (e *Exchange) wait(timeout time.Duration) ([]byte, bool) {
+	select {
+	case resp := <-e.captured:
+		return resp, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+func NewExchange() *Exchange {
+	return &Exchange{
+		captured: make(chan []byte, 1),
+	}
+}
+
+type Differ struct {
+	Read       ResponseReader
+	Matched    int64
+	Mismatched int64
+	// target or captured response not available
+	Failed int64
+	// not compared as all slots were busy
+	Dropped int64
+	// held by each comparison in flight, nil for no limit
+	slots chan struct{}
+}
+
+// acquire takes a slot for a comparison, it counts the request
+// dropped if none is free.
+func (df *Differ) acquire() bool {
+	if df.slots == nil {
+		return true
+	}
+	select {
+	case df.slots <- struct{}{}:
+		return true
+	default:
+		atomic.AddInt64(&df.Dropped, 1)
+		log.Debugf("diff slots busy, drop request")
+		return false
+	}
+}
+
+func (df *Differ) release() {
+	if df.slots != nil {
+		<-df.slots
+	}
+}
+
+// Compare waits for the captured response of e and compares
+// it with the target response got.
+func (df *Differ) Compare(e *Exchange, got []byte) {
+	want, ok := e.wait(DiffTimeout)
+	if !ok {
+		atomic.AddInt64(&df.Failed, 1)
+		log.Debugf("diff captured response not found")
+		return
+	}
+	if bytes.Equal(want, got) {
+		atomic.AddInt64(&df.Matched, 1)
+		return
+	}
+	atomic.AddInt64(&df.Mismatched, 1)
+	log.Warnf("diff response mismatch: %s", diffLines(want, got))
+}
+
+func (df *Differ) Summary() string {
+	return fmt.Sprintf("diff matched %d, mismatched %d, failed %d, dropped %d",
+		atomic.LoadInt64(&df.Matched), atomic.LoadInt64(&df.Mismatched), atomic.LoadInt64(&df.Failed),
+		atomic.LoadInt64(&df.Dropped))
+}
+
+// NewDiffer returns a Differ reading responses with read and
+// comparing at most slots requests at a time, no limit if
+// slots <= 0.
+func NewDiffer(read ResponseReader, slots int) *Differ {
+	df := &Differ{Read: read}
+	if slots > 0 {
+		df.slots = make(chan struct{}, slots)
+	}
+	return df
+}
+
+// diffLines describes the first differing line of want and got.
+func diffLines(want, got []byte) string {
+	wl, gl := bytes.Split(want, []byte("\n")), bytes.Split(got, []byte("\n"))
+	for i := 0; i < len(wl) || i < len(gl); i++ {
+		var w, g []byte
+		if i < len(wl) {
+			w = wl[i]
+		}
+		if i < len(gl) {
+			g = gl[i]
+		}
+		if !bytes.Equal(w, g) {
+			return fmt.Sprintf("line %d, captured %q, target %q", i+1, w, g)
+		}
+	}
+	return fmt.Sprintf("captured %d bytes, target %d bytes", len(want), len(got))
+}
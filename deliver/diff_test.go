@@ -0,0 +1,36 @@
+package deliver
+
+import (
+	"bufio"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiffDropsWhenSlotsBusy(t *testing.T) {
+	// never answers, each comparison holds its slot until
+	// DiffTimeout
+	l, _ := listenStalled(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{l.Addr().String()},
+		IsLong:      true,
+		Concurrency: 2,
+		Diff:        true,
+		ResponseReader: func(r *bufio.Reader) ([]byte, error) {
+			return r.ReadBytes('\n')
+		},
+	})
+	const n = 5
+	for i := 0; i < n; i++ {
+		req := NewRequest([]byte("ping\n"))
+		req.Exchange = NewExchange()
+		d.C <- req
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&d.Differ.Dropped) < n-2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&d.Differ.Dropped); got != n-2 {
+		t.Fatalf("%d requests dropped with 2 slots busy, want %d", got, n-2)
+	}
+}
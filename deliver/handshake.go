@@ -0,0 +1,47 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+)
+
+// max time to write the handshake to a new connection
+const HandshakeTimeout = time.Second * 3
+
+func (d *Deliver) skipHandshake() bool {
+	return d.Config.SkipHandshake || len(d.Config.Handshake) != 0
+}
+
+// greet writes handshake to a new connection to a target, its
+// reply is read like the responses of requests. conn is closed
+// if the write fails.
+func greet(conn net.Conn, handshake []byte, m *metrics.Set) error {
+	if len(handshake) == 0 {
+		return nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(HandshakeTimeout))
+	n, err := conn.Write(handshake)
+	m.BytesSent.Add(uint64(n))
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("write handshake failed: %v", err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// idleTimer fires once a sender has written nothing for its
+// duration, a nil idleTimer never fires.
+type idleTimer struct {
+	t *time.Timer
+	d time.Duration
+}
+
+func (t *idleTimer) C() <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.t.C
+}
+
+// reset restarts the timer, a tick not received yet is dropped.
+func (t *idleTimer) reset() {
+	if t == nil {
+		return
+	}
+	if !t.t.Stop() {
+		select {
+		case <-t.t.C:
+		default:
+		}
+	}
+	t.t.Reset(t.d)
+}
+
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.t.Stop()
+	}
+}
+
+func newIdleTimer(d time.Duration) *idleTimer {
+	if d <= 0 {
+		return nil
+	}
+	return &idleTimer{t: time.NewTimer(d), d: d}
+}
+
+// reap closes the alive connections of an idle sender, which
+// stays alive and redials them on the next request. It is only
+// called by run, so no write is in flight.
+func (s *LongConnSender) reap() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	n := 0
+	for idx, conn := range s.Remotes {
+		if !s.ConnState[idx] {
+			continue
+		}
+		conn.Close()
+		s.Remotes[idx] = nil
+		s.ConnState[idx] = false
+		atomic.AddInt32(&s.alive, -1)
+		n++
+	}
+	if n > 0 {
+		atomic.StoreInt32(&s.idle, 1)
+		log.Debugf("remote %s idle for %v, close %d connections", s.RemoteAddr, s.IdleTimeout, n)
+	}
+}
+
+// wake redials the connections closed by reap, connections
+// failing to dial are reconnected with Reconnect and dead
+// otherwise.
+func (s *LongConnSender) wake() {
+	atomic.StoreInt32(&s.idle, 0)
+	for idx := range s.Remotes {
+		if _, ok := s.conn(idx); ok {
+			continue
+		}
+		conn, err := dial(s.RemoteAddr, s.redialTimeout(), s.TLS, s.KeepAlive, s.Linger, s.LocalAddr, s.Metrics)
+		if err == nil {
+			err = greet(conn, s.Handshake, s.Metrics)
+		}
+		s.report(err)
+		if err != nil {
+			log.Errorf("redial %d to idle remote %s failed: %v", idx, s.RemoteAddr, err)
+			if s.Reconnect {
+				go s.reconnect(idx)
+			}
+			continue
+		}
+		s.mu.Lock()
+		s.Remotes[idx] = conn
+		s.ConnState[idx] = true
+		atomic.AddInt32(&s.alive, 1)
+		s.mu.Unlock()
+		go s.drain(idx)
+	}
+}
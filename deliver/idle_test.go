@@ -0,0 +1,93 @@
+package deliver
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openTarget counts its open connections and the bytes read.
+type openTarget struct {
+	net.Listener
+	open  int64
+	bytes int64
+}
+
+func newOpenTarget(t *testing.T) *openTarget {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot := &openTarget{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&ot.open, 1)
+			go func() {
+				defer atomic.AddInt64(&ot.open, -1)
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					atomic.AddInt64(&ot.bytes, int64(n))
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ot
+}
+
+// waitFor polls cond for up to 2 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIdleConnectionsReaped(t *testing.T) {
+	ot := newOpenTarget(t)
+	s, err := NewLongConnSender(context.Background(), &SenderConfig{
+		RemoteAddr:  ot.Addr().String(),
+		ConnNum:     2,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	waitFor(t, "2 connections", func() bool { return atomic.LoadInt64(&ot.open) == 2 })
+	// written to both connections
+	s.Data() <- []byte("0123456789")
+	waitFor(t, "the first request", func() bool { return atomic.LoadInt64(&ot.bytes) == 20 })
+
+	start := time.Now()
+	waitFor(t, "idle connections closed", func() bool { return atomic.LoadInt64(&ot.open) == 0 })
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("connections closed after %v, before the idle timeout", elapsed)
+	}
+	if !s.Alive() {
+		t.Fatal("idle sender not alive")
+	}
+
+	// redialed on the next request
+	s.Data() <- []byte("0123456789")
+	waitFor(t, "the request after idle", func() bool { return atomic.LoadInt64(&ot.bytes) == 40 })
+	if open := atomic.LoadInt64(&ot.open); open != 2 {
+		t.Fatalf("%d connections open after idle, want 2", open)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Limiter is a token bucket shared by senders, callers block
+// until enough tokens are available, so a limited remote
+// applies backpressure up the pipeline instead of dropping.
+package deliver
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter wraps a rate.Limiter whose rate can be lifted and
+// set again, a nil or zero Limiter is unlimited.
+type Limiter struct {
+	mu sync.Mutex
+	// nil while unlimited
+	lim *rate.Limiter
+}
+
+// limiter returns the rate.Limiter in use, nil if unlimited.
+func (l *Limiter) limiter() *rate.Limiter {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lim
+}
+
+// WaitN blocks until n tokens are taken or ctx is done, a nil
+// or unlimited Limiter never blocks. Tokens are reserved before
+// sleeping, so concurrent waiters are served in order. More
+// than a burst of tokens, like a large request of a ByteLimiter,
+// are taken a burst at a time.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	lim := l.limiter()
+	if lim == nil {
+		return nil
+	}
+	burst := lim.Burst()
+	for ; n > burst; n -= burst {
+		if err := lim.WaitN(ctx, burst); err != nil {
+			return err
+		}
+	}
+	return lim.WaitN(ctx, n)
+}
+
+func (l *Limiter) Wait(ctx context.Context) error {
+	return l.WaitN(ctx, 1)
+}
+
+// SetRate changes the rate of a running Limiter, rate <= 0
+// lifts the limit. Waiters already sleeping keep their wait. A
+// limit set after none starts with a full bucket of one second
+// like NewLimiter, later changes keep its burst.
+func (l *Limiter) SetRate(r int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case r <= 0:
+		l.lim = nil
+	case l.lim == nil:
+		l.lim = newRateLimiter(r)
+	default:
+		l.lim.SetLimit(rate.Limit(r))
+	}
+}
+
+// Rate returns the events allowed per second, 0 for unlimited.
+func (l *Limiter) Rate() int {
+	lim := l.limiter()
+	if lim == nil {
+		return 0
+	}
+	return int(lim.Limit())
+}
+
+// newRateLimiter allows r events per second with a burst of one
+// second, its bucket is full until the first event.
+func newRateLimiter(r int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(r), r)
+}
+
+// NewLimiter creates a Limiter allowing rate events per second
+// with a burst of one second, it returns nil for rate <= 0.
+func NewLimiter(r int) *Limiter {
+	if r <= 0 {
+		return nil
+	}
+	return &Limiter{lim: newRateLimiter(r)}
+}
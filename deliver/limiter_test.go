@@ -0,0 +1,111 @@
+package deliver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// elapsed returns how long waiting for n tokens of l takes, one
+// at a time or all at once.
+func elapsed(t *testing.T, l *Limiter, n int, each bool) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if !each {
+		if err := l.WaitN(context.Background(), n); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	for i := 0; i < n; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return time.Since(start)
+}
+
+func within(t *testing.T, got, want time.Duration) {
+	t.Helper()
+	if got < want*8/10 || got > want*13/10+50*time.Millisecond {
+		t.Fatalf("took %v, want about %v", got, want)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	// a full bucket of 200, then 100 more at 200/s
+	within(t, elapsed(t, NewLimiter(200), 300, true), 500*time.Millisecond)
+}
+
+func TestLimiterWaitMoreThanBurst(t *testing.T) {
+	// like a request of a ByteLimiter larger than its rate
+	within(t, elapsed(t, NewLimiter(1000), 1500, false), 500*time.Millisecond)
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	var l Limiter
+	if l.Rate() != 0 {
+		t.Fatal("zero limiter is limited")
+	}
+	within(t, elapsed(t, &l, 1000, true), 0)
+
+	l.SetRate(100)
+	if l.Rate() != 100 {
+		t.Fatalf("rate %d, want 100", l.Rate())
+	}
+	// starts with a full bucket
+	within(t, elapsed(t, &l, 100, true), 0)
+	within(t, elapsed(t, &l, 50, true), 500*time.Millisecond)
+
+	l.SetRate(200)
+	within(t, elapsed(t, &l, 100, true), 500*time.Millisecond)
+
+	l.SetRate(0)
+	if l.Rate() != 0 {
+		t.Fatal("limit not lifted")
+	}
+	within(t, elapsed(t, &l, 1000, true), 0)
+}
+
+func TestLimiterCanceled(t *testing.T) {
+	l := NewLimiter(1)
+	l.Wait(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err == nil {
+		t.Fatal("wait beyond the deadline of ctx succeeded")
+	}
+}
+
+func TestMaxBytesPerSec(t *testing.T) {
+	const rate, size, n = 10000, 1000, 30
+	ot := newOpenTarget(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs:    []string{ot.Addr().String()},
+		IsLong:         true,
+		Concurrency:    1,
+		QueueSize:      n,
+		MaxBytesPerSec: rate,
+	})
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		d.C <- NewRequest(make([]byte, size))
+	}
+	// a full bucket of rate bytes, the rest at rate, with one
+	// request of slack for the tolerance
+	for {
+		got, since := atomic.LoadInt64(&ot.bytes), time.Since(start)
+		if limit := rate + int64(float64(rate)*since.Seconds()*1.1) + size; got > limit {
+			t.Fatalf("target read %d bytes after %v, want at most %d", got, since, limit)
+		}
+		if got == n*size {
+			break
+		}
+		if since > 5*time.Second {
+			t.Fatalf("target read %d of %d bytes", got, n*size)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	within(t, time.Since(start), (n*size-rate)*time.Second/rate)
+}
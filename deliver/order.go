@@ -0,0 +1,135 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"container/heap"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// default time a request is held for earlier captured requests
+// of other connections, streams are parsed concurrently and
+// reach C slightly out of order
+const DefaultOrderWindow = time.Millisecond * 200
+
+// order releases requests of C sorted by capture time, the
+// earliest captured request is released once it has been held
+// for window. It is only used by the goroutine reading C.
+type order struct {
+	window time.Duration
+	held   heldHeap
+	seq    uint64
+	// capture time of the last request released
+	last time.Time
+	// C is drained, held requests are released at once
+	drained bool
+	// the client all requests are sent to while alive
+	t *Target
+	c *Client
+}
+
+type held struct {
+	req     *Request
+	seq     uint64
+	arrival time.Time
+}
+
+// heldHeap is a min heap by capture time, then by arrival.
+type heldHeap []*held
+
+func (h heldHeap) Len() int { return len(h) }
+
+func (h heldHeap) Less(i, j int) bool {
+	if !h[i].req.Time.Equal(h[j].req.Time) {
+		return h[i].req.Time.Before(h[j].req.Time)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h heldHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *heldHeap) Push(x interface{}) { *h = append(*h, x.(*held)) }
+
+func (h *heldHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// next returns the earliest captured request once it is due,
+// or nil like recv.
+func (o *order) next(d *Deliver) *Request {
+	for {
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		if len(o.held) > 0 {
+			wait := time.Until(o.held[0].arrival.Add(o.window))
+			if wait <= 0 || o.drained {
+				return o.pop()
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		} else if o.drained {
+			return nil
+		}
+		req, timedOut := d.recvUntil(timeout)
+		if timer != nil {
+			timer.Stop()
+		}
+		if timedOut {
+			continue
+		}
+		if req == nil {
+			if d.Ctx.Err() != nil {
+				return nil
+			}
+			o.drained = true
+			continue
+		}
+		o.seq++
+		heap.Push(&o.held, &held{req: req, seq: o.seq, arrival: time.Now()})
+	}
+}
+
+func (o *order) pop() *Request {
+	req := heap.Pop(&o.held).(*held).req
+	if req.Time.Before(o.last) {
+		log.Debugf("request captured %v before the last one arrived too late to be ordered", o.last.Sub(req.Time))
+	} else {
+		o.last = req.Time
+	}
+	return req
+}
+
+// client returns the client of the last request while it is
+// alive, so requests are written by one connection in order.
+func (o *order) client(d *Deliver) (*Target, *Client) {
+	if o.c != nil && o.c.S.Alive() && o.t.Available(time.Now()) {
+		return o.t, o.c
+	}
+	o.t, o.c = d.pickClient()
+	return o.t, o.c
+}
+
+func newOrder(window time.Duration) *order {
+	if window <= 0 {
+		window = DefaultOrderWindow
+	}
+	return &order{window: window}
+}
@@ -0,0 +1,113 @@
+package deliver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seqTarget records the lines read from each accepted
+// connection in order.
+type seqTarget struct {
+	net.Listener
+	mu    sync.Mutex
+	lines map[int][]string
+}
+
+func newSeqTarget(t *testing.T) *seqTarget {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &seqTarget{Listener: l, lines: make(map[int][]string)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for idx := 0; ; idx++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(idx int) {
+				defer conn.Close()
+				sc := bufio.NewScanner(conn)
+				for sc.Scan() {
+					st.mu.Lock()
+					st.lines[idx] = append(st.lines[idx], sc.Text())
+					st.mu.Unlock()
+				}
+			}(idx)
+		}
+	}()
+	return st
+}
+
+// read returns the lines of all connections.
+func (st *seqTarget) read() map[int][]string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	lines := make(map[int][]string, len(st.lines))
+	for idx, l := range st.lines {
+		lines[idx] = append([]string(nil), l...)
+	}
+	return lines
+}
+
+func TestStrictOrder(t *testing.T) {
+	st := newSeqTarget(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{st.Addr().String()},
+		IsLong:      true,
+		Concurrency: 4,
+		StrictOrder: true,
+	})
+	// the requests of connections 1 and 2 are captured
+	// interleaved, all of connection 2 reach C first
+	const n = 10
+	start := time.Unix(1500000000, 0)
+	var want []string
+	for i := 0; i < n; i++ {
+		for conn := 1; conn <= 2; conn++ {
+			want = append(want, fmt.Sprintf("conn %d req %d", conn, i))
+		}
+	}
+	for conn := 2; conn >= 1; conn-- {
+		for i := 0; i < n; i++ {
+			d.C <- &Request{
+				Data: []byte(fmt.Sprintf("conn %d req %d\n", conn, i)),
+				Conn: uint64(conn),
+				Time: start.Add(time.Duration(2*i+conn) * time.Millisecond),
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		lines := st.read()
+		done := len(lines) > 0
+		for _, l := range lines {
+			done = done && len(l) >= len(want)
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("target read %v, want %d lines on each connection", lines, len(want))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for idx, l := range st.read() {
+		if strings.Join(l, ", ") != strings.Join(want, ", ") {
+			t.Errorf("connection %d read %v, want %v", idx, l, want)
+		}
+	}
+}
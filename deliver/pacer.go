@@ -0,0 +1,61 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pacer reproduces the gaps between capture timestamps, the
+// first paced request fixes the mapping from capture time to
+// wall time, later ones wait until their scaled offset.
+type pacer struct {
+	speed float64
+	mu    sync.Mutex
+	base  time.Time
+	start time.Time
+}
+
+func (p *pacer) wait(ctx context.Context, t time.Time) error {
+	if p == nil || t.IsZero() {
+		return nil
+	}
+	p.mu.Lock()
+	if p.base.IsZero() {
+		p.base, p.start = t, time.Now()
+	}
+	due := p.start.Add(time.Duration(float64(t.Sub(p.base)) / p.speed))
+	p.mu.Unlock()
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func newPacer(speed float64) *pacer {
+	if speed <= 0 {
+		speed = 1
+	}
+	return &pacer{speed: speed}
+}
@@ -0,0 +1,72 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pause gates reading C, see Deliver.Pause.
+type pause struct {
+	mu sync.Mutex
+	// closed on Resume, nil while not paused
+	resumed chan struct{}
+}
+
+// wait returns a channel closed once resumed, or nil if not
+// paused.
+func (p *pause) wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		return nil
+	}
+	return p.resumed
+}
+
+// Pause stops taking requests from C until Resume, e.g. while
+// the target is deployed. Requests are buffered in C up to
+// QueueSize, then Enqueue blocks and backpressures capture.
+// Requests already taken from C are still sent. ModeRaw
+// streams do not go through C and are not paused.
+func (d *Deliver) Pause() {
+	d.pause.mu.Lock()
+	defer d.pause.mu.Unlock()
+	if d.pause.resumed != nil {
+		return
+	}
+	d.pause.resumed = make(chan struct{})
+	d.Metrics.Paused.Inc()
+	log.Infof("deliver paused")
+}
+
+// Resume continues taking requests from C after Pause.
+func (d *Deliver) Resume() {
+	d.pause.mu.Lock()
+	defer d.pause.mu.Unlock()
+	if d.pause.resumed == nil {
+		return
+	}
+	close(d.pause.resumed)
+	d.pause.resumed = nil
+	d.Metrics.Paused.Dec()
+	log.Infof("deliver resumed")
+}
+
+// Paused reports whether deliver is paused.
+func (d *Deliver) Paused() bool {
+	return d.pause.wait() != nil
+}
@@ -0,0 +1,47 @@
+package deliver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+)
+
+func TestPauseResume(t *testing.T) {
+	lt := newLineTarget(t)
+	m := metrics.NewSet()
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{lt.Addr().String()},
+		IsLong:      true,
+		Concurrency: 1,
+		QueueSize:   10,
+		Metrics:     m,
+	})
+	d.Pause()
+	if !d.Paused() || m.Paused.Value() != 1 {
+		t.Fatal("pause not reported")
+	}
+	const n = 5
+	for i := 0; i < n; i++ {
+		d.C <- NewRequest([]byte("0123456789\n"))
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := lt.read(); got != 0 {
+		t.Fatalf("target read %d requests while paused", got)
+	}
+	if got := len(d.C); got != n {
+		t.Fatalf("%d requests queued while paused, want %d", got, n)
+	}
+
+	d.Resume()
+	if d.Paused() || m.Paused.Value() != 0 {
+		t.Fatal("resume not reported")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for lt.read() < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := lt.read(); got != n {
+		t.Fatalf("target read %d requests after resume, want %d", got, n)
+	}
+}
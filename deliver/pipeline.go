@@ -0,0 +1,128 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Pipeline is a named deliver fed with a copy of each request
+// parsed for the deliver it belongs to, e.g. a canary getting
+// 5% of the traffic replayed to staging. Config has its own
+// targets, rates, sampling and Transform, Proto, ProtocolType,
+// Mode and Transport are taken from the parent deliver. A zero
+// Config.QueueSize is DefaultPipelineQueueSize.
+type Pipeline struct {
+	Name   string
+	Config DeliverConfig
+}
+
+// queue of a pipeline without QueueSize, copies are offered
+// without blocking so a pipeline without a queue would drop
+// every request its deliver is not waiting for right then
+const DefaultPipelineQueueSize = 1024
+
+type pipeline struct {
+	name string
+	d    *Deliver
+	// metrics of the parent deliver, copies queued and dropped
+	// are counted there
+	m *metrics.Set
+}
+
+func validatePipelines(config *DeliverConfig) error {
+	names := make(map[string]bool, len(config.Pipelines))
+	for _, p := range config.Pipelines {
+		if p.Name == "" || names[p.Name] {
+			return fmt.Errorf("deliver pipeline names must be set and unique")
+		}
+		names[p.Name] = true
+		if config.Mode == ModeRaw {
+			return fmt.Errorf("deliver pipelines do not support ModeRaw")
+		}
+		if p.Config.Diff || len(p.Config.Pipelines) != 0 {
+			return fmt.Errorf("deliver pipeline %s does not support diff or pipelines", p.Name)
+		}
+		if p.Config.QueueSize < 0 {
+			return fmt.Errorf("deliver pipeline %s queue size must not be negative", p.Name)
+		}
+	}
+	return nil
+}
+
+// newPipelines creates the pipelines of d with ctx, so that
+// they are drained after d by Shutdown.
+func (d *Deliver) newPipelines(ctx context.Context) error {
+	for _, p := range d.Config.Pipelines {
+		pc := p.Config
+		pc.Proto = d.Config.Proto
+		pc.ProtocolType = d.Config.ProtocolType
+		pc.Mode = d.Config.Mode
+		pc.Transport = d.Config.Transport
+		pc.Metrics = d.Metrics.Sub("pipeline", p.Name)
+		if pc.QueueSize == 0 {
+			pc.QueueSize = DefaultPipelineQueueSize
+		}
+		pd, err := NewDeliver(ctx, &pc)
+		if err != nil {
+			d.cancelPipelines()
+			return fmt.Errorf("create deliver pipeline %s failed: %v", p.Name, err)
+		}
+		d.pipelines = append(d.pipelines, &pipeline{name: p.Name, d: pd, m: d.Metrics})
+	}
+	return nil
+}
+
+func (d *Deliver) cancelPipelines() {
+	for _, p := range d.pipelines {
+		p.d.cancel()
+	}
+}
+
+// offer copies req to the queue of p if sampled, a full queue
+// drops the copy instead of holding back capture and the other
+// pipelines.
+func (p *pipeline) offer(req *Request) {
+	if !p.d.sample(req) {
+		return
+	}
+	r := *req
+	r.Data = append([]byte(nil), req.Data...)
+	r.Exchange = nil
+	if !p.d.accept(&r) {
+		return
+	}
+	select {
+	case p.d.C <- &r:
+		p.m.PipelineQueued.With(p.name).Inc()
+	default:
+		log.Debugf("deliver pipeline %s full, drop request of %s", p.name, req.Flow)
+		p.m.PipelineDrops.With(p.name).Inc()
+	}
+}
+
+// Pipeline returns the deliver of the pipeline named name, nil
+// if there is none.
+func (d *Deliver) Pipeline(name string) *Deliver {
+	for _, p := range d.pipelines {
+		if p.name == name {
+			return p.d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package deliver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPipelinesSampleIndependently(t *testing.T) {
+	d, err := NewDeliver(context.Background(), &DeliverConfig{
+		Sink: SinkDiscard,
+		Pipelines: []Pipeline{
+			{Name: "staging", Config: DeliverConfig{Sink: SinkDiscard}},
+			{Name: "canary", Config: DeliverConfig{Sink: SinkDiscard, SampleRate: 0.1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := d.Enqueue(context.Background(), NewRequest([]byte("PING\r\n"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Stat.TotalRequest; got != n {
+		t.Errorf("deliver got %d requests, want %d", got, n)
+	}
+	if got := d.Pipeline("staging").Stat.TotalRequest; got != n {
+		t.Errorf("staging got %d requests, want %d", got, n)
+	}
+	// 100 expected, far from both 0 and n
+	if got := d.Pipeline("canary").Stat.TotalRequest; got < 50 || got > 150 {
+		t.Errorf("canary got %d requests, want about %d", got, n/10)
+	}
+}
+
+func TestPipelineQueueSize(t *testing.T) {
+	_, err := NewDeliver(context.Background(), &DeliverConfig{
+		Sink:      SinkDiscard,
+		Pipelines: []Pipeline{{Name: "canary", Config: DeliverConfig{Sink: SinkDiscard, QueueSize: -1}}},
+	})
+	if err == nil {
+		t.Fatal("negative pipeline queue size accepted")
+	}
+}
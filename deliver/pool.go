@@ -0,0 +1,180 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Pool shares long connection senders among ModeRaw streams,
+// or among the workers delivering requests of ModeRequest, so
+// outbound connections are bounded by the pool size rather
+// than the number of captured connections.
+package deliver
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// senderPool leases each sender to one stream at a time, the
+// bytes of a stream are never interleaved with another one.
+// A sender is reused by the next stream once put back, streams
+// not ending at a request boundary discard it instead.
+type senderPool struct {
+	// one token for each live sender
+	slots chan struct{}
+	idle  chan Sender
+	// creates a sender to the next target
+	create func() (Sender, error)
+}
+
+// get returns an idle sender, or creates one if the pool is
+// not full, otherwise it waits for a sender to be released.
+func (p *senderPool) get(ctx context.Context) (Sender, error) {
+	for {
+		select {
+		case s := <-p.idle:
+			if s.Alive() {
+				return s, nil
+			}
+			p.discard(s)
+			continue
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case s := <-p.idle:
+			if s.Alive() {
+				return s, nil
+			}
+			p.discard(s)
+		case p.slots <- struct{}{}:
+			s, err := p.create()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return s, nil
+		}
+	}
+}
+
+// put returns a leased sender, dead ones are dropped so their
+// slot can be used by a new sender.
+func (p *senderPool) put(s Sender) {
+	if !s.Alive() {
+		p.discard(s)
+		return
+	}
+	// never blocks, live senders are at most cap(idle)
+	p.idle <- s
+}
+
+// discard stops a leased sender, it frees its slot.
+func (p *senderPool) discard(s Sender) {
+	s.stop()
+	<-p.slots
+}
+
+// close stops idle senders, leased ones are stopped with the
+// context they were created with.
+func (p *senderPool) close() {
+	for {
+		select {
+		case s := <-p.idle:
+			p.discard(s)
+		default:
+			return
+		}
+	}
+}
+
+func newSenderPool(size int, create func() (Sender, error)) *senderPool {
+	return &senderPool{
+		slots:  make(chan struct{}, size),
+		idle:   make(chan Sender, size),
+		create: create,
+	}
+}
+
+// poolRequest hands requests to PoolSize workers until deliver
+// is stopped or drained.
+func (d *Deliver) poolRequest() {
+	defer close(d.drained)
+	work := make(chan []byte)
+	var wg sync.WaitGroup
+	for i := 0; i < d.Config.PoolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.poolWorker(work)
+		}()
+	}
+	defer wg.Wait()
+	defer close(work)
+	for {
+		req := d.next()
+		if req == nil {
+			return
+		}
+		if !d.transform(req) {
+			continue
+		}
+		if err := d.Pace(d.Ctx, req.Time); err != nil {
+			return
+		}
+		for i := 0; i < d.copies(); i++ {
+			d.Stat.TotalRequest++
+			d.Verifier.Track(req.Data)
+			select {
+			case <-d.Ctx.Done():
+				return
+			case work <- req.Data:
+			}
+		}
+		if d.delivered() {
+			return
+		}
+	}
+}
+
+// poolWorker sends work with a sender leased from the pool,
+// it is owned by the worker until work is closed. A dead
+// sender is discarded and a new one leased for the next
+// request.
+func (d *Deliver) poolWorker(work chan []byte) {
+	var s Sender
+	defer func() {
+		if s != nil {
+			d.pool.put(s)
+		}
+	}()
+	for data := range work {
+		if s != nil && !s.Alive() {
+			d.pool.discard(s)
+			s = nil
+		}
+		if s == nil {
+			var err error
+			if s, err = d.pool.get(d.Ctx); err != nil {
+				log.Errorf("lease sender failed, drop request: %v", err)
+				d.Metrics.SendErrors.Inc()
+				continue
+			}
+		}
+		select {
+		case <-d.Ctx.Done():
+			return
+		case s.Data() <- data:
+		}
+	}
+}
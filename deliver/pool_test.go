@@ -0,0 +1,107 @@
+package deliver
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countTarget accepts connections and counts them and the bytes
+// read from them.
+type countTarget struct {
+	net.Listener
+	conns int64
+	bytes int64
+}
+
+func newCountTarget(t *testing.T) *countTarget {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := &countTarget{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&ct.conns, 1)
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(ioutil.Discard, conn)
+				atomic.AddInt64(&ct.bytes, n)
+			}()
+		}
+	}()
+	return ct
+}
+
+func TestPoolBoundsConnections(t *testing.T) {
+	ct := newCountTarget(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{ct.Addr().String()},
+		IsLong:      true,
+		Concurrency: 8,
+		PoolSize:    2,
+	})
+	const n = 500
+	for i := 0; i < n; i++ {
+		d.C <- NewRequest([]byte("0123456789"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&ct.bytes) < n*10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&ct.bytes); got != n*10 {
+		t.Fatalf("target read %d bytes, want %d", got, n*10)
+	}
+	if conns := atomic.LoadInt64(&ct.conns); conns > 2 {
+		t.Fatalf("%d connections to the target with a pool of 2", conns)
+	}
+}
+
+func TestLeaseSenderReuse(t *testing.T) {
+	ct := newCountTarget(t)
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{ct.Addr().String()},
+		Mode:        ModeRaw,
+		PoolSize:    1,
+	})
+	s1, release, err := d.LeaseSender(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(true)
+	s2, release, err := d.LeaseSender(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2 != s1 {
+		t.Fatal("sender of a stream ended at a request boundary not reused")
+	}
+	// e.g. a partial read
+	release(false)
+	s3, release, err := d.LeaseSender(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release(true)
+	if s3 == s2 {
+		t.Fatal("sender of a stream ended in a partial request reused")
+	}
+	if s2.Alive() {
+		t.Fatal("discarded sender still alive")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// max time to dial one target in Preflight
+const PreflightTimeout = time.Second * 3
+
+// Preflight dials every target of config, with the TLS
+// handshake if configured, and fails if none is reachable.
+// Unreachable targets of a pool are only warned about. It is
+// a no-op for sinks, export and udp, which dial nothing or
+// cannot tell a reachable target. Pipelines are checked alike.
+func Preflight(config *DeliverConfig) error {
+	if err := preflight(config); err != nil {
+		return err
+	}
+	for _, p := range config.Pipelines {
+		if err := preflight(&p.Config); err != nil {
+			return fmt.Errorf("pipeline %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func preflight(config *DeliverConfig) error {
+	if len(config.Sink) != 0 || len(config.ExportFile) != 0 || config.Transport == TransportUDP {
+		return nil
+	}
+	addrs := config.RemoteAddrs
+	if len(addrs) == 0 && len(config.RemoteAddr) != 0 {
+		addrs = []string{config.RemoteAddr}
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("deliver config not set RemoteAddrs")
+	}
+	var tc *tls.Config
+	if config.TLS != nil {
+		var err error
+		if tc, err = config.TLS.build(); err != nil {
+			return err
+		}
+	}
+	errs := make([]error, len(addrs))
+	done := make(chan struct{})
+	for i, addr := range addrs {
+		go func(i int, addr string) {
+			defer func() { done <- struct{}{} }()
+			conn, err := dial(addr, PreflightTimeout, tc, 0, 0, config.LocalAddr, config.metrics())
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			conn.Close()
+		}(i, addr)
+	}
+	for range addrs {
+		<-done
+	}
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", addrs[i], err))
+		}
+	}
+	if len(failed) == len(addrs) {
+		return fmt.Errorf("no target reachable: %s", strings.Join(failed, "; "))
+	}
+	for _, f := range failed {
+		log.Warnf("target not reachable, %s", f)
+	}
+	return nil
+}
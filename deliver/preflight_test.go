@@ -0,0 +1,43 @@
+package deliver
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// closedAddr returns an address no one is listening on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestPreflight(t *testing.T) {
+	closed := closedAddr(t)
+	open := newCountTarget(t).Addr().String()
+	err := Preflight(&DeliverConfig{RemoteAddrs: []string{closed}})
+	if err == nil || !strings.Contains(err.Error(), closed) {
+		t.Fatalf("preflight of a closed port got %v, want an error naming it", err)
+	}
+	// one reachable target of a pool is enough
+	if err := Preflight(&DeliverConfig{RemoteAddrs: []string{closed, open}}); err != nil {
+		t.Fatal(err)
+	}
+	err = Preflight(&DeliverConfig{
+		RemoteAddrs: []string{open},
+		Pipelines:   []Pipeline{{Name: "canary", Config: DeliverConfig{RemoteAddrs: []string{closed}}}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "canary") {
+		t.Fatalf("preflight of a closed pipeline target got %v, want an error naming the pipeline", err)
+	}
+	// sinks dial nothing
+	if err := Preflight(&DeliverConfig{RemoteAddrs: []string{closed}, Sink: SinkDiscard}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// PROXY protocol versions of DeliverConfig.ProxyProtocol
+const (
+	ProxyOff = "off"
+	ProxyV1  = "v1"
+	ProxyV2  = "v2"
+)
+
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// version 2 and the PROXY or LOCAL command
+	proxyV2Proxy byte = 0x21
+	proxyV2Local byte = 0x20
+	// address family and tcp
+	proxyV2TCP4   byte = 0x11
+	proxyV2TCP6   byte = 0x21
+	proxyV2Unspec byte = 0x00
+)
+
+// proxyAddrs returns the ips of src and dst of one family, the
+// 4 byte form for IPv4, ok is false if they can not be sent.
+func proxyAddrs(src, dst *net.TCPAddr) (sip, dip net.IP, ok bool) {
+	if src == nil || dst == nil {
+		return nil, nil, false
+	}
+	sip, dip = src.IP.To4(), dst.IP.To4()
+	if sip != nil && dip != nil {
+		return sip, dip, true
+	}
+	sip, dip = src.IP.To16(), dst.IP.To16()
+	return sip, dip, sip != nil && dip != nil && src.IP.To4() == nil && dst.IP.To4() == nil
+}
+
+/*
+Version 1, one line of text:
+PROXY TCP4 <src ip> <dst ip> <src port> <dst port>\r\n
+Version 2:
++--------+...+--------+--------+--------+--------+--------+...+--------+
+| signature (12)      | ver cmd| family | length          | addresses  |
++--------+...+--------+--------+--------+--------+--------+...+--------+
+addresses are src ip, dst ip, src port and dst port, big
+endian. Unknown addresses are sent as UNKNOWN in version 1 and
+with the LOCAL command in version 2, the target takes the
+address of the connection then.
+*/
+// proxyHeader returns the header of version telling the target
+// that the connection comes from src to dst, nil with ProxyOff.
+func proxyHeader(version string, src, dst *net.TCPAddr) []byte {
+	sip, dip, ok := proxyAddrs(src, dst)
+	switch version {
+	case ProxyV1:
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if len(sip) == net.IPv6len {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, sip, dip, src.Port, dst.Port))
+	case ProxyV2:
+		h := append([]byte{}, proxyV2Signature...)
+		if !ok {
+			return append(h, proxyV2Local, proxyV2Unspec, 0, 0)
+		}
+		family := proxyV2TCP4
+		if len(sip) == net.IPv6len {
+			family = proxyV2TCP6
+		}
+		length := 2*len(sip) + 4
+		h = append(h, proxyV2Proxy, family, byte(length>>8), byte(length))
+		h = append(h, sip...)
+		h = append(h, dip...)
+		port := make([]byte, 4)
+		binary.BigEndian.PutUint16(port, uint16(src.Port))
+		binary.BigEndian.PutUint16(port[2:], uint16(dst.Port))
+		return append(h, port...)
+	}
+	return nil
+}
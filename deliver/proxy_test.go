@@ -0,0 +1,84 @@
+package deliver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.IPv4(10, 1, 0, 5), Port: 40000}
+	dst4 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6379}
+	src6 := &net.TCPAddr{IP: net.ParseIP("fd00::5"), Port: 40000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 6379}
+	v2 := func(b ...byte) []byte { return append(append([]byte{}, proxyV2Signature...), b...) }
+	for _, c := range []struct {
+		version  string
+		src, dst *net.TCPAddr
+		want     []byte
+	}{
+		{ProxyOff, src4, dst4, nil},
+		{"", src4, dst4, nil},
+		{ProxyV1, src4, dst4, []byte("PROXY TCP4 10.1.0.5 10.0.0.1 40000 6379\r\n")},
+		{ProxyV1, src6, dst6, []byte("PROXY TCP6 fd00::5 fd00::1 40000 6379\r\n")},
+		{ProxyV1, nil, nil, []byte("PROXY UNKNOWN\r\n")},
+		// families differ
+		{ProxyV1, src4, dst6, []byte("PROXY UNKNOWN\r\n")},
+		{ProxyV2, src4, dst4, v2(0x21, 0x11, 0, 12, 10, 1, 0, 5, 10, 0, 0, 1, 0x9c, 0x40, 0x18, 0xeb)},
+		{ProxyV2, nil, nil, v2(0x20, 0x00, 0, 0)},
+	} {
+		if got := proxyHeader(c.version, c.src, c.dst); !bytes.Equal(got, c.want) {
+			t.Errorf("%q header of %v->%v got %q, want %q", c.version, c.src, c.dst, got, c.want)
+		}
+	}
+	h := proxyHeader(ProxyV2, src6, dst6)
+	if len(h) != 16+36 || h[13] != 0x21 || h[15] != 36 {
+		t.Errorf("v2 header of tcp6 got %x", h)
+	}
+}
+
+func TestProxyHeaderPrecedesPayload(t *testing.T) {
+	for _, version := range []string{ProxyV1, ProxyV2} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		src := &net.TCPAddr{IP: net.IPv4(10, 1, 0, 5), Port: 40000}
+		dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6379}
+		payload := []byte("*1\r\n$4\r\nPING\r\n")
+		want := append(proxyHeader(version, src, dst), payload...)
+		got := make(chan []byte, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			b := make([]byte, len(want))
+			n, _ := io.ReadFull(conn, b)
+			got <- b[:n]
+		}()
+		d := newTestDeliver(t, &DeliverConfig{
+			RemoteAddrs:   []string{l.Addr().String()},
+			Mode:          ModeRaw,
+			ProxyProtocol: version,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		s, release, err := d.LeaseSender(ctx, src, dst)
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		s.Data() <- payload
+		if b := <-got; !bytes.Equal(b, want) {
+			t.Errorf("%s target read %q, want %q", version, b, want)
+		}
+		release(true)
+		cancel()
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a producer blocked this long on a full C is warned about, at
+// most once per QueueFullWarn
+const QueueFullWarn = time.Second * 5
+
+// Enqueue sends req to C, it blocks while C is full, which
+// applies backpressure to the capture. The depth of C and the
+// time producers are blocked go to metrics. Duplicates are
+// dropped without error with DedupWindow, and handshakes with
+// SkipHandshake. With Pipelines a copy of req is offered to
+// each of them first, and req is sampled here.
+func (d *Deliver) Enqueue(ctx context.Context, req *Request) error {
+	for _, p := range d.pipelines {
+		p.offer(req)
+	}
+	if len(d.pipelines) > 0 && !d.sample(req) {
+		return nil
+	}
+	if !d.accept(req) {
+		return nil
+	}
+	select {
+	case d.C <- req:
+		d.Metrics.QueueDepth.Set(int64(len(d.C)))
+		return nil
+	default:
+	}
+	start := time.Now()
+	defer func() {
+		d.Metrics.QueueWait.Observe(time.Since(start).Seconds())
+	}()
+	warn := time.NewTimer(QueueFullWarn)
+	defer warn.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d.C <- req:
+			d.Metrics.QueueDepth.Set(int64(len(d.C)))
+			return nil
+		case <-warn.C:
+			d.warnQueueFull(start)
+			warn.Reset(QueueFullWarn)
+		}
+	}
+}
+
+// accept reports whether req is delivered, it is not if it is
+// a handshake to skip or a duplicate.
+func (d *Deliver) accept(req *Request) bool {
+	if req.Handshake && d.skipHandshake() {
+		log.Debugf("skip handshake request of %s", req.Flow)
+		return false
+	}
+	if d.dedup != nil && d.dedup.duplicate(req) {
+		d.Metrics.DedupDrops.Inc()
+		return false
+	}
+	return true
+}
+
+// warnQueueFull logs that producers are blocked since start,
+// once per QueueFullWarn for all producers.
+func (d *Deliver) warnQueueFull(start time.Time) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&d.queueWarned)
+	if now-last < int64(QueueFullWarn) || !atomic.CompareAndSwapInt64(&d.queueWarned, last, now) {
+		return
+	}
+	log.Warnf("deliver queue of %d requests full for %v, targets can not keep up with capture", cap(d.C), time.Since(start))
+}
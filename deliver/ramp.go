@@ -0,0 +1,97 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often a ramp raises the rate
+const RampInterval = time.Millisecond * 100
+
+// RampUp raises the rate limit linearly from From to To times
+// MaxQPS over Duration, e.g. from 0.1 to 1 to find the breaking
+// point of a target. MaxQPS stays the ceiling, also when Tune
+// changes it during the ramp.
+type RampUp struct {
+	From     float64
+	To       float64
+	Duration time.Duration
+}
+
+func (r *RampUp) validate(maxQPS int) error {
+	if maxQPS <= 0 {
+		return fmt.Errorf("deliver ramp up needs MaxQPS")
+	}
+	if r.From <= 0 || r.To <= 0 || r.From > 1 || r.To > 1 {
+		return fmt.Errorf("deliver ramp up ratios must be within (0, 1]")
+	}
+	if r.Duration <= 0 {
+		return fmt.Errorf("deliver ramp up duration must be positive")
+	}
+	return nil
+}
+
+// ratio returns the share of MaxQPS allowed after elapsed.
+func (r *RampUp) ratio(elapsed time.Duration) float64 {
+	if elapsed >= r.Duration {
+		return r.To
+	}
+	return r.From + (r.To-r.From)*float64(elapsed)/float64(r.Duration)
+}
+
+// rampedQPS returns the rate limit for maxQPS at the current
+// point of the ramp, at least 1 as 0 lifts the limit.
+func (d *Deliver) rampedQPS(maxQPS int) int {
+	r := d.Config.RampUp
+	if r == nil || maxQPS <= 0 {
+		return maxQPS
+	}
+	qps := int(float64(maxQPS) * r.ratio(time.Since(d.rampStart)))
+	if qps < 1 {
+		qps = 1
+	}
+	return qps
+}
+
+// setQPS applies the rate limit for maxQPS, tuneMu is held.
+func (d *Deliver) setQPS(maxQPS int) {
+	qps := d.rampedQPS(maxQPS)
+	d.Limiter.SetRate(qps)
+	d.Metrics.MaxQPS.Set(int64(qps))
+}
+
+// ramp raises the rate limit every RampInterval until the end
+// of the ramp or deliver is stopped.
+func (d *Deliver) ramp() {
+	t := time.NewTicker(RampInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.Ctx.Done():
+			return
+		case <-t.C:
+		}
+		d.tuneMu.Lock()
+		d.setQPS(d.tuned().MaxQPS)
+		d.tuneMu.Unlock()
+		if time.Since(d.rampStart) >= d.Config.RampUp.Duration {
+			log.Infof("deliver ramp up done at %d qps", d.Limiter.Rate())
+			return
+		}
+	}
+}
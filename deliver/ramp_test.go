@@ -0,0 +1,31 @@
+package deliver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRampUpRate(t *testing.T) {
+	const maxQPS = 1000
+	r := &RampUp{From: 0.1, To: 0.8, Duration: time.Second}
+	d := newTestDeliver(t, &DeliverConfig{Sink: SinkDiscard, MaxQPS: maxQPS, RampUp: r})
+	// the rate is raised every RampInterval, allow one more
+	// for scheduling
+	lag := 2 * RampInterval
+	last := 0
+	for elapsed := time.Duration(0); elapsed < r.Duration+500*time.Millisecond; elapsed = time.Since(d.rampStart) {
+		rate := d.Limiter.Rate()
+		low, high := int(maxQPS*r.ratio(elapsed-lag)), int(maxQPS*r.ratio(elapsed))
+		if rate < low-1 || rate > high+1 {
+			t.Fatalf("rate %d after %v, want within [%d, %d]", rate, elapsed, low, high)
+		}
+		if rate < last {
+			t.Fatalf("rate fell from %d to %d after %v", last, rate, elapsed)
+		}
+		last = rate
+		time.Sleep(20 * time.Millisecond)
+	}
+	if rate := d.Limiter.Rate(); rate != maxQPS*8/10 {
+		t.Fatalf("rate %d after the ramp, want %d", rate, maxQPS*8/10)
+	}
+}
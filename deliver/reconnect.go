@@ -0,0 +1,133 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ReconnectMinBackoff  = time.Millisecond * 100
+	ReconnectMaxBackoff  = time.Second * 10
+	ReconnectDialTimeout = time.Second * 3
+)
+
+// backoff doubles the delay on each attempt up to max, the
+// delay is jittered in [d/2, d) so senders of a restarted
+// target do not reconnect all at once.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.min
+	for i := uint(0); i < b.attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	b.attempt++
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reconnect dials the remote again for connection idx until it
+// succeeds or the sender is stopped.
+func (s *LongConnSender) reconnect(idx int) {
+	b := &backoff{min: ReconnectMinBackoff, max: ReconnectMaxBackoff}
+	for attempt := 1; ; attempt++ {
+		delay := b.next()
+		log.Infof("reconnect %d to remote %s in %v, attempt %d", idx, s.RemoteAddr, delay, attempt)
+		select {
+		case <-s.Ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-time.After(delay):
+		}
+		conn, err := dial(s.RemoteAddr, s.redialTimeout(), s.TLS, s.KeepAlive, s.Linger, s.LocalAddr, s.Metrics)
+		if err == nil {
+			err = greet(conn, s.Handshake, s.Metrics)
+		}
+		s.report(err)
+		if err != nil {
+			log.Errorf("reconnect %d to remote %s failed: %v", idx, s.RemoteAddr, err)
+			continue
+		}
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.Remotes[idx] = conn
+		s.ConnState[idx] = true
+		atomic.AddInt32(&s.alive, 1)
+		s.mu.Unlock()
+		s.Metrics.Reconnects.Inc()
+		log.Infof("reconnected %d to remote %s after %d attempts", idx, s.RemoteAddr, attempt)
+		go s.drain(idx)
+		select {
+		case s.reconnected <- struct{}{}:
+		default:
+		}
+		return
+	}
+}
+
+// redialTimeout is ConnectTimeout, or ReconnectDialTimeout if
+// it is not set, so that reconnecting never hangs.
+func (s *LongConnSender) redialTimeout() time.Duration {
+	if s.ConnectTimeout > 0 {
+		return s.ConnectTimeout
+	}
+	return ReconnectDialTimeout
+}
+
+// hold keeps req while all connections are down, the oldest
+// request is dropped once BufferCap is reached.
+func (s *LongConnSender) hold(req []byte) {
+	if s.BufferCap <= 0 {
+		log.Debugf("remote %s disconnected, drop request", s.RemoteAddr)
+		s.release(req)
+		return
+	}
+	if len(s.pending) >= s.BufferCap {
+		log.Debugf("remote %s disconnected and buffer full, drop oldest request", s.RemoteAddr)
+		s.release(s.pending[0])
+		s.pending = s.pending[1:]
+	}
+	s.pending = append(s.pending, req)
+}
+
+// flushPending writes requests held while disconnected.
+func (s *LongConnSender) flushPending() error {
+	if len(s.pending) > 0 {
+		log.Infof("remote %s back, flush %d buffered requests", s.RemoteAddr, len(s.pending))
+	}
+	for len(s.pending) > 0 && s.Alive() {
+		if err := s.write(s.pending[0]); err != nil {
+			return err
+		}
+		s.release(s.pending[0])
+		s.pending = s.pending[1:]
+	}
+	return nil
+}
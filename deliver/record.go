@@ -0,0 +1,153 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Record files keep parsed requests for later replay, so
+// capture and replay can be decoupled.
+package deliver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Record file:
++--------+--------+--------+--------+--------+--------+
+| magic "TCPR"                      | version         |
++--------+--------+--------+--------+--------+--------+
+followed by records:
++--------+...+--------+--------+...+--------+--------+--------+...+--------+--------+...+--------+
+| body length(4)      | timestamp unix nano(8)        | proto len(1)    | proto  | payload       |
++--------+...+--------+--------+...+--------+--------+--------+...+--------+--------+...+--------+
+All integers are big endian, body length counts the bytes after it.
+*/
+const (
+	RecordMagic          = "TCPR"
+	RecordVersion uint16 = 1
+	// records larger than this are considered corrupted
+	RecordMaxSize uint32 = 1024 * 1024 * 64
+)
+
+type RecordWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Write appends one record, each record is written with a
+// single write so the file is consistent on crash.
+func (w *RecordWriter) Write(proto string, req *Request) error {
+	if len(proto) > 255 {
+		return fmt.Errorf("record proto %q too long", proto)
+	}
+	size := 8 + 1 + len(proto) + len(req.Data)
+	buf := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	var ts int64
+	if !req.Time.IsZero() {
+		ts = req.Time.UnixNano()
+	}
+	binary.BigEndian.PutUint64(buf[4:], uint64(ts))
+	buf[12] = byte(len(proto))
+	copy(buf[13:], proto)
+	copy(buf[13+len(proto):], req.Data)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.f.Write(buf)
+	return err
+}
+
+func (w *RecordWriter) Close() error {
+	return w.f.Close()
+}
+
+func NewRecordWriter(path string) (*RecordWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 6)
+	copy(header, RecordMagic)
+	binary.BigEndian.PutUint16(header[4:], RecordVersion)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &RecordWriter{f: f}, nil
+}
+
+type RecordReader struct {
+	f *os.File
+	r *bufio.Reader
+}
+
+// Read returns the next record, io.EOF at the end of file.
+func (r *RecordReader) Read() (string, *Request, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, head); err != nil {
+		return "", nil, err
+	}
+	size := binary.BigEndian.Uint32(head)
+	if size < 9 || size > RecordMaxSize {
+		return "", nil, fmt.Errorf("record size %d not valid", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+	req := &Request{}
+	if ts := int64(binary.BigEndian.Uint64(body)); ts != 0 {
+		req.Time = time.Unix(0, ts)
+	}
+	n := int(body[8])
+	if 9+n > len(body) {
+		return "", nil, fmt.Errorf("record proto len %d not valid", n)
+	}
+	req.Data = body[9+n:]
+	req.Proto = string(body[9 : 9+n])
+	return req.Proto, req, nil
+}
+
+func (r *RecordReader) Close() error {
+	return r.f.Close()
+}
+
+// OpenRecordReader opens a record file and checks its header.
+func OpenRecordReader(path string) (*RecordReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &RecordReader{f: f, r: bufio.NewReader(f)}
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read record header failed: %v", err)
+	}
+	if string(header[:4]) != RecordMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a record file", path)
+	}
+	if v := binary.BigEndian.Uint16(header[4:]); v != RecordVersion {
+		f.Close()
+		return nil, fmt.Errorf("record version %d not supported", v)
+	}
+	return r, nil
+}
@@ -0,0 +1,50 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"time"
+)
+
+// Request is a parsed application layer request.
+type Request struct {
+	Data []byte
+	// capture timestamp, zero if unknown
+	Time time.Time
+	// same for requests of one captured connection, zero if
+	// unknown like requests of record files
+	Conn uint64
+	// name of the protocol parsed, the detected one with auto,
+	// and the captured src:port->dst:port, empty if unknown
+	Proto string
+	Flow  string
+	// RPC method of the request like a gRPC path, empty if the
+	// protocol has none
+	Method string
+	// set by factories for handshake and auth requests, like
+	// the Redis AUTH command, see DeliverConfig.SkipHandshake
+	Handshake bool
+	// set in diff mode to get the captured response
+	Exchange *Exchange
+}
+
+// NewRequest returns a request of data without capture
+// metadata, for producers which only have the payload.
+func NewRequest(data []byte) *Request {
+	return &Request{Data: data}
+}
+
+// TransformFunc returns the data sent for req of protocol proto,
+// req.Data may be modified in place, an error drops req.
+type TransformFunc func(proto string, req *Request) ([]byte, error)
@@ -0,0 +1,59 @@
+package deliver
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSampleRequestRate(t *testing.T) {
+	d := newTestDeliver(t, &DeliverConfig{Sink: SinkDiscard, SampleRate: 0.1})
+	const n = 10000
+	kept := 0
+	for i := 0; i < n; i++ {
+		if !d.SampleConn(rand.Uint64()) {
+			t.Fatal("connection dropped with per request sampling")
+		}
+		if d.SampleRequest() {
+			kept++
+		}
+	}
+	// 1000 expected, the deviation is 30
+	if kept < 850 || kept > 1150 {
+		t.Fatalf("kept %d of %d requests, want about %d", kept, n, n/10)
+	}
+}
+
+func TestSampleConnRate(t *testing.T) {
+	d := newTestDeliver(t, &DeliverConfig{Sink: SinkDiscard, SampleRate: 0.1, SampleByConn: true})
+	const n = 10000
+	kept := 0
+	for i := 0; i < n; i++ {
+		hash := rand.Uint64()
+		keep := d.SampleConn(hash)
+		for j := 0; j < 3; j++ {
+			if !d.SampleRequest() {
+				t.Fatal("request dropped with per connection sampling")
+			}
+			if d.SampleConn(hash) != keep {
+				t.Fatal("connection sampled differently for the same hash")
+			}
+		}
+		if keep {
+			kept++
+		}
+	}
+	if kept < 850 || kept > 1150 {
+		t.Fatalf("kept %d of %d connections, want about %d", kept, n, n/10)
+	}
+}
+
+func TestSampleRateKeepsAll(t *testing.T) {
+	for _, rate := range []float64{0, 1} {
+		d := newTestDeliver(t, &DeliverConfig{Sink: SinkDiscard, SampleRate: rate})
+		for i := 0; i < 1000; i++ {
+			if !d.SampleConn(rand.Uint64()) || !d.SampleRequest() {
+				t.Fatalf("request dropped with rate %v", rate)
+			}
+		}
+	}
+}
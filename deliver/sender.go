@@ -18,115 +18,391 @@ package deliver
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/feilengcui008/tcplayer/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
+type TimeoutPolicy int
+
+const (
+	// close the connection, the rest of a partially written
+	// request would break the framing of following ones
+	TimeoutReconnect TimeoutPolicy = iota
+	// drop the request and keep using the connection if none of
+	// it was written, a partial write still reconnects, so does
+	// any timeout on TLS, whose conn is broken after one
+	TimeoutDrop
+)
+
+// ResponseHandler consumes the responses of connection idx of a
+// long connection sender, e.g. with a ResponseReader to diff
+// them, it must read r until an error so that the target never
+// blocks on a full send buffer.
+type ResponseHandler func(idx int, r io.Reader) error
+
 type Sender interface {
 	run()
 	destroy()
+	// stop waits for pending requests to be written and closes
+	// connections, Data must not be sent to after stop
+	stop()
 	Data() chan []byte
+	// Alive reports whether the sender can still deliver
+	Alive() bool
+}
+
+// SenderConfig is shared by senders, one SenderConfig
+// may be used to create many senders.
+type SenderConfig struct {
+	RemoteAddr string
+	ConnNum    int
+	// shared by all senders of a Deliver, nil for unlimited
+	Limiter *Limiter
+	// limits bytes written instead of requests, also shared
+	ByteLimiter *Limiter
+	// latency injected before each request, nil for none
+	Delay *Delay
+	// checks requests right before they are written, nil
+	// unless verifying
+	Verifier *Verifier
+	// redial broken long connections with backoff, requests
+	// are held up to BufferCap while all connections are
+	// down, 0 drops them
+	Reconnect bool
+	BufferCap int
+	// called with each request once it is written to all
+	// connections or dropped, nil if requests are not reused
+	Release func([]byte)
+	// connect with TLS if set
+	TLS *tls.Config
+	// socket options of connections, see DeliverConfig
+	KeepAlive time.Duration
+	Linger    time.Duration
+	LocalAddr string
+	// written to each new connection before any request
+	Handshake []byte
+	// max time to dial a connection, 0 for no limit, reconnects
+	// use ReconnectDialTimeout then
+	ConnectTimeout time.Duration
+	// max time to write one request, 0 for no limit
+	WriteTimeout  time.Duration
+	TimeoutPolicy TimeoutPolicy
+	// responses of long connections are discarded if nil
+	Responses ResponseHandler
+	// called with the result of each dial and write, e.g. for
+	// the circuit breaker of the target, nil to ignore them
+	Report func(error)
+	// close long connections after writing nothing for this
+	// long and redial them on the next request, 0 keeps them
+	IdleTimeout time.Duration
+	// metrics.Default if nil
+	Metrics *metrics.Set
+}
+
+// metrics returns the metrics of senders created with c.
+func (c *SenderConfig) metrics() *metrics.Set {
+	if c.Metrics == nil {
+		return metrics.Default
+	}
+	return c.Metrics
 }
 
 type LongConnSender struct {
 	RemoteAddr string
 	ConnNum    int
-	Remotes    []net.Conn
-	ConnState  []bool
-	Ctx        context.Context
-	C          chan []byte
-	Stat       *Stat
+	Limiter    *Limiter
+	// bytes written to all connections
+	ByteLimiter *Limiter
+	Delay       *Delay
+	Verifier    *Verifier
+	Remotes     []net.Conn
+	ConnState   []bool
+	Ctx         context.Context
+	C           chan []byte
+	Stat        *Stat
+	Reconnect   bool
+	BufferCap   int
+	Release     func([]byte)
+	TLS         *tls.Config
+	KeepAlive   time.Duration
+	Linger      time.Duration
+	LocalAddr   string
+	Handshake   []byte
+	// max time to dial each connection
+	ConnectTimeout time.Duration
+	// write deadline of each request
+	WriteTimeout  time.Duration
+	TimeoutPolicy TimeoutPolicy
+	Responses     ResponseHandler
+	Report        func(error)
+	IdleTimeout   time.Duration
+	Metrics       *metrics.Set
+	// guards Remotes and ConnState, conns are closed by reader
+	// and writer, and replaced by reconnect
+	mu      sync.Mutex
+	alive   int32
+	stopped bool
+	// set while connections are closed by reap
+	idle int32
+	// requests held while disconnected, only used by run
+	pending     [][]byte
+	reconnected chan struct{}
+	// closed when run returns
+	done chan struct{}
 }
 
-func (s *LongConnSender) readOne(idx int) {
-	if !s.ConnState[idx] {
+// closeConn marks connection idx down if it is still conn, a
+// stale conn already replaced by reconnect is left alone.
+func (s *LongConnSender) closeConn(idx int, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ConnState[idx] && s.Remotes[idx] == conn {
+		conn.Close()
+		s.ConnState[idx] = false
+		atomic.AddInt32(&s.alive, -1)
+		if s.Reconnect && !s.stopped {
+			go s.reconnect(idx)
+		}
+	}
+}
+
+// conn returns connection idx if it is alive.
+func (s *LongConnSender) conn(idx int) (net.Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Remotes[idx], s.ConnState[idx]
+}
+
+func (s *LongConnSender) Alive() bool {
+	return atomic.LoadInt32(&s.alive) > 0 || atomic.LoadInt32(&s.idle) == 1
+}
+
+// drain reads responses of connection idx until it is closed,
+// a target writing back is never stalled by a full window.
+func (s *LongConnSender) drain(idx int) {
+	conn, ok := s.conn(idx)
+	if !ok {
 		return
 	}
-	buf := make([]byte, 4096)
-	for {
-		select {
-		case <-s.Ctx.Done():
-			return
-		default:
-			if _, err := io.ReadFull(s.Remotes[idx], buf); err != nil {
-				log.Errorf("read from remote %s failed: %v", s.RemoteAddr, err)
-				s.Remotes[idx].Close()
-				s.ConnState[idx] = false
-				return
-			}
-		}
+	r := &countReader{r: conn, m: s.Metrics}
+	var err error
+	if s.Responses != nil {
+		err = s.Responses(idx, r)
+	} else if _, err = io.Copy(ioutil.Discard, r); err == nil {
+		err = io.EOF
+	}
+	s.mu.Lock()
+	stopped := s.stopped
+	s.mu.Unlock()
+	if stopped || s.Ctx.Err() != nil {
+		return
 	}
+	if cur, _ := s.conn(idx); cur != conn {
+		// closed by reap or replaced by reconnect
+		return
+	}
+	log.Errorf("read from remote %s failed: %v", s.RemoteAddr, err)
+	s.closeConn(idx, conn)
+}
+
+// countReader counts response bytes read from targets.
+type countReader struct {
+	r io.Reader
+	m *metrics.Set
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.m.BytesReceived.Add(uint64(n))
+	return n, err
 }
 
 func (s *LongConnSender) run() {
+	defer close(s.done)
 	defer s.destroy()
 
 	// read out and comsume data
-	for idx, _ := range s.Remotes {
-		if !s.ConnState[idx] {
-			continue
-		}
-		go s.readOne(idx)
+	for idx := range s.Remotes {
+		go s.drain(idx)
 	}
 
+	idle := newIdleTimer(s.IdleTimeout)
+	defer idle.stop()
 	for {
 		select {
 		case <-s.Ctx.Done():
 			return
-		case req := <-s.C:
-			s.Stat.TotalRequest++
-			now := time.Now()
-			if now.After(s.Stat.LastStatTime.Add(time.Second * 1)) {
-				s.Stat.RequestPerSecond = s.Stat.TotalRequest - s.Stat.LastTotalRequest
-				log.Infof("remote %s total reqs %d, %d reqs/s", s.RemoteAddr, s.Stat.TotalRequest, s.Stat.RequestPerSecond)
-				s.Stat.LastTotalRequest = s.Stat.TotalRequest
-				s.Stat.LastStatTime = now
+		case <-idle.C():
+			s.reap()
+		case <-s.reconnected:
+			if err := s.flushPending(); err != nil {
+				return
 			}
-			for idx, conn := range s.Remotes {
-				if !s.ConnState[idx] {
-					continue
-				}
-				if _, err := conn.Write(req); err != nil {
-					log.Errorf("write to remote %s failed: %v", s.RemoteAddr, err)
-					s.Remotes[idx].Close()
-					s.ConnState[idx] = false
-				}
+		case req, ok := <-s.C:
+			if !ok {
+				return
 			}
+			idle.reset()
+			if atomic.LoadInt32(&s.idle) == 1 {
+				s.wake()
+			}
+			if s.Reconnect && !s.Alive() {
+				s.hold(req)
+				continue
+			}
+			if err := s.write(req); err != nil {
+				return
+			}
+			s.release(req)
 		}
 	}
 }
 
-func (s *LongConnSender) destroy() {
-	for idx, conn := range s.Remotes {
-		if s.ConnState[idx] && conn != nil {
-			conn.Close()
-			s.ConnState[idx] = false
+func (s *LongConnSender) release(req []byte) {
+	if s.Release != nil {
+		s.Release(req)
+	}
+}
+
+func (s *LongConnSender) report(err error) {
+	if s.Report != nil {
+		s.Report(err)
+	}
+}
+
+// write sends req to all alive connections, it only fails
+// when the context is done.
+func (s *LongConnSender) write(req []byte) error {
+	// block instead of dropping when limited
+	if err := s.Limiter.Wait(s.Ctx); err != nil {
+		return err
+	}
+	if err := s.ByteLimiter.WaitN(s.Ctx, len(req)*len(s.Remotes)); err != nil {
+		return err
+	}
+	// later requests wait behind a delayed one, like on a
+	// slow link
+	if err := s.Delay.Wait(s.Ctx); err != nil {
+		return err
+	}
+	s.Stat.TotalRequest++
+	now := time.Now()
+	if now.After(s.Stat.LastStatTime.Add(time.Second * 1)) {
+		s.Stat.RequestPerSecond = s.Stat.TotalRequest - s.Stat.LastTotalRequest
+		log.Infof("remote %s total reqs %d, %d reqs/s", s.RemoteAddr, s.Stat.TotalRequest, s.Stat.RequestPerSecond)
+		s.Stat.LastTotalRequest = s.Stat.TotalRequest
+		s.Stat.LastStatTime = now
+	}
+	s.Verifier.Check(req)
+	for idx := range s.Remotes {
+		conn, ok := s.conn(idx)
+		if !ok {
+			continue
+		}
+		start := time.Now()
+		if s.WriteTimeout > 0 {
+			conn.SetWriteDeadline(start.Add(s.WriteTimeout))
+		}
+		n, err := conn.Write(req)
+		s.Metrics.BytesSent.Add(uint64(n))
+		s.report(err)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				s.writeTimeout(idx, conn, n)
+				continue
+			}
+			log.Errorf("write to remote %s failed: %v", s.RemoteAddr, err)
+			s.Metrics.SendErrors.Inc()
+			s.closeConn(idx, conn)
+			continue
 		}
+		s.Metrics.SendLatency.Observe(time.Since(start).Seconds())
+	}
+	return nil
+}
+
+// writeTimeout handles a write to a stalled target by policy,
+// TimeoutReconnect redials even if Reconnect is not set.
+func (s *LongConnSender) writeTimeout(idx int, conn net.Conn, written int) {
+	s.Metrics.SendTimeouts.Inc()
+	if s.TimeoutPolicy == TimeoutDrop && written == 0 && s.TLS == nil {
+		log.Warnf("write to remote %s timeout after %d bytes, drop request", s.RemoteAddr, written)
+		return
+	}
+	log.Warnf("write to remote %s timeout after %d bytes, reconnect", s.RemoteAddr, written)
+	s.closeConn(idx, conn)
+	if !s.Reconnect {
+		go s.reconnect(idx)
 	}
 }
 
+func (s *LongConnSender) destroy() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	for idx := range s.Remotes {
+		conn, _ := s.conn(idx)
+		s.closeConn(idx, conn)
+	}
+}
+
+func (s *LongConnSender) stop() {
+	close(s.C)
+	<-s.done
+}
+
 func (s *LongConnSender) Data() chan []byte {
 	return s.C
 }
 
-func NewLongConnSender(ctx context.Context, n int, addr string) (Sender, error) {
+func NewLongConnSender(ctx context.Context, c *SenderConfig) (Sender, error) {
 	s := &LongConnSender{
-		RemoteAddr: addr,
-		ConnNum:    n,
-		ConnState:  []bool{},
-		Ctx:        ctx,
-		C:          make(chan []byte),
-		Stat:       &Stat{},
+		RemoteAddr:     c.RemoteAddr,
+		ConnNum:        c.ConnNum,
+		Limiter:        c.Limiter,
+		ByteLimiter:    c.ByteLimiter,
+		Delay:          c.Delay,
+		Verifier:       c.Verifier,
+		Reconnect:      c.Reconnect,
+		BufferCap:      c.BufferCap,
+		Release:        c.Release,
+		TLS:            c.TLS,
+		KeepAlive:      c.KeepAlive,
+		Linger:         c.Linger,
+		LocalAddr:      c.LocalAddr,
+		Handshake:      c.Handshake,
+		ConnectTimeout: c.ConnectTimeout,
+		ConnState:      []bool{},
+		WriteTimeout:   c.WriteTimeout,
+		TimeoutPolicy:  c.TimeoutPolicy,
+		Responses:      c.Responses,
+		Report:         c.Report,
+		IdleTimeout:    c.IdleTimeout,
+		Metrics:        c.metrics(),
+		Ctx:            ctx,
+		C:              make(chan []byte),
+		Stat:           &Stat{},
+		done:           make(chan struct{}),
+		// at most one pending flush is needed
+		reconnected: make(chan struct{}, 1),
 	}
 
 	// establish several connections, each request
 	// bytes buf will be send to all those conns.
-	for i := 0; i < n; i++ {
-		conn, err := net.Dial("tcp", addr)
+	for i := 0; i < s.ConnNum; i++ {
+		conn, err := dial(s.RemoteAddr, s.ConnectTimeout, s.TLS, s.KeepAlive, s.Linger, s.LocalAddr, s.Metrics)
+		if err == nil {
+			err = greet(conn, s.Handshake, s.Metrics)
+		}
 		if err != nil {
 			err = fmt.Errorf("connect to remote %s failed: %v", s.RemoteAddr, err)
 			s.destroy()
@@ -134,6 +410,7 @@ func NewLongConnSender(ctx context.Context, n int, addr string) (Sender, error)
 		}
 		s.Remotes = append(s.Remotes, conn)
 		s.ConnState = append(s.ConnState, true)
+		s.alive++
 	}
 
 	go s.run()
@@ -143,18 +420,56 @@ func NewLongConnSender(ctx context.Context, n int, addr string) (Sender, error)
 type ShortConnSender struct {
 	RemoteAddr string
 	ConnNum    int
-	Ctx        context.Context
-	C          chan []byte
-	Stat       *Stat
+	Limiter    *Limiter
+	// bytes written to all connections
+	ByteLimiter *Limiter
+	Delay       *Delay
+	Verifier    *Verifier
+	Ctx         context.Context
+	C           chan []byte
+	Stat        *Stat
+	Release     func([]byte)
+	TLS         *tls.Config
+	KeepAlive   time.Duration
+	Linger      time.Duration
+	LocalAddr   string
+	Handshake   []byte
+	// max time to dial each connection
+	ConnectTimeout time.Duration
+	// write deadline of each request, the connection is
+	// closed anyway so there is no policy
+	WriteTimeout time.Duration
+	Report       func(error)
+	Metrics      *metrics.Set
+	// set when the last dial failed
+	failed int32
+	// pending sendOne calls
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+func (s *ShortConnSender) Alive() bool {
+	return atomic.LoadInt32(&s.failed) == 0
 }
 
 func (s *ShortConnSender) run() {
+	defer close(s.done)
 	defer s.destroy()
 	for {
 		select {
 		case <-s.Ctx.Done():
 			return
-		case req := <-s.C:
+		case req, ok := <-s.C:
+			if !ok {
+				s.wg.Wait()
+				return
+			}
+			if err := s.Limiter.Wait(s.Ctx); err != nil {
+				return
+			}
+			if err := s.ByteLimiter.WaitN(s.Ctx, len(req)*s.ConnNum); err != nil {
+				return
+			}
 			s.Stat.TotalRequest++
 			now := time.Now()
 			if now.After(s.Stat.LastStatTime.Add(time.Second * 1)) {
@@ -163,52 +478,137 @@ func (s *ShortConnSender) run() {
 				s.Stat.LastTotalRequest = s.Stat.TotalRequest
 				s.Stat.LastStatTime = now
 			}
+			// the last sendOne of req releases it
+			pending := int32(s.ConnNum)
 			for i := 0; i < s.ConnNum; i++ {
-				go s.sendOne(req)
+				s.wg.Add(1)
+				go s.sendOne(req, &pending)
 			}
 		}
 	}
 }
 
-func (s *ShortConnSender) sendOne(req []byte) {
-	conn, err := net.Dial("tcp", s.RemoteAddr)
+func (s *ShortConnSender) sendOne(req []byte, pending *int32) {
+	defer s.wg.Done()
+	if err := s.Delay.Wait(s.Ctx); err != nil {
+		s.release(req, pending)
+		return
+	}
+	// latency of short connections includes dialing
+	start := time.Now()
+	conn, err := dial(s.RemoteAddr, s.ConnectTimeout, s.TLS, s.KeepAlive, s.Linger, s.LocalAddr, s.Metrics)
+	if err == nil {
+		err = greet(conn, s.Handshake, s.Metrics)
+	}
 	if err != nil {
+		s.report(err)
 		log.Errorf("send one to remote %s failed: %v", s.RemoteAddr, err)
+		s.Metrics.SendErrors.Inc()
+		atomic.StoreInt32(&s.failed, 1)
+		s.release(req, pending)
 		return
 	}
+	atomic.StoreInt32(&s.failed, 0)
 	defer conn.Close()
-	if _, err := conn.Write(req); err != nil {
+	if s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+	s.Verifier.Check(req)
+	n, err := conn.Write(req)
+	s.release(req, pending)
+	s.Metrics.BytesSent.Add(uint64(n))
+	s.report(err)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Warnf("write one to remote %s timeout after %d bytes", s.RemoteAddr, n)
+		s.Metrics.SendTimeouts.Inc()
+	} else if err != nil {
 		log.Errorf("write one to remote %s failed: %v", s.RemoteAddr, err)
+		s.Metrics.SendErrors.Inc()
+	} else {
+		s.Metrics.SendLatency.Observe(time.Since(start).Seconds())
 	}
-	// try to cunsume response for 3 seconds
+	// try to cunsume response for 3 seconds, the deadline
+	// also bounds a read blocked on a silent remote
 	tm := time.After(time.Second * time.Duration(3))
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(3)))
 	buf := make([]byte, 4096)
+	r := &countReader{r: conn, m: s.Metrics}
 	for {
 		select {
 		case <-tm:
 			return
 		default:
-			if _, err := io.ReadFull(conn, buf); err != nil {
+			if _, err := io.ReadFull(r, buf); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// probe dials the remote once, a short sender has no
+// connection to replace so a successful dial makes it alive
+// again.
+func (s *ShortConnSender) probe() error {
+	timeout := s.ConnectTimeout
+	if timeout <= 0 {
+		timeout = ReconnectDialTimeout
+	}
+	conn, err := dial(s.RemoteAddr, timeout, s.TLS, s.KeepAlive, s.Linger, s.LocalAddr, s.Metrics)
+	s.report(err)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	atomic.StoreInt32(&s.failed, 0)
+	return nil
+}
+
+func (s *ShortConnSender) release(req []byte, pending *int32) {
+	if atomic.AddInt32(pending, -1) == 0 && s.Release != nil {
+		s.Release(req)
+	}
+}
+
+func (s *ShortConnSender) report(err error) {
+	if s.Report != nil {
+		s.Report(err)
+	}
+}
+
 func (s *ShortConnSender) destroy() {
 }
 
+func (s *ShortConnSender) stop() {
+	close(s.C)
+	<-s.done
+}
+
 func (s *ShortConnSender) Data() chan []byte {
 	return s.C
 }
 
-func NewShortConnSender(ctx context.Context, n int, addr string) (Sender, error) {
+func NewShortConnSender(ctx context.Context, c *SenderConfig) (Sender, error) {
 	s := &ShortConnSender{
-		RemoteAddr: addr,
-		ConnNum:    n,
-		Ctx:        ctx,
-		C:          make(chan []byte),
-		Stat:       &Stat{},
+		RemoteAddr:     c.RemoteAddr,
+		ConnNum:        c.ConnNum,
+		Limiter:        c.Limiter,
+		ByteLimiter:    c.ByteLimiter,
+		Delay:          c.Delay,
+		Verifier:       c.Verifier,
+		Release:        c.Release,
+		TLS:            c.TLS,
+		KeepAlive:      c.KeepAlive,
+		Linger:         c.Linger,
+		LocalAddr:      c.LocalAddr,
+		Handshake:      c.Handshake,
+		ConnectTimeout: c.ConnectTimeout,
+		WriteTimeout:   c.WriteTimeout,
+		Report:         c.Report,
+		Metrics:        c.metrics(),
+		Ctx:            ctx,
+		C:              make(chan []byte),
+		Stat:           &Stat{},
+		done:           make(chan struct{}),
 	}
 
 	go s.run()
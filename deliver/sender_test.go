@@ -0,0 +1,232 @@
+package deliver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenStalled returns a target accepting connections without
+// reading them, accepted connections are sent to the returned
+// channel.
+func listenStalled(t *testing.T) (net.Listener, chan net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 16)
+	t.Cleanup(func() {
+		l.Close()
+		for {
+			select {
+			case conn := <-accepted:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return l, accepted
+}
+
+func newStalledSender(t *testing.T, addr string) *LongConnSender {
+	t.Helper()
+	s, err := NewLongConnSender(context.Background(), &SenderConfig{
+		RemoteAddr:    addr,
+		ConnNum:       1,
+		WriteTimeout:  100 * time.Millisecond,
+		TimeoutPolicy: TimeoutDrop,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.stop)
+	return s.(*LongConnSender)
+}
+
+func TestTimeoutDropReconnectsPartialWrite(t *testing.T) {
+	l, accepted := listenStalled(t)
+	s := newStalledSender(t, l.Addr().String())
+	// kept open, not reading
+	conn := <-accepted
+	defer conn.Close()
+	// far more than the socket buffers take, the write times
+	// out after a part of it
+	s.C <- make([]byte, 16<<20)
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnect after a partially written request was dropped")
+	}
+}
+
+func TestTimeoutDropKeepsConnection(t *testing.T) {
+	l, accepted := listenStalled(t)
+	s := newStalledSender(t, l.Addr().String())
+	defer (<-accepted).Close()
+	conn, _ := s.conn(0)
+	s.writeTimeout(0, conn, 0)
+	if cur, ok := s.conn(0); !ok || cur != conn {
+		t.Fatal("connection closed after a request was dropped unwritten")
+	}
+
+	// a timed out write breaks a TLS connection
+	s.TLS = &tls.Config{}
+	s.writeTimeout(0, conn, 0)
+	if _, ok := s.conn(0); ok {
+		t.Fatal("TLS connection kept after a write timeout")
+	}
+}
+
+// listenEcho returns a target writing back what it reads, the
+// bytes written back are added to echoed.
+func listenEcho(t *testing.T, echoed *int64) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 32<<10)
+				for {
+					n, err := conn.Read(buf)
+					if n > 0 {
+						if _, err := conn.Write(buf[:n]); err != nil {
+							return
+						}
+						atomic.AddInt64(echoed, int64(n))
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestLongConnDrainsEchoingTarget(t *testing.T) {
+	var echoed int64
+	l := listenEcho(t, &echoed)
+	s, err := NewLongConnSender(context.Background(), &SenderConfig{
+		RemoteAddr: l.Addr().String(),
+		ConnNum:    1,
+		// a stalled write is dropped instead of blocking stop
+		WriteTimeout:  2 * time.Second,
+		TimeoutPolicy: TimeoutDrop,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(*LongConnSender).stop()
+	// far more than the socket buffers of both sides take, the
+	// target stops reading once its writes block
+	const n, size = 64, 1 << 20
+	for i := 0; i < n; i++ {
+		select {
+		case s.Data() <- make([]byte, size):
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sender stalled after %d requests", i)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&echoed) < n*size && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&echoed); got != n*size {
+		t.Fatalf("target echoed %d bytes, want %d", got, n*size)
+	}
+}
+
+func TestReconnectFlushesBuffered(t *testing.T) {
+	l, accepted := listenStalled(t)
+	addr := l.Addr().String()
+	s, err := NewLongConnSender(context.Background(), &SenderConfig{
+		RemoteAddr: addr,
+		ConnNum:    1,
+		Reconnect:  true,
+		BufferCap:  3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := s.(*LongConnSender)
+	defer sender.stop()
+	// the target goes away
+	l.Close()
+	(<-accepted).Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for sender.Alive() {
+		if time.Now().After(deadline) {
+			t.Fatal("sender alive after the target closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		s.Data() <- []byte(fmt.Sprintf("request %d\n", i))
+	}
+	// held by the sender before the target is back
+	time.Sleep(100 * time.Millisecond)
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 8)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+	// the oldest requests are dropped beyond the buffer
+	for _, want := range []string{"request 2", "request 3", "request 4"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("target read %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not delivered after the target came back", want)
+		}
+	}
+	s.Data() <- []byte("request 5\n")
+	select {
+	case got := <-lines:
+		if got != "request 5" {
+			t.Fatalf("target read %q after the flush, want request 5", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("delivery did not resume after the reconnect")
+	}
+}
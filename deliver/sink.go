@@ -0,0 +1,83 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// sinks consume parsed requests instead of sending them, e.g.
+// to check a factory without a live target
+const (
+	SinkFile    = "file"
+	SinkStdout  = "stdout"
+	SinkDiscard = "discard"
+)
+
+/*
+Each request is written as a header line and the payload as a
+quoted Go string on its own line:
+2017-01-02T15:04:05.000000000Z redis conn 3f2a9c1b len 14
+"*1\r\n$4\r\nPING\r\n"
+The time is the capture time, "-" if unknown.
+*/
+type sink struct {
+	w *bufio.Writer
+	// nil for stdout and discard
+	c io.Closer
+}
+
+func (s *sink) write(proto string, req *Request) error {
+	ts := "-"
+	if !req.Time.IsZero() {
+		ts = req.Time.UTC().Format(time.RFC3339Nano)
+	}
+	_, err := fmt.Fprintf(s.w, "%s %s conn %x len %d\n%q\n", ts, proto, req.Conn, len(req.Data), req.Data)
+	return err
+}
+
+func (s *sink) close() error {
+	err := s.w.Flush()
+	if s.c != nil {
+		if cerr := s.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// newSink opens a sink of kind, path is only used by SinkFile.
+func newSink(kind, path string) (*sink, error) {
+	switch kind {
+	case SinkFile:
+		if len(path) == 0 {
+			return nil, fmt.Errorf("file sink needs a path")
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("create sink file failed: %v", err)
+		}
+		return &sink{w: bufio.NewWriter(f), c: f}, nil
+	case SinkStdout:
+		return &sink{w: bufio.NewWriter(os.Stdout)}, nil
+	case SinkDiscard:
+		return &sink{w: bufio.NewWriter(ioutil.Discard)}, nil
+	}
+	return nil, fmt.Errorf("unknown sink %q", kind)
+}
@@ -0,0 +1,248 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Target is one of the remote hosts traffic is balanced to,
+// a target failing to connect or write is removed from
+// rotation for a cooldown period, then tried again. With a
+// circuit breaker, consecutive failures remove it until a
+// probe succeeds.
+package deliver
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how long an unreachable target is out of rotation
+const TargetCooldown = time.Second * 5
+
+// balancing strategies of DeliverConfig.Balance
+const (
+	BalanceRoundRobin = "rr"
+	BalanceWeighted   = "weighted"
+	BalanceLeastConn  = "leastconn"
+)
+
+type Target struct {
+	Addr string
+	// share of requests with BalanceWeighted, at least 1
+	Weight int
+	// smooth weighted round robin state, guarded by the
+	// balancer
+	current int
+	// clients of ModeRequest
+	mu        sync.RWMutex
+	clients   []*Client
+	downUntil int64
+	// nil if BreakerThreshold is not set
+	breaker *breaker
+}
+
+// Available reports whether the target is in rotation, when
+// the circuit is half open only the probe request gets true.
+func (t *Target) Available(now time.Time) bool {
+	return atomic.LoadInt64(&t.downUntil) <= now.UnixNano() && t.breaker.allow(now)
+}
+
+// report records the result of a dial or write to the target
+// for its circuit breaker.
+func (t *Target) report(err error) {
+	t.breaker.report(err)
+}
+
+// MarkDown removes the target from rotation for TargetCooldown.
+func (t *Target) MarkDown() {
+	until := time.Now().Add(TargetCooldown)
+	if atomic.SwapInt64(&t.downUntil, until.UnixNano()) <= time.Now().UnixNano() {
+		log.Warnf("target %s is down, remove it from rotation for %v", t.Addr, TargetCooldown)
+	}
+}
+
+// client returns a random alive client, or nil if none.
+func (t *Target) client() *Client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := len(t.clients)
+	if n == 0 {
+		return nil
+	}
+	start := rand.Int() % n
+	for i := 0; i < n; i++ {
+		if c := t.clients[(start+i)%n]; c != nil && c.S.Alive() {
+			return c
+		}
+	}
+	return nil
+}
+
+// clientFrom returns the first alive client from idx on and
+// its index, or nil if none.
+func (t *Target) clientFrom(idx int) (int, *Client) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := len(t.clients)
+	for i := 0; i < n; i++ {
+		j := (idx + i) % n
+		if c := t.clients[j]; c != nil && c.S.Alive() {
+			return j, c
+		}
+	}
+	return 0, nil
+}
+
+// clientAt returns client idx if it is alive.
+func (t *Target) clientAt(idx int) *Client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if c := t.clients[idx]; c != nil && c.S.Alive() {
+		return c
+	}
+	return nil
+}
+
+// inflight returns the requests handed to alive clients of
+// the target and not written yet.
+func (t *Target) inflight() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var n int64
+	for _, c := range t.clients {
+		if c != nil && c.S.Alive() {
+			n += c.InFlight()
+		}
+	}
+	return n
+}
+
+func (t *Target) setClient(idx int, c *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clients[idx] = c
+}
+
+// balancer picks targets by strategy, in round robin order by
+// default.
+type balancer struct {
+	targets  []*Target
+	strategy string
+	next     uint64
+	// guards the weighted state of targets
+	mu sync.Mutex
+}
+
+// pick returns the next available target, or nil if all
+// targets are down. Availability is checked in the order of
+// preference and only until a target is found, so a half open
+// target is only probed when picked.
+func (b *balancer) pick() *Target {
+	switch b.strategy {
+	case BalanceWeighted:
+		return b.pickWeighted()
+	case BalanceLeastConn:
+		return b.pickLeastConn()
+	}
+	now := time.Now()
+	n := uint64(len(b.targets))
+	for i := uint64(0); i < n; i++ {
+		t := b.targets[atomic.AddUint64(&b.next, 1)%n]
+		if t.Available(now) {
+			return t
+		}
+	}
+	return nil
+}
+
+// pickWeighted picks targets in smooth weighted round robin
+// order like nginx, so a heavy target is not picked in bursts.
+// Unavailable targets are skipped for one round of weights.
+func (b *balancer) pickWeighted() *Target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	total := 0
+	for _, t := range b.targets {
+		total += t.Weight
+	}
+	for i := 0; i < total; i++ {
+		var best *Target
+		for _, t := range b.targets {
+			t.current += t.Weight
+			if best == nil || t.current > best.current {
+				best = t
+			}
+		}
+		best.current -= total
+		if best.Available(now) {
+			return best
+		}
+	}
+	return nil
+}
+
+// pickLeastConn picks the target with the fewest requests in
+// flight, ties are broken in round robin order. Requests of
+// ModeRaw senders are not counted.
+func (b *balancer) pickLeastConn() *Target {
+	now := time.Now()
+	n := len(b.targets)
+	start := int(atomic.AddUint64(&b.next, 1) % uint64(n))
+	order := make([]*Target, n)
+	inflight := make(map[*Target]int64, n)
+	for i := range order {
+		t := b.targets[(start+i)%n]
+		order[i] = t
+		inflight[t] = t.inflight()
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return inflight[order[i]] < inflight[order[j]]
+	})
+	for _, t := range order {
+		if t.Available(now) {
+			return t
+		}
+	}
+	return nil
+}
+
+// newBalancer creates targets of addrs, weights[i] is the
+// weight of addrs[i], missing or zero weights are 1.
+func newBalancer(addrs []string, strategy string, weights []int) (*balancer, error) {
+	switch strategy {
+	case "", BalanceRoundRobin, BalanceWeighted, BalanceLeastConn:
+	default:
+		return nil, fmt.Errorf("balance strategy %q not supported", strategy)
+	}
+	if len(weights) > len(addrs) {
+		return nil, fmt.Errorf("%d weights for %d targets", len(weights), len(addrs))
+	}
+	b := &balancer{strategy: strategy}
+	for i, addr := range addrs {
+		t := &Target{Addr: addr, Weight: 1}
+		if i < len(weights) {
+			if weights[i] < 0 {
+				return nil, fmt.Errorf("weight %d of target %s not valid", weights[i], addr)
+			}
+			if weights[i] > 0 {
+				t.Weight = weights[i]
+			}
+		}
+		b.targets = append(b.targets, t)
+	}
+	return b, nil
+}
@@ -0,0 +1,107 @@
+package deliver
+
+import (
+	"strings"
+	"testing"
+)
+
+// idleSender is an alive sender which writes nothing.
+type idleSender struct{}
+
+func (idleSender) run()              {}
+func (idleSender) destroy()          {}
+func (idleSender) stop()             {}
+func (idleSender) Data() chan []byte { return nil }
+func (idleSender) Alive() bool       { return true }
+
+// picks returns the addresses picked n times by b, in order.
+func picks(t *testing.T, b *balancer, n int) []string {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		tg := b.pick()
+		if tg == nil {
+			t.Fatal("no target picked")
+		}
+		got = append(got, tg.Addr)
+	}
+	return got
+}
+
+func count(addrs []string) map[string]int {
+	m := make(map[string]int)
+	for _, a := range addrs {
+		m[a]++
+	}
+	return m
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	b, err := newBalancer([]string{"a", "b", "c"}, BalanceRoundRobin, []int{5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// weights are ignored
+	for addr, n := range count(picks(t, b, 300)) {
+		if n != 100 {
+			t.Errorf("target %s picked %d times, want 100", addr, n)
+		}
+	}
+}
+
+func TestBalanceWeighted(t *testing.T) {
+	b, err := newBalancer([]string{"a", "b", "c"}, BalanceWeighted, []int{5, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := picks(t, b, 700)
+	want := map[string]int{"a": 500, "b": 100, "c": 100}
+	for addr, n := range count(got) {
+		if n != want[addr] {
+			t.Errorf("target %s picked %d times, want %d", addr, n, want[addr])
+		}
+	}
+	// smooth, the heavy target is not picked 5 times in a row
+	if seq := strings.Join(got[:7], ""); seq != "aabacaa" {
+		t.Errorf("picked %s in a round of weights, want aabacaa", seq)
+	}
+
+	// an unavailable target is skipped, the others keep their
+	// ratio
+	b.targets[0].MarkDown()
+	if c := count(picks(t, b, 200)); c["a"] != 0 || c["b"] != 100 || c["c"] != 100 {
+		t.Errorf("picked %v with a down, want b and c evenly", c)
+	}
+}
+
+func TestBalanceLeastConn(t *testing.T) {
+	b, err := newBalancer([]string{"a", "b", "c"}, BalanceLeastConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tg := range b.targets {
+		tg.clients = []*Client{{S: idleSender{}}}
+		// a has 2 requests in flight, b 0 and c 1
+		tg.clients[0].inflight = int64([]int{2, 0, 1}[i])
+	}
+	// each pick gets a request which is not written, like a
+	// controlled workload of slow targets
+	var got []string
+	for i := 0; i < 6; i++ {
+		tg := b.pick()
+		tg.clients[0].inflight++
+		got = append(got, tg.Addr)
+	}
+	if got[0] != "b" {
+		t.Errorf("picked %s first, want b without requests in flight", got[0])
+	}
+	if c := count(got); c["a"] != 1 || c["b"] != 3 || c["c"] != 2 {
+		t.Errorf("picked %v, want in flight requests leveled at 3", c)
+	}
+
+	// a dead client does not count
+	b.targets[0].clients[0] = nil
+	if tg := b.pick(); tg.Addr != "a" {
+		t.Errorf("picked %s, want a without requests in flight", tg.Addr)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+)
+
+// TLSConfig wraps connections to targets in TLS.
+type TLSConfig struct {
+	// defaults to the host of each target address
+	ServerName string
+	// optional client certificate
+	CertFile string
+	KeyFile  string
+	// do not verify the target certificate, for self signed
+	// staging endpoints
+	InsecureSkipVerify bool
+}
+
+func (c *TLSConfig) build() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if len(c.CertFile) != 0 || len(c.KeyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate failed: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// reset connections on close, see DeliverConfig.Linger
+const LingerReset time.Duration = -1
+
+// dial connects to addr, the TLS handshake is done before it
+// returns if tc is set. A zero timeout means no timeout, it
+// bounds the handshake as well. keepAlive, linger and local
+// are socket options, see DeliverConfig. The connection is
+// counted by m.ActiveConns until closed.
+func dial(addr string, timeout time.Duration, tc *tls.Config, keepAlive, linger time.Duration, local string, m *metrics.Set) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+	if local != "" {
+		laddr, err := resolveLocal("tcp", local)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = laddr
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok && linger != 0 {
+		sec := 0
+		if linger > 0 {
+			sec = int((linger + time.Second - 1) / time.Second)
+		}
+		tcp.SetLinger(sec)
+	}
+	if tc != nil {
+		if conn, err = handshake(conn, addr, timeout, tc); err != nil {
+			return nil, err
+		}
+	}
+	m.ActiveConns.Inc()
+	return &countedConn{Conn: conn, m: m}, nil
+}
+
+// resolveLocal resolves a local address to bind to, an ip
+// without a port gets an ephemeral one.
+func resolveLocal(network, addr string) (net.Addr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	if network == "udp" {
+		return net.ResolveUDPAddr(network, addr)
+	}
+	return net.ResolveTCPAddr(network, addr)
+}
+
+// handshake wraps conn in TLS like tls.DialWithDialer, which
+// does not expose the tcp connection for socket options. conn
+// is closed if the handshake fails.
+func handshake(conn net.Conn, addr string, timeout time.Duration, tc *tls.Config) (net.Conn, error) {
+	if tc.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		tc = tc.Clone()
+		tc.ServerName = host
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	tconn := tls.Client(conn, tc)
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tconn, nil
+}
+
+// countedConn leaves m.ActiveConns on the first Close.
+type countedConn struct {
+	net.Conn
+	m    *metrics.Set
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.m.ActiveConns.Dec)
+	return c.Conn.Close()
+}
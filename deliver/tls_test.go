@@ -0,0 +1,43 @@
+package deliver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliverTLS(t *testing.T) {
+	var got int64
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			atomic.AddInt64(&got, 1)
+		}
+	}))
+	defer srv.Close()
+	d := newTestDeliver(t, &DeliverConfig{
+		RemoteAddrs: []string{strings.TrimPrefix(srv.URL, "https://")},
+		IsLong:      true,
+		Concurrency: 1,
+		TLS:         &TLSConfig{InsecureSkipVerify: true},
+	})
+	const n = 10
+	for i := 0; i < n; i++ {
+		d.C <- NewRequest([]byte("GET / HTTP/1.1\r\nHost: staging\r\n\r\n"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&got) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&got); got != n {
+		t.Fatalf("target served %d requests over TLS, want %d", got, n)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tunables are the settings of a running Deliver changed by
+// Tune, Config keeps the values it was created with.
+type Tunables struct {
+	MaxQPS         int
+	MaxBytesPerSec int
+	SampleRate     float64
+	Amplify        int
+	DeliveryDelay  time.Duration
+	DeliveryJitter time.Duration
+}
+
+func (t *Tunables) validate(mode ModeType) error {
+	if t.SampleRate < 0 {
+		return fmt.Errorf("deliver sample rate must not be negative")
+	}
+	if t.DeliveryDelay < 0 || t.DeliveryJitter < 0 {
+		return fmt.Errorf("deliver delay and jitter must not be negative")
+	}
+	if t.Amplify < 0 {
+		return fmt.Errorf("deliver amplify must not be negative")
+	}
+	if t.Amplify > 1 && mode == ModeRaw {
+		return fmt.Errorf("deliver amplify does not support ModeRaw, use Clone")
+	}
+	return nil
+}
+
+// Tune applies t to the running deliver, requests sent after
+// it returns use the new settings. Connections already kept or
+// dropped by SampleByConn are not sampled again.
+func (d *Deliver) Tune(t Tunables) error {
+	if err := t.validate(d.Config.Mode); err != nil {
+		return err
+	}
+	if d.Config.RampUp != nil && t.MaxQPS <= 0 {
+		return fmt.Errorf("deliver ramp up needs MaxQPS")
+	}
+	d.tuneMu.Lock()
+	defer d.tuneMu.Unlock()
+	d.setQPS(t.MaxQPS)
+	d.ByteLimiter.SetRate(t.MaxBytesPerSec)
+	d.Delay.Set(t.DeliveryDelay, t.DeliveryJitter)
+	d.tunables.Store(&t)
+	log.Infof("deliver tuned to %+v", t)
+	return nil
+}
+
+// Tunables returns the settings in use.
+func (d *Deliver) Tunables() Tunables {
+	return *d.tuned()
+}
+
+// tuned falls back to Config for a Deliver not created by
+// NewDeliver.
+func (d *Deliver) tuned() *Tunables {
+	if t, ok := d.tunables.Load().(*Tunables); ok {
+		return t
+	}
+	return &Tunables{
+		MaxQPS:         d.Config.MaxQPS,
+		MaxBytesPerSec: d.Config.MaxBytesPerSec,
+		SampleRate:     d.Config.SampleRate,
+		Amplify:        d.Config.Amplify,
+		DeliveryDelay:  d.Config.DeliveryDelay,
+		DeliveryJitter: d.Config.DeliveryJitter,
+	}
+}
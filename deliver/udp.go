@@ -0,0 +1,205 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// transports of DeliverConfig.Transport
+const (
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+)
+
+// UDPSender writes each request as one datagram to ConnNum
+// connected udp sockets, responses are read like those of
+// LongConnSender. A datagram lost or refused by the remote is
+// not retried.
+type UDPSender struct {
+	RemoteAddr  string
+	ConnNum     int
+	Limiter     *Limiter
+	ByteLimiter *Limiter
+	Delay       *Delay
+	Verifier    *Verifier
+	Remotes     []net.Conn
+	Ctx         context.Context
+	C           chan []byte
+	Stat        *Stat
+	Release     func([]byte)
+	Responses   ResponseHandler
+	Report      func(error)
+	LocalAddr   string
+	Metrics     *metrics.Set
+	// closed when run returns
+	done chan struct{}
+}
+
+// Alive is always true, udp sockets have no connection to lose.
+func (s *UDPSender) Alive() bool {
+	return true
+}
+
+// drain reads responses of socket idx until it is closed.
+func (s *UDPSender) drain(idx int) {
+	r := &countReader{r: s.Remotes[idx], m: s.Metrics}
+	var err error
+	if s.Responses != nil {
+		err = s.Responses(idx, r)
+	} else {
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	if s.Ctx.Err() != nil {
+		return
+	}
+	log.Debugf("read from remote %s stopped: %v", s.RemoteAddr, err)
+}
+
+func (s *UDPSender) run() {
+	defer close(s.done)
+	defer s.destroy()
+	for idx := range s.Remotes {
+		go s.drain(idx)
+	}
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return
+		case req, ok := <-s.C:
+			if !ok {
+				return
+			}
+			if err := s.write(req); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends req to all sockets, it only fails when the
+// context is done.
+func (s *UDPSender) write(req []byte) error {
+	defer s.release(req)
+	if err := s.Limiter.Wait(s.Ctx); err != nil {
+		return err
+	}
+	if err := s.ByteLimiter.WaitN(s.Ctx, len(req)*len(s.Remotes)); err != nil {
+		return err
+	}
+	if err := s.Delay.Wait(s.Ctx); err != nil {
+		return err
+	}
+	s.Stat.TotalRequest++
+	now := time.Now()
+	if now.After(s.Stat.LastStatTime.Add(time.Second * 1)) {
+		s.Stat.RequestPerSecond = s.Stat.TotalRequest - s.Stat.LastTotalRequest
+		log.Infof("remote %s total reqs %d, %d reqs/s", s.RemoteAddr, s.Stat.TotalRequest, s.Stat.RequestPerSecond)
+		s.Stat.LastTotalRequest = s.Stat.TotalRequest
+		s.Stat.LastStatTime = now
+	}
+	s.Verifier.Check(req)
+	for _, conn := range s.Remotes {
+		start := time.Now()
+		n, err := conn.Write(req)
+		s.Metrics.BytesSent.Add(uint64(n))
+		s.report(err)
+		if err != nil {
+			// e.g. refused by an icmp error of a former datagram
+			log.Errorf("write to remote %s failed: %v", s.RemoteAddr, err)
+			s.Metrics.SendErrors.Inc()
+			continue
+		}
+		s.Metrics.SendLatency.Observe(time.Since(start).Seconds())
+	}
+	return nil
+}
+
+func (s *UDPSender) release(req []byte) {
+	if s.Release != nil {
+		s.Release(req)
+	}
+}
+
+func (s *UDPSender) report(err error) {
+	if s.Report != nil {
+		s.Report(err)
+	}
+}
+
+func (s *UDPSender) destroy() {
+	for _, conn := range s.Remotes {
+		conn.Close()
+	}
+}
+
+func (s *UDPSender) stop() {
+	close(s.C)
+	<-s.done
+}
+
+func (s *UDPSender) Data() chan []byte {
+	return s.C
+}
+
+// dial opens a socket to the remote, bound to LocalAddr if set.
+func (s *UDPSender) dial() (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if s.LocalAddr != "" {
+		laddr, err := resolveLocal("udp", s.LocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = laddr
+	}
+	return dialer.Dial("udp", s.RemoteAddr)
+}
+
+func NewUDPSender(ctx context.Context, c *SenderConfig) (Sender, error) {
+	s := &UDPSender{
+		RemoteAddr:  c.RemoteAddr,
+		ConnNum:     c.ConnNum,
+		Limiter:     c.Limiter,
+		ByteLimiter: c.ByteLimiter,
+		Delay:       c.Delay,
+		Verifier:    c.Verifier,
+		Release:     c.Release,
+		Responses:   c.Responses,
+		Report:      c.Report,
+		LocalAddr:   c.LocalAddr,
+		Metrics:     c.metrics(),
+		Ctx:         ctx,
+		C:           make(chan []byte),
+		Stat:        &Stat{},
+		done:        make(chan struct{}),
+	}
+	for i := 0; i < s.ConnNum; i++ {
+		conn, err := s.dial()
+		if err != nil {
+			s.destroy()
+			return nil, fmt.Errorf("connect to remote %s failed: %v", s.RemoteAddr, err)
+		}
+		s.Remotes = append(s.Remotes, conn)
+	}
+	go s.run()
+	return s, nil
+}
@@ -0,0 +1,103 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deliver
+
+import (
+	"hash/crc32"
+	"sync"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// max buffers tracked by a Verifier, buffers dropped by senders
+// are never checked, so all are forgotten once it is reached
+const VerifyMaxTracked int = 1 << 16
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Verifier checks that the bytes written to targets are the
+// bytes handed to senders, a change in between means a buffer
+// was reused before it was written.
+type Verifier struct {
+	mu sync.Mutex
+	// by the first byte of a buffer, a buffer sent to several
+	// senders is tracked once for each
+	tracked map[*byte]*tracked
+	m       *metrics.Set
+}
+
+type tracked struct {
+	len  int
+	sum  uint32
+	refs int
+}
+
+// Track records the checksum of data handed to a sender, a nil
+// Verifier does nothing.
+func (v *Verifier) Track(data []byte) {
+	if v == nil || len(data) == 0 {
+		return
+	}
+	sum := crc32.Checksum(data, castagnoli)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	t := v.tracked[&data[0]]
+	if t != nil && t.len == len(data) && t.sum == sum {
+		t.refs++
+		return
+	}
+	if len(v.tracked) >= VerifyMaxTracked {
+		log.Debugf("verifier tracks %d buffers, forget them", len(v.tracked))
+		v.tracked = make(map[*byte]*tracked)
+	}
+	// a buffer tracked again with other bytes was released
+	// and reused, its earlier handoffs are done
+	v.tracked[&data[0]] = &tracked{len: len(data), sum: sum, refs: 1}
+}
+
+// Check compares data about to be written with its tracked
+// checksum, it reports false on a mismatch. Untracked data
+// passes.
+func (v *Verifier) Check(data []byte) bool {
+	if v == nil || len(data) == 0 {
+		return true
+	}
+	sum := crc32.Checksum(data, castagnoli)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	t := v.tracked[&data[0]]
+	if t == nil {
+		return true
+	}
+	if t.refs--; t.refs <= 0 {
+		delete(v.tracked, &data[0])
+	}
+	if t.len == len(data) && t.sum == sum {
+		return true
+	}
+	log.Errorf("verifier request of %d bytes changed before write, got %d bytes with checksum %08x, want %08x",
+		t.len, len(data), sum, t.sum)
+	v.m.IntegrityErrors.Inc()
+	return false
+}
+
+// NewVerifier returns nil if verification is off, mismatches
+// are counted in m.
+func NewVerifier(enabled bool, m *metrics.Set) *Verifier {
+	if !enabled {
+		return nil
+	}
+	return &Verifier{tracked: make(map[*byte]*tracked), m: m}
+}
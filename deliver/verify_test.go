@@ -0,0 +1,63 @@
+package deliver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+)
+
+func TestVerifierDetectsCorruption(t *testing.T) {
+	m := metrics.NewSet()
+	v := NewVerifier(true, m)
+	data := []byte("set foo bar\r\n")
+	v.Track(data)
+	if !v.Check(data) {
+		t.Fatal("intact request failed verification")
+	}
+	// the buffer is reused before it is written
+	v.Track(data)
+	copy(data, "get")
+	if v.Check(data) {
+		t.Fatal("corrupted request passed verification")
+	}
+	if got := m.IntegrityErrors.Value(); got != 1 {
+		t.Fatalf("%d integrity errors, want 1", got)
+	}
+	// untracked data and a nil verifier pass
+	if !v.Check([]byte("ping\r\n")) || !(*Verifier)(nil).Check(data) {
+		t.Fatal("untracked request failed verification")
+	}
+}
+
+func TestSenderVerifiesWrites(t *testing.T) {
+	ot := newOpenTarget(t)
+	m := metrics.NewSet()
+	v := NewVerifier(true, m)
+	s, err := NewLongConnSender(context.Background(), &SenderConfig{
+		RemoteAddr: ot.Addr().String(),
+		ConnNum:    1,
+		Verifier:   v,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	data := []byte("0123456789")
+	v.Track(data)
+	s.Data() <- data
+	waitFor(t, "the intact request", func() bool { return atomic.LoadInt64(&ot.bytes) == 10 })
+	if got := m.IntegrityErrors.Value(); got != 0 {
+		t.Fatalf("%d integrity errors of an intact request", got)
+	}
+
+	data = []byte("0123456789")
+	v.Track(data)
+	data[0] = 'x'
+	s.Data() <- data
+	waitFor(t, "the corrupted request", func() bool { return atomic.LoadInt64(&ot.bytes) == 20 })
+	if got := m.IntegrityErrors.Value(); got != 1 {
+		t.Fatalf("%d integrity errors, want 1", got)
+	}
+}
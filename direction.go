@@ -0,0 +1,62 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// directions of captured streams
+const (
+	DirectionBoth = "both"
+	DirectionC2S  = "c2s"
+	DirectionS2C  = "s2c"
+)
+
+// directionFilter creates streams of one direction with the
+// factory, streams of the other direction are dropped without
+// a reader goroutine. The direction is told by the packet
+// creating the stream, SYN opens client streams and SYN ACK
+// server ones. Streams captured after the handshake are told
+// by ports, the lower one is taken as the server port.
+type directionFilter struct {
+	f tcpassembly.StreamFactory
+	a *assembly
+	// keep client to server streams, or server to client ones
+	c2s bool
+}
+
+func (d *directionFilter) New(l, r gopacket.Flow) tcpassembly.Stream {
+	// New is only called within assemble, which holds a.mu
+	if tcp := d.a.current; tcp != nil && d.client(tcp) != d.c2s {
+		return dropStream{}
+	}
+	return d.f.New(l, r)
+}
+
+func (d *directionFilter) client(tcp *layers.TCP) bool {
+	if tcp.SYN {
+		return !tcp.ACK
+	}
+	return tcp.SrcPort > tcp.DstPort
+}
+
+// dropStream discards the data of an unwanted direction.
+type dropStream struct{}
+
+func (dropStream) Reassembled([]tcpassembly.Reassembly) {}
+
+func (dropStream) ReassemblyComplete() {}
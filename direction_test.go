@@ -0,0 +1,96 @@
+package tcplayer
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// the server of connections assembled by assembleConn
+var testServer = net.IPv4(10, 0, 0, 1)
+
+// flowFactory records the network and transport flows of the
+// streams it creates.
+type flowFactory struct {
+	mu    sync.Mutex
+	nets  []string
+	flows []string
+}
+
+func (f *flowFactory) New(net, tcp gopacket.Flow) tcpassembly.Stream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nets = append(f.nets, net.String())
+	f.flows = append(f.flows, tcp.String())
+	return dropStream{}
+}
+
+// assembleSegment assembles tcp with payload between client and
+// testServer, it is sent by the server from port 6379.
+func assembleSegment(a *assembly, client net.IP, tcp *layers.TCP, payload string, seen time.Time) {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: testServer}
+	if tcp.SrcPort == 6379 {
+		ip.SrcIP, ip.DstIP = testServer, client
+	}
+	// decoded for the flows of the layers
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, tcp, gopacket.Payload(payload))
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	a.assemble(p.NetworkLayer().NetworkFlow(), p.Layer(layers.LayerTypeTCP).(*layers.TCP), seen)
+}
+
+// assembleConn assembles a connection between port 40000 of
+// client and port 6379 of testServer, from the handshake if syn.
+func assembleConn(a *assembly, client net.IP, syn bool) {
+	seen := time.Unix(1500000000, 0)
+	segment := func(src, dst layers.TCPPort, seq uint32, payload string, flags func(*layers.TCP)) {
+		tcp := &layers.TCP{SrcPort: src, DstPort: dst, Seq: seq, ACK: true, Window: 65535}
+		if flags != nil {
+			flags(tcp)
+		}
+		seen = seen.Add(time.Millisecond)
+		assembleSegment(a, client, tcp, payload, seen)
+	}
+	cseq, sseq := uint32(1000), uint32(5000)
+	if syn {
+		segment(40000, 6379, cseq, "", func(tcp *layers.TCP) { tcp.SYN, tcp.ACK = true, false })
+		segment(6379, 40000, sseq, "", func(tcp *layers.TCP) { tcp.SYN = true })
+		cseq, sseq = cseq+1, sseq+1
+	}
+	segment(40000, 6379, cseq, "PING\r\n", nil)
+	segment(6379, 40000, sseq, "+PONG\r\n", nil)
+}
+
+func TestCaptureDirection(t *testing.T) {
+	for _, c := range []struct {
+		direction string
+		want      []string
+	}{
+		{DirectionBoth, []string{"40000->6379", "6379->40000"}},
+		{DirectionC2S, []string{"40000->6379"}},
+		{DirectionS2C, []string{"6379->40000"}},
+	} {
+		for _, syn := range []bool{true, false} {
+			f := &flowFactory{}
+			a := newAssembly(f, 0, 0, c.direction)
+			assembleConn(a, net.IPv4(10, 1, 0, 5), syn)
+			a.flushAll()
+			f.mu.Lock()
+			got := f.flows
+			f.mu.Unlock()
+			if len(got) != len(c.want) {
+				t.Fatalf("%s with handshake %v created streams %v, want %v", c.direction, syn, got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("%s with handshake %v created streams %v, want %v", c.direction, syn, got, c.want)
+				}
+			}
+		}
+	}
+}
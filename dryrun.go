@@ -0,0 +1,60 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+)
+
+// dryRunConfig keeps the parts of dc which affect parsing and
+// sends all requests to the discard sink.
+func dryRunConfig(dc deliver.DeliverConfig) deliver.DeliverConfig {
+	return deliver.DeliverConfig{
+		Proto:     dc.Proto,
+		Transport: dc.Transport,
+		QueueSize: dc.QueueSize,
+		Transform: dc.Transform,
+		Sink:      deliver.SinkDiscard,
+		// framing of the parsed requests is kept for analysis
+		AnalysisFile: dc.AnalysisFile,
+	}
+}
+
+// ParseSummary describes how captured streams were parsed, e.g.
+// after a DryRun. Counts come from the parser metrics of p.
+func (p *Player) ParseSummary() string {
+	m := p.metrics
+	parsed := m.RequestsParsed.Values()
+	protos := make([]string, 0, len(parsed))
+	var total uint64
+	for proto, n := range parsed {
+		protos = append(protos, fmt.Sprintf("%s %d", proto, n))
+		total += n
+	}
+	sort.Strings(protos)
+	var errs uint64
+	for _, n := range m.ParseErrors.Values() {
+		errs += n
+	}
+	s := fmt.Sprintf("parsed %d requests", total)
+	if len(protos) > 0 {
+		s += " (" + strings.Join(protos, ", ") + ")"
+	}
+	return s + fmt.Sprintf(", %d streams given up on invalid requests, %d resyncs skipping %d bytes, %d oversized frames",
+		errs, m.Resyncs.Value(), m.BytesSkipped.Value(), m.OversizedFrames.Value())
+}
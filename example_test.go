@@ -0,0 +1,128 @@
+package tcplayer_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/feilengcui008/tcplayer"
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/source"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writePcap writes a capture of one client connection sending
+// the payloads to port 6379, one segment each.
+func writePcap(path string, payloads ...string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+	ts := time.Unix(1500000000, 0)
+	seq := uint32(1000)
+	write := func(tcp *layers.TCP, payload []byte) error {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    net.IP{10, 0, 0, 1},
+			DstIP:    net.IP{10, 0, 0, 2},
+		}
+		tcp.SrcPort, tcp.DstPort = 40000, 6379
+		tcp.Seq, tcp.Window = seq, 65535
+		tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+			return err
+		}
+		ts = ts.Add(time.Millisecond)
+		data := buf.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+		return w.WritePacket(ci, data)
+	}
+	if err := write(&layers.TCP{SYN: true}, nil); err != nil {
+		return err
+	}
+	seq++
+	for _, p := range payloads {
+		if err := write(&layers.TCP{ACK: true, PSH: true}, []byte(p)); err != nil {
+			return err
+		}
+		seq += uint32(len(p))
+	}
+	return write(&layers.TCP{ACK: true, FIN: true}, nil)
+}
+
+// Replay a pcap file of Redis commands to a target, Run returns
+// once the file is consumed and the requests are delivered.
+func ExamplePlayer() {
+	dir, err := ioutil.TempDir("", "tcplayer")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pcap := filepath.Join(dir, "redis.pcap")
+	ping := "*1\r\n$4\r\nPING\r\n"
+	if err := writePcap(pcap, ping, ping, ping); err != nil {
+		log.Fatal(err)
+	}
+
+	// a target reading and discarding the requests
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	p, err := tcplayer.NewPlayer(&tcplayer.Config{
+		Protocol: "redis",
+		Source:   source.SourceConfig{PcapFile: pcap},
+		Deliver: deliver.DeliverConfig{
+			RemoteAddrs: []string{l.Addr().String()},
+			IsLong:      true,
+		},
+		LogLevel: "error",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := p.Run(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("parsed", p.ReadStats().RequestsTotal)
+	fmt.Println("delivered", p.Deliver().Stat.TotalRequest)
+	// Output:
+	// parsed 3
+	// delivered 3
+}
@@ -0,0 +1,271 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AMQPProtocolHeader  string = "AMQP\x00\x00\x09\x01"
+	AMQPFrameHeaderSize int    = 7
+	AMQPFrameEnd        byte   = 0xCE
+	// same as the RabbitMQ frame_max default
+	AMQPMaxFrameSize int = 128 * 1024
+	// same as the RabbitMQ max_message_size default
+	AMQPMaxMessageSize int64 = 128 * 1024 * 1024
+)
+
+// AMQP frame types
+const (
+	AMQPFrameMethod    byte = 1
+	AMQPFrameHeader    byte = 2
+	AMQPFrameBody      byte = 3
+	AMQPFrameHeartbeat byte = 8
+)
+
+// Basic.Publish class and method id
+const (
+	amqpClassBasic    uint16 = 60
+	amqpMethodPublish uint16 = 40
+)
+
+// methods only sent by clients, class id << 16 | method id,
+// the first method frame of a stream tells its direction
+var amqpClientMethods = map[uint32]bool{
+	10<<16 | 11: true, // Connection.StartOk
+	10<<16 | 31: true, // Connection.TuneOk
+	10<<16 | 40: true, // Connection.Open
+	20<<16 | 10: true, // Channel.Open
+	40<<16 | 10: true, // Exchange.Declare
+	50<<16 | 10: true, // Queue.Declare
+	50<<16 | 20: true, // Queue.Bind
+	60<<16 | 10: true, // Basic.Qos
+	60<<16 | 20: true, // Basic.Consume
+	60<<16 | 40: true, // Basic.Publish
+	85<<16 | 10: true, // Confirm.Select
+	90<<16 | 10: true, // Tx.Select
+}
+
+// TCP -> AMQP 0-9-1
+type AMQPStreamFactory struct {
+	d *deliver.Deliver
+	streams
+	// junk bytes skipped while resyncing on the frame end
+	skippedBytes uint64
+}
+
+func init() {
+	Register(ProtoAMQP.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewAMQPStreamFactory(d), nil
+	})
+}
+
+func (f *AMQPStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoAMQP.String())
+	f.start(f.d, s, func() {
+		// a whole frame is peeked before it is consumed
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), AMQPFrameHeaderSize+AMQPMaxFrameSize+1)
+		c := &amqpConn{
+			f:         f,
+			r:         r,
+			l:         s.logger().WithField("factory", "AMQPStreamFactory"),
+			publishes: make(map[uint16]*amqpPublish),
+		}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "AMQPStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "AMQPStreamFactory")
+		}
+	})
+	return s
+}
+
+// SkippedBytes returns the number of junk bytes skipped
+// while resyncing on the frame end.
+func (f *AMQPStreamFactory) SkippedBytes() uint64 {
+	return atomic.LoadUint64(&f.skippedBytes)
+}
+
+// amqpPublish is a Basic.Publish waiting for its content.
+type amqpPublish struct {
+	frames []byte
+	// body size from the content header, -1 before it
+	size int64
+	read int64
+}
+
+// amqpConn is the parsing state of one stream.
+type amqpConn struct {
+	f *AMQPStreamFactory
+	r *bufio.Reader
+	l *log.Entry
+	// protocol header checked
+	started bool
+	// direction known after the first method frame
+	known  bool
+	client bool
+	// publishes being assembled by channel, content frames of
+	// different channels may interleave
+	publishes map[uint16]*amqpPublish
+}
+
+// https://www.rabbitmq.com/resources/specs/amqp0-9-1.pdf
+/*
+AMQP frame:
++--------+--------+--------+--------+...+--------+...+--------+
+| type   | channel         | size                | payload    | 0xCE
++--------+--------+--------+--------+...+--------+...+--------+
+A publish is a Basic.Publish method frame, a content header
+frame with the body size, then body frames until the size.
+*/
+// parse returns the protocol header, a whole publish, or any
+// other client frame, heartbeats and server frames are skipped.
+// The r argument is the same reader as c.r.
+func (c *amqpConn) parse(r io.Reader) ([]byte, error) {
+	if !c.started {
+		c.started = true
+		if head, _ := c.r.Peek(len(AMQPProtocolHeader)); string(head) == AMQPProtocolHeader {
+			c.known, c.client = true, true
+			c.r.Discard(len(head))
+			c.l.Debug("got protocol header")
+			return []byte(AMQPProtocolHeader), nil
+		}
+	}
+	for {
+		frame, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		typ := frame[0]
+		channel := binary.BigEndian.Uint16(frame[1:])
+		payload := frame[AMQPFrameHeaderSize : len(frame)-1]
+		if typ == AMQPFrameHeartbeat {
+			continue
+		}
+		if typ == AMQPFrameMethod && !c.known {
+			if len(payload) < 4 {
+				continue
+			}
+			id := binary.BigEndian.Uint32(payload)
+			c.known, c.client = true, amqpClientMethods[id]
+			c.l.WithField("client", c.client).Debug("stream direction known")
+		}
+		if !c.client {
+			continue
+		}
+		if msg := c.frame(typ, channel, frame, payload); msg != nil {
+			c.l.WithFields(log.Fields{"len": len(msg), "type": typ, "channel": channel}).Debug("got a valid message")
+			return msg, nil
+		}
+	}
+}
+
+// frame adds a client frame to the publish of its channel, it
+// returns the message completed by the frame if any.
+func (c *amqpConn) frame(typ byte, channel uint16, frame, payload []byte) []byte {
+	switch typ {
+	case AMQPFrameMethod:
+		if len(payload) >= 4 && binary.BigEndian.Uint16(payload) == amqpClassBasic &&
+			binary.BigEndian.Uint16(payload[2:]) == amqpMethodPublish {
+			c.publishes[channel] = &amqpPublish{frames: frame, size: -1}
+			return nil
+		}
+		return frame
+	case AMQPFrameHeader:
+		p := c.publishes[channel]
+		if p == nil || p.size >= 0 || len(payload) < 12 {
+			c.l.WithField("channel", channel).Debug("unexpected content header")
+			return nil
+		}
+		// class id, weight, body size
+		size := binary.BigEndian.Uint64(payload[4:])
+		if size > uint64(AMQPMaxMessageSize) {
+			c.l.WithFields(log.Fields{"size": size, "channel": channel}).Debug("skip publish larger than the max message size")
+			delete(c.publishes, channel)
+			return nil
+		}
+		p.frames = append(p.frames, frame...)
+		p.size = int64(size)
+	case AMQPFrameBody:
+		p := c.publishes[channel]
+		if p == nil || p.size < 0 {
+			c.l.WithField("channel", channel).Debug("unexpected body")
+			return nil
+		}
+		p.frames = append(p.frames, frame...)
+		p.read += int64(len(payload))
+	default:
+		return nil
+	}
+	p := c.publishes[channel]
+	if p.read < p.size {
+		return nil
+	}
+	delete(c.publishes, channel)
+	return p.frames
+}
+
+// readFrame returns a whole frame, a frame with an unknown
+// type, a bad size or without the frame end makes it resync
+// one byte later.
+func (c *amqpConn) readFrame() ([]byte, error) {
+	skipped := 0
+	for {
+		header, err := c.r.Peek(AMQPFrameHeaderSize)
+		if err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint32(header[3:]))
+		if isAMQPFrameType(header[0]) && size <= AMQPMaxFrameSize {
+			frame, err := c.r.Peek(AMQPFrameHeaderSize + size + 1)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			if frame[len(frame)-1] == AMQPFrameEnd {
+				if skipped > 0 {
+					c.l.WithField("skipped", skipped).Debug("resynced on a valid frame")
+					countResync(c.f.d.Metrics, skipped)
+				}
+				frame = append([]byte{}, frame...)
+				c.r.Discard(len(frame))
+				return frame, nil
+			}
+		}
+		c.r.Discard(1)
+		skipped++
+		atomic.AddUint64(&c.f.skippedBytes, 1)
+	}
+}
+
+func isAMQPFrameType(t byte) bool {
+	return t == AMQPFrameMethod || t == AMQPFrameHeader || t == AMQPFrameBody || t == AMQPFrameHeartbeat
+}
+
+func NewAMQPStreamFactory(d *deliver.Deliver) *AMQPStreamFactory {
+	return &AMQPStreamFactory{
+		d: d,
+	}
+}
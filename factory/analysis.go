@@ -0,0 +1,127 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+)
+
+// analysisHeaders describe the header fields of a parsed request
+// of a protocol for deliver.AnalysisRecord, protocols without
+// one only get the offset and length of their requests.
+var analysisHeaders = map[string]func([]byte) string{
+	ProtoVideoPacket.String(): videoPacketHeader,
+	ProtoHTTP.String():        httpHeader,
+	ProtoRedis.String():       redisHeader,
+	ProtoMySQL.String():       mySQLHeader,
+	ProtoMongo.String():       mongoHeader,
+	ProtoKafka.String():       kafkaHeader,
+}
+
+// analyze writes the framing of req, parsed from s up to the
+// position end, to the analysis file of d. start is the position
+// of s after the previous request.
+func analyze(d *deliver.Deliver, s *stream, req []byte, start, end int64) {
+	rec := &deliver.AnalysisRecord{
+		Flow:   s.flow,
+		Proto:  s.proto,
+		Time:   s.Seen(),
+		Offset: end - int64(len(req)),
+		Len:    len(req),
+	}
+	// parsers fixing up a request, like a partial one, return
+	// more bytes than they read
+	if rec.Offset < start {
+		rec.Offset = start
+	}
+	rec.Skipped = rec.Offset - start
+	rec.Resync = rec.Skipped > 0
+	if header, ok := analysisHeaders[s.proto]; ok {
+		rec.Header = header(req)
+	}
+	d.Analysis.Write(rec)
+}
+
+// position returns the offset in s of the next byte parsed from
+// r, bytes buffered by r are not parsed yet.
+func (s *stream) position(r io.Reader) int64 {
+	if b, ok := r.(interface{ Buffered() int }); ok {
+		return s.read - int64(b.Buffered())
+	}
+	return s.read
+}
+
+func videoPacketHeader(frame []byte) string {
+	if len(frame) < 6 {
+		return ""
+	}
+	return fmt.Sprintf("length=%d version=%d", binary.BigEndian.Uint32(frame[1:]), frame[5])
+}
+
+func httpHeader(req []byte) string {
+	if i := bytes.IndexByte(req, '\n'); i >= 0 {
+		req = req[:i]
+	}
+	// method, target and version
+	fields := bytes.Fields(req)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("method=%s path=%s", fields[0], fields[1])
+}
+
+func redisHeader(cmd []byte) string {
+	var name []byte
+	if len(cmd) > 0 && cmd[0] == '*' {
+		// array, bulk length, bulk string
+		if lines := bytes.SplitN(cmd, []byte("\r\n"), 4); len(lines) > 2 {
+			name = lines[2]
+		}
+	} else if fields := bytes.Fields(cmd); len(fields) > 0 {
+		name = fields[0]
+	}
+	if len(name) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("cmd=%s", bytes.ToUpper(name))
+}
+
+func mySQLHeader(packet []byte) string {
+	if len(packet) < 5 {
+		return ""
+	}
+	return fmt.Sprintf("seq=%d command=0x%02x", packet[3], packet[4])
+}
+
+func mongoHeader(msg []byte) string {
+	if len(msg) < MongoHeaderSize {
+		return ""
+	}
+	return fmt.Sprintf("request_id=%d opcode=%d",
+		int32(binary.LittleEndian.Uint32(msg[4:])), int32(binary.LittleEndian.Uint32(msg[12:])))
+}
+
+func kafkaHeader(msg []byte) string {
+	if len(msg) < 12 {
+		return ""
+	}
+	return fmt.Sprintf("api_key=%d api_version=%d correlation_id=%d",
+		int16(binary.BigEndian.Uint16(msg[4:])), int16(binary.BigEndian.Uint16(msg[6:])),
+		int32(binary.BigEndian.Uint32(msg[8:])))
+}
@@ -0,0 +1,378 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// bytes of a stream sniffed before it falls back to raw
+const DefaultAutoDetectPeek int = 512
+
+// name of the raw passthrough fallback in logs
+const autoRaw = "raw"
+
+// autoSignature tells a protocol by the first bytes of a
+// stream, match returns false until enough bytes are seen.
+type autoSignature struct {
+	proto ProtoType
+	match func(b []byte) bool
+}
+
+// checked in order, a stream of a server speaking first, like
+// the MySQL greeting, decides the factory of its connection
+var autoSignatures = []autoSignature{
+	{ProtoHTTP2, func(b []byte) bool { return bytes.HasPrefix(b, []byte(HTTP2ClientPreface[:16])) }},
+	{ProtoSIP, func(b []byte) bool { return isRequestLine(b, "SIP/2.0") }},
+	{ProtoHTTP, func(b []byte) bool { return isRequestLine(b, "HTTP/1.") }},
+	{ProtoRedis, func(b []byte) bool { return len(b) >= 2 && b[0] == '*' && b[1] >= '0' && b[1] <= '9' }},
+	{ProtoAMQP, func(b []byte) bool { return bytes.HasPrefix(b, []byte(AMQPProtocolHeader[:5])) }},
+	{ProtoNATS, func(b []byte) bool {
+		return bytes.HasPrefix(b, []byte("INFO {")) || bytes.HasPrefix(b, []byte("CONNECT {"))
+	}},
+	{ProtoSTOMP, isSTOMPConnect},
+	{ProtoSMTP, func(b []byte) bool { return bytes.HasPrefix(b, []byte("220 ")) || bytes.HasPrefix(b, []byte("220-")) }},
+	{ProtoMySQL, isMySQLGreeting},
+	{ProtoPostgres, isPostgresStartup},
+	{ProtoDubbo, func(b []byte) bool { return len(b) >= 2 && binary.BigEndian.Uint16(b) == DubboMagic }},
+	{ProtoCQL, isCQLStartup},
+	{ProtoMQTT, isMQTTConnect},
+	{ProtoTDS, isTDSPrelogin},
+	// magic, 4 length bytes and version 1
+	{ProtoVideoPacket, func(b []byte) bool { return len(b) >= 6 && b[0] == 0x26 && b[5] == 1 }},
+}
+
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// isRequestLine reports whether b starts with a whole
+// "METHOD target VERSION" line of an HTTP or SIP version.
+func isRequestLine(b []byte, version string) bool {
+	end := bytes.Index(b, []byte("\r\n"))
+	if end < 0 {
+		return false
+	}
+	fields := bytes.Fields(b[:end])
+	if len(fields) != 3 || !bytes.HasPrefix(fields[2], []byte(version)) {
+		return false
+	}
+	if version == "SIP/2.0" {
+		return bytes.Equal(bytes.ToUpper(fields[0]), fields[0])
+	}
+	return httpMethods[string(fields[0])]
+}
+
+func isSTOMPConnect(b []byte) bool {
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		return false
+	}
+	cmd := string(bytes.TrimSuffix(b[:end], []byte("\r")))
+	return cmd == "CONNECT" || cmd == "STOMP"
+}
+
+// isMySQLGreeting matches the first packet of the server, with
+// seq id 0 and protocol version 10.
+func isMySQLGreeting(b []byte) bool {
+	if len(b) < 5 {
+		return false
+	}
+	length := readMySQLLength(b)
+	return b[3] == 0 && b[4] == 0x0a && length > 20 && length < 1024
+}
+
+func isPostgresStartup(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	length := int(int32(binary.BigEndian.Uint32(b)))
+	code := binary.BigEndian.Uint32(b[4:])
+	if length < 8 || length > PostgresMaxStartupSize {
+		return false
+	}
+	switch code {
+	case PostgresSSLRequest, PostgresGSSENCRequest, PostgresCancelRequest:
+		return true
+	}
+	return code>>16 == postgresProtocolMajor3
+}
+
+// isCQLStartup matches the OPTIONS or STARTUP request a CQL
+// client opens a connection with.
+func isCQLStartup(b []byte) bool {
+	if len(b) < CQLHeaderSize {
+		return false
+	}
+	version, opcode := b[0], b[4]
+	length := int(int32(binary.BigEndian.Uint32(b[5:])))
+	return version >= 3 && version <= 5 && (opcode == CQLStartup || opcode == CQLOptions) &&
+		length >= 0 && length <= CQLMaxFrameSize
+}
+
+// isMQTTConnect matches the CONNECT packet opening an MQTT
+// connection, with protocol name MQTT or MQIsdp of 3.1.
+func isMQTTConnect(b []byte) bool {
+	if len(b) < 2 || b[0] != MQTTConnect<<4 {
+		return false
+	}
+	// skip the remaining length
+	i := 1
+	for i < len(b) && i < 5 && b[i]&0x80 != 0 {
+		i++
+	}
+	i++
+	if len(b) < i+2 {
+		return false
+	}
+	name := b[i+2:]
+	return bytes.HasPrefix(name, []byte("MQTT")) || bytes.HasPrefix(name, []byte("MQIsdp"))
+}
+
+// detectProtocol returns the name of the first protocol whose
+// signature matches b, or "" if none.
+func detectProtocol(b []byte) string {
+	for _, sig := range autoSignatures {
+		if sig.match(b) {
+			return sig.proto.String()
+		}
+	}
+	return ""
+}
+
+// TCP -> any registered protocol, picked by the first bytes
+type AutoDetectStreamFactory struct {
+	d *deliver.Deliver
+	o *Options
+	// bytes sniffed before falling back to raw
+	peek int
+	// connections seen in both directions use the factory
+	// detected by the first of them
+	mu        sync.Mutex
+	factories map[string]tcpassembly.StreamFactory
+	conns     map[connKey]*autoConn
+	streams   uint64
+}
+
+func init() {
+	Register(ProtoAutoDetect.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewAutoDetectStreamFactory(d, o), nil
+	})
+}
+
+type autoConn struct {
+	// nil until the protocol is detected
+	f       tcpassembly.StreamFactory
+	streams int
+}
+
+func (f *AutoDetectStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	key := newConnKey(l, r)
+	n := atomic.AddUint64(&f.streams, 1)
+	log.WithFields(log.Fields{"factory": "AutoDetectStreamFactory", "streams": n}).Debug("new stream")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.conns[key]
+	if !ok {
+		c = &autoConn{}
+		f.conns[key] = c
+	}
+	c.streams++
+	return &autoStream{f: f, net: l, transport: r, key: key}
+}
+
+// ActiveStreams returns the number of streams not yet
+// completed, including those still being sniffed.
+func (f *AutoDetectStreamFactory) ActiveStreams() uint64 {
+	return atomic.LoadUint64(&f.streams)
+}
+
+// decide returns the factory of the connection of key, it is
+// detected from head unless the other direction did it, nil if
+// head is too short to tell. With final an unknown protocol
+// falls back to raw.
+func (f *AutoDetectStreamFactory) decide(key connKey, head []byte, final bool) tcpassembly.StreamFactory {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.conns[key]
+	if c.f != nil {
+		return c.f
+	}
+	name := detectProtocol(head)
+	if name == "" {
+		if !final {
+			return nil
+		}
+		name = autoRaw
+	}
+	sf, ok := f.factories[name]
+	if !ok {
+		var err error
+		if sf, err = f.newFactory(name); err != nil {
+			log.WithFields(log.Fields{"factory": "AutoDetectStreamFactory", "protocol": name}).WithError(err).Error("create stream factory failed, relay raw")
+			name, sf = autoRaw, f.factories[autoRaw]
+		} else {
+			f.factories[name] = sf
+		}
+	}
+	log.WithFields(log.Fields{"factory": "AutoDetectStreamFactory", "protocol": name}).Debug("detected protocol")
+	c.f = sf
+	return sf
+}
+
+func (f *AutoDetectStreamFactory) newFactory(name string) (tcpassembly.StreamFactory, error) {
+	c, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return c(f.d, f.o)
+}
+
+func (f *AutoDetectStreamFactory) release(key connKey) {
+	atomic.AddUint64(&f.streams, ^uint64(0))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.conns[key]; c != nil {
+		c.streams--
+		if c.streams <= 0 {
+			delete(f.conns, key)
+		}
+	}
+}
+
+// autoStream keeps copies of reassembled data until the
+// protocol is detected, then replays them to a stream of the
+// detected factory and passes the rest through.
+type autoStream struct {
+	f              *AutoDetectStreamFactory
+	net, transport gopacket.Flow
+	key            connKey
+	pending        []tcpassembly.Reassembly
+	size           int
+	target         tcpassembly.Stream
+}
+
+func (s *autoStream) Reassembled(rs []tcpassembly.Reassembly) {
+	if s.target != nil {
+		s.target.Reassembled(rs)
+		return
+	}
+	// the assembler reuses the bytes after Reassembled returns
+	for _, r := range rs {
+		r.Bytes = append([]byte(nil), r.Bytes...)
+		s.pending = append(s.pending, r)
+		s.size += len(r.Bytes)
+	}
+	s.detect(s.size >= s.f.peek)
+}
+
+func (s *autoStream) ReassemblyComplete() {
+	if s.target == nil {
+		s.detect(true)
+	}
+	s.target.ReassemblyComplete()
+	s.f.release(s.key)
+}
+
+// detect creates the target stream once the protocol is known
+// and hands it the pending data.
+func (s *autoStream) detect(final bool) {
+	head := make([]byte, 0, s.size)
+	for _, r := range s.pending {
+		head = append(head, r.Bytes...)
+	}
+	sf := s.f.decide(s.key, head, final)
+	if sf == nil {
+		return
+	}
+	s.target = sf.New(s.net, s.transport)
+	if len(s.pending) > 0 {
+		s.target.Reassembled(s.pending)
+	}
+	s.pending = nil
+}
+
+// autoRawStreamFactory passes streams of unknown protocols
+// through, each read is sent as is.
+type autoRawStreamFactory struct {
+	d *deliver.Deliver
+}
+
+func (f *autoRawStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, autoRaw)
+	f.d.Metrics.ActiveStreams.Inc()
+	go func() {
+		defer f.d.Metrics.ActiveStreams.Dec()
+		r := newContextReader(f.d.Ctx, s)
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, passthrough, "AutoDetectStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, passthrough, "AutoDetectStreamFactory")
+		}
+	}()
+	return s
+}
+
+// passthrough returns the bytes of one read as a request.
+func passthrough(r io.Reader) ([]byte, error) {
+	buf := make([]byte, RawMaxBufferSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			return buf[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// NewAutoDetectStreamFactory creates a factory sniffing up to
+// o.AutoDetectPeek bytes, default DefaultAutoDetectPeek, the
+// detected factories are created with o as well.
+func NewAutoDetectStreamFactory(d *deliver.Deliver, o *Options) *AutoDetectStreamFactory {
+	peek := o.AutoDetectPeek
+	if peek <= 0 {
+		peek = DefaultAutoDetectPeek
+	}
+	return &AutoDetectStreamFactory{
+		d:    d,
+		o:    o,
+		peek: peek,
+		factories: map[string]tcpassembly.StreamFactory{
+			autoRaw: &autoRawStreamFactory{d: d},
+		},
+		conns: make(map[connKey]*autoConn),
+	}
+}
+
+// isTDSPrelogin matches a single packet PRELOGIN message of a
+// client, whose option list starts with the VERSION token.
+func isTDSPrelogin(b []byte) bool {
+	if len(b) < TDSHeaderSize+1 || b[0] != TDSPrelogin || b[1] != TDSStatusEOM {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	return length > TDSHeaderSize && b[TDSHeaderSize] == 0x00
+}
@@ -0,0 +1,149 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BeanstalkdMaxBufferSize int = 64 * 1024
+	// far above the default max-job-size of the server, larger
+	// jobs are skipped
+	BeanstalkdMaxJobSize int64 = 16 * 1024 * 1024
+)
+
+// Beanstalkd client commands, true if a data block follows
+var beanstalkdCommands = map[string]bool{
+	"put": true, "use": false, "reserve": false, "reserve-with-timeout": false,
+	"reserve-job": false, "delete": false, "release": false, "bury": false,
+	"touch": false, "watch": false, "ignore": false, "peek": false,
+	"peek-ready": false, "peek-delayed": false, "peek-buried": false,
+	"kick": false, "kick-job": false, "stats-job": false, "stats-tube": false,
+	"stats": false, "list-tubes": false, "list-tube-used": false,
+	"list-tubes-watched": false, "pause-tube": false, "quit": false,
+}
+
+// TCP -> Beanstalkd
+type BeanstalkdStreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoBeanstalkd.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewBeanstalkdStreamFactory(d), nil
+	})
+}
+
+func (f *BeanstalkdStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoBeanstalkd.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), BeanstalkdMaxBufferSize)
+		// commands are lower case, responses like INSERTED or
+		// RESERVED upper case
+		l := s.logger().WithField("factory", "BeanstalkdStreamFactory")
+		if head, _ := r.Peek(1); len(head) > 0 && head[0] >= 'A' && head[0] <= 'Z' {
+			l.Debug("not a client stream, skip it")
+			drain(r)
+			return
+		}
+		c := &beanstalkdConn{r: r, l: l}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "BeanstalkdStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "BeanstalkdStreamFactory")
+		}
+	})
+	return s
+}
+
+// beanstalkdConn is the client side of a connection.
+type beanstalkdConn struct {
+	r *bufio.Reader
+	l *log.Entry
+}
+
+// https://github.com/beanstalkd/beanstalkd/blob/master/doc/protocol.txt
+/*
+	put <pri> <delay> <ttr> <bytes>\r\n<data>\r\n
+	reserve\r\n
+	delete <id>\r\n
+*/
+// parse returns a command line, with its data block for put,
+// the byte count drives how many bytes are read. Pipelined
+// commands are returned one by one, unknown lines are skipped.
+// The r argument is the same reader as c.r.
+func (c *beanstalkdConn) parse(r io.Reader) ([]byte, error) {
+	for {
+		line, err := readLine(c.r)
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		verb := string(fields[0])
+		data, ok := beanstalkdCommands[verb]
+		if !ok {
+			c.l.WithField("line", string(line)).Debug("skip line")
+			continue
+		}
+		if !data {
+			c.l.WithField("command", verb).Debug("got a command")
+			return line, nil
+		}
+		if len(fields) != 5 {
+			c.l.WithFields(log.Fields{"command": verb, "line": string(line)}).Debug("command not valid")
+			continue
+		}
+		size, err := strconv.ParseInt(string(fields[4]), 10, 64)
+		if err != nil || size < 0 {
+			c.l.WithFields(log.Fields{"command": verb, "size": string(fields[4])}).Debug("size not valid")
+			continue
+		}
+		// the data is followed by CRLF
+		size += 2
+		if size > BeanstalkdMaxJobSize {
+			c.l.WithFields(log.Fields{"command": verb, "size": size}).Debugf("skip data larger than %d", BeanstalkdMaxJobSize)
+			if _, err := io.CopyN(ioutil.Discard, c.r, size); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			continue
+		}
+		cmd := make([]byte, len(line)+int(size))
+		copy(cmd, line)
+		if _, err := io.ReadFull(c.r, cmd[len(line):]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		c.l.WithFields(log.Fields{"command": verb, "len": len(cmd)}).Debug("got a command")
+		return cmd, nil
+	}
+}
+
+func NewBeanstalkdStreamFactory(d *deliver.Deliver) *BeanstalkdStreamFactory {
+	return &BeanstalkdStreamFactory{
+		d: d,
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CQLHeaderSize int = 9
+	// same as the server native_transport_max_frame_size default
+	CQLMaxFrameSize int = 256 * 1024 * 1024
+)
+
+// CQL opcodes of requests
+const (
+	CQLStartup      byte = 0x01
+	CQLOptions      byte = 0x05
+	CQLQuery        byte = 0x07
+	CQLPrepare      byte = 0x09
+	CQLExecute      byte = 0x0A
+	CQLRegister     byte = 0x0B
+	CQLBatch        byte = 0x0D
+	CQLAuthResponse byte = 0x0F
+	cqlMaxOpcode    byte = 0x10
+)
+
+const (
+	cqlResponse    byte = 0x80
+	cqlCompression byte = 0x01
+)
+
+// TCP -> Cassandra CQL native protocol v3 and v4
+type CQLStreamFactory struct {
+	d *deliver.Deliver
+	// only forward requests of these opcodes, all if empty
+	opcodes map[byte]bool
+	// connections seen in both directions share the state
+	mu    sync.Mutex
+	conns map[connKey]*cqlConn
+	streams
+}
+
+func init() {
+	Register(ProtoCQL.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewCQLStreamFactory(d, o.CQLOpcodes), nil
+	})
+}
+
+// cqlConn matches responses to requests of one connection
+// by stream id, the version byte tells the direction.
+type cqlConn struct {
+	mu      sync.Mutex
+	streams int
+	// opcodes of requests waiting for a response
+	pending map[int16]byte
+}
+
+// request records a request seen on the stream of l.
+func (c *cqlConn) request(l *log.Entry, id int16, opcode byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if op, ok := c.pending[id]; ok {
+		l.WithFields(log.Fields{"stream_id": id, "opcode": op}).Debug("stream id reused before the response")
+	}
+	c.pending[id] = opcode
+}
+
+// response matches a response seen on the stream of l.
+func (c *cqlConn) response(l *log.Entry, id int16, opcode byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id < 0 {
+		// server pushed events
+		return
+	}
+	op, ok := c.pending[id]
+	if !ok {
+		l.WithField("stream_id", id).Debug("response of unknown stream id")
+		return
+	}
+	delete(c.pending, id)
+	l.WithFields(log.Fields{"stream_id": id, "opcode": opcode, "request_opcode": op}).Debug("got a response")
+}
+
+func (f *CQLStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoCQL.String())
+	key := newConnKey(l, r)
+	f.start(f.d, s, func() {
+		c := f.acquireConn(key)
+		defer f.releaseConn(key)
+		parse := f.cqlParser(c, s.logger().WithField("factory", "CQLStreamFactory"))
+		rd := newContextReader(f.d.Ctx, s)
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, rd, parse, "CQLStreamFactory")
+		} else {
+			handleRequests(f.d, s, rd, parse, "CQLStreamFactory")
+		}
+	})
+	return s
+}
+
+func (f *CQLStreamFactory) acquireConn(key connKey) *cqlConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.conns[key]
+	if !ok {
+		c = &cqlConn{pending: make(map[int16]byte)}
+		f.conns[key] = c
+	}
+	c.streams++
+	return c
+}
+
+func (f *CQLStreamFactory) releaseConn(key connKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.conns[key]; c != nil {
+		c.streams--
+		if c.streams == 0 {
+			delete(f.conns, key)
+		}
+	}
+}
+
+// https://github.com/apache/cassandra/blob/trunk/doc/native_protocol_v4.spec
+/*
+Frame, all integers are big endian:
++--------+--------+--------+--------+--------+--------+...+--------+...
+| version| flags  | stream id       | opcode | length              | body
++--------+--------+--------+--------+--------+--------+...+--------+...
+The high bit of version is set for responses, length does not
+count the header.
+*/
+// cqlParser returns the parseFunc of a stream of c logging to
+// l, it returns
+// requests accepted by the opcode filter and skips responses.
+// Requests with a compressed body are skipped as the body can
+// not be checked, the session still works as the compression
+// flag is set per frame. STARTUP and PREPARE should be kept by
+// the filter, servers reject queries before STARTUP and
+// EXECUTE of statements they have not prepared.
+func (f *CQLStreamFactory) cqlParser(c *cqlConn, l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		for {
+			frame, err := readCQLFrame(r, l)
+			if err != nil {
+				return nil, err
+			}
+			flags, opcode := frame[1], frame[4]
+			id := int16(binary.BigEndian.Uint16(frame[2:]))
+			if frame[0]&cqlResponse != 0 {
+				c.response(l, id, opcode)
+				continue
+			}
+			c.request(l, id, opcode)
+			if len(f.opcodes) > 0 && !f.opcodes[opcode] {
+				l.WithField("opcode", opcode).Debug("skip request by filter")
+				continue
+			}
+			if flags&cqlCompression != 0 {
+				l.WithField("opcode", opcode).Debug("skip compressed request")
+				continue
+			}
+			l.WithFields(log.Fields{"len": len(frame), "opcode": opcode, "stream_id": id}).Debug("got a valid request")
+			return frame, nil
+		}
+	}
+}
+
+// readCQLFrame returns a whole frame including its header.
+func readCQLFrame(r io.Reader, l *log.Entry) ([]byte, error) {
+	header := make([]byte, CQLHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		l.WithError(err).Debug("read header failed")
+		return nil, err
+	}
+	version := header[0] &^ cqlResponse
+	if version != 3 && version != 4 {
+		// no magic to resync on, give up the stream
+		return nil, fmt.Errorf("protocol version %d not supported", version)
+	}
+	if header[4] > cqlMaxOpcode {
+		return nil, fmt.Errorf("opcode %#x not valid", header[4])
+	}
+	length := int(int32(binary.BigEndian.Uint32(header[5:])))
+	if length < 0 || length > CQLMaxFrameSize {
+		return nil, fmt.Errorf("frame len %d not valid", length)
+	}
+	frame := make([]byte, CQLHeaderSize+length)
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[CQLHeaderSize:]); err != nil {
+		l.WithError(err).Debug("read body failed")
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+func NewCQLStreamFactory(d *deliver.Deliver, opcodes []byte) *CQLStreamFactory {
+	f := &CQLStreamFactory{
+		d:       d,
+		opcodes: make(map[byte]bool),
+		conns:   make(map[connKey]*cqlConn),
+	}
+	for _, op := range opcodes {
+		f.opcodes[op] = true
+	}
+	return f
+}
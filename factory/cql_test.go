@@ -0,0 +1,81 @@
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// cqlFrame returns a v4 request frame, a response if response
+// is set.
+func cqlFrame(response bool, flags byte, id int16, opcode byte, body string) []byte {
+	frame := []byte{4, flags, 0, 0, opcode, 0, 0, 0, 0}
+	if response {
+		frame[0] |= cqlResponse
+	}
+	binary.BigEndian.PutUint16(frame[2:], uint16(id))
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(body)))
+	return append(frame, body...)
+}
+
+// cqlOpcodes returns the opcodes of the requests parsed from
+// frames by a factory forwarding opcodes.
+func cqlOpcodes(t *testing.T, f *CQLStreamFactory, frames ...[]byte) []byte {
+	t.Helper()
+	parse := f.cqlParser(&cqlConn{pending: make(map[int16]byte)}, testLogger())
+	r := bytes.NewReader(bytes.Join(frames, nil))
+	var ops []byte
+	for {
+		frame, err := parse(r)
+		if err == io.EOF {
+			return ops
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, frame[4])
+	}
+}
+
+func TestCQLOpcodeFilter(t *testing.T) {
+	d := newTestDeliver(t, nil)
+	frames := [][]byte{
+		cqlFrame(false, 0, 0, CQLStartup, "\x00\x00"),
+		cqlFrame(true, 0, 0, 0x02, ""),
+		cqlFrame(false, 0, 1, CQLOptions, ""),
+		cqlFrame(false, 0, 2, CQLPrepare, "select"),
+		cqlFrame(false, 0, 3, CQLExecute, "id"),
+		cqlFrame(false, 0, 4, CQLQuery, "select"),
+	}
+	want := []byte{CQLStartup, CQLPrepare, CQLExecute}
+	if got := cqlOpcodes(t, NewCQLStreamFactory(d, want), frames...); !bytes.Equal(got, want) {
+		t.Fatalf("filter got opcodes %x, want %x", got, want)
+	}
+	// responses are never returned
+	want = []byte{CQLStartup, CQLOptions, CQLPrepare, CQLExecute, CQLQuery}
+	if got := cqlOpcodes(t, NewCQLStreamFactory(d, nil), frames...); !bytes.Equal(got, want) {
+		t.Fatalf("got opcodes %x, want %x", got, want)
+	}
+}
+
+func TestCQLCompressedSkipped(t *testing.T) {
+	d := newTestDeliver(t, nil)
+	compressed := cqlFrame(false, cqlCompression, 1, CQLQuery, "\x00\x00\x00\x10lz4 garbage")
+	plain := cqlFrame(false, 0, 2, CQLQuery, "select")
+	f := NewCQLStreamFactory(d, nil)
+	parse := f.cqlParser(&cqlConn{pending: make(map[int16]byte)}, testLogger())
+	r := bytes.NewReader(bytes.Join([][]byte{compressed, plain}, nil))
+	// the body of the compressed frame is read by its length,
+	// the next frame parses
+	frame, err := parse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, plain) {
+		t.Fatalf("got %q, want the uncompressed frame", frame)
+	}
+	if _, err := parse(r); err != io.EOF {
+		t.Fatalf("got %v after the frames, want EOF", err)
+	}
+}
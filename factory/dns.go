@@ -0,0 +1,145 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const DNSHeaderSize int = 12
+
+// TCP -> DNS
+type DNSTCPStreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoDNS.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewDNSTCPStreamFactory(d), nil
+	})
+}
+
+func (f *DNSTCPStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoDNS.String())
+	f.start(f.d, s, func() {
+		r := newContextReader(f.d.Ctx, s)
+		parse := f.dnsParser(s.logger().WithField("factory", "DNSTCPStreamFactory"))
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "DNSTCPStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "DNSTCPStreamFactory")
+		}
+	})
+	return s
+}
+
+// dnsParser returns the parseFunc of a stream, l logs its flow.
+func (f *DNSTCPStreamFactory) dnsParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseDNSMessage(r, l)
+	}
+}
+
+// https://tools.ietf.org/html/rfc1035#section-4.2.2
+/*
+DNS message over TCP:
++--------+--------+--------+--------+--------+...+--------+
+| length (BE)     | id              | header and body     |
++--------+--------+--------+--------+--------+...+--------+
+The length does not count itself, the 12 bytes header has
+the QR bit set in the third byte for responses.
+*/
+// parseDNSMessage returns a whole query message including the
+// length prefix, responses and malformed messages are skipped.
+func (f *DNSTCPStreamFactory) parseDNSMessage(r io.Reader, l *log.Entry) ([]byte, error) {
+	for {
+		prefix := make([]byte, 2)
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			l.WithError(err).Debug("read length failed")
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(prefix))
+		msg := make([]byte, 2+length)
+		copy(msg, prefix)
+		if _, err := io.ReadFull(r, msg[2:]); err != nil {
+			l.WithError(err).Debug("read message failed")
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if length < DNSHeaderSize {
+			l.WithField("len", length).Debug("message len not valid")
+			continue
+		}
+		if msg[4]&0x80 != 0 {
+			l.Debug("skip response")
+			continue
+		}
+		if log.IsLevelEnabled(log.DebugLevel) {
+			name, qtype, err := parseDNSQuestion(msg[2:])
+			if err != nil {
+				l.WithField("len", length).WithError(err).Debug("got a query, question not valid")
+			} else {
+				l.WithFields(log.Fields{"len": length, "name": name, "type": qtype}).Debug("got a query")
+			}
+		}
+		return msg, nil
+	}
+}
+
+// parseDNSQuestion returns the name and type of the first
+// question of msg, which starts from the header.
+func parseDNSQuestion(msg []byte) (string, uint16, error) {
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", 0, fmt.Errorf("no question")
+	}
+	var labels []string
+	off := DNSHeaderSize
+	for {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("name out of message")
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		// queries do not compress the first name
+		if n&0xc0 != 0 || off+n > len(msg) {
+			return "", 0, fmt.Errorf("label len %d not valid", n)
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+2 > len(msg) {
+		return "", 0, fmt.Errorf("type out of message")
+	}
+	return strings.Join(labels, ".") + ".", binary.BigEndian.Uint16(msg[off:]), nil
+}
+
+func NewDNSTCPStreamFactory(d *deliver.Deliver) *DNSTCPStreamFactory {
+	return &DNSTCPStreamFactory{
+		d: d,
+	}
+}
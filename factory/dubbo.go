@@ -0,0 +1,155 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DubboHeaderSize int = 16
+	// same as the default payload limit of dubbo
+	DubboMaxBodySize int    = 8 * 1024 * 1024
+	DubboMagic       uint16 = 0xdabb
+)
+
+// flag bits of the third header byte, the low bits are the
+// serialization id
+const (
+	DubboFlagRequest byte = 0x80
+	DubboFlagTwoWay  byte = 0x40
+	DubboFlagEvent   byte = 0x20
+)
+
+// TCP -> Dubbo
+type DubboStreamFactory struct {
+	d *deliver.Deliver
+	// forward heartbeat events too
+	heartbeats bool
+	// junk bytes skipped while resyncing on the magic
+	skippedBytes uint64
+	streams
+}
+
+func init() {
+	Register(ProtoDubbo.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewDubboStreamFactory(d, o.DubboHeartbeats), nil
+	})
+}
+
+func (f *DubboStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoDubbo.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		c := &dubboConn{f: f, r: r, l: s.logger().WithField("factory", "DubboStreamFactory")}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "DubboStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "DubboStreamFactory")
+		}
+	})
+	return s
+}
+
+// SkippedBytes returns the number of junk bytes skipped
+// while resyncing on the magic.
+func (f *DubboStreamFactory) SkippedBytes() uint64 {
+	return atomic.LoadUint64(&f.skippedBytes)
+}
+
+// dubboConn is one side of a connection.
+type dubboConn struct {
+	f *DubboStreamFactory
+	r *bufio.Reader
+	l *log.Entry
+}
+
+// https://dubbo.apache.org/en/blog/2018/10/05/introduction-to-the-dubbo-protocol/
+/*
+Header, all integers are big endian:
++--------+--------+--------+--------+--------+...+--------+--------+...+--------+...
+| magic 0xdabb    | flag   | status | request id (8)      | body length (4)     | body
++--------+--------+--------+--------+--------+...+--------+--------+...+--------+...
+flag: 0x80 request, 0x40 two way, 0x20 event, low 5 bits
+serialization id. status is only set in responses.
+*/
+// parse returns a request message, responses of server streams
+// are skipped, and heartbeat events unless heartbeats is set.
+// The r argument is the same reader as c.r.
+func (c *dubboConn) parse(r io.Reader) ([]byte, error) {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		flag := msg[2]
+		id := binary.BigEndian.Uint64(msg[4:])
+		if flag&DubboFlagRequest == 0 {
+			c.l.WithField("request_id", id).Debug("skip response")
+			continue
+		}
+		if flag&DubboFlagEvent != 0 && !c.f.heartbeats {
+			c.l.WithField("request_id", id).Debug("skip event")
+			continue
+		}
+		c.l.WithFields(log.Fields{"len": len(msg), "request_id": id, "two_way": flag&DubboFlagTwoWay != 0}).Debug("got a valid request")
+		return msg, nil
+	}
+}
+
+// readMessage returns a whole message, a header without the
+// magic or with a bad body length makes it resync one byte
+// later.
+func (c *dubboConn) readMessage() ([]byte, error) {
+	skipped := 0
+	for {
+		header, err := c.r.Peek(DubboHeaderSize)
+		if err != nil {
+			if err == io.EOF && skipped > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		length := int(int32(binary.BigEndian.Uint32(header[12:])))
+		if binary.BigEndian.Uint16(header) == DubboMagic && length >= 0 && length <= DubboMaxBodySize {
+			if skipped > 0 {
+				c.l.WithField("skipped", skipped).Debug("resynced on a valid magic")
+				countResync(c.f.d.Metrics, skipped)
+			}
+			msg := make([]byte, DubboHeaderSize+length)
+			if _, err := io.ReadFull(c.r, msg); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			return msg, nil
+		}
+		c.r.Discard(1)
+		skipped++
+		atomic.AddUint64(&c.f.skippedBytes, 1)
+	}
+}
+
+func NewDubboStreamFactory(d *deliver.Deliver, heartbeats bool) *DubboStreamFactory {
+	return &DubboStreamFactory{
+		d:          d,
+		heartbeats: heartbeats,
+	}
+}
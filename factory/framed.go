@@ -0,0 +1,209 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const FramedMaxFrameSize int = 1024 * 1024 * 10
+
+// FrameConfig describes binary protocols shaped like
+// "magic + length-prefix + trailer", the frame is
+//
+// | Magic | ... length field ... | data | Trailer |
+// |<------- HeaderSize --------->|
+//
+// and the whole frame size is length field value + LengthAdjust.
+type FrameConfig struct {
+	// leading bytes used to find a frame start
+	Magic []byte
+	// offset and width(1, 2, 4 or 8) of the length field
+	LengthOffset int
+	LengthSize   int
+	// byte order of the length field, default big endian
+	ByteOrder binary.ByteOrder
+	// bytes before data, including the magic and length field
+	HeaderSize int
+	// added to the length value to get the whole frame size,
+	// e.g. HeaderSize+len(Trailer) if length counts data only
+	LengthAdjust int
+	// optional bytes expected at the end of each frame
+	Trailer []byte
+	// frames larger than this are skipped, default FramedMaxFrameSize
+	MaxFrameSize int
+}
+
+// VideoPacketFrameConfig describes VideoPacket with FrameConfig,
+// it does not check the version byte.
+var VideoPacketFrameConfig = &FrameConfig{
+	Magic:        []byte{0x26},
+	LengthOffset: 1,
+	LengthSize:   4,
+	ByteOrder:    binary.BigEndian,
+	HeaderSize:   16,
+	Trailer:      []byte{0x28},
+}
+
+func (c *FrameConfig) validate() error {
+	if len(c.Magic) == 0 {
+		return fmt.Errorf("frame magic is not set")
+	}
+	switch c.LengthSize {
+	case 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("frame length size %d not valid", c.LengthSize)
+	}
+	if c.LengthOffset < len(c.Magic) || c.LengthOffset+c.LengthSize > c.HeaderSize {
+		return fmt.Errorf("frame length field [%d, %d) not in header after magic",
+			c.LengthOffset, c.LengthOffset+c.LengthSize)
+	}
+	return nil
+}
+
+func (c *FrameConfig) length(header []byte) int64 {
+	field := header[c.LengthOffset : c.LengthOffset+c.LengthSize]
+	switch c.LengthSize {
+	case 1:
+		return int64(field[0])
+	case 2:
+		return int64(c.ByteOrder.Uint16(field))
+	case 4:
+		return int64(c.ByteOrder.Uint32(field))
+	default:
+		return int64(c.ByteOrder.Uint64(field))
+	}
+}
+
+// TCP -> length prefixed frames
+type FramedStreamFactory struct {
+	d *deliver.Deliver
+	c *FrameConfig
+	streams
+}
+
+func init() {
+	Register("framed", func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		if o.Frame == nil {
+			return nil, fmt.Errorf("framed protocol needs a FrameConfig")
+		}
+		f, err := NewFramedStreamFactory(d, o.Frame)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+}
+
+func (f *FramedStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, "framed")
+	f.start(f.d, s, func() {
+		r := newContextReader(f.d.Ctx, s)
+		parse := f.frameParser(s.logger().WithField("factory", "FramedStreamFactory"))
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "FramedStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "FramedStreamFactory")
+		}
+	})
+	return s
+}
+
+// frameParser returns the parseFunc of a stream, l logs its
+// flow.
+func (f *FramedStreamFactory) frameParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseFrame(r, l)
+	}
+}
+
+// parseFrame scans for the magic, then reads the header, data
+// and trailer, any invalid field makes it resync on the magic.
+func (f *FramedStreamFactory) parseFrame(r io.Reader, l *log.Entry) ([]byte, error) {
+	c := f.c
+	for {
+		header := make([]byte, c.HeaderSize)
+		if err := scanMagic(r, c.Magic, header[:len(c.Magic)]); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, header[len(c.Magic):]); err != nil {
+			l.WithError(err).Debug("read header failed")
+			return nil, err
+		}
+		size := c.length(header) + int64(c.LengthAdjust)
+		minSize := int64(c.HeaderSize + len(c.Trailer))
+		if size < minSize || size > int64(c.MaxFrameSize) {
+			l.WithField("size", size).Debug("frame size not valid")
+			continue
+		}
+		frame := make([]byte, size)
+		copy(frame, header)
+		if _, err := io.ReadFull(r, frame[c.HeaderSize:]); err != nil {
+			l.WithError(err).Debug("read data failed")
+			return nil, err
+		}
+		if !bytes.HasSuffix(frame, c.Trailer) {
+			l.WithField("trailer", frame[size-int64(len(c.Trailer)):]).Debug("trailer not valid")
+			continue
+		}
+		l.WithField("len", size).Debug("got a valid frame")
+		return frame, nil
+	}
+}
+
+// scanMagic reads r until magic is found and copies it into buf.
+func scanMagic(r io.Reader, magic []byte, buf []byte) error {
+	b := make([]byte, 1)
+	matched := 0
+	for matched < len(magic) {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		if b[0] == magic[matched] {
+			matched++
+		} else if b[0] == magic[0] {
+			// simple restart, enough for short magics
+			matched = 1
+		} else {
+			matched = 0
+		}
+	}
+	copy(buf, magic)
+	return nil
+}
+
+func NewFramedStreamFactory(d *deliver.Deliver, c *FrameConfig) (*FramedStreamFactory, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	cc := *c
+	if cc.ByteOrder == nil {
+		cc.ByteOrder = binary.BigEndian
+	}
+	if cc.MaxFrameSize <= 0 {
+		cc.MaxFrameSize = FramedMaxFrameSize
+	}
+	return &FramedStreamFactory{
+		d: d,
+		c: &cc,
+	}, nil
+}
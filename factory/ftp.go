@@ -0,0 +1,310 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const FTPMaxBufferSize int = 64 * 1024
+
+// FTP commands, lines starting with anything else are skipped
+var ftpCommands = map[string]bool{
+	"USER": true, "PASS": true, "ACCT": true, "CWD": true, "CDUP": true,
+	"SMNT": true, "QUIT": true, "REIN": true, "PORT": true, "PASV": true,
+	"TYPE": true, "STRU": true, "MODE": true, "RETR": true, "STOR": true,
+	"STOU": true, "APPE": true, "ALLO": true, "REST": true, "RNFR": true,
+	"RNTO": true, "ABOR": true, "DELE": true, "RMD": true, "MKD": true,
+	"PWD": true, "LIST": true, "NLST": true, "SITE": true, "SYST": true,
+	"STAT": true, "HELP": true, "NOOP": true, "FEAT": true, "OPTS": true,
+	"AUTH": true, "PBSZ": true, "PROT": true, "CCC": true, "EPRT": true,
+	"EPSV": true, "MDTM": true, "SIZE": true, "MLSD": true, "MLST": true,
+	"LANG": true, "HOST": true, "XCWD": true, "XMKD": true, "XPWD": true,
+	"XRMD": true,
+}
+
+// TCP -> FTP control connections, data connections are not
+// replayed, their addresses negotiated by PORT, EPRT, PASV and
+// EPSV are tracked by DataChannels
+type FTPStreamFactory struct {
+	d *deliver.Deliver
+	// connections seen in both directions share the state
+	mu    sync.Mutex
+	conns map[connKey]*ftpConn
+	streams
+}
+
+func init() {
+	Register(ProtoFTP.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewFTPStreamFactory(d), nil
+	})
+}
+
+// ftpConn is the state of one control connection.
+type ftpConn struct {
+	mu      sync.Mutex
+	streams int
+	// latest data channel address, "" if none
+	data string
+}
+
+// setData notes a data channel negotiated on the stream of l.
+func (c *ftpConn) setData(l *log.Entry, addr, by string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = addr
+	l.WithFields(log.Fields{"addr": addr, "via": by}).Debug("data channel negotiated")
+}
+
+func (f *FTPStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoFTP.String())
+	key := newConnKey(l, r)
+	f.start(f.d, s, func() {
+		c := f.acquireConn(key)
+		defer f.releaseConn(key)
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), FTPMaxBufferSize)
+		lg := s.logger().WithField("factory", "FTPStreamFactory")
+		// replies start with a 3 digit code, commands with letters
+		if head, _ := r.Peek(3); isFTPCode(head) {
+			src, _ := l.Endpoints()
+			f.handleReplies(r, c, src.String(), lg)
+			return
+		}
+		cc := &ftpClientConn{r: r, c: c, l: lg}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, cc.parse, "FTPStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, cc.parse, "FTPStreamFactory")
+		}
+	})
+	return s
+}
+
+// DataChannels returns the latest data channel addresses of
+// the live control connections, e.g. to capture them as well.
+func (f *FTPStreamFactory) DataChannels() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var addrs []string
+	for _, c := range f.conns {
+		c.mu.Lock()
+		if c.data != "" {
+			addrs = append(addrs, c.data)
+		}
+		c.mu.Unlock()
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (f *FTPStreamFactory) acquireConn(key connKey) *ftpConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.conns[key]
+	if !ok {
+		c = &ftpConn{}
+		f.conns[key] = c
+	}
+	c.streams++
+	return c
+}
+
+func (f *FTPStreamFactory) releaseConn(key connKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.conns[key]; c != nil {
+		c.streams--
+		if c.streams == 0 {
+			delete(f.conns, key)
+		}
+	}
+}
+
+// handleReplies reads the replies of the server stream for
+// passive mode data channels of server, the rest is skipped.
+// l logs the flow of the stream.
+func (f *FTPStreamFactory) handleReplies(r *bufio.Reader, c *ftpConn, server string, l *log.Entry) {
+	for {
+		reply, err := ReadFTPReply(r)
+		if err != nil {
+			l.WithError(err).Debug("read reply failed")
+			drain(r)
+			return
+		}
+		switch string(reply[:3]) {
+		case "227":
+			if addr, ok := parseFTPHostPort(reply[4:]); ok {
+				c.setData(l, addr, "PASV")
+			}
+		case "229":
+			// (|||port|), the host is the server
+			if _, port, ok := parseFTPExtended(reply[4:]); ok {
+				c.setData(l, net.JoinHostPort(server, port), "EPSV")
+			}
+		}
+	}
+}
+
+// ftpClientConn is the client side of a connection.
+type ftpClientConn struct {
+	r *bufio.Reader
+	c *ftpConn
+	l *log.Entry
+}
+
+// https://tools.ietf.org/html/rfc959
+// https://tools.ietf.org/html/rfc2428
+// parse returns a command line, pipelined commands are returned
+// one by one. Active mode data channels of PORT and EPRT are
+// noted. The r argument is the same reader as c.r.
+func (c *ftpClientConn) parse(r io.Reader) ([]byte, error) {
+	for {
+		line, err := readLine(c.r)
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		verb := string(bytes.ToUpper(fields[0]))
+		if !ftpCommands[verb] {
+			c.l.WithField("line", string(line)).Debug("skip line")
+			continue
+		}
+		if len(fields) > 1 {
+			switch verb {
+			case "PORT":
+				if addr, ok := parseFTPHostPort(fields[1]); ok {
+					c.c.setData(c.l, addr, verb)
+				}
+			case "EPRT":
+				if host, port, ok := parseFTPExtended(fields[1]); ok && host != "" {
+					c.c.setData(c.l, net.JoinHostPort(host, port), verb)
+				}
+			}
+		}
+		c.l.WithField("command", verb).Debug("got a command")
+		return line, nil
+	}
+}
+
+func isFTPCode(b []byte) bool {
+	if len(b) < 3 {
+		return false
+	}
+	for _, c := range b[:3] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadFTPReply is a deliver.ResponseReader for FTP, it reads a
+// whole reply including the lines of a multi-line one, which
+// starts with "xyz-" and ends with a "xyz " line of the same
+// code.
+func ReadFTPReply(r *bufio.Reader) ([]byte, error) {
+	first, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(first) < 4 || !isFTPCode(first) {
+		return nil, fmt.Errorf("reply %q not valid", first)
+	}
+	if first[3] != '-' {
+		return first, nil
+	}
+	reply := first
+	end := append(append([]byte{}, first[:3]...), ' ')
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		reply = append(reply, line...)
+		if bytes.HasPrefix(line, end) {
+			return reply, nil
+		}
+	}
+}
+
+// parseFTPHostPort finds h1,h2,h3,h4,p1,p2 of PORT or a 227
+// reply in b, some servers do not put it in parentheses.
+func parseFTPHostPort(b []byte) (string, bool) {
+	start := bytes.IndexAny(b, "0123456789")
+	if start < 0 {
+		return "", false
+	}
+	end := start
+	for end < len(b) && (b[end] == ',' || b[end] >= '0' && b[end] <= '9') {
+		end++
+	}
+	parts := bytes.Split(b[start:end], []byte(","))
+	if len(parts) != 6 {
+		return "", false
+	}
+	var v [6]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(string(p))
+		if err != nil || n > 255 {
+			return "", false
+		}
+		v[i] = n
+	}
+	host := fmt.Sprintf("%d.%d.%d.%d", v[0], v[1], v[2], v[3])
+	return net.JoinHostPort(host, strconv.Itoa(v[4]<<8|v[5])), true
+}
+
+// parseFTPExtended finds <d>proto<d>host<d>port<d> of EPRT or a
+// 229 reply in b, host is empty for 229.
+func parseFTPExtended(b []byte) (string, string, bool) {
+	if i := bytes.IndexByte(b, '('); i >= 0 {
+		b = b[i+1:]
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) < 4 {
+		return "", "", false
+	}
+	parts := bytes.Split(b, b[:1])
+	// empty, proto, host, port, rest
+	if len(parts) < 5 {
+		return "", "", false
+	}
+	port := string(parts[3])
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", false
+	}
+	return string(parts[2]), port, true
+}
+
+func NewFTPStreamFactory(d *deliver.Deliver) *FTPStreamFactory {
+	return &FTPStreamFactory{
+		d:     d,
+		conns: make(map[connKey]*ftpConn),
+	}
+}
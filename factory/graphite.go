@@ -0,0 +1,154 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+const (
+	// longer lines are skipped up to their newline
+	GraphiteMaxLineSize int = 4096
+	GraphiteBufferSize  int = 64 * 1024
+)
+
+// TCP -> Graphite plaintext metric lines
+type GraphiteStreamFactory struct {
+	d *deliver.Deliver
+	// max metric lines grouped into one request
+	batch int
+	streams
+}
+
+func init() {
+	Register(ProtoGraphite.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewGraphiteStreamFactory(d, o.GraphiteBatch), nil
+	})
+}
+
+func (f *GraphiteStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoGraphite.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), GraphiteBufferSize)
+		c := &graphiteConn{
+			lines: &lineConn{
+				c: &LineConfig{Delimiter: []byte("\n"), MaxLineSize: GraphiteMaxLineSize},
+				r: r,
+				m: f.d.Metrics,
+				l: s.logger().WithField("factory", "GraphiteStreamFactory"),
+			},
+			batch: f.batch,
+		}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "GraphiteStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "GraphiteStreamFactory")
+		}
+	})
+	return s
+}
+
+// graphiteConn is the client side of a connection.
+type graphiteConn struct {
+	lines *lineConn
+	batch int
+}
+
+// https://graphite.readthedocs.io/en/latest/feeding-carbon.html
+// A metric is one line "<path> <value> <timestamp>\n".
+// parse returns up to batch valid lines, a batch is cut short
+// when no more lines are buffered so that slow senders are not
+// delayed. Malformed lines are dropped and counted.
+func (c *graphiteConn) parse(io.Reader) ([]byte, error) {
+	var req []byte
+	for n := 0; n < c.batch; {
+		line, err := c.lines.readLine()
+		if err != nil {
+			if len(req) > 0 {
+				// the error is returned by the next parse
+				break
+			}
+			return nil, err
+		}
+		if !validGraphiteLine(line) {
+			if !c.lines.blank(line) {
+				c.lines.l.WithField("line", string(line)).Debug("line not valid, skip it")
+				c.lines.m.Malformed.With(ProtoGraphite.String()).Inc()
+			}
+			continue
+		}
+		req = append(req, line...)
+		n++
+		if c.lines.r.Buffered() == 0 {
+			break
+		}
+	}
+	c.lines.l.WithField("len", len(req)).Debug("got valid lines")
+	return req, nil
+}
+
+// validGraphiteLine reports whether line has three fields split
+// by spaces or tabs, the value and timestamp being numbers. A
+// timestamp of -1 means now to carbon.
+func validGraphiteLine(line []byte) bool {
+	var fields [3][]byte
+	n := 0
+	for i := 0; i < len(line); {
+		if graphiteSpace(line[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(line) && !graphiteSpace(line[j]) {
+			j++
+		}
+		if n == len(fields) {
+			return false
+		}
+		fields[n] = line[i:j]
+		n++
+		i = j
+	}
+	if n != len(fields) {
+		return false
+	}
+	for _, number := range fields[1:] {
+		if _, err := strconv.ParseFloat(string(number), 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func graphiteSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// NewGraphiteStreamFactory creates a factory grouping up to
+// batch metric lines into one request, 1 if batch <= 0.
+func NewGraphiteStreamFactory(d *deliver.Deliver, batch int) *GraphiteStreamFactory {
+	if batch <= 0 {
+		batch = 1
+	}
+	return &GraphiteStreamFactory{
+		d:     d,
+		batch: batch,
+	}
+}
@@ -14,62 +14,171 @@
 package factory
 
 import (
-	"context"
+	"bufio"
+	"encoding/binary"
+	"fmt"
 	"io"
-	"sync/atomic"
+	"strings"
 
 	"github.com/feilengcui008/tcplayer/deliver"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 	log "github.com/sirupsen/logrus"
 )
 
-const GrpcMaxBufferSize int = 4096
+const (
+	GrpcMaxBufferSize int = deliver.BufferSize
+	// compressed flag and big endian length of a message
+	GrpcMessagePrefixSize int = 5
+)
 
 // TCP -> GRPC
-var grpcStreamCount uint64
-
 type GrpcStreamFactory struct {
 	d *deliver.Deliver
+	// method paths replayed, all if empty
+	methods []string
+	streams
+}
+
+func init() {
+	Register(ProtoGRPC.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewGrpcStreamFactory(d, o.GRPCMethods), nil
+	})
 }
 
 func (f *GrpcStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
-	s := tcpreader.NewReaderStream()
-	n := atomic.AddUint64(&grpcStreamCount, 1)
-	log.Debugf("stream count %d", n)
-	go f.handleGRPCStream(&s)
-	return &s
+	s := newStream(l, r, ProtoGRPC.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		// calls are carried by HTTP/2, whose header blocks can
+		// only be decoded from the start of a connection
+		if head, _ := r.Peek(len(HTTP2ClientPreface)); string(head) != HTTP2ClientPreface {
+			s.logger().WithField("factory", "GrpcStreamFactory").Debug("no client preface, skip stream")
+			drain(r)
+			return
+		}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, readHTTP2Preface, "GrpcStreamFactory")
+		} else {
+			f.handleCalls(s, r)
+		}
+	})
+	return s
 }
 
-// Since grpc is based on http2 which formed by frames,
-// the protocol fields for frame are variable, so we
-// can't recognize the frame and dig out the requests
-// content, so here we just reverse proxy whole tcp
-// packets to remote, but this require we capture the
-// whole tcp establishing process. Maybe try directly
-// recognize grpc binary content later?
-func (f *GrpcStreamFactory) handleGRPCStream(r io.Reader) {
-	ctx, cancel := context.WithCancel(f.d.Ctx)
-	defer cancel()
-	sender, err := deliver.NewLongConnSender(ctx, f.d.Config.Clone+1, f.d.Config.RemoteAddr)
-	if err != nil {
-		log.Errorf("GrpcStreamFactory create serder failed: %v", err)
+// handleCalls sends each call of a connection as one request
+// with its method path, like handleRequests.
+func (f *GrpcStreamFactory) handleCalls(s *stream, r io.Reader) {
+	if !s.sampled(f.d, r) {
 		return
 	}
+	defer drain(r)
+	l := s.logger().WithField("factory", "GrpcStreamFactory")
+	c := newHTTP2Conn(l)
 	for {
-		buf := make([]byte, GrpcMaxBufferSize)
-		if _, err := io.ReadFull(r, buf); err != nil {
-			log.Errorf("Grpc read full failed: %v", err)
+		method, m, err := f.nextCall(c, r)
+		if err != nil {
+			l.WithError(err).Error("did not find a valid req")
+			countParseError(f.d, s, err)
 			return
 		}
-		sender.Data() <- buf
+		data := m.encode()
+		l.WithFields(log.Fields{"len": len(data), "method": method}).Debug("got a valid req")
+		f.d.Metrics.ObserveRequest(s.proto, len(data), s.Seen())
+		if s.skipFirst(f.d) {
+			l.Debug("skip one of the first requests")
+			continue
+		}
+		if !f.d.SampleRequest() {
+			continue
+		}
+		req := s.request(data)
+		req.Method = method
+		if err := f.d.Enqueue(f.d.Ctx, req); err != nil {
+			return
+		}
+	}
+}
+
+/*
+A call is an HTTP/2 request of content type application/grpc,
+its :path is /package.Service/Method and its data is a sequence
+of messages:
++--------+--------+--------+--------+--------+...+--------+
+| flag   | length                            | message    |
++--------+--------+--------+--------+--------+...+--------+
+Flag 1 means the message is compressed. A unary call has one
+message, a client streaming call is replayed as one request
+with all of its messages. A stream reset by the client cancels
+its call, which is dropped.
+*/
+// nextCall reads requests until a call of an allowed method is
+// complete, other HTTP/2 requests are skipped. They are logged
+// to the logger of c.
+func (f *GrpcStreamFactory) nextCall(c *http2Conn, r io.Reader) (string, *http2Message, error) {
+	for {
+		m, err := c.next(r)
+		if err != nil {
+			return "", nil, err
+		}
+		method := m.header(":path")
+		if !strings.HasPrefix(m.header("content-type"), "application/grpc") {
+			c.l.WithField("method", method).Debug("skip non grpc request")
+			continue
+		}
+		n, err := grpcMessages(m.data.Bytes())
+		if err != nil {
+			c.l.WithField("method", method).WithError(err).Debug("skip call")
+			continue
+		}
+		if !f.allowed(method) {
+			c.l.WithField("method", method).Debug("skip call not allowed")
+			continue
+		}
+		c.l.WithFields(log.Fields{"method": method, "messages": n}).Debug("got a valid call")
+		return method, m, nil
 	}
+}
 
+func (f *GrpcStreamFactory) allowed(method string) bool {
+	if len(f.methods) == 0 {
+		return true
+	}
+	for _, m := range f.methods {
+		if method == m || strings.HasSuffix(m, "/") && strings.HasPrefix(method, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcMessages returns the number of length prefixed messages
+// of data, which must hold whole messages only.
+func grpcMessages(data []byte) (int, error) {
+	n := 0
+	for len(data) > 0 {
+		if len(data) < GrpcMessagePrefixSize {
+			return 0, fmt.Errorf("message prefix truncated")
+		}
+		if data[0] > 1 {
+			return 0, fmt.Errorf("compressed flag %d not valid", data[0])
+		}
+		length := binary.BigEndian.Uint32(data[1:])
+		if uint64(length) > uint64(len(data)-GrpcMessagePrefixSize) {
+			return 0, fmt.Errorf("message of %d bytes truncated", length)
+		}
+		data = data[GrpcMessagePrefixSize+int(length):]
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no message")
+	}
+	return n, nil
 }
 
-func NewGrpcStreamFactory(d *deliver.Deliver) *GrpcStreamFactory {
+func NewGrpcStreamFactory(d *deliver.Deliver, methods []string) *GrpcStreamFactory {
 	return &GrpcStreamFactory{
-		d: d,
+		d:       d,
+		methods: methods,
 	}
 }
@@ -15,54 +15,329 @@ package factory
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
-	"sync/atomic"
+	"strings"
+	"sync"
 
 	"github.com/feilengcui008/tcplayer/deliver"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 	log "github.com/sirupsen/logrus"
 )
 
 // TCP -> HTTP 1.x
-var httpStreamCount uint64
-
 type HTTPStreamFactory struct {
 	d *deliver.Deliver
+	// rewrite Host header to the remote address, so that
+	// replayed requests route correctly to the target
+	rewriteHost bool
+	// nil replays all requests
+	filter *HTTPFilter
+	// connections paired in diff mode
+	mu    sync.Mutex
+	conns map[connKey]*httpConn
+	streams
+}
+
+func init() {
+	Register(ProtoHTTP.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		// the Host is set when parsing, before a target is picked
+		if o.RewriteHost && (len(d.Config.RemoteAddrs) > 1 || len(d.Config.Pipelines) > 0) {
+			return nil, fmt.Errorf("rewrite host needs a single target and no pipelines")
+		}
+		filter := NewHTTPFilter(o.HTTPMethodAllow, o.HTTPPathPrefix, o.HTTPHeaderMatch)
+		return NewHTTPStreamFactory(d, o.RewriteHost, filter), nil
+	})
+}
+
+// HTTPFilter selects requests to replay, e.g. only reads during
+// a read only load test. A request must match every non empty
+// condition.
+type HTTPFilter struct {
+	// upper case methods
+	Methods map[string]bool
+	// the path must have one of the prefixes
+	PathPrefixes []string
+	// header values by canonical name, an empty value only
+	// needs the header to be present
+	Headers map[string]string
+}
+
+// Match reports whether req is replayed, a nil filter matches
+// all requests.
+func (f *HTTPFilter) Match(req *http.Request) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Methods) > 0 && !f.Methods[req.Method] {
+		return false
+	}
+	if len(f.PathPrefixes) > 0 {
+		matched := false
+		for _, prefix := range f.PathPrefixes {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for name, value := range f.Headers {
+		values, ok := req.Header[name]
+		if !ok {
+			return false
+		}
+		if value != "" && !containsString(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHTTPFilter returns nil if all conditions are empty.
+func NewHTTPFilter(methods, pathPrefixes []string, headers map[string]string) *HTTPFilter {
+	if len(methods) == 0 && len(pathPrefixes) == 0 && len(headers) == 0 {
+		return nil
+	}
+	f := &HTTPFilter{
+		Methods:      make(map[string]bool),
+		PathPrefixes: pathPrefixes,
+		Headers:      make(map[string]string),
+	}
+	for _, m := range methods {
+		f.Methods[strings.ToUpper(m)] = true
+	}
+	for name, value := range headers {
+		f.Headers[http.CanonicalHeaderKey(name)] = value
+	}
+	return f
+}
+
+// httpConn pairs requests and captured responses of one
+// connection in order, either side may be parsed first.
+type httpConn struct {
+	mu        sync.Mutex
+	streams   int
+	exchanges []*deliver.Exchange
+	responses [][]byte
+}
+
+func (c *httpConn) addExchange(e *deliver.Exchange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.responses) > 0 {
+		e.SetCaptured(c.responses[0])
+		c.responses = c.responses[1:]
+		return
+	}
+	c.exchanges = append(c.exchanges, e)
+}
+
+func (c *httpConn) addResponse(resp []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.exchanges) > 0 {
+		c.exchanges[0].SetCaptured(resp)
+		c.exchanges = c.exchanges[1:]
+		return
+	}
+	c.responses = append(c.responses, resp)
 }
 
 func (f *HTTPStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
-	s := tcpreader.NewReaderStream()
-	httpStreamCount++
-	n := atomic.AddUint64(&httpStreamCount, 1)
-	log.Debugf("stream count %d", n)
-	go f.handleHTTPRequest(&s)
-	return &s
+	s := newStream(l, r, ProtoHTTP.String())
+	key := newConnKey(l, r)
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		// both directions of a connection are sampled alike
+		if !s.sampled(f.d, r) {
+			return
+		}
+		l := s.logger().WithField("factory", "HTTPStreamFactory")
+		// server to client streams carry responses
+		if head, _ := r.Peek(5); string(head) == "HTTP/" {
+			if f.d.Differ == nil {
+				drain(r)
+				return
+			}
+			c := f.acquireConn(key)
+			defer f.releaseConn(key)
+			f.handleHTTPResponses(r, c, l)
+			return
+		}
+		if f.d.Differ == nil {
+			handleRequests(f.d, s, r, f.httpParser(l), "HTTPStreamFactory")
+			return
+		}
+		c := f.acquireConn(key)
+		defer f.releaseConn(key)
+		f.handleHTTPDiffRequests(s, r, c, l)
+	})
+	return s
+}
+
+func (f *HTTPStreamFactory) acquireConn(key connKey) *httpConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.conns[key]
+	if !ok {
+		c = &httpConn{}
+		f.conns[key] = c
+	}
+	c.streams++
+	return c
+}
+
+func (f *HTTPStreamFactory) releaseConn(key connKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.conns[key]; c != nil {
+		c.streams--
+		if c.streams == 0 {
+			delete(f.conns, key)
+		}
+	}
+}
+
+// handleHTTPDiffRequests attaches an Exchange to each request,
+// the captured response is set by the reverse stream. l logs
+// the flow of s.
+func (f *HTTPStreamFactory) handleHTTPDiffRequests(s *stream, r io.Reader, c *httpConn, l *log.Entry) {
+	defer drain(r)
+	for {
+		req, ok, err := f.readHTTPRequest(r, l)
+		if err != nil {
+			l.WithError(err).Error("did not find a valid req")
+			countParseError(f.d, s, err)
+			return
+		}
+		if !ok {
+			// the response of a filtered request is skipped
+			c.addExchange(deliver.NewExchange())
+			continue
+		}
+		f.d.Metrics.ObserveRequest(s.proto, len(req), s.Seen())
+		if s.skipFirst(f.d) || !f.d.SampleRequest() {
+			// keep responses paired with requests
+			c.addExchange(deliver.NewExchange())
+			continue
+		}
+		e := deliver.NewExchange()
+		c.addExchange(e)
+		dr := s.request(req)
+		dr.Exchange = e
+		if err := f.d.Enqueue(f.d.Ctx, dr); err != nil {
+			return
+		}
+	}
+}
+
+func (f *HTTPStreamFactory) handleHTTPResponses(r *bufio.Reader, c *httpConn, l *log.Entry) {
+	defer drain(r)
+	for {
+		resp, err := ReadHTTPResponse(r)
+		if err != nil {
+			l.WithError(err).Debug("read captured response failed")
+			return
+		}
+		c.addResponse(resp)
+	}
+}
+
+// ReadHTTPResponse is a deliver.ResponseReader for HTTP 1.x,
+// the Date header is dropped since it always differs.
+func ReadHTTPResponse(r *bufio.Reader) ([]byte, error) {
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Del("Date")
+	return httputil.DumpResponse(resp, true)
 }
 
 // Usually for http 1.x, one request consumes one short
-// connection, there is no need for the loop of  parsing
-// the protocol, if read error happens, we just drop this
-// connection.
-func (f *HTTPStreamFactory) handleHTTPRequest(r io.Reader) {
+// connection, but keep-alive and pipelined connections
+// carry several requests, so we keep parsing until EOF.
+// The body is read according to Content-Length or chunked
+// encoding, and the request is re-serialized by DumpRequest,
+// chunked bodies are kept chunked. Requests dropped by the
+// filter are skipped.
+func (f *HTTPStreamFactory) parseHTTPRequest(r io.Reader, l *log.Entry) ([]byte, error) {
+	for {
+		data, ok, err := f.readHTTPRequest(r, l)
+		if err != nil || ok {
+			return data, err
+		}
+	}
+}
+
+// httpParser returns the parseFunc of a stream, l logs its flow.
+func (f *HTTPStreamFactory) httpParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseHTTPRequest(r, l)
+	}
+}
+
+// readHTTPRequest returns the next request and whether it
+// passes the filter, the data is nil if it does not.
+func (f *HTTPStreamFactory) readHTTPRequest(r io.Reader, l *log.Entry) ([]byte, bool, error) {
 	buf := bufio.NewReader(r)
 	for {
-		if req, err := http.ReadRequest(buf); err == io.EOF {
-			return
+		req, err := http.ReadRequest(buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, false, err
 		} else if err != nil {
-			log.Errorf("parsing http request error: %v", err)
-		} else {
-			data, _ := httputil.DumpRequest(req, true)
-			f.d.C <- data
+			if f.d.Ctx.Err() != nil {
+				return nil, false, err
+			}
+			// malformed lines are consumed, try the following
+			l.WithError(err).Error("parse http request failed")
+			continue
+		}
+		if !f.filter.Match(req) {
+			// the body must be consumed to reach the next request
+			if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+				return nil, false, unexpectedEOF(err)
+			}
+			l.WithFields(log.Fields{"method": req.Method, "url": req.URL}).Debug("skip request by filter")
+			return nil, false, nil
+		}
+		if f.rewriteHost {
+			req.Host = f.d.Config.RemoteAddr
+		}
+		data, err := httputil.DumpRequest(req, true)
+		if err != nil {
+			l.WithError(err).Error("dump http request failed")
+			if err == io.ErrUnexpectedEOF {
+				return nil, false, err
+			}
+			continue
 		}
+		l.WithFields(log.Fields{"method": req.Method, "url": req.URL, "len": len(data)}).Debug("got a request")
+		return data, true, nil
 	}
 }
 
-func NewHTTPStreamFactory(d *deliver.Deliver) *HTTPStreamFactory {
+func NewHTTPStreamFactory(d *deliver.Deliver, rewriteHost bool, filter *HTTPFilter) *HTTPStreamFactory {
 	return &HTTPStreamFactory{
-		d: d,
+		d:           d,
+		rewriteHost: rewriteHost,
+		filter:      filter,
+		conns:       make(map[connKey]*httpConn),
 	}
 }
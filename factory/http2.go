@@ -0,0 +1,408 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	HTTP2ClientPreface   string = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	HTTP2FrameHeaderSize int    = 9
+	// default SETTINGS_MAX_FRAME_SIZE, larger frames are sent
+	// only if the peer allows them
+	HTTP2MaxFrameSize int = 16384
+	// default initial window size, a replayed message can not
+	// send more data before the target's WINDOW_UPDATE
+	HTTP2MaxDataSize int = 65535
+	// default SETTINGS_HEADER_TABLE_SIZE
+	HTTP2HeaderTableSize uint32 = 4096
+)
+
+// HTTP/2 frame types
+const (
+	http2FrameData         byte = 0x0
+	http2FrameHeaders      byte = 0x1
+	http2FrameRSTStream    byte = 0x3
+	http2FrameSettings     byte = 0x4
+	http2FramePushPromise  byte = 0x5
+	http2FrameGoAway       byte = 0x7
+	http2FrameContinuation byte = 0x9
+)
+
+// HTTP/2 frame flags
+const (
+	http2FlagEndStream  byte = 0x1
+	http2FlagEndHeaders byte = 0x4
+	http2FlagPadded     byte = 0x8
+	http2FlagPriority   byte = 0x20
+)
+
+// TCP -> HTTP/2
+type HTTP2StreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoHTTP2.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewHTTP2StreamFactory(d), nil
+	})
+}
+
+func (f *HTTP2StreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoHTTP2.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		l := s.logger().WithField("factory", "HTTP2StreamFactory")
+		// header blocks can only be decoded from the start of a
+		// connection, the server side has no preface either
+		if head, _ := r.Peek(len(HTTP2ClientPreface)); string(head) != HTTP2ClientPreface {
+			l.Debug("no client preface, skip stream")
+			drain(r)
+			return
+		}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			// the whole connection is relayed, the target sees
+			// the same frames and header compression state
+			relayRaw(f.d, s, r, readHTTP2Preface, "HTTP2StreamFactory")
+		} else {
+			handleRequests(f.d, s, r, newHTTP2Conn(l).parse, "HTTP2StreamFactory")
+		}
+	})
+	return s
+}
+
+func readHTTP2Preface(r io.Reader) ([]byte, error) {
+	preface := make([]byte, len(HTTP2ClientPreface))
+	if _, err := io.ReadFull(r, preface); err != nil {
+		return nil, err
+	}
+	if string(preface) != HTTP2ClientPreface {
+		return nil, fmt.Errorf("client preface %q not valid", preface)
+	}
+	return preface, nil
+}
+
+// http2Message is a request being reassembled from the frames
+// of one stream.
+type http2Message struct {
+	headers  []hpack.HeaderField
+	trailers []hpack.HeaderField
+	data     bytes.Buffer
+	// header block fragments until END_HEADERS
+	block     []byte
+	endStream bool
+	// data larger than HTTP2MaxDataSize, dropped on END_STREAM
+	oversize bool
+}
+
+// header returns the first value of a header, empty if absent.
+func (m *http2Message) header(name string) string {
+	for _, f := range m.headers {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// http2Conn keeps the client side state of a connection, the
+// HPACK dynamic table is shared by all streams, so every header
+// block must be decoded in order even for skipped messages.
+type http2Conn struct {
+	preface bool
+	dec     *hpack.Decoder
+	// open streams by id, they interleave on the connection
+	messages map[uint32]*http2Message
+	// stream whose header block is continued by CONTINUATION
+	continuing uint32
+	l          *log.Entry
+}
+
+// newHTTP2Conn returns the state of a connection whose client
+// stream l logs.
+func newHTTP2Conn(l *log.Entry) *http2Conn {
+	return &http2Conn{
+		dec:      hpack.NewDecoder(HTTP2HeaderTableSize, nil),
+		messages: make(map[uint32]*http2Message),
+		l:        l,
+	}
+}
+
+// https://http2.github.io/http2-spec/#FrameHeader
+/*
+HTTP/2 frame:
++--------+--------+--------+--------+--------+--------+--------+--------+--------+...+--------+
+| length                   | type   | flags  | R + stream id                     | payload    |
++--------+--------+--------+--------+--------+--------+--------+--------+--------+...+--------+
+A request is the HEADERS frame of a client stream with its
+CONTINUATION frames, then DATA frames and optional trailers,
+the last frame has END_STREAM set.
+*/
+// parse reads frames until a request is complete, it returns
+// the request as the frames of a new connection, so that the
+// target decodes it without the captured HPACK state.
+func (c *http2Conn) parse(r io.Reader) ([]byte, error) {
+	m, err := c.next(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.encode(), nil
+}
+
+// next reads frames until a request is complete.
+func (c *http2Conn) next(r io.Reader) (*http2Message, error) {
+	if !c.preface {
+		if _, err := readHTTP2Preface(r); err != nil {
+			return nil, err
+		}
+		c.preface = true
+	}
+	header := make([]byte, HTTP2FrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			c.l.WithError(err).Debug("read frame header failed")
+			return nil, err
+		}
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		typ, flags := header[3], header[4]
+		id := binary.BigEndian.Uint32(header[5:]) & 0x7fffffff
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			c.l.WithError(err).Debug("read frame payload failed")
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if c.continuing != 0 && (typ != http2FrameContinuation || id != c.continuing) {
+			// header compression state is lost
+			return nil, fmt.Errorf("frame type %d in header block of stream %d", typ, c.continuing)
+		}
+		m, err := c.frame(typ, flags, id, payload)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			continue
+		}
+		c.l.WithFields(log.Fields{"stream_id": id, "headers": len(m.headers), "len": m.data.Len()}).Debug("got a valid request")
+		return m, nil
+	}
+}
+
+// frame applies one frame to the connection state, it returns
+// the message completed by the frame if any.
+func (c *http2Conn) frame(typ, flags byte, id uint32, payload []byte) (*http2Message, error) {
+	switch typ {
+	case http2FrameHeaders:
+		fragment, err := http2HeadersFragment(flags, payload)
+		if err != nil {
+			return nil, err
+		}
+		m := c.messages[id]
+		if m == nil {
+			m = &http2Message{}
+			c.messages[id] = m
+		}
+		m.block = append(m.block[:0], fragment...)
+		m.endStream = flags&http2FlagEndStream != 0
+		if flags&http2FlagEndHeaders == 0 {
+			c.continuing = id
+			return nil, nil
+		}
+		return c.endHeaders(id, m)
+	case http2FrameContinuation:
+		m := c.messages[id]
+		if m == nil || c.continuing != id {
+			return nil, fmt.Errorf("CONTINUATION of stream %d without HEADERS", id)
+		}
+		m.block = append(m.block, payload...)
+		if flags&http2FlagEndHeaders == 0 {
+			return nil, nil
+		}
+		c.continuing = 0
+		return c.endHeaders(id, m)
+	case http2FrameData:
+		data, err := http2Unpad(flags, payload)
+		if err != nil {
+			return nil, err
+		}
+		m := c.messages[id]
+		if m == nil {
+			c.l.WithField("stream_id", id).Debug("DATA of unknown stream")
+			return nil, nil
+		}
+		if m.data.Len()+len(data) > HTTP2MaxDataSize {
+			m.oversize = true
+			m.data.Reset()
+		}
+		if !m.oversize {
+			m.data.Write(data)
+		}
+		if flags&http2FlagEndStream == 0 {
+			return nil, nil
+		}
+		delete(c.messages, id)
+		if m.oversize {
+			c.l.WithField("stream_id", id).Debugf("skip stream with more than %d data bytes", HTTP2MaxDataSize)
+			return nil, nil
+		}
+		return m, nil
+	case http2FrameRSTStream:
+		if _, ok := c.messages[id]; ok {
+			c.l.WithField("stream_id", id).Debug("stream reset by client, drop it")
+			delete(c.messages, id)
+		}
+	case http2FramePushPromise:
+		return nil, fmt.Errorf("PUSH_PROMISE sent by client")
+	case http2FrameGoAway:
+		c.l.Debug("client sent GOAWAY")
+	}
+	// SETTINGS, PING, PRIORITY and WINDOW_UPDATE are connection
+	// control, the replayed connections have their own
+	return nil, nil
+}
+
+// endHeaders decodes the complete header block of stream id,
+// a second block of a stream holds its trailers.
+func (c *http2Conn) endHeaders(id uint32, m *http2Message) (*http2Message, error) {
+	fields, err := c.dec.DecodeFull(m.block)
+	m.block = nil
+	if err != nil {
+		return nil, fmt.Errorf("decode header block of stream %d failed: %v", id, err)
+	}
+	if m.headers == nil {
+		m.headers = fields
+	} else {
+		m.trailers = fields
+	}
+	if !m.endStream {
+		return nil, nil
+	}
+	delete(c.messages, id)
+	return m, nil
+}
+
+// http2Unpad strips the padding of DATA and HEADERS payloads.
+func http2Unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&http2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, fmt.Errorf("padding not valid")
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+// http2HeadersFragment returns the header block fragment of a
+// HEADERS payload without padding and priority fields.
+func http2HeadersFragment(flags byte, payload []byte) ([]byte, error) {
+	fragment, err := http2Unpad(flags, payload)
+	if err != nil {
+		return nil, err
+	}
+	if flags&http2FlagPriority != 0 {
+		if len(fragment) < 5 {
+			return nil, fmt.Errorf("priority fields not valid")
+		}
+		fragment = fragment[5:]
+	}
+	return fragment, nil
+}
+
+// encode writes m as stream 1 of a new connection, the header
+// block is encoded without the dynamic table, so one connection
+// is needed per message.
+func (m *http2Message) encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(HTTP2ClientPreface)
+	writeHTTP2Frame(&buf, http2FrameSettings, 0, 0, nil)
+	const id uint32 = 1
+	trailers := len(m.trailers) > 0
+	end := m.data.Len() == 0 && !trailers
+	writeHTTP2Headers(&buf, id, m.headers, end)
+	data := m.data.Bytes()
+	for len(data) > 0 {
+		n := len(data)
+		if n > HTTP2MaxFrameSize {
+			n = HTTP2MaxFrameSize
+		}
+		var flags byte
+		if n == len(data) && !trailers {
+			flags = http2FlagEndStream
+		}
+		writeHTTP2Frame(&buf, http2FrameData, flags, id, data[:n])
+		data = data[n:]
+	}
+	if trailers {
+		writeHTTP2Headers(&buf, id, m.trailers, true)
+	}
+	return buf.Bytes()
+}
+
+func writeHTTP2Headers(w *bytes.Buffer, id uint32, fields []hpack.HeaderField, endStream bool) {
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	enc.SetMaxDynamicTableSize(0)
+	for _, f := range fields {
+		enc.WriteField(f)
+	}
+	b := block.Bytes()
+	typ, flags := http2FrameHeaders, byte(0)
+	if endStream {
+		flags = http2FlagEndStream
+	}
+	for {
+		n := len(b)
+		if n > HTTP2MaxFrameSize {
+			n = HTTP2MaxFrameSize
+		}
+		if n == len(b) {
+			flags |= http2FlagEndHeaders
+		}
+		writeHTTP2Frame(w, typ, flags, id, b[:n])
+		b = b[n:]
+		if len(b) == 0 {
+			return
+		}
+		typ, flags = http2FrameContinuation, 0
+	}
+}
+
+func writeHTTP2Frame(w *bytes.Buffer, typ, flags byte, id uint32, payload []byte) {
+	header := make([]byte, HTTP2FrameHeaderSize)
+	header[0], header[1], header[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	header[3], header[4] = typ, flags
+	binary.BigEndian.PutUint32(header[5:], id)
+	w.Write(header)
+	w.Write(payload)
+}
+
+func NewHTTP2StreamFactory(d *deliver.Deliver) *HTTP2StreamFactory {
+	return &HTTP2StreamFactory{
+		d: d,
+	}
+}
@@ -0,0 +1,63 @@
+package factory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+)
+
+func TestRewriteHostNeedsSingleTarget(t *testing.T) {
+	construct, err := Get(ProtoHTTP.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	single := newTestDeliver(t, &deliver.DeliverConfig{RemoteAddrs: []string{"127.0.0.1:8080"}, Sink: deliver.SinkDiscard})
+	if _, err := construct(single, &Options{RewriteHost: true}); err != nil {
+		t.Fatal(err)
+	}
+	pool := newTestDeliver(t, &deliver.DeliverConfig{
+		RemoteAddrs: []string{"127.0.0.1:8080", "127.0.0.1:8081"},
+		Sink:        deliver.SinkDiscard,
+	})
+	if _, err := construct(pool, &Options{RewriteHost: true}); err == nil {
+		t.Fatal("rewrite host accepted with 2 targets")
+	}
+	if _, err := construct(pool, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPFilterMatch(t *testing.T) {
+	f := NewHTTPFilter([]string{"get", "HEAD"}, []string{"/api/", "/static/"}, map[string]string{
+		"x-tenant": "blue",
+		"X-Trace":  "",
+	})
+	for _, c := range []struct {
+		method, path string
+		headers      http.Header
+		match        bool
+	}{
+		{"GET", "/api/users", http.Header{"X-Tenant": {"blue"}, "X-Trace": {"1"}}, true},
+		{"HEAD", "/static/app.js", http.Header{"X-Tenant": {"red", "blue"}, "X-Trace": {""}}, true},
+		// the method is not allowed
+		{"POST", "/api/users", http.Header{"X-Tenant": {"blue"}, "X-Trace": {"1"}}, false},
+		// no prefix matches
+		{"GET", "/admin/api/", http.Header{"X-Tenant": {"blue"}, "X-Trace": {"1"}}, false},
+		{"GET", "/api", http.Header{"X-Tenant": {"blue"}, "X-Trace": {"1"}}, false},
+		// the header value differs
+		{"GET", "/api/users", http.Header{"X-Tenant": {"red"}, "X-Trace": {"1"}}, false},
+		// a header is missing
+		{"GET", "/api/users", http.Header{"X-Tenant": {"blue"}}, false},
+	} {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header = c.headers
+		if got := f.Match(req); got != c.match {
+			t.Errorf("%s %s %v matched %v, want %v", c.method, c.path, c.headers, got, c.match)
+		}
+	}
+	if f := NewHTTPFilter(nil, nil, nil); f != nil || !f.Match(httptest.NewRequest("DELETE", "/", nil)) {
+		t.Error("empty filter does not match all requests")
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// api key, api version, correlation id and client id length
+	KafkaRequestHeaderSize int = 10
+	// same as the broker socket.request.max.bytes default
+	KafkaMaxMessageSize int = 100 * 1024 * 1024
+	// requests waiting for a response on one connection, produce
+	// requests with acks=0 are never answered
+	KafkaMaxPending int = 1024
+)
+
+// Kafka api keys
+const (
+	KafkaAPIProduce  int16 = 0
+	KafkaAPIFetch    int16 = 1
+	KafkaAPIMetadata int16 = 3
+	// bounds to tell a request header from garbage
+	kafkaMaxAPIKey     int16 = 100
+	kafkaMaxAPIVersion int16 = 20
+)
+
+// TCP -> Kafka
+type KafkaStreamFactory struct {
+	d *deliver.Deliver
+	// only forward requests of these api keys, all if empty
+	apiKeys map[int16]bool
+	// connections whose direction is known
+	mu    sync.Mutex
+	conns map[connKey]*kafkaConn
+	streams
+}
+
+func init() {
+	Register(ProtoKafka.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewKafkaStreamFactory(d, o.KafkaAPIKeys), nil
+	})
+}
+
+// kafkaConn tells requests from responses of one connection,
+// the client speaks first, so the direction of the first valid
+// request is taken as the client one. Responses may come in
+// any order, they are matched to requests by correlation id.
+type kafkaConn struct {
+	mu      sync.Mutex
+	streams int
+	client  gopacket.Flow
+	claimed bool
+	pending map[int32]bool
+}
+
+// isClient reports whether msg read from the transport
+// direction is a request.
+func (c *kafkaConn) isClient(transport gopacket.Flow, msg []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.claimed {
+		if !isKafkaRequest(msg) {
+			return false
+		}
+		c.client, c.claimed = transport, true
+	}
+	return c.client == transport
+}
+
+func (c *kafkaConn) request(id int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) >= KafkaMaxPending {
+		c.pending = make(map[int32]bool)
+	}
+	c.pending[id] = true
+}
+
+// response settles a correlation id answered on the stream of
+// l.
+func (c *kafkaConn) response(l *log.Entry, id int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.pending[id] {
+		l.WithField("correlation_id", id).Debug("response of unknown correlation id")
+		return
+	}
+	delete(c.pending, id)
+}
+
+func (f *KafkaStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoKafka.String())
+	key := newConnKey(l, r)
+	f.start(f.d, s, func() {
+		c := f.acquireConn(key)
+		defer f.releaseConn(key)
+		parse := f.kafkaParser(c, r, s.logger().WithField("factory", "KafkaStreamFactory"))
+		rd := newContextReader(f.d.Ctx, s)
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, rd, parse, "KafkaStreamFactory")
+		} else {
+			handleRequests(f.d, s, rd, parse, "KafkaStreamFactory")
+		}
+	})
+	return s
+}
+
+func (f *KafkaStreamFactory) acquireConn(key connKey) *kafkaConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.conns[key]
+	if !ok {
+		c = &kafkaConn{pending: make(map[int32]bool)}
+		f.conns[key] = c
+	}
+	c.streams++
+	return c
+}
+
+func (f *KafkaStreamFactory) releaseConn(key connKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.conns[key]; c != nil {
+		c.streams--
+		if c.streams == 0 {
+			delete(f.conns, key)
+		}
+	}
+}
+
+// https://kafka.apache.org/protocol#protocol_messages
+/*
+Request, all integers are big endian:
++--------+...+--------+--------+--------+--------+--------+--------+...+--------+--------+--------+...
+| size                | api key         | api version     | correlation id      | client id len   | client id
++--------+...+--------+--------+--------+--------+--------+--------+...+--------+--------+--------+...
+Response:
++--------+...+--------+--------+...+--------+...
+| size                | correlation id      | body
++--------+...+--------+--------+...+--------+...
+size does not count itself.
+*/
+// kafkaParser returns the parseFunc of one direction of c
+// logging to l, it returns requests accepted by the api key
+// filter and skips responses, which only settle pending
+// correlation ids.
+func (f *KafkaStreamFactory) kafkaParser(c *kafkaConn, transport gopacket.Flow, l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		for {
+			msg, err := readKafkaMessage(r, l)
+			if err != nil {
+				return nil, err
+			}
+			if !c.isClient(transport, msg) {
+				if len(msg) >= 8 {
+					c.response(l, int32(binary.BigEndian.Uint32(msg[4:])))
+				}
+				continue
+			}
+			if len(msg) < 4+KafkaRequestHeaderSize {
+				l.WithField("len", len(msg)).Debug("request too short")
+				continue
+			}
+			api := int16(binary.BigEndian.Uint16(msg[4:]))
+			version := int16(binary.BigEndian.Uint16(msg[6:]))
+			c.request(int32(binary.BigEndian.Uint32(msg[8:])))
+			if len(f.apiKeys) > 0 && !f.apiKeys[api] {
+				l.WithField("api_key", api).Debug("skip request by filter")
+				continue
+			}
+			l.WithFields(log.Fields{"len": len(msg), "api_key": api, "version": version}).Debug("got a valid request")
+			return msg, nil
+		}
+	}
+}
+
+// readKafkaMessage returns a whole message including its size.
+func readKafkaMessage(r io.Reader, l *log.Entry) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		l.WithError(err).Debug("read size failed")
+		return nil, err
+	}
+	length := int(int32(binary.BigEndian.Uint32(size)))
+	if length < 4 || length > KafkaMaxMessageSize {
+		// no magic to resync on, give up the stream
+		return nil, fmt.Errorf("message len %d not valid", length)
+	}
+	msg := make([]byte, 4+length)
+	copy(msg, size)
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		l.WithError(err).Debug("read message failed")
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// isKafkaRequest checks the request header fields of msg.
+func isKafkaRequest(msg []byte) bool {
+	if len(msg) < 4+KafkaRequestHeaderSize {
+		return false
+	}
+	api := int16(binary.BigEndian.Uint16(msg[4:]))
+	version := int16(binary.BigEndian.Uint16(msg[6:]))
+	clientID := int(int16(binary.BigEndian.Uint16(msg[12:])))
+	return api >= 0 && api <= kafkaMaxAPIKey &&
+		version >= 0 && version <= kafkaMaxAPIVersion &&
+		clientID >= -1 && 4+KafkaRequestHeaderSize+clientID <= len(msg)
+}
+
+func NewKafkaStreamFactory(d *deliver.Deliver, apiKeys []int16) *KafkaStreamFactory {
+	f := &KafkaStreamFactory{
+		d:       d,
+		apiKeys: make(map[int16]bool),
+		conns:   make(map[connKey]*kafkaConn),
+	}
+	for _, k := range apiKeys {
+		f.apiKeys[k] = true
+	}
+	return f
+}
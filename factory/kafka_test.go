@@ -0,0 +1,76 @@
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// kafkaRequest returns a request of api with client id "test"
+// and body.
+func kafkaRequest(api int16, id int32, body []byte) []byte {
+	msg := make([]byte, 4+KafkaRequestHeaderSize)
+	binary.BigEndian.PutUint16(msg[4:], uint16(api))
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	binary.BigEndian.PutUint32(msg[8:], uint32(id))
+	binary.BigEndian.PutUint16(msg[12:], 4)
+	msg = append(msg, "test"...)
+	msg = append(msg, body...)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4))
+	return msg
+}
+
+// kafkaParse returns the requests parsed from r by a factory
+// forwarding apiKeys, until EOF.
+func kafkaParse(t *testing.T, apiKeys []int16, r io.Reader) [][]byte {
+	t.Helper()
+	f := NewKafkaStreamFactory(newTestDeliver(t, nil), apiKeys)
+	_, transport := testFlows()
+	parse := f.kafkaParser(&kafkaConn{pending: make(map[int32]bool)}, transport, testLogger())
+	var reqs [][]byte
+	for {
+		req, err := parse(r)
+		if err == io.EOF {
+			return reqs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, req)
+	}
+}
+
+func TestKafkaPipelinedRequests(t *testing.T) {
+	produce := kafkaRequest(KafkaAPIProduce, 1, []byte("records"))
+	fetch := kafkaRequest(KafkaAPIFetch, 2, []byte("partitions"))
+	reqs := kafkaParse(t, nil, bytes.NewReader(append(append([]byte{}, produce...), fetch...)))
+	if len(reqs) != 2 || !bytes.Equal(reqs[0], produce) || !bytes.Equal(reqs[1], fetch) {
+		t.Fatalf("got %q, want the produce and fetch requests", reqs)
+	}
+}
+
+func TestKafkaSplitRequest(t *testing.T) {
+	produce := kafkaRequest(KafkaAPIProduce, 1, bytes.Repeat([]byte("r"), 4000))
+	// split within the size, the header and the body
+	for _, n := range []int{3, 7, 1460} {
+		reqs := kafkaParse(t, nil, &chunkReader{r: bytes.NewReader(produce), n: n})
+		if len(reqs) != 1 || !bytes.Equal(reqs[0], produce) {
+			t.Fatalf("got %d requests of segments of %d bytes, want the produce request", len(reqs), n)
+		}
+	}
+}
+
+func TestKafkaAPIKeyFilter(t *testing.T) {
+	produce := kafkaRequest(KafkaAPIProduce, 1, []byte("records"))
+	fetch := kafkaRequest(KafkaAPIFetch, 2, []byte("partitions"))
+	stream := append(append([]byte{}, fetch...), produce...)
+	// the fetch is skipped
+	reqs := kafkaParse(t, []int16{KafkaAPIProduce}, bytes.NewReader(stream))
+	if len(reqs) != 1 || !bytes.Equal(reqs[0], produce) {
+		t.Fatalf("produce filter got %q, want the produce request", reqs)
+	}
+	if reqs := kafkaParse(t, []int16{KafkaAPIMetadata}, bytes.NewReader(stream)); len(reqs) != 0 {
+		t.Fatalf("metadata filter got %q, want none", reqs)
+	}
+}
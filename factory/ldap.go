@@ -0,0 +1,224 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// larger messages are taken as junk and resynced
+const LDAPMaxMessageSize int = 16 * 1024 * 1024
+
+// LDAP protocolOp tags of requests
+const (
+	LDAPBindRequest     byte = 0x60
+	LDAPUnbindRequest   byte = 0x42
+	LDAPSearchRequest   byte = 0x63
+	LDAPModifyRequest   byte = 0x66
+	LDAPAddRequest      byte = 0x68
+	LDAPDelRequest      byte = 0x4a
+	LDAPModDNRequest    byte = 0x6c
+	LDAPCompareRequest  byte = 0x6e
+	LDAPAbandonRequest  byte = 0x50
+	LDAPExtendedRequest byte = 0x77
+)
+
+const (
+	berSequence byte = 0x30
+	berInteger  byte = 0x02
+	// long form length, the low bits are the number of length
+	// bytes, 0 for the indefinite form LDAP does not allow
+	berLongLength byte = 0x80
+)
+
+var ldapRequests = map[byte]string{
+	LDAPBindRequest:     "bind",
+	LDAPUnbindRequest:   "unbind",
+	LDAPSearchRequest:   "search",
+	LDAPModifyRequest:   "modify",
+	LDAPAddRequest:      "add",
+	LDAPDelRequest:      "del",
+	LDAPModDNRequest:    "moddn",
+	LDAPCompareRequest:  "compare",
+	LDAPAbandonRequest:  "abandon",
+	LDAPExtendedRequest: "extended",
+}
+
+// TCP -> LDAP
+type LDAPStreamFactory struct {
+	d *deliver.Deliver
+	// only forward requests of these protocolOp tags, all if
+	// empty
+	ops map[byte]bool
+	streams
+}
+
+func init() {
+	Register(ProtoLDAP.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewLDAPStreamFactory(d, o.LDAPOps), nil
+	})
+}
+
+func (f *LDAPStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoLDAP.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		c := &ldapConn{f: f, r: r, l: s.logger().WithField("factory", "LDAPStreamFactory")}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "LDAPStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "LDAPStreamFactory")
+		}
+	})
+	return s
+}
+
+// ldapConn is one side of a connection.
+type ldapConn struct {
+	f *LDAPStreamFactory
+	r *bufio.Reader
+	l *log.Entry
+}
+
+// https://tools.ietf.org/html/rfc4511#section-4.1.1
+/*
+LDAPMessage ::= SEQUENCE {
+	messageID       INTEGER (0 .. maxInt),
+	protocolOp      CHOICE { bindRequest [APPLICATION 0], ... },
+	controls        [0] Controls OPTIONAL }
+
+BER encoded as
++------+----------+------+-----+-----------+--------+-----+...
+| 0x30 | length   | 0x02 | len | messageID | op tag | ...
++------+----------+------+-----+-----------+--------+-----+...
+length is one byte below 0x80, or 0x8n followed by n bytes.
+*/
+// parse returns a request message accepted by the op filter,
+// responses of server streams are skipped. The r argument is
+// the same reader as c.r.
+func (c *ldapConn) parse(r io.Reader) ([]byte, error) {
+	for {
+		msg, id, op, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := ldapRequests[op]
+		if !ok {
+			c.l.WithFields(log.Fields{"op": op, "message_id": id}).Debug("skip op")
+			continue
+		}
+		if len(c.f.ops) > 0 && !c.f.ops[op] {
+			c.l.WithField("op", name).Debug("skip request by filter")
+			continue
+		}
+		c.l.WithFields(log.Fields{"op": name, "len": len(msg), "message_id": id}).Debug("got a valid request")
+		return msg, nil
+	}
+}
+
+// readMessage returns a whole message with its id and op tag,
+// a bad header makes it resync one byte later. The indefinite
+// length form is not allowed by LDAP and resynced as well.
+func (c *ldapConn) readMessage() ([]byte, int64, byte, error) {
+	skipped := 0
+	for {
+		hdr, length, id, op, ok, err := c.peekHeader()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if ok {
+			if skipped > 0 {
+				c.l.WithField("skipped", skipped).Debug("resynced on a valid message")
+				countResync(c.f.d.Metrics, skipped)
+			}
+			msg := make([]byte, hdr+length)
+			if _, err := io.ReadFull(c.r, msg); err != nil {
+				return nil, 0, 0, unexpectedEOF(err)
+			}
+			return msg, id, op, nil
+		}
+		c.r.Discard(1)
+		skipped++
+	}
+}
+
+// peekHeader checks the header of the next message without
+// reading it, hdr is the size of the outer tag and length.
+func (c *ldapConn) peekHeader() (hdr, length int, id int64, op byte, ok bool, err error) {
+	b, err := c.r.Peek(2)
+	if err != nil {
+		return
+	}
+	if b[0] != berSequence {
+		return
+	}
+	hdr, length = 2, int(b[1])
+	if b[1]&berLongLength != 0 {
+		n := int(b[1] &^ berLongLength)
+		if n == 0 || n > 4 {
+			return
+		}
+		if b, err = c.r.Peek(2 + n); err != nil {
+			err = unexpectedEOF(err)
+			return
+		}
+		length = 0
+		for _, v := range b[2:] {
+			length = length<<8 | int(v)
+		}
+		hdr += n
+	}
+	if length > LDAPMaxMessageSize {
+		return
+	}
+	// messageID is a short INTEGER of up to 4 bytes, followed
+	// by the op tag
+	b, err = c.r.Peek(hdr + 2)
+	if err != nil {
+		err = unexpectedEOF(err)
+		return
+	}
+	idLen := int(b[hdr+1])
+	if b[hdr] != berInteger || idLen == 0 || idLen > 4 || 2+idLen >= length {
+		return
+	}
+	if b, err = c.r.Peek(hdr + 2 + idLen + 1); err != nil {
+		err = unexpectedEOF(err)
+		return
+	}
+	for _, v := range b[hdr+2 : hdr+2+idLen] {
+		id = id<<8 | int64(v)
+	}
+	op = b[hdr+2+idLen]
+	// protocolOp is always of the application class
+	ok = op&0xc0 == 0x40
+	return
+}
+
+func NewLDAPStreamFactory(d *deliver.Deliver, ops []byte) *LDAPStreamFactory {
+	f := &LDAPStreamFactory{
+		d:   d,
+		ops: make(map[byte]bool),
+	}
+	for _, op := range ops {
+		f.ops[op] = true
+	}
+	return f
+}
@@ -0,0 +1,207 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/metrics"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	LineMaxLineSize int = 64 * 1024
+	// larger blocks are skipped up to their blank line
+	LineMaxBlockSize int = 1024 * 1024
+)
+
+// LineConfig describes text protocols of delimited lines, like
+// monitoring agents or simple RPCs.
+type LineConfig struct {
+	// end of each line, default "\n", which also ends lines
+	// with "\r\n"
+	Delimiter []byte
+	// longer lines, delimiter included, are skipped up to their
+	// delimiter, default LineMaxLineSize
+	MaxLineSize int
+	// group lines up to a blank line into one request, like
+	// the headers of HTTP or STOMP
+	Blocks bool
+}
+
+// TCP -> delimited lines
+type LineStreamFactory struct {
+	d *deliver.Deliver
+	c *LineConfig
+	streams
+}
+
+func init() {
+	Register(ProtoLine.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		c := o.Line
+		if c == nil {
+			c = &LineConfig{}
+		}
+		f, err := NewLineStreamFactory(d, c)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+}
+
+func (f *LineStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoLine.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		c := &lineConn{c: f.c, r: r, m: f.d.Metrics, l: s.logger().WithField("factory", "LineStreamFactory")}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "LineStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "LineStreamFactory")
+		}
+	})
+	return s
+}
+
+// lineConn is one side of a connection, requests and responses
+// look alike so both directions are parsed.
+type lineConn struct {
+	c *LineConfig
+	r *bufio.Reader
+	m *metrics.Set
+	l *log.Entry
+}
+
+// parse returns a line, or with Blocks the lines up to and
+// including a blank line, blank lines between blocks are
+// skipped. The r argument is the same reader as c.r.
+func (c *lineConn) parse(r io.Reader) ([]byte, error) {
+	if !c.c.Blocks {
+		return c.readLine()
+	}
+	var (
+		block []byte
+		// bytes of a block too large, skipped
+		skipped int
+	)
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			if err == io.EOF && len(block)+skipped > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if !c.blank(line) {
+			if skipped == 0 && len(block)+len(line) > LineMaxBlockSize {
+				c.l.Debugf("block longer than %d, skip it", LineMaxBlockSize)
+				skipped, block = len(block), nil
+			}
+			if skipped > 0 {
+				skipped += len(line)
+			} else {
+				block = append(block, line...)
+			}
+			continue
+		}
+		if skipped > 0 {
+			countResync(c.m, skipped+len(line))
+			skipped = 0
+			continue
+		}
+		if len(block) == 0 {
+			continue
+		}
+		c.l.WithField("len", len(block)+len(line)).Debug("got a block")
+		return append(block, line...), nil
+	}
+}
+
+// readLine returns a line including its delimiter, the rest
+// of a line longer than MaxLineSize is discarded up to the
+// next delimiter.
+func (c *lineConn) readLine() ([]byte, error) {
+	var (
+		line    []byte
+		skipped int
+		// discarding the rest of a long line
+		long bool
+	)
+	delim := c.c.Delimiter
+	for {
+		chunk, err := c.r.ReadSlice(delim[len(delim)-1])
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF && len(line)+len(chunk)+skipped == 0 {
+				return nil, io.EOF
+			}
+			return nil, unexpectedEOF(err)
+		}
+		line = append(line, chunk...)
+		if !long && len(line) > c.c.MaxLineSize {
+			c.l.Debugf("line longer than %d, skip it", c.c.MaxLineSize)
+			long = true
+		}
+		if err == nil && bytes.HasSuffix(line, delim) {
+			if long {
+				skipped += len(line)
+				line, long = nil, false
+				continue
+			}
+			if skipped > 0 {
+				c.l.WithField("skipped", skipped).Debug("resynced after a long line")
+				countResync(c.m, skipped)
+			}
+			return line, nil
+		}
+		if long {
+			// the delimiter may start within the kept bytes
+			keep := len(delim) - 1
+			skipped += len(line) - keep
+			line = append([]byte{}, line[len(line)-keep:]...)
+		}
+	}
+}
+
+// blank reports whether line is the delimiter alone, or CRLF
+// with the default delimiter.
+func (c *lineConn) blank(line []byte) bool {
+	if bytes.Equal(line, c.c.Delimiter) {
+		return true
+	}
+	return bytes.Equal(c.c.Delimiter, []byte("\n")) && bytes.Equal(line, []byte("\r\n"))
+}
+
+func NewLineStreamFactory(d *deliver.Deliver, c *LineConfig) (*LineStreamFactory, error) {
+	cc := *c
+	if len(cc.Delimiter) == 0 {
+		cc.Delimiter = []byte("\n")
+	}
+	if cc.MaxLineSize <= 0 {
+		cc.MaxLineSize = LineMaxLineSize
+	}
+	if cc.MaxLineSize < len(cc.Delimiter) {
+		return nil, fmt.Errorf("line max size %d shorter than the delimiter", cc.MaxLineSize)
+	}
+	return &LineStreamFactory{
+		d: d,
+		c: &cc,
+	}, nil
+}
@@ -0,0 +1,178 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MemcachedMaxBufferSize int = 4096
+	// larger data blocks or bodies are considered corrupted
+	MemcachedMaxItemSize int64 = 128 * 1024 * 1024
+	// request magic and header size of the binary protocol
+	MemcachedBinaryMagic      byte = 0x80
+	MemcachedBinaryHeaderSize int  = 24
+)
+
+// text commands and the index of the <bytes> field for those
+// followed by a data block, -1 for single line commands
+var memcachedCommands = map[string]int{
+	"set": 4, "add": 4, "replace": 4, "append": 4, "prepend": 4, "cas": 4,
+	"ms":  2,
+	"get": -1, "gets": -1, "gat": -1, "gats": -1, "touch": -1,
+	"delete": -1, "incr": -1, "decr": -1,
+	"mg": -1, "md": -1, "ma": -1, "mn": -1,
+	"stats": -1, "flush_all": -1, "version": -1, "verbosity": -1, "quit": -1,
+}
+
+// TCP -> Memcached
+type MemcachedStreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoMemcached.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewMemcachedStreamFactory(d), nil
+	})
+}
+
+func (f *MemcachedStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoMemcached.String())
+	f.start(f.d, s, func() {
+		// the same buffered reader is used by parsing and relaying
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), MemcachedMaxBufferSize)
+		parse := f.memcachedParser(s.logger().WithField("factory", "MemcachedStreamFactory"))
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "MemcachedStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "MemcachedStreamFactory")
+		}
+	})
+	return s
+}
+
+// memcachedParser returns the parseFunc of a stream, l logs its
+// flow.
+func (f *MemcachedStreamFactory) memcachedParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseMemcachedCommand(r, l)
+	}
+}
+
+// https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+// https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+// A binary request starts with the 0x80 magic and has a 24 bytes
+// header with the body length at offset 8. A text command is a
+// line, storage commands are followed by a data block of <bytes>
+// and CRLF. Lines of unknown commands, like responses, are skipped.
+func (f *MemcachedStreamFactory) parseMemcachedCommand(r io.Reader, l *log.Entry) ([]byte, error) {
+	br := bufio.NewReaderSize(r, MemcachedMaxBufferSize)
+	for {
+		first, err := br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] == MemcachedBinaryMagic {
+			cmd, err := readMemcachedBinary(br, l)
+			if err != nil {
+				return nil, err
+			}
+			if cmd == nil {
+				continue
+			}
+			l.WithFields(log.Fields{"len": len(cmd), "opcode": cmd[1]}).Debug("got a binary command")
+			return cmd, nil
+		}
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		idx, ok := memcachedCommands[string(fields[0])]
+		if !ok {
+			l.WithField("line", string(line)).Debug("skip line")
+			continue
+		}
+		if idx < 0 {
+			l.WithField("command", string(fields[0])).Debug("got a text command")
+			return line, nil
+		}
+		if idx >= len(fields) {
+			l.WithField("line", string(line)).Debug("storage command not valid")
+			continue
+		}
+		size, err := strconv.ParseInt(string(fields[idx]), 10, 64)
+		if err != nil || size < 0 || size > MemcachedMaxItemSize {
+			l.WithField("size", string(fields[idx])).Debug("data size not valid")
+			continue
+		}
+		cmd := bytes.NewBuffer(line)
+		// data block and the trailing CRLF
+		if _, err := io.CopyN(cmd, br, size+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if !bytes.HasSuffix(cmd.Bytes(), []byte("\r\n")) {
+			l.Debug("data block not terminated by CRLF")
+			continue
+		}
+		l.WithFields(log.Fields{"command": string(fields[0]), "len": cmd.Len()}).Debug("got a storage command")
+		return cmd.Bytes(), nil
+	}
+}
+
+// readMemcachedBinary reads a binary request, it returns nil
+// without error if the body length is not valid.
+func readMemcachedBinary(br *bufio.Reader, l *log.Entry) ([]byte, error) {
+	header := make([]byte, MemcachedBinaryHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[8:12]))
+	if size > MemcachedMaxItemSize {
+		l.WithField("len", size).Debug("body len not valid")
+		return nil, nil
+	}
+	cmd := make([]byte, int64(MemcachedBinaryHeaderSize)+size)
+	copy(cmd, header)
+	if _, err := io.ReadFull(br, cmd[MemcachedBinaryHeaderSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func NewMemcachedStreamFactory(d *deliver.Deliver) *MemcachedStreamFactory {
+	return &MemcachedStreamFactory{
+		d: d,
+	}
+}
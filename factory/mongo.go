@@ -0,0 +1,212 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MongoHeaderSize int = 16
+	// same as the server maxMessageSizeBytes
+	MongoMaxMessageSize int = 48 * 1000 * 1000
+)
+
+// MongoDB opcodes
+const (
+	MongoOpReply       int32 = 1
+	MongoOpUpdate      int32 = 2001
+	MongoOpInsert      int32 = 2002
+	MongoOpQuery       int32 = 2004
+	MongoOpGetMore     int32 = 2005
+	MongoOpDelete      int32 = 2006
+	MongoOpKillCursors int32 = 2007
+	MongoOpCompressed  int32 = 2012
+	MongoOpMsg         int32 = 2013
+)
+
+type MongoFilter int
+
+const (
+	// replay all client messages
+	MongoAll MongoFilter = iota
+	// only reads: find, aggregate, count, distinct, getMore
+	MongoQueries
+	// only writes: insert, update, delete, findAndModify
+	MongoWrites
+)
+
+var mongoCommands = map[string]MongoFilter{
+	"find":          MongoQueries,
+	"aggregate":     MongoQueries,
+	"count":         MongoQueries,
+	"distinct":      MongoQueries,
+	"getMore":       MongoQueries,
+	"insert":        MongoWrites,
+	"update":        MongoWrites,
+	"delete":        MongoWrites,
+	"findAndModify": MongoWrites,
+	"findandmodify": MongoWrites,
+}
+
+// TCP -> MongoDB
+type MongoStreamFactory struct {
+	d      *deliver.Deliver
+	filter MongoFilter
+	streams
+}
+
+func init() {
+	Register(ProtoMongo.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewMongoStreamFactory(d, o.MongoFilter), nil
+	})
+}
+
+func (f *MongoStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoMongo.String())
+	f.start(f.d, s, func() {
+		r := newContextReader(f.d.Ctx, s)
+		parse := f.mongoParser(s.logger().WithField("factory", "MongoStreamFactory"))
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "MongoStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "MongoStreamFactory")
+		}
+	})
+	return s
+}
+
+// mongoParser returns the parseFunc of a stream, l logs its flow.
+func (f *MongoStreamFactory) mongoParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseMongoMessage(r, l)
+	}
+}
+
+// https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/
+/*
+Message header, all fields are int32 little endian:
++--------+...+--------+--------+...+--------+--------+...+--------+--------+...+--------+
+| messageLength       | requestID           | responseTo          | opCode              |
++--------+...+--------+--------+...+--------+--------+...+--------+--------+...+--------+
+messageLength counts the header. Server messages answer a
+request with responseTo set, an exhaust cursor makes the
+server send several of them for one request, so messages are
+never paired and server ones are just skipped.
+*/
+// parseMongoMessage returns a whole client message accepted
+// by the filter.
+func (f *MongoStreamFactory) parseMongoMessage(r io.Reader, l *log.Entry) ([]byte, error) {
+	for {
+		header := make([]byte, MongoHeaderSize)
+		if _, err := io.ReadFull(r, header); err != nil {
+			l.WithError(err).Debug("read header failed")
+			return nil, err
+		}
+		length := int(int32(binary.LittleEndian.Uint32(header)))
+		if length < MongoHeaderSize || length > MongoMaxMessageSize {
+			// no magic to resync on, give up the stream
+			return nil, fmt.Errorf("message len %d not valid", length)
+		}
+		msg := make([]byte, length)
+		copy(msg, header)
+		if _, err := io.ReadFull(r, msg[MongoHeaderSize:]); err != nil {
+			l.WithError(err).Debug("read message failed")
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		responseTo := int32(binary.LittleEndian.Uint32(header[8:]))
+		op := int32(binary.LittleEndian.Uint32(header[12:]))
+		if op == MongoOpReply || responseTo != 0 {
+			l.WithField("opcode", op).Debug("skip server message")
+			continue
+		}
+		if f.filter != MongoAll && mongoMessageKind(op, msg) != f.filter {
+			l.WithField("opcode", op).Debug("skip message by filter")
+			continue
+		}
+		l.WithFields(log.Fields{"len": length, "opcode": op}).Debug("got a valid message")
+		return msg, nil
+	}
+}
+
+// mongoMessageKind tells reads from writes by opcode, or by the
+// command name for OP_MSG and OP_QUERY commands. Compressed and
+// other messages are MongoAll, they only pass without filter.
+func mongoMessageKind(op int32, msg []byte) MongoFilter {
+	body := msg[MongoHeaderSize:]
+	switch op {
+	case MongoOpInsert, MongoOpUpdate, MongoOpDelete:
+		return MongoWrites
+	case MongoOpGetMore:
+		return MongoQueries
+	case MongoOpMsg:
+		// flagBits, then section kind 0 with the command document
+		if len(body) < 5 || body[4] != 0 {
+			return MongoAll
+		}
+		return mongoCommands[bsonFirstKey(body[5:])]
+	case MongoOpQuery:
+		// flags, fullCollectionName, numberToSkip, numberToReturn, query
+		if len(body) < 4 {
+			return MongoAll
+		}
+		end := bytes.IndexByte(body[4:], 0)
+		if end < 0 {
+			return MongoAll
+		}
+		collection := string(body[4 : 4+end])
+		if !strings.HasSuffix(collection, ".$cmd") {
+			return MongoQueries
+		}
+		doc := body[4+end+1:]
+		if len(doc) < 8 {
+			return MongoAll
+		}
+		return mongoCommands[bsonFirstKey(doc[8:])]
+	}
+	return MongoAll
+}
+
+// bsonFirstKey returns the name of the first element of a
+// BSON document, which is the command name.
+func bsonFirstKey(doc []byte) string {
+	// int32 document size, element type, then the name cstring
+	if len(doc) < 6 {
+		return ""
+	}
+	end := bytes.IndexByte(doc[5:], 0)
+	if end < 0 {
+		return ""
+	}
+	return string(doc[5 : 5+end])
+}
+
+func NewMongoStreamFactory(d *deliver.Deliver, filter MongoFilter) *MongoStreamFactory {
+	return &MongoStreamFactory{
+		d:      d,
+		filter: filter,
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// read buffer of a stream, packets themselves are limited to
+// 256MB by the 4 bytes of remaining length
+const MQTTMaxBufferSize int = 64 * 1024
+
+// MQTT control packet types
+const (
+	MQTTConnect     byte = 1
+	MQTTConnack     byte = 2
+	MQTTPublish     byte = 3
+	MQTTPuback      byte = 4
+	MQTTPubrec      byte = 5
+	MQTTPubrel      byte = 6
+	MQTTPubcomp     byte = 7
+	MQTTSubscribe   byte = 8
+	MQTTSuback      byte = 9
+	MQTTUnsubscribe byte = 10
+	MQTTUnsuback    byte = 11
+	MQTTPingreq     byte = 12
+	MQTTPingresp    byte = 13
+	MQTTDisconnect  byte = 14
+	MQTTAuth        byte = 15
+)
+
+// packet types only sent by servers
+var mqttServerTypes = map[byte]bool{
+	MQTTConnack: true, MQTTSuback: true, MQTTUnsuback: true, MQTTPingresp: true,
+}
+
+// TCP -> MQTT 3.1, 3.1.1 and 5
+type MQTTStreamFactory struct {
+	d *deliver.Deliver
+	// only forward packets of these types, all if empty
+	types map[byte]bool
+	streams
+}
+
+func init() {
+	Register(ProtoMQTT.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewMQTTStreamFactory(d, o.MQTTPacketTypes), nil
+	})
+}
+
+func (f *MQTTStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoMQTT.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), MQTTMaxBufferSize)
+		parse := f.mqttParser(s.logger().WithField("factory", "MQTTStreamFactory"))
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "MQTTStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "MQTTStreamFactory")
+		}
+	})
+	return s
+}
+
+// http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html
+/*
+Fixed header:
++--------+--------+...+--------+...
+| type   | remaining length    | variable header and payload
+| flags  | 1 to 4 bytes        |
++--------+--------+...+--------+...
+The high 4 bits of the first byte are the packet type,
+remaining length is a varint of 7 bits per byte, least
+significant first, the high bit set if more bytes follow.
+*/
+// mqttParser returns the parseFunc of a stream, it returns
+// client packets accepted by the type filter. A stream opened
+// by CONNACK is the server side and all its packets are
+// skipped. CONNECT should be kept by the filter, servers close
+// connections sending other packets first, l logs its flow.
+func (f *MQTTStreamFactory) mqttParser(l *log.Entry) parseFunc {
+	var first, server = true, false
+	return func(r io.Reader) ([]byte, error) {
+		for {
+			packet, err := readMQTTPacket(r, l)
+			if err != nil {
+				return nil, err
+			}
+			typ := packet[0] >> 4
+			if first {
+				first = false
+				server = typ == MQTTConnack
+			}
+			if server || mqttServerTypes[typ] {
+				l.WithField("type", typ).Debug("skip server packet")
+				continue
+			}
+			if len(f.types) > 0 && !f.types[typ] {
+				l.WithField("type", typ).Debug("skip packet by filter")
+				continue
+			}
+			l.WithFields(log.Fields{"len": len(packet), "type": typ}).Debug("got a valid packet")
+			return packet, nil
+		}
+	}
+}
+
+// readMQTTPacket returns a whole control packet including its
+// fixed header.
+func readMQTTPacket(r io.Reader, l *log.Entry) ([]byte, error) {
+	header := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		l.WithError(err).Debug("read header failed")
+		return nil, err
+	}
+	if typ := header[0] >> 4; typ == 0 {
+		// reserved, no magic to resync on, give up the stream
+		return nil, fmt.Errorf("packet type %d not valid", typ)
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, fmt.Errorf("remaining length longer than 4 bytes")
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		header = append(header, b[0])
+		length += int(b[0]&0x7f) * multiplier
+		if b[0]&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	packet := make([]byte, len(header)+length)
+	copy(packet, header)
+	if _, err := io.ReadFull(r, packet[len(header):]); err != nil {
+		l.WithError(err).Debug("read body failed")
+		return nil, unexpectedEOF(err)
+	}
+	return packet, nil
+}
+
+func NewMQTTStreamFactory(d *deliver.Deliver, types []byte) *MQTTStreamFactory {
+	f := &MQTTStreamFactory{
+		d:     d,
+		types: make(map[byte]bool),
+	}
+	for _, t := range types {
+		f.types[t] = true
+	}
+	return f
+}
@@ -0,0 +1,108 @@
+package factory
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// mqttPacket returns a packet of typ with body, its remaining
+// length encoded in as few bytes as possible.
+func mqttPacket(typ byte, body []byte) []byte {
+	packet := []byte{typ << 4}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	for _, c := range []struct {
+		length, header int
+	}{
+		{0, 2},
+		{127, 2},
+		{128, 3},
+		{16383, 3},
+		{16384, 4},
+		{2097151, 4},
+		{2097152, 5},
+	} {
+		packet := mqttPacket(MQTTPublish, bytes.Repeat([]byte{'p'}, c.length))
+		if len(packet) != c.header+c.length {
+			t.Fatalf("length %d encoded in a header of %d bytes, want %d", c.length, len(packet)-c.length, c.header)
+		}
+		got, err := readMQTTPacket(bytes.NewReader(packet), testLogger())
+		if err != nil {
+			t.Fatalf("length %d: %v", c.length, err)
+		}
+		if !bytes.Equal(got, packet) {
+			t.Fatalf("length %d got a packet of %d bytes, want %d", c.length, len(got), len(packet))
+		}
+	}
+	// more than 4 bytes of remaining length
+	if _, err := readMQTTPacket(bytes.NewReader([]byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}), testLogger()); err == nil {
+		t.Fatal("remaining length of 5 bytes parsed")
+	}
+}
+
+func TestMQTTPublishInSegments(t *testing.T) {
+	publish := mqttPacket(MQTTPublish, append([]byte("\x00\x05topic"), bytes.Repeat([]byte{'p'}, 300)...))
+	f := NewMQTTStreamFactory(newTestDeliver(t, nil), nil)
+	// split within the remaining length and the payload
+	for _, n := range []int{1, 2, 100} {
+		r := &chunkReader{r: bytes.NewReader(publish), n: n}
+		parse := f.mqttParser(testLogger())
+		got, err := parse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, publish) {
+			t.Fatalf("segments of %d bytes got %q, want the publish", n, got)
+		}
+		if _, err := parse(r); err != io.EOF {
+			t.Fatalf("got %v after the publish, want EOF", err)
+		}
+	}
+}
+
+func TestMQTTPacketTypeFilter(t *testing.T) {
+	var stream []byte
+	for _, typ := range []byte{MQTTConnect, MQTTPublish, MQTTSubscribe, MQTTPingreq, MQTTPublish, MQTTDisconnect} {
+		stream = append(stream, mqttPacket(typ, []byte("body"))...)
+	}
+	d := newTestDeliver(t, nil)
+	for _, c := range []struct {
+		filter []byte
+		want   []byte
+	}{
+		{nil, []byte{MQTTConnect, MQTTPublish, MQTTSubscribe, MQTTPingreq, MQTTPublish, MQTTDisconnect}},
+		{[]byte{MQTTConnect, MQTTPublish}, []byte{MQTTConnect, MQTTPublish, MQTTPublish}},
+		{[]byte{MQTTAuth}, nil},
+	} {
+		parse := NewMQTTStreamFactory(d, c.filter).mqttParser(testLogger())
+		r := bytes.NewReader(stream)
+		var got []byte
+		for {
+			packet, err := parse(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, packet[0]>>4)
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("filter %v got types %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// payload of a packet is at most 2^24-1 bytes, a payload of
+// exactly this size is continued by the next packet
+const MySQLMaxPayloadSize int = 0xffffff
+
+// MySQL command bytes
+const (
+	MySQLComQuery       byte = 0x03
+	MySQLComChangeUser  byte = 0x11
+	MySQLComStmtPrepare byte = 0x16
+	MySQLComStmtExecute byte = 0x17
+	mysqlComMax         byte = 0x1f
+)
+
+// TCP -> MySQL
+type MySQLStreamFactory struct {
+	d *deliver.Deliver
+	// only forward query commands, drop handshake, auth and
+	// other commands
+	queryOnly bool
+	streams
+}
+
+func init() {
+	Register(ProtoMySQL.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewMySQLStreamFactory(d, o.QueryOnly), nil
+	})
+}
+
+func (f *MySQLStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoMySQL.String())
+	s.handshake = isMySQLAuth
+	f.start(f.d, s, func() {
+		r := newContextReader(f.d.Ctx, s)
+		parse := f.mysqlParser(s.logger().WithField("factory", "MySQLStreamFactory"))
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "MySQLStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "MySQLStreamFactory")
+		}
+	})
+	return s
+}
+
+func isMySQLQuery(cmd byte) bool {
+	return cmd == MySQLComQuery || cmd == MySQLComStmtPrepare || cmd == MySQLComStmtExecute
+}
+
+// mysqlParser returns the parseFunc of a stream, l logs its flow.
+func (f *MySQLStreamFactory) mysqlParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseMySQLPacket(r, l)
+	}
+}
+
+// https://dev.mysql.com/doc/internals/en/mysql-packet.html
+/*
+MySQL packet:
++--------+--------+--------+--------+--------+...+--------+
+| payload length (LE)      | seq id | payload             |
++--------+--------+--------+--------+--------+...+--------+
+A client command starts a new sequence with seq id 0 and the
+first payload byte is the command, packets in the connection
+phase(handshake response, auth switch) have non zero seq id.
+*/
+// parseMySQLPacket returns a whole client packet, payloads of
+// 16MB or larger are joined with their continuation packets.
+func (f *MySQLStreamFactory) parseMySQLPacket(r io.Reader, l *log.Entry) ([]byte, error) {
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			l.WithError(err).Debug("read packet header failed")
+			return nil, err
+		}
+		seq := header[3]
+		packet := bytes.NewBuffer(header)
+		length := readMySQLLength(header)
+		for {
+			if _, err := io.CopyN(packet, r, int64(length)); err != nil {
+				l.WithError(err).Debug("read payload failed")
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			if length < MySQLMaxPayloadSize {
+				break
+			}
+			// continuation packet with the next seq id
+			next := make([]byte, 4)
+			if _, err := io.ReadFull(r, next); err != nil {
+				return nil, err
+			}
+			packet.Write(next)
+			length = readMySQLLength(next)
+		}
+		data := packet.Bytes()
+		if seq != 0 {
+			if f.queryOnly {
+				l.WithField("seq", seq).Debug("skip connection phase packet")
+				continue
+			}
+			return data, nil
+		}
+		if len(data) == 4 || data[4] > mysqlComMax {
+			l.Debug("command packet not valid")
+			continue
+		}
+		if f.queryOnly && !isMySQLQuery(data[4]) {
+			l.WithField("command", data[4]).Debug("skip command")
+			continue
+		}
+		l.WithFields(log.Fields{"len": len(data), "command": data[4]}).Debug("got a valid packet")
+		return data, nil
+	}
+}
+
+// isMySQLAuth reports whether packet is in the connection phase
+// or a COM_CHANGE_USER command.
+func isMySQLAuth(packet []byte) bool {
+	if len(packet) < 5 {
+		return false
+	}
+	return packet[3] != 0 || packet[4] == MySQLComChangeUser
+}
+
+func readMySQLLength(header []byte) int {
+	return int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+}
+
+func NewMySQLStreamFactory(d *deliver.Deliver, queryOnly bool) *MySQLStreamFactory {
+	return &MySQLStreamFactory{
+		d:         d,
+		queryOnly: queryOnly,
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	NATSMaxBufferSize int = 64 * 1024
+	// same as the default max_payload of the server, larger
+	// messages are skipped
+	NATSMaxPayloadSize int64 = 1024 * 1024
+)
+
+// NATS client commands, the number is the index of the byte
+// count field from the end of a command line, 0 if there is no
+// payload
+var natsCommands = map[string]int{
+	"CONNECT": 0, "PUB": 1, "HPUB": 1, "SUB": 0, "UNSUB": 0,
+	"PING": 0, "PONG": 0,
+}
+
+// TCP -> NATS
+type NATSStreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoNATS.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewNATSStreamFactory(d), nil
+	})
+}
+
+func (f *NATSStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoNATS.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), NATSMaxBufferSize)
+		// the server greets clients with INFO
+		l := s.logger().WithField("factory", "NATSStreamFactory")
+		if head, _ := r.Peek(4); string(head) == "INFO" {
+			l.Debug("not a client stream, skip it")
+			drain(r)
+			return
+		}
+		c := &natsConn{r: r, l: l}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "NATSStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "NATSStreamFactory")
+		}
+	})
+	return s
+}
+
+// natsConn is the client side of a connection.
+type natsConn struct {
+	r *bufio.Reader
+	l *log.Entry
+}
+
+// https://docs.nats.io/reference/reference-protocols/nats-protocol
+/*
+	PUB <subject> [reply-to] <#bytes>\r\n[payload]\r\n
+	HPUB <subject> [reply-to] <#header bytes> <#total bytes>\r\n[headers][payload]\r\n
+*/
+// parse returns a command line, with its payload for PUB and
+// HPUB, the byte count drives how many bytes are read like a
+// Redis bulk string. Unknown lines are skipped. The r argument
+// is the same reader as c.r.
+func (c *natsConn) parse(r io.Reader) ([]byte, error) {
+	for {
+		line, err := readLine(c.r)
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		verb := string(bytes.ToUpper(fields[0]))
+		idx, ok := natsCommands[verb]
+		if !ok {
+			c.l.WithField("line", string(line)).Debug("skip line")
+			continue
+		}
+		if idx == 0 {
+			c.l.WithField("command", verb).Debug("got a command")
+			return line, nil
+		}
+		if len(fields) < 3 {
+			c.l.WithFields(log.Fields{"command": verb, "line": string(line)}).Debug("command not valid")
+			continue
+		}
+		size, err := strconv.ParseInt(string(fields[len(fields)-idx]), 10, 64)
+		if err != nil || size < 0 {
+			c.l.WithFields(log.Fields{"command": verb, "size": string(fields[len(fields)-idx])}).Debug("size not valid")
+			continue
+		}
+		// the payload is followed by CRLF
+		size += 2
+		if size > NATSMaxPayloadSize {
+			c.l.WithFields(log.Fields{"command": verb, "size": size}).Debugf("skip payload larger than %d", NATSMaxPayloadSize)
+			if _, err := io.CopyN(ioutil.Discard, c.r, size); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			continue
+		}
+		cmd := make([]byte, len(line)+int(size))
+		copy(cmd, line)
+		if _, err := io.ReadFull(c.r, cmd[len(line):]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		c.l.WithFields(log.Fields{"command": verb, "len": len(cmd)}).Debug("got a command")
+		return cmd, nil
+	}
+}
+
+func NewNATSStreamFactory(d *deliver.Deliver) *NATSStreamFactory {
+	return &NATSStreamFactory{
+		d: d,
+	}
+}
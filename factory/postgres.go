@@ -0,0 +1,241 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// larger messages are taken as garbage
+	PostgresMaxMessageSize int = 64 * 1024 * 1024
+	// same as the server MAX_STARTUP_PACKET_LENGTH
+	PostgresMaxStartupSize int = 10000
+)
+
+// request codes of untagged startup phase messages
+const (
+	PostgresCancelRequest  uint32 = 80877102
+	PostgresSSLRequest     uint32 = 80877103
+	PostgresGSSENCRequest  uint32 = 80877104
+	postgresProtocolMajor3 uint32 = 3
+)
+
+// client message tags replayed with QueryOnly, Sync is kept so
+// that extended queries are executed and errors recovered
+var postgresQueries = map[byte]bool{
+	'Q': true,
+	'P': true,
+	'B': true,
+	'E': true,
+	'S': true,
+}
+
+// tags a client stream may start with after the startup phase,
+// servers never send them
+var postgresClientFirst = map[byte]bool{
+	'Q': true,
+	'P': true,
+	'B': true,
+	'F': true,
+	'X': true,
+	'p': true,
+}
+
+// TCP -> PostgreSQL
+type PostgresStreamFactory struct {
+	d *deliver.Deliver
+	// only forward simple and extended query messages
+	queryOnly bool
+	// forward SSLRequest and startup messages instead of skipping them
+	startup bool
+	streams
+}
+
+func init() {
+	Register(ProtoPostgres.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewPostgresStreamFactory(d, o.QueryOnly, o.PostgresStartup), nil
+	})
+}
+
+func (f *PostgresStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoPostgres.String())
+	s.handshake = isPostgresAuth
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		l := s.logger().WithField("factory", "PostgresStreamFactory")
+		startup, ok := isPostgresClient(r)
+		if !ok {
+			l.Debug("not a client stream, skip it")
+			drain(r)
+			return
+		}
+		c := &postgresConn{f: f, l: l, startup: startup}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "PostgresStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "PostgresStreamFactory")
+		}
+	})
+	return s
+}
+
+// isPostgresClient tells client streams from server ones by the
+// first message, it also reports whether the stream starts with
+// the startup phase.
+func isPostgresClient(r *bufio.Reader) (startup bool, ok bool) {
+	head, err := r.Peek(1)
+	if err != nil {
+		return false, false
+	}
+	if postgresClientFirst[head[0]] {
+		return false, true
+	}
+	head, err = r.Peek(8)
+	if err != nil {
+		return false, false
+	}
+	length := int(int32(binary.BigEndian.Uint32(head)))
+	code := binary.BigEndian.Uint32(head[4:])
+	if length < 8 || length > PostgresMaxStartupSize {
+		return false, false
+	}
+	switch code {
+	case PostgresSSLRequest, PostgresGSSENCRequest, PostgresCancelRequest:
+		return true, true
+	}
+	return true, code>>16 == postgresProtocolMajor3
+}
+
+// postgresConn is the client side state of a connection.
+type postgresConn struct {
+	f *PostgresStreamFactory
+	l *log.Entry
+	// untagged messages are read until the startup message
+	startup bool
+}
+
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+/*
+Startup phase message, untagged:
++--------+...+--------+--------+...+--------+...
+| length              | code or version     | parameters
++--------+...+--------+--------+...+--------+...
+Other messages:
++--------+--------+...+--------+...
+| tag    | length              | body
++--------+--------+...+--------+...
+Lengths are big endian and count themselves but not the tag.
+After SSLRequest or GSSENCRequest the server answers one byte,
+then the client starts TLS, which can not be parsed, or sends
+the startup message.
+*/
+// parse returns a whole client message, startup phase messages
+// are skipped unless startup is set.
+func (c *postgresConn) parse(r io.Reader) ([]byte, error) {
+	for {
+		if c.startup {
+			msg, err := readPostgresStartup(r, c.l)
+			if err != nil {
+				return nil, err
+			}
+			switch binary.BigEndian.Uint32(msg[4:]) {
+			case PostgresSSLRequest, PostgresGSSENCRequest, PostgresCancelRequest:
+			default:
+				c.startup = false
+			}
+			if !c.f.startup {
+				c.l.WithField("len", len(msg)).Debug("skip startup phase message")
+				continue
+			}
+			return msg, nil
+		}
+		msg, err := readPostgresMessage(r, c.l)
+		if err != nil {
+			return nil, err
+		}
+		if c.f.queryOnly && !postgresQueries[msg[0]] {
+			c.l.WithField("tag", string(msg[0])).Debug("skip message")
+			continue
+		}
+		c.l.WithFields(log.Fields{"len": len(msg), "tag": string(msg[0])}).Debug("got a valid message")
+		return msg, nil
+	}
+}
+
+// isPostgresAuth reports whether msg is a startup phase message
+// or a password, SASL or GSSAPI response. Untagged messages
+// start with the high byte of their length, which is 0.
+func isPostgresAuth(msg []byte) bool {
+	return len(msg) > 0 && (msg[0] == 0 || msg[0] == 'p')
+}
+
+func readPostgresStartup(r io.Reader, l *log.Entry) ([]byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		l.WithError(err).Debug("read startup header failed")
+		return nil, err
+	}
+	length := int(int32(binary.BigEndian.Uint32(header)))
+	if length < 8 || length > PostgresMaxStartupSize {
+		// TLS after SSLRequest ends up here too
+		return nil, fmt.Errorf("startup message len %d not valid", length)
+	}
+	return readPostgresBody(r, header, length, l)
+}
+
+func readPostgresMessage(r io.Reader, l *log.Entry) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		l.WithError(err).Debug("read message header failed")
+		return nil, err
+	}
+	length := int(int32(binary.BigEndian.Uint32(header[1:])))
+	if length < 4 || length > PostgresMaxMessageSize {
+		// no magic to resync on, give up the stream
+		return nil, fmt.Errorf("message %q len %d not valid", header[0], length)
+	}
+	return readPostgresBody(r, header, length+1, l)
+}
+
+// readPostgresBody reads the rest of a message of size bytes
+// whose header is already read.
+func readPostgresBody(r io.Reader, header []byte, size int, l *log.Entry) ([]byte, error) {
+	msg := make([]byte, size)
+	copy(msg, header)
+	if _, err := io.ReadFull(r, msg[len(header):]); err != nil {
+		l.WithError(err).Debug("read message body failed")
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+func NewPostgresStreamFactory(d *deliver.Deliver, queryOnly bool, startup bool) *PostgresStreamFactory {
+	return &PostgresStreamFactory{
+		d:         d,
+		queryOnly: queryOnly,
+		startup:   startup,
+	}
+}
@@ -0,0 +1,85 @@
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// postgresMessage returns a message of tag with body, untagged
+// if tag is 0.
+func postgresMessage(tag byte, body []byte) []byte {
+	var msg []byte
+	if tag != 0 {
+		msg = append(msg, tag)
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(body)+4))
+	msg = append(msg, length...)
+	return append(msg, body...)
+}
+
+func postgresCode(code uint32, params string) []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, code)
+	return append(body, params...)
+}
+
+// postgresTags returns the tags of the messages parsed from
+// stream, 0 for startup phase messages.
+func postgresTags(t *testing.T, f *PostgresStreamFactory, stream []byte) []byte {
+	t.Helper()
+	r := bufio.NewReader(bytes.NewReader(stream))
+	startup, ok := isPostgresClient(r)
+	if !ok {
+		t.Fatal("client stream not told")
+	}
+	c := &postgresConn{f: f, l: testLogger(), startup: startup}
+	var tags []byte
+	for {
+		msg, err := c.parse(r)
+		if err == io.EOF {
+			return tags
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the high byte of the length of untagged messages
+		tags = append(tags, msg[0])
+	}
+}
+
+func TestPostgresStartupSkipped(t *testing.T) {
+	d := newTestDeliver(t, nil)
+	var stream []byte
+	for _, msg := range [][]byte{
+		postgresMessage(0, postgresCode(PostgresSSLRequest, "")),
+		postgresMessage(0, postgresCode(postgresProtocolMajor3<<16, "user\x00test\x00\x00")),
+		postgresMessage('Q', []byte("select 1\x00")),
+		postgresMessage('X', nil),
+	} {
+		stream = append(stream, msg...)
+	}
+	if got := postgresTags(t, NewPostgresStreamFactory(d, false, false), stream); string(got) != "QX" {
+		t.Fatalf("got messages %q, want the startup phase skipped", got)
+	}
+	if got := postgresTags(t, NewPostgresStreamFactory(d, false, true), stream); string(got) != "\x00\x00QX" {
+		t.Fatalf("got messages %q with PostgresStartup, want SSLRequest and startup", got)
+	}
+}
+
+func TestPostgresQueryOnly(t *testing.T) {
+	d := newTestDeliver(t, nil)
+	var stream []byte
+	for _, tag := range []byte("QPBDESHCX") {
+		stream = append(stream, postgresMessage(tag, []byte("body\x00"))...)
+	}
+	if got := postgresTags(t, NewPostgresStreamFactory(d, true, false), stream); string(got) != "QPBES" {
+		t.Fatalf("query only got messages %q, want QPBES", got)
+	}
+	if got := postgresTags(t, NewPostgresStreamFactory(d, false, false), stream); string(got) != "QPBDESHCX" {
+		t.Fatalf("got messages %q, want all", got)
+	}
+}
@@ -13,6 +13,8 @@
 
 package factory
 
+import "fmt"
+
 type ProtoType int
 
 const (
@@ -20,4 +22,70 @@ const (
 	ProtoHTTP
 	ProtoGRPC
 	ProtoThrift
+	ProtoRedis
+	ProtoMySQL
+	ProtoDNS
+	ProtoMemcached
+	ProtoMongo
+	ProtoKafka
+	ProtoHTTP2
+	ProtoPostgres
+	ProtoAMQP
+	ProtoWebSocket
+	ProtoCQL
+	ProtoSMTP
+	ProtoSIP
+	ProtoSTOMP
+	ProtoLDAP
+	ProtoDubbo
+	ProtoNATS
+	ProtoAutoDetect
+	ProtoBeanstalkd
+	ProtoMQTT
+	ProtoFTP
+	ProtoTDS
+	ProtoZooKeeper
+	ProtoProtobuf
+	ProtoLine
+	ProtoGraphite
 )
+
+var protoNames = map[ProtoType]string{
+	ProtoVideoPacket: "videopacket",
+	ProtoHTTP:        "http",
+	ProtoGRPC:        "grpc",
+	ProtoThrift:      "thrift",
+	ProtoRedis:       "redis",
+	ProtoMySQL:       "mysql",
+	ProtoDNS:         "dns",
+	ProtoMemcached:   "memcached",
+	ProtoMongo:       "mongo",
+	ProtoKafka:       "kafka",
+	ProtoHTTP2:       "http2",
+	ProtoPostgres:    "postgres",
+	ProtoAMQP:        "amqp",
+	ProtoWebSocket:   "websocket",
+	ProtoCQL:         "cql",
+	ProtoSMTP:        "smtp",
+	ProtoSIP:         "sip",
+	ProtoSTOMP:       "stomp",
+	ProtoLDAP:        "ldap",
+	ProtoDubbo:       "dubbo",
+	ProtoNATS:        "nats",
+	ProtoAutoDetect:  "auto",
+	ProtoBeanstalkd:  "beanstalkd",
+	ProtoMQTT:        "mqtt",
+	ProtoFTP:         "ftp",
+	ProtoTDS:         "tds",
+	ProtoZooKeeper:   "zookeeper",
+	ProtoProtobuf:    "protobuf",
+	ProtoLine:        "line",
+	ProtoGraphite:    "graphite",
+}
+
+func (p ProtoType) String() string {
+	if name, ok := protoNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("ProtoType(%d)", int(p))
+}
@@ -0,0 +1,157 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// larger messages are taken as junk by default
+	ProtobufMaxMessageSize int = 4 * 1024 * 1024
+	// a 64 bit varint takes at most 10 bytes
+	ProtobufMaxVarintSize int = binary.MaxVarintLen64
+)
+
+// wire types valid in a field tag, groups are deprecated
+var protobufWireTypes = [8]bool{0: true, 1: true, 2: true, 5: true}
+
+// TCP -> varint length delimited protobuf messages, as written
+// by writeDelimitedTo in Java or protodelim in Go
+type ProtobufVarintStreamFactory struct {
+	d       *deliver.Deliver
+	maxSize int
+	// junk bytes skipped while resyncing on a valid length
+	skippedBytes uint64
+	streams
+}
+
+func init() {
+	Register(ProtoProtobuf.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewProtobufVarintStreamFactory(d, o.ProtobufMaxSize), nil
+	})
+}
+
+func (f *ProtobufVarintStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoProtobuf.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		l := s.logger().WithField("factory", "ProtobufVarintStreamFactory")
+		parse := func(io.Reader) ([]byte, error) {
+			return f.readMessage(r, l)
+		}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "ProtobufVarintStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "ProtobufVarintStreamFactory")
+		}
+	})
+	return s
+}
+
+// SkippedBytes returns the number of junk bytes skipped
+// while resyncing on a valid length.
+func (f *ProtobufVarintStreamFactory) SkippedBytes() uint64 {
+	return atomic.LoadUint64(&f.skippedBytes)
+}
+
+/*
+Message:
++--------+...+--------+--------+...+--------+
+| length (varint)     | protobuf payload    |
++--------+...+--------+--------+...+--------+
+length is base 128, least significant group first, the high
+bit of each byte set but the last. The payload starts with
+the tag of a field, its low 3 bits being the wire type.
+*/
+// readMessage returns the length and payload of a message, a
+// non minimal or too large length, or a payload not starting with
+// a valid tag makes it resync one byte later. Empty messages
+// are valid. There are no message types to tell requests from
+// responses, both directions are replayed.
+func (f *ProtobufVarintStreamFactory) readMessage(r *bufio.Reader, l *log.Entry) ([]byte, error) {
+	skipped := 0
+	for {
+		head, err := r.Peek(ProtobufMaxVarintSize)
+		if len(head) == 0 {
+			if err == io.EOF && skipped > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		length, n := binary.Uvarint(head)
+		if n == 0 {
+			// the stream ends within the length
+			return nil, io.ErrUnexpectedEOF
+		}
+		if f.validLength(head, length, n) {
+			msg, _ := r.Peek(n + 1)
+			if length == 0 || len(msg) < n+1 || protobufTag(msg[n]) {
+				if skipped > 0 {
+					l.WithField("skipped", skipped).Debug("resynced on a valid length")
+					countResync(f.d.Metrics, skipped)
+				}
+				msg := make([]byte, n+int(length))
+				if _, err := io.ReadFull(r, msg); err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				l.WithField("len", length).Debug("got a valid message")
+				return msg, nil
+			}
+		}
+		r.Discard(1)
+		skipped++
+		atomic.AddUint64(&f.skippedBytes, 1)
+	}
+}
+
+// validLength reports whether the varint of n bytes at the
+// head is minimally encoded and within the max message size.
+func (f *ProtobufVarintStreamFactory) validLength(head []byte, length uint64, n int) bool {
+	if n < 0 || length > uint64(f.maxSize) {
+		return false
+	}
+	// a trailing zero group would be encoded shorter
+	return n == 1 || head[n-1] != 0
+}
+
+// protobufTag reports whether b can be the first byte of a
+// field tag, a field number of 0 is invalid.
+func protobufTag(b byte) bool {
+	if !protobufWireTypes[b&0x7] {
+		return false
+	}
+	return b&0x80 != 0 || b>>3 != 0
+}
+
+// NewProtobufVarintStreamFactory creates a factory taking
+// messages longer than maxSize as junk, default
+// ProtobufMaxMessageSize.
+func NewProtobufVarintStreamFactory(d *deliver.Deliver, maxSize int) *ProtobufVarintStreamFactory {
+	if maxSize <= 0 {
+		maxSize = ProtobufMaxMessageSize
+	}
+	return &ProtobufVarintStreamFactory{
+		d:       d,
+		maxSize: maxSize,
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"context"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+)
+
+const RawMaxBufferSize int = deliver.BufferSize
+
+// parseFunc reads until a valid request is found, it returns
+// an error only when the stream can not be read any more.
+type parseFunc func(r io.Reader) ([]byte, error)
+
+// relayRaw is the ModeRaw handler shared by factories, it
+// leases long connections to remote and relays the whole
+// byte stream once a valid request is found.
+func relayRaw(d *deliver.Deliver, s *stream, r io.Reader, parse parseFunc, name string) {
+	// a stream can only be sampled as a whole
+	if !s.sampled(d, r) {
+		return
+	}
+	defer drain(r)
+	l := s.logger().WithField("factory", name)
+	ctx, cancel := context.WithCancel(d.Ctx)
+	defer cancel()
+
+	sender, release, err := d.LeaseSender(ctx, s.src, s.dst)
+	if err != nil {
+		l.WithError(err).Error("create sender failed")
+		return
+	}
+	// a pooled sender is only reused by the next stream if this
+	// one ends where a request ends, not after a partial read or
+	// a parse error
+	reuse, partial := false, false
+	defer func() { release(reuse) }()
+
+	for {
+		// first we get a valid request, then we can
+		// assume the following traffic contains all
+		// valid requests until error happens
+		req, err := parse(r)
+		if err != nil {
+			reuse = err == io.EOF && !partial
+			l.WithError(err).Error("did not find a valid req")
+			countParseError(d, s, err)
+			return
+		}
+		partial = false
+		l.WithField("len", len(req)).Debug("relay from a valid req")
+		d.Metrics.ObserveRequest(s.proto, len(req), s.Seen())
+		if err := d.Pace(ctx, s.Seen()); err != nil {
+			return
+		}
+		d.Verifier.Track(req)
+		select {
+		case <-ctx.Done():
+			return
+		case sender.Data() <- req:
+		}
+
+		for {
+			// buf must in loop for avoiding race condition,
+			// the sender puts it back to pool once written
+			buf := deliver.GetBuffer()
+			// when error happens, we go to outer loop
+			// and try to refind a valid request
+			if n, err := io.ReadFull(r, buf); err != nil {
+				l.WithError(err).Error("read full failed")
+				if n > 0 {
+					partial = true
+					if err := d.Pace(ctx, s.Seen()); err != nil {
+						return
+					}
+					d.Verifier.Track(buf[:n])
+					select {
+					case <-ctx.Done():
+						return
+					case sender.Data() <- buf[:n]:
+					}
+				} else {
+					deliver.PutBuffer(buf)
+				}
+				break
+			}
+			if err := d.Pace(ctx, s.Seen()); err != nil {
+				return
+			}
+			d.Verifier.Track(buf)
+			select {
+			case <-ctx.Done():
+				return
+			case sender.Data() <- buf:
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const contextReaderBufferSize int = 4096
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// contextReader wraps a blocking reader like tcpreader.ReaderStream,
+// which has no deadline support, so that pending reads return
+// ctx.Err() once the context is done. The underlying reader is
+// consumed by a pump goroutine, each chunk is copied so the caller's
+// buffer is never written after Read returns.
+type contextReader struct {
+	ctx  context.Context
+	ch   chan readResult
+	left []byte
+	err  error
+	// counts the bytes returned by Read, nil if not a stream
+	read *int64
+}
+
+func (r *contextReader) pump(src io.Reader) {
+	for {
+		buf := make([]byte, contextReaderBufferSize)
+		n, err := src.Read(buf)
+		select {
+		case <-r.ctx.Done():
+			return
+		case r.ch <- readResult{data: buf[:n], err: err}:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	for len(r.left) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		select {
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		case res := <-r.ch:
+			r.left, r.err = res.data, res.err
+		}
+	}
+	n := copy(p, r.left)
+	r.left = r.left[n:]
+	if r.read != nil {
+		*r.read += int64(n)
+	}
+	return n, nil
+}
+
+func newContextReader(ctx context.Context, src io.Reader) io.Reader {
+	r := &contextReader{
+		ctx: ctx,
+		ch:  make(chan readResult),
+	}
+	if s, ok := src.(*stream); ok {
+		// tells the offsets of parsed requests
+		r.read = &s.read
+	}
+	go r.pump(src)
+	return r
+}
+
+// readLine reads a line including the line ending for line
+// based protocols, lines longer than the buffer are dropped.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Debug("line too long, skip it")
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, line...), nil
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RedisMaxBufferSize int = 4096
+	// same as redis proto-max-bulk-len default
+	RedisMaxBulkSize int64 = 512 * 1024 * 1024
+	RedisMaxArgs     int64 = 1024 * 1024
+)
+
+// TCP -> Redis
+type RedisStreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoRedis.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewRedisStreamFactory(d), nil
+	})
+}
+
+func (f *RedisStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoRedis.String())
+	s.handshake = isRedisAuth
+	f.start(f.d, s, func() {
+		// the same buffered reader is used by parsing and relaying
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), RedisMaxBufferSize)
+		parse := f.redisParser(s.logger().WithField("factory", "RedisStreamFactory"))
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "RedisStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "RedisStreamFactory")
+		}
+	})
+	return s
+}
+
+// redisParser returns the parseFunc of a stream, l logs its flow.
+func (f *RedisStreamFactory) redisParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseRedisCommand(r, l)
+	}
+}
+
+// https://redis.io/topics/protocol
+// A client sends commands as a RESP array of bulk strings,
+// "*<argc>\r\n$<len>\r\n<arg>\r\n...", or as an inline command, a plain line split by spaces.
+// Bulk strings are binary safe, so their content is read by
+// the declared length instead of looking for CRLF.
+func (f *RedisStreamFactory) parseRedisCommand(r io.Reader, l *log.Entry) ([]byte, error) {
+	br := bufio.NewReaderSize(r, RedisMaxBufferSize)
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			l.WithField("len", len(line)).Debug("got an inline command")
+			return line, nil
+		}
+		argc, err := parseRedisLength(line)
+		if err != nil || argc > RedisMaxArgs {
+			l.WithField("line", string(line)).WithError(err).Debug("array length not valid")
+			continue
+		}
+		cmd := bytes.NewBuffer(line)
+		if err := readRedisBulks(br, cmd, argc); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			// resync on the next line
+			l.WithError(err).Debug("command not valid")
+			continue
+		}
+		l.WithField("len", cmd.Len()).Debug("got a valid command")
+		return cmd.Bytes(), nil
+	}
+}
+
+// readRedisBulks appends argc bulk strings to cmd.
+func readRedisBulks(br *bufio.Reader, cmd *bytes.Buffer, argc int64) error {
+	for i := int64(0); i < argc; i++ {
+		line, err := readLine(br)
+		if err != nil {
+			return err
+		}
+		if line[0] != '$' {
+			return fmt.Errorf("bulk header %q not valid", line)
+		}
+		size, err := parseRedisLength(line)
+		if err != nil || size > RedisMaxBulkSize {
+			return fmt.Errorf("bulk length %q not valid", line)
+		}
+		cmd.Write(line)
+		// content and the trailing CRLF
+		if _, err := io.CopyN(cmd, br, size+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if !bytes.HasSuffix(cmd.Bytes(), []byte("\r\n")) {
+			return fmt.Errorf("bulk string not terminated by CRLF")
+		}
+	}
+	return nil
+}
+
+// parseRedisLength parses the number in a "*<n>\r\n" or "$<n>\r\n" line.
+func parseRedisLength(line []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(bytes.TrimRight(line[1:], "\r\n")), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative length %d", n)
+	}
+	return n, nil
+}
+
+// isRedisAuth reports whether cmd is AUTH, or HELLO with AUTH
+// arguments. Bulk strings with CRLF inside are split wrongly,
+// which is fine for telling the command name.
+func isRedisAuth(cmd []byte) bool {
+	var args [][]byte
+	if len(cmd) > 0 && cmd[0] == '*' {
+		// array, bulk length, bulk string, ...
+		lines := bytes.Split(cmd, []byte("\r\n"))
+		for i := 2; i < len(lines); i += 2 {
+			args = append(args, lines[i])
+		}
+	} else {
+		args = bytes.Fields(cmd)
+	}
+	if len(args) == 0 {
+		return false
+	}
+	if bytes.EqualFold(args[0], []byte("AUTH")) {
+		return true
+	}
+	if !bytes.EqualFold(args[0], []byte("HELLO")) {
+		return false
+	}
+	for _, arg := range args[1:] {
+		if bytes.EqualFold(arg, []byte("AUTH")) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewRedisStreamFactory(d *deliver.Deliver) *RedisStreamFactory {
+	return &RedisStreamFactory{
+		d: d,
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// Options are protocol specific settings passed to every
+// Constructor, each factory uses the fields it knows.
+type Options struct {
+	// HTTP: rewrite Host header to the target address, only
+	// with a single target and no pipelines
+	RewriteHost bool
+	// HTTP: only replay requests of these methods, whose path
+	// has one of these prefixes and which carry these headers,
+	// an empty header value matches any value. Empty conditions
+	// match all requests.
+	HTTPMethodAllow []string
+	HTTPPathPrefix  []string
+	HTTPHeaderMatch map[string]string
+	// MySQL, PostgreSQL, TDS: only replay query commands
+	QueryOnly bool
+	// PostgreSQL: replay SSLRequest and startup messages
+	PostgresStartup bool
+	// MongoDB: replay all, queries or writes
+	MongoFilter MongoFilter
+	// Kafka: only replay these api keys, all if empty
+	KafkaAPIKeys []int16
+	// CQL: only replay requests of these opcodes, all if empty
+	CQLOpcodes []byte
+	// LDAP: only replay requests of these protocolOp tags, all
+	// if empty
+	LDAPOps []byte
+	// MQTT: only replay control packets of these types, all if
+	// empty
+	MQTTPacketTypes []byte
+	// WebSocket: replay close, ping and pong frames too
+	WebSocketControl bool
+	// VideoPacket: max data bytes of a frame, larger frames are
+	// dropped, default VideoPacketMaxFrameSize
+	MaxFrameSize int
+	// VideoPacket: a frame missing only its tail byte at the
+	// end of a stream, e.g. cut off by the end of a capture, is
+	// delivered with the tail added instead of dropped. The
+	// target may get a frame the client never finished.
+	// ModeRequest only.
+	FlushPartialOnEOF bool
+	// gRPC: only replay calls of these method paths, e.g.
+	// /etcdserverpb.KV/Range, a path ending with / matches all
+	// methods of a service, all if empty
+	GRPCMethods []string
+	// Protobuf: longer messages are junk, default
+	// ProtobufMaxMessageSize
+	ProtobufMaxSize int
+	// ZooKeeper: replay ping requests too
+	ZooKeeperPings bool
+	// Dubbo: replay heartbeat events too
+	DubboHeartbeats bool
+	// auto: bytes sniffed before an unknown stream is relayed
+	// raw, default DefaultAutoDetectPeek
+	AutoDetectPeek int
+	// framed: frame layout, required
+	Frame *FrameConfig
+	// line: delimiter and max sizes, defaults of LineConfig
+	// if nil
+	Line *LineConfig
+	// Graphite: max metric lines grouped into one request, 1 if
+	// 0, fewer are sent when no more lines are buffered
+	GraphiteBatch int
+}
+
+// Constructor creates the StreamFactory of a protocol.
+type Constructor func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Constructor)
+)
+
+// Register makes a protocol available by name, built-in
+// factories register themselves with their ProtoType names.
+// It panics if name is registered twice or c is nil.
+func Register(name string, c Constructor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if c == nil {
+		panic("factory: Register constructor is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("factory: Register called twice for " + name)
+	}
+	registry[name] = c
+}
+
+// Get returns the constructor registered by name.
+func Get(name string) (Constructor, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	c, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown protocol %q, registered: %s", name, strings.Join(namesLocked(), ", "))
+	}
+	return c, nil
+}
+
+// Names returns the registered protocol names in order.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return namesLocked()
+}
+
+func namesLocked() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
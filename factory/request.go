@@ -0,0 +1,97 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/metrics"
+)
+
+// handleRequests is the ModeRequest handler shared by factories,
+// it sends each parsed request with its capture timestamp to
+// deliver until parse fails or deliver is stopped.
+func handleRequests(d *deliver.Deliver, s *stream, r io.Reader, parse parseFunc, name string) {
+	if !s.sampled(d, r) {
+		return
+	}
+	// also after a parse error or once deliver is stopped
+	defer drain(r)
+	l := s.logger().WithField("factory", name)
+	var start int64
+	for {
+		// must be a valid request or EOF
+		req, err := parse(r)
+		if p, ok := err.(*partialRequest); ok {
+			// the next parse returns EOF
+			l.WithField("len", len(p.data)).Warn("flush a req cut off by the end of the stream")
+			d.Metrics.PartialFlushes.Inc()
+			req, err = p.data, nil
+		}
+		if err != nil {
+			l.WithError(err).Error("did not find a valid req")
+			countParseError(d, s, err)
+			return
+		}
+		l.WithField("len", len(req)).Debug("got a valid req")
+		d.Metrics.ObserveRequest(s.proto, len(req), s.Seen())
+		if d.Analysis != nil {
+			end := s.position(r)
+			analyze(d, s, req, start, end)
+			start = end
+		}
+		if s.skipFirst(d) {
+			l.Debug("skip one of the first requests")
+			continue
+		}
+		if !d.SampleRequest() {
+			continue
+		}
+		if err := d.Enqueue(d.Ctx, s.request(req)); err != nil {
+			return
+		}
+	}
+}
+
+// partialRequest is returned by parsers at the end of a stream
+// which cut off a request complete enough to be delivered, with
+// Options.FlushPartialOnEOF only. data is fixed up to be a valid
+// request, so that it does not break the framing of requests
+// following it on a connection to a target.
+type partialRequest struct {
+	data []byte
+}
+
+func (e *partialRequest) Error() string {
+	return fmt.Sprintf("request len %d cut off by the end of the stream", len(e.data))
+}
+
+// countParseError counts a stream given up by its parser, the
+// end of a stream is not an error.
+func countParseError(d *deliver.Deliver, s *stream, err error) {
+	if err != io.EOF {
+		d.Metrics.ParseErrors.With(s.proto).Inc()
+	}
+}
+
+// countResync counts a valid message found after skipped junk
+// bytes in m.
+func countResync(m *metrics.Set, skipped int) {
+	if skipped > 0 {
+		m.Resyncs.Inc()
+		m.BytesSkipped.Add(uint64(skipped))
+	}
+}
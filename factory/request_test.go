@@ -0,0 +1,144 @@
+package factory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/metrics"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// newTestDeliver returns a deliver of c, discarding requests
+// if c is nil, it is shut down at the end of the test.
+func newTestDeliver(t *testing.T, c *deliver.DeliverConfig) *deliver.Deliver {
+	t.Helper()
+	if c == nil {
+		c = &deliver.DeliverConfig{Sink: deliver.SinkDiscard}
+	}
+	if len(c.RemoteAddrs) == 0 {
+		c.RemoteAddrs = []string{"127.0.0.1:1"}
+	}
+	d, err := deliver.NewDeliver(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		d.Shutdown(ctx)
+	})
+	return d
+}
+
+// testFlows are the flows of a captured client connection.
+func testFlows() (gopacket.Flow, gopacket.Flow) {
+	return gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}),
+		gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x9c, 0x40}, []byte{0x1f, 0x90})
+}
+
+// testLogger is the logger handed to parsers in tests.
+func testLogger() *log.Entry {
+	return log.NewEntry(log.StandardLogger())
+}
+
+// feedStream hands chunks to a new stream of f like the
+// assembler does, it fails if Reassembled blocks since the
+// assembler would stall all connections.
+func feedStream(t *testing.T, f tcpassembly.StreamFactory, chunks ...[]byte) {
+	t.Helper()
+	s := f.New(testFlows())
+	for i, c := range chunks {
+		done := make(chan struct{})
+		go func() {
+			s.Reassembled([]tcpassembly.Reassembly{{Bytes: c, Seen: time.Now()}})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Reassembled of chunk %d blocked", i)
+		}
+	}
+	s.ReassemblyComplete()
+}
+
+// junk larger than the buffer of a contextReader, so that an
+// unread stream blocks its pump
+func testJunk() []byte {
+	junk := make([]byte, 3*contextReaderBufferSize)
+	for i := range junk {
+		junk[i] = byte(i)
+	}
+	return junk
+}
+
+func TestGiveUpDrainsStream(t *testing.T) {
+	for _, c := range []*deliver.DeliverConfig{
+		{Sink: deliver.SinkDiscard},
+		// no target is listening, the stream is not relayed
+		{Mode: deliver.ModeRaw, IsLong: true},
+	} {
+		d := newTestDeliver(t, c)
+		// a message length below the header size gives up the
+		// stream, Mongo has no magic to resync on
+		bad := []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xdd, 0x07, 0, 0}
+		feedStream(t, NewMongoStreamFactory(d, MongoAll), bad, testJunk(), testJunk())
+	}
+}
+
+func TestActiveStreamsReturnToZero(t *testing.T) {
+	const n = 8
+	m := metrics.NewSet()
+	f := NewRedisStreamFactory(newTestDeliver(t, &deliver.DeliverConfig{Sink: deliver.SinkDiscard, Metrics: m}))
+	network, _ := testFlows()
+	var open []tcpassembly.Stream
+	for i := 0; i < n; i++ {
+		transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x9c, byte(i)}, []byte{0x18, 0xeb})
+		s := f.New(network, transport)
+		s.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("*1\r\n$4\r\nPING\r\n"), Seen: time.Now()}})
+		open = append(open, s)
+	}
+	if got := f.ActiveStreams(); got != n {
+		t.Fatalf("%d active streams, want %d", got, n)
+	}
+	for _, s := range open {
+		s.ReassemblyComplete()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for f.ActiveStreams() != 0 || m.ActiveStreams.Value() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d active streams after teardown, %d counted", f.ActiveStreams(), m.ActiveStreams.Value())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCancelUnblocksHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := deliver.NewDeliver(ctx, &deliver.DeliverConfig{Sink: deliver.SinkDiscard, RemoteAddrs: []string{"127.0.0.1:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewRedisStreamFactory(d)
+	s := f.New(testFlows())
+	// a command cut short, the handler waits for the rest
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("*1\r\n$4\r\nPI"), Seen: time.Now()}})
+	time.Sleep(50 * time.Millisecond)
+	if got := f.ActiveStreams(); got != 1 {
+		t.Fatalf("%d active streams, want the blocked one", got)
+	}
+	cancel()
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for f.ActiveStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("handler still blocked in a read after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
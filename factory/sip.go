@@ -0,0 +1,226 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SIPMaxBufferSize int = 64 * 1024
+	// messages with a larger body are skipped
+	SIPMaxBodySize int64 = 16 * 1024 * 1024
+	sipVersion           = "SIP/2.0"
+)
+
+// TCP -> SIP
+type SIPStreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoSIP.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewSIPStreamFactory(d), nil
+	})
+}
+
+func (f *SIPStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoSIP.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), SIPMaxBufferSize)
+		l := s.logger().WithField("factory", "SIPStreamFactory")
+		if !isSIPClient(r) {
+			l.Debug("not a client stream, skip it")
+			drain(r)
+			return
+		}
+		c := &sipConn{r: r, l: l}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "SIPStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "SIPStreamFactory")
+		}
+	})
+	return s
+}
+
+// isSIPClient tells client streams from server ones, a server
+// stream starts with a response to the first request. Keep-alive
+// CRLFs before the first message are skipped.
+func isSIPClient(r *bufio.Reader) bool {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return false
+		}
+		if b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		r.Discard(1)
+	}
+	head, err := r.Peek(len(sipVersion) + 1)
+	if err != nil {
+		return false
+	}
+	return string(head) != sipVersion+" "
+}
+
+// sipConn is the client side of a connection.
+type sipConn struct {
+	r *bufio.Reader
+	l *log.Entry
+}
+
+// sipMessage is the start line and the headers of a message
+// used for logging and framing.
+type sipMessage struct {
+	// method of a request, status code of a response
+	method string
+	callID string
+	// top Via header, the branch correlates transactions
+	via           string
+	contentLength int64
+}
+
+// https://tools.ietf.org/html/rfc3261#section-7
+/*
+	start-line CRLF
+	*( message-header CRLF )
+	CRLF
+	[ message-body ]
+*/
+// parse returns a request or response with its body, the
+// Content-Length header is mandatory over TCP, a message without
+// it has no body. Lines before a valid start line and keep-alive
+// CRLFs between messages are skipped. The r argument is the same
+// reader as c.r.
+func (c *sipConn) parse(r io.Reader) ([]byte, error) {
+	br := c.r
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		m := &sipMessage{}
+		if !m.parseStartLine(line) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				c.l.WithField("line", string(line)).Debug("skip line")
+			}
+			continue
+		}
+		msg := line
+		for {
+			line, err := readLine(br)
+			if err != nil {
+				return nil, err
+			}
+			msg = append(msg, line...)
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				break
+			}
+			m.parseHeader(line)
+		}
+		if m.contentLength < 0 {
+			c.l.Debug("skip message with invalid Content-Length")
+			continue
+		}
+		if m.contentLength > SIPMaxBodySize {
+			c.l.WithField("len", m.contentLength).Debug("skip message with too large body")
+			if _, err := io.CopyN(ioutil.Discard, br, m.contentLength); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if m.contentLength > 0 {
+			body := make([]byte, m.contentLength)
+			if _, err := io.ReadFull(br, body); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			msg = append(msg, body...)
+		}
+		c.l.WithFields(log.Fields{
+			"method":  m.method,
+			"call-id": m.callID,
+			"via":     m.via,
+			"len":     len(msg),
+		}).Debug("got a message")
+		return msg, nil
+	}
+}
+
+// parseStartLine parses "Method Request-URI SIP/2.0" or
+// "SIP/2.0 Status-Code Reason-Phrase".
+func (m *sipMessage) parseStartLine(line []byte) bool {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return false
+	}
+	if string(fields[0]) == sipVersion {
+		code := string(fields[1])
+		if _, err := strconv.Atoi(code); err != nil || len(code) != 3 {
+			return false
+		}
+		m.method = code
+		return true
+	}
+	if len(fields) != 3 || string(fields[2]) != sipVersion {
+		return false
+	}
+	m.method = string(fields[0])
+	return true
+}
+
+// parseHeader keeps the headers used by sipMessage, compact
+// forms included.
+func (m *sipMessage) parseHeader(line []byte) {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return
+	}
+	name := string(bytes.ToLower(bytes.TrimSpace(line[:i])))
+	value := string(bytes.TrimSpace(line[i+1:]))
+	switch name {
+	case "content-length", "l":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			n = -1
+		}
+		m.contentLength = n
+	case "call-id", "i":
+		m.callID = value
+	case "via", "v":
+		if m.via == "" {
+			m.via = value
+		}
+	}
+}
+
+func NewSIPStreamFactory(d *deliver.Deliver) *SIPStreamFactory {
+	return &SIPStreamFactory{
+		d: d,
+	}
+}
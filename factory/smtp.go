@@ -0,0 +1,198 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SMTPMaxBufferSize int = 64 * 1024
+	// larger message bodies are skipped
+	SMTPMaxMessageSize int64 = 64 * 1024 * 1024
+)
+
+// SMTP commands, lines starting with anything else like replies
+// are skipped
+var smtpCommands = map[string]bool{
+	"HELO": true, "EHLO": true, "MAIL": true, "RCPT": true,
+	"DATA": true, "BDAT": true, "RSET": true, "NOOP": true,
+	"QUIT": true, "VRFY": true, "EXPN": true, "HELP": true,
+	"AUTH": true, "STARTTLS": true,
+}
+
+// TCP -> SMTP
+type SMTPStreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoSMTP.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewSMTPStreamFactory(d), nil
+	})
+}
+
+func (f *SMTPStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoSMTP.String())
+	f.start(f.d, s, func() {
+		// the same buffered reader is used by parsing and relaying
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), SMTPMaxBufferSize)
+		c := &smtpConn{r: r, l: s.logger().WithField("factory", "SMTPStreamFactory")}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "SMTPStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "SMTPStreamFactory")
+		}
+	})
+	return s
+}
+
+// smtpConn is the client side state of a connection.
+type smtpConn struct {
+	r *bufio.Reader
+	l *log.Entry
+	// DATA was read, the message body follows
+	data bool
+	// AUTH was read, base64 response lines follow until the
+	// next command
+	auth bool
+}
+
+// https://tools.ietf.org/html/rfc5321
+// https://tools.ietf.org/html/rfc2920
+// parse returns a command line, a BDAT command with its chunk,
+// or the message body after DATA up to and including the
+// terminating ".\r\n" line. Pipelined commands are returned one
+// by one, DATA is the last command of a pipelined group so the
+// body always follows it. The body is kept dot-stuffed as the
+// target expects it. The r argument is the same reader as c.r.
+func (c *smtpConn) parse(r io.Reader) ([]byte, error) {
+	for {
+		if c.data {
+			c.data = false
+			body, err := c.readBody()
+			if err != nil {
+				return nil, err
+			}
+			if body == nil {
+				continue
+			}
+			c.l.WithField("len", len(body)).Debug("got a message body")
+			return body, nil
+		}
+		line, err := readLine(c.r)
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		verb := string(bytes.ToUpper(fields[0]))
+		if !smtpCommands[verb] {
+			if c.auth {
+				c.l.Debug("got an auth response line")
+				return line, nil
+			}
+			c.l.WithField("line", string(line)).Debug("skip line")
+			continue
+		}
+		c.auth = verb == "AUTH"
+		switch verb {
+		case "DATA":
+			c.data = true
+		case "BDAT":
+			cmd, err := c.readChunk(line, fields)
+			if err != nil {
+				return nil, err
+			}
+			if cmd == nil {
+				continue
+			}
+			c.l.WithField("len", len(cmd)).Debug("got a BDAT command")
+			return cmd, nil
+		}
+		c.l.WithField("command", verb).Debug("got a command")
+		return line, nil
+	}
+}
+
+// readBody reads the message body up to the ".\r\n" line, a
+// body larger than SMTPMaxMessageSize is read and nil returned.
+// A line of a single dot ends the body, dot-stuffed lines start
+// with another dot and are kept.
+func (c *smtpConn) readBody() ([]byte, error) {
+	var body []byte
+	skip := false
+	lineStart := true
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		end := lineStart && (string(chunk) == ".\r\n" || string(chunk) == ".\n")
+		if !skip {
+			body = append(body, chunk...)
+			if int64(len(body)) > SMTPMaxMessageSize {
+				c.l.Debugf("skip message body larger than %d", SMTPMaxMessageSize)
+				skip, body = true, nil
+			}
+		}
+		if end {
+			return body, nil
+		}
+		// a full buffer leaves the line unfinished
+		lineStart = err == nil
+	}
+}
+
+// readChunk reads the chunk of "BDAT <size> [LAST]", it returns
+// nil without error for a bad size.
+func (c *smtpConn) readChunk(line []byte, fields [][]byte) ([]byte, error) {
+	if len(fields) < 2 {
+		c.l.WithField("line", string(line)).Debug("BDAT command not valid")
+		return nil, nil
+	}
+	size, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil || size < 0 || size > SMTPMaxMessageSize {
+		c.l.WithField("size", string(fields[1])).Debug("BDAT size not valid")
+		return nil, nil
+	}
+	cmd := bytes.NewBuffer(line)
+	if _, err := io.CopyN(cmd, c.r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return cmd.Bytes(), nil
+}
+
+func NewSMTPStreamFactory(d *deliver.Deliver) *SMTPStreamFactory {
+	return &SMTPStreamFactory{
+		d: d,
+	}
+}
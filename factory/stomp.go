@@ -0,0 +1,178 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	STOMPMaxBufferSize int = 64 * 1024
+	// frames with a larger body are skipped
+	STOMPMaxBodySize int64 = 16 * 1024 * 1024
+)
+
+// STOMP client frames, server frames like MESSAGE or RECEIPT
+// are skipped
+var stompCommands = map[string]bool{
+	"CONNECT": true, "STOMP": true, "SEND": true, "SUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "ACK": true, "NACK": true, "BEGIN": true,
+	"COMMIT": true, "ABORT": true, "DISCONNECT": true,
+}
+
+// TCP -> STOMP
+type STOMPStreamFactory struct {
+	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoSTOMP.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewSTOMPStreamFactory(d), nil
+	})
+}
+
+func (f *STOMPStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoSTOMP.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReaderSize(newContextReader(f.d.Ctx, s), STOMPMaxBufferSize)
+		c := &stompConn{r: r, l: s.logger().WithField("factory", "STOMPStreamFactory")}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "STOMPStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "STOMPStreamFactory")
+		}
+	})
+	return s
+}
+
+// stompConn is one side of a connection.
+type stompConn struct {
+	r *bufio.Reader
+	l *log.Entry
+}
+
+// https://stomp.github.io/stomp-specification-1.2.html#STOMP_Frames
+/*
+	COMMAND EOL
+	*( header EOL )
+	EOL
+	*OCTET NULL
+	*( EOL )
+*/
+// parse returns a client frame up to and including the NULL
+// byte. With a content-length header the body is read by length
+// so it may contain NULL bytes, otherwise up to the first NULL.
+// Heart-beat EOLs between frames are skipped. The r argument is
+// the same reader as c.r.
+func (c *stompConn) parse(r io.Reader) ([]byte, error) {
+	for {
+		line, err := readLine(c.r)
+		if err != nil {
+			return nil, err
+		}
+		command := string(bytes.TrimRight(line, "\r\n"))
+		if command == "" {
+			continue
+		}
+		frame := line
+		// the first content-length header is used
+		length := int64(-1)
+		for {
+			line, err := readLine(c.r)
+			if err != nil {
+				return nil, err
+			}
+			frame = append(frame, line...)
+			header := bytes.TrimRight(line, "\r\n")
+			if len(header) == 0 {
+				break
+			}
+			if length < 0 && bytes.HasPrefix(header, []byte("content-length:")) {
+				n, err := strconv.ParseInt(string(header[len("content-length:"):]), 10, 64)
+				if err == nil && n >= 0 {
+					length = n
+				}
+			}
+		}
+		body, err := c.readBody(length)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			c.l.WithField("command", command).Debugf("skip frame with body larger than %d", STOMPMaxBodySize)
+			continue
+		}
+		if !stompCommands[command] {
+			c.l.WithField("command", command).Debug("skip frame")
+			continue
+		}
+		frame = append(frame, body...)
+		c.l.WithFields(log.Fields{"command": command, "len": len(frame)}).Debug("got a frame")
+		return frame, nil
+	}
+}
+
+// readBody reads the body with its NULL byte, a body larger
+// than STOMPMaxBodySize is read and nil returned.
+func (c *stompConn) readBody(length int64) ([]byte, error) {
+	if length > STOMPMaxBodySize {
+		if _, err := io.CopyN(ioutil.Discard, c.r, length+1); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return nil, nil
+	}
+	if length >= 0 {
+		body := make([]byte, length+1)
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if body[length] != 0 {
+			c.l.WithField("content-length", length).Debug("body not terminated by NULL")
+		}
+		return body, nil
+	}
+	var body []byte
+	skip := false
+	for {
+		chunk, err := c.r.ReadSlice(0)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, unexpectedEOF(err)
+		}
+		if !skip {
+			body = append(body, chunk...)
+			if int64(len(body)) > STOMPMaxBodySize {
+				skip, body = true, nil
+			}
+		}
+		if err == nil {
+			return body, nil
+		}
+	}
+}
+
+func NewSTOMPStreamFactory(d *deliver.Deliver) *STOMPStreamFactory {
+	return &STOMPStreamFactory{
+		d: d,
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+	log "github.com/sirupsen/logrus"
+)
+
+// stream is a tcpreader.ReaderStream which remembers the
+// capture timestamp of the data being read, Reassembled
+// blocks until the reader consumes the data, so the latest
+// timestamp belongs to the bytes currently parsed.
+type stream struct {
+	tcpreader.ReaderStream
+	seen int64
+	// same for both directions of a connection
+	hash uint64
+	// src:port->dst:port for logging
+	flow string
+	// addresses of flow, nil unless captured over IP and tcp
+	src, dst *net.TCPAddr
+	// name of the protocol parsed, the detected one with auto
+	proto string
+	// tells handshake and auth requests of the protocol, nil
+	// if not supported
+	handshake func([]byte) bool
+	// requests dropped by DeliverConfig.SkipFirst so far
+	skipped int
+	// bytes handed to the parser by its contextReader, only
+	// used by the handler goroutine
+	read int64
+}
+
+func (s *stream) Reassembled(rs []tcpassembly.Reassembly) {
+	if len(rs) > 0 {
+		atomic.StoreInt64(&s.seen, rs[len(rs)-1].Seen.UnixNano())
+	}
+	s.ReaderStream.Reassembled(rs)
+}
+
+// Seen returns the capture timestamp of the latest data.
+func (s *stream) Seen() time.Time {
+	if seen := atomic.LoadInt64(&s.seen); seen != 0 {
+		return time.Unix(0, seen)
+	}
+	return time.Time{}
+}
+
+// logger returns a log entry with the protocol, flow and
+// stream id of s, so logs of one stream can be searched.
+func (s *stream) logger() *log.Entry {
+	return log.WithFields(log.Fields{
+		"protocol": s.proto,
+		"flow":     s.flow,
+		"stream":   s.hash,
+	})
+}
+
+// streams counts the streams of a factory whose handler
+// goroutine is still running, factories embed it.
+type streams struct {
+	n uint64
+}
+
+// ActiveStreams returns the number of streams whose handler
+// goroutine is still running.
+func (c *streams) ActiveStreams() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// start runs the handler of s in a new goroutine, counted until
+// it returns.
+func (c *streams) start(d *deliver.Deliver, s *stream, handle func()) {
+	n := atomic.AddUint64(&c.n, 1)
+	s.logger().WithField("streams", n).Debug("new stream")
+	d.Metrics.ActiveStreams.Inc()
+	go func() {
+		defer atomic.AddUint64(&c.n, ^uint64(0))
+		defer d.Metrics.ActiveStreams.Dec()
+		handle()
+	}()
+}
+
+// connKey identifies a tcp connection regardless of direction.
+type connKey struct {
+	net, transport gopacket.Flow
+}
+
+func newConnKey(net, transport gopacket.Flow) connKey {
+	src, dst := net.Endpoints()
+	tsrc, tdst := transport.Endpoints()
+	if src.LessThan(dst) || (src == dst && tsrc.LessThan(tdst)) {
+		return connKey{net, transport}
+	}
+	return connKey{net.Reverse(), transport.Reverse()}
+}
+
+// sampled reports whether the stream is kept by connection
+// sampling, the rest of a dropped stream is discarded.
+func (s *stream) sampled(d *deliver.Deliver, r io.Reader) bool {
+	if d.SampleConn(s.hash) {
+		return true
+	}
+	drain(r)
+	return false
+}
+
+// drain discards the rest of a stream whose handler is done,
+// Reassembled blocks until its data is read, so a stream left
+// unread stalls the assembler and all other connections. It
+// stops at the first error, not at EOF, as a contextReader
+// returns ctx.Err() on every read once deliver is stopped.
+// The buffer of tcpreader.DiscardBytesToFirstError is shared by
+// all streams, io.Copy takes one from a pool.
+func drain(r io.Reader) {
+	io.Copy(ioutil.Discard, r)
+}
+
+// request returns a request of data parsed from s, stamped
+// with the capture time of the data being read.
+func (s *stream) request(data []byte) *deliver.Request {
+	return &deliver.Request{
+		Data:  data,
+		Time:  s.Seen(),
+		Conn:  s.hash,
+		Proto: s.proto,
+		Flow:  s.flow,
+		// the request is parsed already, the classifier may
+		// look at it as a whole
+		Handshake: s.handshake != nil && s.handshake(data),
+	}
+}
+
+// skipFirst reports whether a request is among the first
+// DeliverConfig.SkipFirst ones of the stream, which are dropped.
+func (s *stream) skipFirst(d *deliver.Deliver) bool {
+	if s.skipped < d.Config.SkipFirst {
+		s.skipped++
+		return true
+	}
+	return false
+}
+
+// tcpAddr returns the address of ip and port endpoints, nil if
+// they are not an IP address and a tcp port.
+func tcpAddr(ip, port gopacket.Endpoint) *net.TCPAddr {
+	if len(port.Raw()) != 2 || (len(ip.Raw()) != net.IPv4len && len(ip.Raw()) != net.IPv6len) {
+		return nil
+	}
+	return &net.TCPAddr{IP: net.IP(ip.Raw()), Port: int(binary.BigEndian.Uint16(port.Raw()))}
+}
+
+func newStream(net, transport gopacket.Flow, proto string) *stream {
+	src, dst := net.Endpoints()
+	sport, dport := transport.Endpoints()
+	return &stream{
+		src:          tcpAddr(src, sport),
+		dst:          tcpAddr(dst, dport),
+		flow:         fmt.Sprintf("%v:%v->%v:%v", src, sport, dst, dport),
+		proto:        proto,
+		ReaderStream: tcpreader.NewReaderStream(),
+		// FastHash is symmetric
+		hash: net.FastHash()*31 + transport.FastHash(),
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TDSHeaderSize int = 8
+	// larger messages are taken as garbage, bulk loads of
+	// huge batches are given up
+	TDSMaxMessageSize int = 64 * 1024 * 1024
+	// status bit of the last packet of a message
+	TDSStatusEOM byte = 0x01
+)
+
+// TDS packet types
+const (
+	TDSSQLBatch    byte = 0x01
+	TDSPreTDS7     byte = 0x02
+	TDSRPC         byte = 0x03
+	TDSTabular     byte = 0x04
+	TDSAttention   byte = 0x06
+	TDSBulkLoad    byte = 0x07
+	TDSFedAuth     byte = 0x08
+	TDSTransaction byte = 0x0E
+	TDSLogin7      byte = 0x10
+	TDSSSPI        byte = 0x11
+	TDSPrelogin    byte = 0x12
+)
+
+// packet types sent by clients
+var tdsClientTypes = map[byte]bool{
+	TDSSQLBatch: true, TDSPreTDS7: true, TDSRPC: true, TDSAttention: true,
+	TDSBulkLoad: true, TDSFedAuth: true, TDSTransaction: true, TDSLogin7: true,
+	TDSSSPI: true, TDSPrelogin: true,
+}
+
+// message types replayed with QueryOnly, transaction manager
+// requests are kept so that transactions begun by them commit
+var tdsQueries = map[byte]bool{
+	TDSSQLBatch: true, TDSRPC: true, TDSTransaction: true,
+}
+
+// TCP -> SQL Server TDS 7.x
+type TDSStreamFactory struct {
+	d *deliver.Deliver
+	// skip pre-login, login and authentication messages
+	queryOnly bool
+	streams
+}
+
+func init() {
+	Register(ProtoTDS.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewTDSStreamFactory(d, o.QueryOnly), nil
+	})
+}
+
+func (f *TDSStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoTDS.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		// servers only send tabular results
+		l := s.logger().WithField("factory", "TDSStreamFactory")
+		if head, err := r.Peek(1); err != nil || !tdsClientTypes[head[0]] {
+			l.Debug("not a client stream, skip it")
+			drain(r)
+			return
+		}
+		parse := f.tdsParser(l)
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "TDSStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "TDSStreamFactory")
+		}
+	})
+	return s
+}
+
+// tdsParser returns the parseFunc of a stream, l logs its flow.
+func (f *TDSStreamFactory) tdsParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseTDSMessage(r, l)
+	}
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-tds
+/*
+Packet header:
++--------+--------+--------+--------+--------+--------+--------+--------+
+| type   | status | length          | spid            | packet | window |
++--------+--------+--------+--------+--------+--------+--------+--------+
+Length is big endian and counts the header. A message is split
+into packets of the negotiated size, the last one has the EOM
+bit of status set. With encryption the TLS handshake is carried
+by pre-login packets and later packets are TLS records, which
+can not be parsed.
+*/
+// parseTDSMessage returns the packets of a whole client message
+// including their headers, pre-login, login and authentication
+// messages are skipped with QueryOnly.
+func (f *TDSStreamFactory) parseTDSMessage(r io.Reader, l *log.Entry) ([]byte, error) {
+	for {
+		msg, err := readTDSMessage(r, l)
+		if err != nil {
+			return nil, err
+		}
+		typ := msg[0]
+		if f.queryOnly && !tdsQueries[typ] {
+			l.WithField("type", typ).Debug("skip message")
+			continue
+		}
+		l.WithFields(log.Fields{"len": len(msg), "type": typ}).Debug("got a valid message")
+		return msg, nil
+	}
+}
+
+func readTDSMessage(r io.Reader, l *log.Entry) ([]byte, error) {
+	var msg []byte
+	for {
+		header := make([]byte, TDSHeaderSize)
+		if _, err := io.ReadFull(r, header); err != nil {
+			l.WithError(err).Debug("read header failed")
+			if len(msg) > 0 {
+				return nil, unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		typ, length := header[0], int(binary.BigEndian.Uint16(header[2:]))
+		if !tdsClientTypes[typ] || length < TDSHeaderSize {
+			// no magic to resync on, give up the stream
+			return nil, fmt.Errorf("packet type 0x%02x len %d not valid", typ, length)
+		}
+		if len(msg) > 0 && typ != msg[0] {
+			return nil, fmt.Errorf("packet type 0x%02x within a message of type 0x%02x", typ, msg[0])
+		}
+		if len(msg)+length > TDSMaxMessageSize {
+			return nil, fmt.Errorf("message of type 0x%02x longer than %d", typ, TDSMaxMessageSize)
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, length)...)
+		copy(msg[start:], header)
+		if _, err := io.ReadFull(r, msg[start+TDSHeaderSize:]); err != nil {
+			l.WithError(err).Debug("read packet body failed")
+			return nil, unexpectedEOF(err)
+		}
+		if header[1]&TDSStatusEOM != 0 {
+			return msg, nil
+		}
+	}
+}
+
+func NewTDSStreamFactory(d *deliver.Deliver, queryOnly bool) *TDSStreamFactory {
+	return &TDSStreamFactory{
+		d:         d,
+		queryOnly: queryOnly,
+	}
+}
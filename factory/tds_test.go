@@ -0,0 +1,84 @@
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// tdsPacket returns a packet of typ with body, the last one of
+// its message if eom.
+func tdsPacket(typ byte, eom bool, body string) []byte {
+	packet := []byte{typ, 0, 0, 0, 0, 0, 1, 0}
+	if eom {
+		packet[1] = TDSStatusEOM
+	}
+	binary.BigEndian.PutUint16(packet[2:], uint16(TDSHeaderSize+len(body)))
+	return append(packet, body...)
+}
+
+// tdsMessages returns the messages parsed from packets by a
+// factory skipping logins if queryOnly.
+func tdsMessages(t *testing.T, f *TDSStreamFactory, packets ...[]byte) [][]byte {
+	t.Helper()
+	parse := f.tdsParser(testLogger())
+	r := &chunkReader{r: bytes.NewReader(bytes.Join(packets, nil)), n: 5}
+	var msgs [][]byte
+	for {
+		msg, err := parse(r)
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestTDSMultiPacketMessage(t *testing.T) {
+	batch := [][]byte{
+		tdsPacket(TDSSQLBatch, false, "select * "),
+		tdsPacket(TDSSQLBatch, false, "from t "),
+		tdsPacket(TDSSQLBatch, true, "where id = 1"),
+	}
+	rpc := tdsPacket(TDSRPC, true, "sp_executesql")
+	msgs := tdsMessages(t, NewTDSStreamFactory(newTestDeliver(t, nil), false), append(batch, rpc)...)
+	if len(msgs) != 2 || !bytes.Equal(msgs[0], bytes.Join(batch, nil)) || !bytes.Equal(msgs[1], rpc) {
+		t.Fatalf("got %q, want the batch up to its EOM packet and the rpc", msgs)
+	}
+
+	// a message cut off before its EOM packet
+	_, err := readTDSMessage(bytes.NewReader(bytes.Join(batch[:2], nil)), testLogger())
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v for a message without EOM, want unexpected EOF", err)
+	}
+	// another type within a message
+	_, err = readTDSMessage(bytes.NewReader(append(append([]byte{}, batch[0]...), rpc...)), testLogger())
+	if err == nil {
+		t.Fatal("packets of two types parsed as one message")
+	}
+}
+
+func TestTDSQueryOnlySkipsLogin(t *testing.T) {
+	packets := [][]byte{
+		tdsPacket(TDSPrelogin, true, "prelogin"),
+		tdsPacket(TDSLogin7, false, "login "),
+		tdsPacket(TDSLogin7, true, "packet"),
+		tdsPacket(TDSSQLBatch, true, "select 1"),
+		tdsPacket(TDSAttention, true, ""),
+		tdsPacket(TDSRPC, true, "sp_executesql"),
+	}
+	d := newTestDeliver(t, nil)
+	var types []byte
+	for _, msg := range tdsMessages(t, NewTDSStreamFactory(d, true), packets...) {
+		types = append(types, msg[0])
+	}
+	if want := []byte{TDSSQLBatch, TDSRPC}; !bytes.Equal(types, want) {
+		t.Fatalf("query only got types %x, want %x", types, want)
+	}
+	if msgs := tdsMessages(t, NewTDSStreamFactory(d, false), packets...); len(msgs) != 5 {
+		t.Fatalf("got %d messages, want all 5", len(msgs))
+	}
+}
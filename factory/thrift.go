@@ -14,66 +14,198 @@
 package factory
 
 import (
-	"context"
+	"bufio"
+	"encoding/binary"
 	"io"
-	"sync/atomic"
 
 	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/metrics"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 	log "github.com/sirupsen/logrus"
 )
 
-const ThriftMaxBufferSize int = 4096
+const (
+	ThriftMaxBufferSize int = 4096
+	// same as the default max frame size of thrift libraries
+	ThriftMaxFrameSize int = 16384000
+)
 
-// TCP -> Thrift
-var thriftStreamCount uint64
+// thrift message types
+const (
+	ThriftCall      byte = 1
+	ThriftReply     byte = 2
+	ThriftException byte = 3
+	ThriftOneway    byte = 4
+)
 
+// TCP -> Thrift
 type ThriftStreamFactory struct {
 	d *deliver.Deliver
+	streams
+}
+
+func init() {
+	Register(ProtoThrift.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewThriftStreamFactory(d), nil
+	})
 }
 
 func (f *ThriftStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
-	s := tcpreader.NewReaderStream()
-	n := atomic.AddUint64(&thriftStreamCount, 1)
-	log.Debugf("stream count %d", n)
-	go f.handleThriftStream(&s)
-	return &s
+	s := newStream(l, r, ProtoThrift.String())
+	f.start(f.d, s, func() { f.handleThriftStream(s) })
+	return s
 }
 
-func (f *ThriftStreamFactory) handleThriftStream(r io.Reader) {
-	ctx, cancel := context.WithCancel(f.d.Ctx)
-	defer cancel()
-	sender, err := deliver.NewLongConnSender(ctx, f.d.Config.Clone+1, f.d.Config.RemoteAddr)
-	if err != nil {
-		log.Errorf("thriftStreamFactory create sender error: %v", err)
+// Framed transport streams are split into frames, calls are
+// sent one by one in ModeRequest. Unframed streams have no
+// message boundary, we assume the packets following a valid
+// message header are valid thrift requests, and relay them
+// as raw bytes, so they are only replayed in ModeRaw.
+func (f *ThriftStreamFactory) handleThriftStream(s *stream) {
+	compact := f.d.Config.ProtocolType == deliver.TCompactProtocol
+	r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+	l := s.logger().WithField("factory", "ThriftStreamFactory")
+	if !isThriftFramed(r, compact) {
+		if f.d.Config.Mode != deliver.ModeRaw {
+			l.Error("stream looks like unframed transport, which needs ModeRaw, skip it")
+			drain(r)
+			return
+		}
+		parser := func(r io.Reader) ([]byte, error) {
+			if compact {
+				return f.parseThriftCompactMessageHeader(r, l)
+			}
+			return f.parseThriftBinaryMessageHeader(r, l)
+		}
+		relayRaw(f.d, s, r, parser, "ThriftStreamFactory")
 		return
 	}
-	parser := f.parseThriftBinaryMessageHeader
-	if f.d.Config.ProtocolType == deliver.TCompactProtocol {
-		parser = f.parseThriftCompactMessageHeader
+	c := &thriftConn{r: r, compact: compact, m: f.d.Metrics, l: l}
+	if f.d.Config.Mode == deliver.ModeRaw {
+		relayRaw(f.d, s, r, c.parse, "ThriftStreamFactory")
+	} else {
+		handleRequests(f.d, s, r, c.parse, "ThriftStreamFactory")
+	}
+}
+
+// isThriftFramed tells framed streams from unframed ones, an
+// unframed stream starts with the protocol magic whose high
+// bit is set, while the frame size of a framed one is below
+// 2^31. Streams starting with anything else are taken as
+// framed, the parser resyncs on the next frame.
+func isThriftFramed(r *bufio.Reader, compact bool) bool {
+	head, err := r.Peek(2)
+	if err != nil {
+		return true
+	}
+	return !isThriftMagic(head, compact)
+}
+
+func isThriftMagic(head []byte, compact bool) bool {
+	if compact {
+		return head[0] == 0x82 && head[1]&0x1f == 1
 	}
+	return head[0] == 0x80 && head[1] == 0x01
+}
+
+// thriftConn is the state of a framed transport stream.
+type thriftConn struct {
+	r       *bufio.Reader
+	compact bool
+	m       *metrics.Set
+	l       *log.Entry
+}
+
+/*
+Framed transport:
++--------+--------+--------+--------+...+--------+
+| frame size                        | message    |
++--------+--------+--------+--------+...+--------+
+The frame size is big endian and does not count itself.
+*/
+// parse returns a whole frame of a call or oneway message,
+// replies and exceptions of server streams are skipped.
+// The r argument is the same reader as c.r.
+func (c *thriftConn) parse(r io.Reader) ([]byte, error) {
 	for {
-		// we assume the following packets are valid thrift requests
-		header, err := parser(r)
+		frame, err := c.readFrame()
 		if err != nil {
-			log.Errorf("ThriftStreamFactory parse thrift message header failed: %v", err)
-			return
+			return nil, err
 		}
-		sender.Data() <- header
-		for {
-			buf := make([]byte, ThriftMaxBufferSize)
-			if n, err := io.ReadFull(r, buf); err != nil {
-				log.Errorf("ThriftStreamFactory read full failed: %v", err)
-				if n > 0 {
-					sender.Data() <- buf[:n]
+		name, typ, seqID, ok := parseThriftMessageHeader(frame[4:], c.compact)
+		if !ok {
+			c.l.WithField("len", len(frame)).Debug("skip frame with a bad message header")
+			continue
+		}
+		if typ != ThriftCall && typ != ThriftOneway {
+			c.l.WithFields(log.Fields{"name": name, "type": typ, "seqid": seqID}).Debug("skip message")
+			continue
+		}
+		c.l.WithFields(log.Fields{"name": name, "type": typ, "seqid": seqID, "len": len(frame)}).Debug("got a valid message")
+		return frame, nil
+	}
+}
+
+// readFrame returns a whole frame, the stream is resynced one
+// byte later if the size is bad or no message magic follows.
+func (c *thriftConn) readFrame() ([]byte, error) {
+	skipped := 0
+	for {
+		head, err := c.r.Peek(6)
+		if err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint32(head))
+		if size >= 3 && size <= ThriftMaxFrameSize && isThriftMagic(head[4:], c.compact) {
+			if skipped > 0 {
+				c.l.WithField("skipped", skipped).Debug("resynced on a valid frame")
+				countResync(c.m, skipped)
+			}
+			frame := make([]byte, 4+size)
+			if _, err := io.ReadFull(c.r, frame); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
 				}
-				break
+				return nil, err
 			}
-			sender.Data() <- buf
+			return frame, nil
 		}
+		c.r.Discard(1)
+		skipped++
+	}
+}
+
+// parseThriftMessageHeader returns the name, type and seqid
+// of the message starting msg.
+func parseThriftMessageHeader(msg []byte, compact bool) (name string, typ byte, seqID int32, ok bool) {
+	if compact {
+		if len(msg) < 2 {
+			return "", 0, 0, false
+		}
+		typ = msg[1] >> 5
+		seq, n := binary.Uvarint(msg[2:])
+		if n <= 0 {
+			return "", 0, 0, false
+		}
+		size, m := binary.Uvarint(msg[2+n:])
+		if m <= 0 || uint64(len(msg)-2-n-m) < size {
+			return "", 0, 0, false
+		}
+		start := 2 + n + m
+		return string(msg[start : start+int(size)]), typ, int32(seq), true
+	}
+	if len(msg) < 8 {
+		return "", 0, 0, false
+	}
+	typ = msg[3] & 0x07
+	size := binary.BigEndian.Uint32(msg[4:])
+	if uint64(len(msg)-8) < uint64(size)+4 {
+		return "", 0, 0, false
 	}
+	name = string(msg[8 : 8+size])
+	seqID = int32(binary.BigEndian.Uint32(msg[8+size:]))
+	return name, typ, seqID, true
 }
 
 // https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
@@ -90,14 +222,14 @@ Where:
     * name length is the byte length of the name field, a signed 32 bit integer encoded as a var int (must be >= 0).
     * name is the method name to invoke, a UTF-8 encoded string.)
 */
-func (f *ThriftStreamFactory) parseThriftCompactMessageHeader(r io.Reader) ([]byte, error) {
+func (f *ThriftStreamFactory) parseThriftCompactMessageHeader(r io.Reader, l *log.Entry) ([]byte, error) {
 	vFirstByte := make([]byte, 1)
 	vSecondByte := make([]byte, 1)
 	for {
 		// loop until find a valid first byte
 		for {
 			if _, err := io.ReadFull(r, vFirstByte); err != nil || int(vFirstByte[0]) != 0x82 {
-				log.Debugf("ThriftStreamFactory read version first byte failed: %v", err)
+				l.WithError(err).Debug("read version first byte failed")
 				if err == io.EOF {
 					return nil, err
 				}
@@ -106,14 +238,14 @@ func (f *ThriftStreamFactory) parseThriftCompactMessageHeader(r io.Reader) ([]by
 			break
 		}
 		if _, err := io.ReadFull(r, vSecondByte); err != nil || (int(vSecondByte[0])&0x1f) != 1 {
-			log.Debugf("ThriftStreamFactory read version second byte failed: %v", err)
+			l.WithError(err).Debug("read version second byte failed")
 			if err == io.EOF {
 				return nil, err
 			}
 			continue
 		}
 		msgHdr := []byte{vFirstByte[0], vSecondByte[0]}
-		log.Debugf("ThriftStreamFactory got a valid request header: %v", msgHdr)
+		l.WithField("header", msgHdr).Debug("got a valid request header")
 		return msgHdr, nil
 	}
 }
@@ -128,7 +260,7 @@ Binary protocol Message, strict encoding, 12+ bytes:
 // Parse thrift message header, we just use the leading
 // 29 bits to recognize a valid thrift message.
 // 10000000 00000001 00000000 00000xxx
-func (f *ThriftStreamFactory) parseThriftBinaryMessageHeader(r io.Reader) ([]byte, error) {
+func (f *ThriftStreamFactory) parseThriftBinaryMessageHeader(r io.Reader, l *log.Entry) ([]byte, error) {
 	vFirstByte := make([]byte, 1)
 	vSecondByte := make([]byte, 1)
 	vThirdByte := make([]byte, 1)
@@ -137,7 +269,7 @@ func (f *ThriftStreamFactory) parseThriftBinaryMessageHeader(r io.Reader) ([]byt
 		// loop until find a valid first byte
 		for {
 			if _, err := io.ReadFull(r, vFirstByte); err != nil || int(vFirstByte[0]) != 128 {
-				log.Debugf("ThriftStreamFactory read version first byte failed: %v", err)
+				l.WithError(err).Debug("read version first byte failed")
 				if err == io.EOF {
 					return nil, err
 				}
@@ -146,14 +278,14 @@ func (f *ThriftStreamFactory) parseThriftBinaryMessageHeader(r io.Reader) ([]byt
 			break
 		}
 		if _, err := io.ReadFull(r, vSecondByte); err != nil || int(vSecondByte[0]) != 1 {
-			log.Debugf("ThriftStreamFactory read version second byte failed: %v", err)
+			l.WithError(err).Debug("read version second byte failed")
 			if err == io.EOF {
 				return nil, err
 			}
 			continue
 		}
 		if _, err := io.ReadFull(r, vThirdByte); err != nil || int(vThirdByte[0]) != 0 {
-			log.Debugf("ThriftStreamFactory read version third byte failed: %v", err)
+			l.WithError(err).Debug("read version third byte failed")
 			if err == io.EOF {
 				return nil, err
 			}
@@ -161,14 +293,14 @@ func (f *ThriftStreamFactory) parseThriftBinaryMessageHeader(r io.Reader) ([]byt
 		}
 
 		if _, err := io.ReadFull(r, vFourthByte); err != nil || int(vFourthByte[0]) > 7 || int(vFourthByte[0]) < 0 {
-			log.Debugf("ThriftStreamFactory read version fourth byte failed: %v", err)
+			l.WithError(err).Debug("read version fourth byte failed")
 			if err == io.EOF {
 				return nil, err
 			}
 			continue
 		}
 		msgHdr := []byte{vFirstByte[0], vSecondByte[0], vThirdByte[0], vFourthByte[0]}
-		log.Debugf("ThriftStreamFactory got a valid request header: %v", msgHdr)
+		l.WithField("header", msgHdr).Debug("got a valid request header")
 		return msgHdr, nil
 	}
 }
@@ -14,193 +14,212 @@
 package factory
 
 import (
-	"context"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"sync/atomic"
 
 	"github.com/feilengcui008/tcplayer/deliver"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 	log "github.com/sirupsen/logrus"
 )
 
-const VideoPacketMaxBufferSize int = 4096
+const VideoPacketMaxBufferSize int = RawMaxBufferSize
 
-// TCP -> VideoPacket
-var videoPacketStreamCount uint64
+// VideoPacketMaxReadRetries is the number of consecutive non-EOF
+// read errors tolerated while scanning for the header byte.
+const VideoPacketMaxReadRetries int = 3
+
+// VideoPacketOverhead is the frame length without data, the length
+// field counts 1 header byte, 4 length bytes, 1 version byte, 10
+// reserved bytes and 1 tail byte.
+const VideoPacketOverhead uint32 = 17
 
+// default max data bytes of a frame, larger frames are dropped
+const VideoPacketMaxFrameSize int = 10 * 1024 * 1024
+
+// TCP -> VideoPacket
 type VideoPacketStreamFactory struct {
 	d *deliver.Deliver
+	// max data bytes of a frame
+	maxFrameSize uint64
+	// deliver a frame missing its tail byte at the end of a
+	// stream
+	flushPartial bool
+	streams
+	// junk bytes skipped while resyncing on the header byte
+	skippedBytes uint64
 }
 
-func (f *VideoPacketStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
-	s := tcpreader.NewReaderStream()
-	n := atomic.AddUint64(&videoPacketStreamCount, 1)
-	log.Debugf("stream count %d", n)
-	if f.d.Config.Mode == deliver.ModeRaw {
-		go f.handleVideoPacketRaw(&s)
-	} else {
-		go f.handleVideoPacketRequest(&s)
-	}
-	return &s
+func init() {
+	Register(ProtoVideoPacket.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewVideoPacketStreamFactory(d, o.MaxFrameSize, o.FlushPartialOnEOF), nil
+	})
 }
 
-func (f *VideoPacketStreamFactory) handleVideoPacketRequest(r io.Reader) {
-	for {
-		// must be a valid request or EOF
-		req, err := f.parseVideoPacketRequest(r)
-		if err != nil {
-			log.Errorf("VideoPacketStreamFactory did not find a valid req: %v", err)
-			return
+func (f *VideoPacketStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoVideoPacket.String())
+	f.start(f.d, s, func() {
+		// reads return once deliver is stopped
+		r := newContextReader(f.d.Ctx, s)
+		parse := f.videoPacketParser(s.logger().WithField("factory", "VideoPacketStreamFactory"))
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "VideoPacketStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "VideoPacketStreamFactory")
 		}
-		f.d.C <- req
-	}
+	})
+	return s
 }
 
-func (f *VideoPacketStreamFactory) handleVideoPacketRaw(r io.Reader) {
-	ctx, cancel := context.WithCancel(f.d.Ctx)
-	defer cancel()
-
-	sender, err := deliver.NewLongConnSender(ctx, f.d.Config.Clone+1, f.d.Config.RemoteAddr)
-	if err != nil {
-		log.Errorf("Create sender failed: %v", err)
-		return
-	}
-
-	for {
-		// first we get a valid request, then we can
-		// assume the following traffic contains all
-		// valid requests until error happens
-		req, err := f.parseVideoPacketRequest(r)
-		if err != nil {
-			log.Errorf("VideoPacketStreamFactory did not find a valid req: %v", err)
-			return
-		}
-		sender.Data() <- req
-
-		for {
-			// buf must in loop for avoiding race condition
-			buf := make([]byte, VideoPacketMaxBufferSize)
-			// when error happens, we go to outer loop
-			// and try to refind a valid request
-			if n, err := io.ReadFull(r, buf); err != nil {
-				log.Errorf("VideoPacketStreamFactory read full failed: %v", err)
-				if n > 0 {
-					sender.Data() <- buf
-				}
-				break
-			}
-			sender.Data() <- buf
-		}
+// videoPacketParser returns the parseFunc of a stream, l logs
+// its flow.
+func (f *VideoPacketStreamFactory) videoPacketParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseVideoPacketRequest(r, l)
 	}
 }
 
-func (f *VideoPacketStreamFactory) parseVideoPacketRequest(r io.Reader) ([]byte, error) {
+// parseVideoPacketRequest returns a whole frame, frames with
+// data larger than maxFrameSize are drained by their declared
+// length and dropped, so parsing goes on with the next frame.
+func (f *VideoPacketStreamFactory) parseVideoPacketRequest(r io.Reader, l *log.Entry) ([]byte, error) {
 	for {
-		// 1 header byte
+		// 1 header byte, skip junk bytes until the magic
 		proto := make([]byte, 1)
+		skipped, failures := 0, 0
 		for {
-			if _, err := r.Read(proto); err != nil {
-				log.Debugf("read header byte for VideoPacket failed: %v", err)
+			if n, err := r.Read(proto); err != nil {
+				l.WithError(err).Debug("read header byte failed")
 				if err == io.EOF {
 					return nil, err
 				}
-			} else {
+				// a persistent error would spin here forever
+				failures++
+				if failures >= VideoPacketMaxReadRetries {
+					return nil, err
+				}
+			} else if n > 0 {
+				failures = 0
 				// maybe a valid packet
 				if int(proto[0]) == 0x26 {
+					l.WithField("skipped", skipped).Debug("resynced on a valid proto head")
+					countResync(f.d.Metrics, skipped)
 					break
 				}
-				log.Debugf("got a valid proto head")
+				skipped++
+				atomic.AddUint64(&f.skippedBytes, 1)
 			}
 		}
-		// 4 length bytes
+		// 4 length bytes, fixed-length fields must be read
+		// fully, a short read means we lost sync with the
+		// frame, so return the error to the stream handler
 		length := make([]byte, 4)
-		var dataLength uint64 = 0
-		if _, err := r.Read(length); err != nil {
-			log.Debugf("read length for VideoPacket failed: %v", err)
-			if err == io.EOF {
-				return nil, err
-			}
-		} else {
-			dataLength = uint64(binary.BigEndian.Uint32(length)) - 17
-			if dataLength < 0 {
-				log.Debugf("length %d for VideoPacket not valid", dataLength)
-				continue
-			}
-			log.Debugf("got a valid data len %d", dataLength)
+		if _, err := io.ReadFull(r, length); err != nil {
+			l.WithError(err).Debug("read length failed")
+			return nil, err
+		}
+		// validate the raw length before subtracting, or a
+		// truncated frame wraps dataLength to a huge value
+		frameLength := binary.BigEndian.Uint32(length)
+		if frameLength < VideoPacketOverhead {
+			l.WithField("len", frameLength).Debug("length not valid")
+			continue
 		}
+		dataLength := uint64(frameLength - VideoPacketOverhead)
+		l.WithField("len", dataLength).Debug("got a valid data length")
 		// 1 version byte
 		version := make([]byte, 1)
-		if _, err := r.Read(version); err != nil {
-			log.Debugf("read version for VideoPacket failed: %v", err)
-			if err == io.EOF {
-				return nil, err
-			}
-		} else {
-			if int(version[0]) != 1 {
-				log.Debugf("version %d for VideoPacket not valid", int(version[0]))
-				continue
-			}
-			log.Debugf("read version %d", int(version[0]))
+		if _, err := io.ReadFull(r, version); err != nil {
+			l.WithError(err).Debug("read version failed")
+			return nil, err
 		}
+		if int(version[0]) != 1 {
+			l.WithField("version", version[0]).Debug("version not valid")
+			continue
+		}
+		l.WithField("version", version[0]).Debug("read version")
 		// 10 reserved bytes
 		reserved := make([]byte, 10)
-		if n, err := r.Read(reserved); err != nil {
-			log.Debugf("read reserved for VideoPacket failed: %v", err)
-			if err == io.EOF {
-				return nil, err
-			}
-		} else {
-			log.Debugf("read reserved len %d", n)
+		if _, err := io.ReadFull(r, reserved); err != nil {
+			l.WithError(err).Debug("read reserved failed")
+			return nil, err
 		}
 		// read data
 		data := []byte{}
 		if dataLength > 0 {
-			if dataLength > 1024*1024*10 {
-				log.Debugf("data length too long, skip this request")
+			if dataLength > f.maxFrameSize {
+				// the data and the tail byte
+				if _, err := io.CopyN(ioutil.Discard, r, int64(dataLength)+1); err != nil {
+					l.WithError(err).Debug("drain oversized data failed")
+					return nil, unexpectedEOF(err)
+				}
+				f.d.Metrics.OversizedFrames.Inc()
+				l.WithField("len", dataLength).Warnf("drop VideoPacket frame larger than %d", f.maxFrameSize)
 				continue
 			}
+			// a single Read of a stream returns at most the
+			// bytes of one segment, large frames need many
 			data = make([]byte, dataLength)
-			if n, err := r.Read(data); err != nil {
-				log.Debugf("read data for VideoPacket failed: %v", err)
+			if _, err := io.ReadFull(r, data); err != nil {
+				l.WithError(err).Debug("read data failed")
 				if err == io.EOF {
-					return nil, err
+					err = io.ErrUnexpectedEOF
 				}
-			} else {
-				log.Debugf("read data len %d", n)
+				return nil, err
 			}
+			l.WithField("len", len(data)).Debug("read data")
 		}
 		// 1 tail byte
 		tail := make([]byte, 1)
-		if _, err := r.Read(tail); err != nil {
-			log.Debugf("read tail byte for VideoPacket failed: %v", err)
-			if err == io.EOF {
-				return nil, err
-			}
-		} else {
-			if int(tail[0]) != 0x28 {
-				log.Debugf("tail byte is not 0x28")
-				continue
+		if _, err := io.ReadFull(r, tail); err != nil {
+			l.WithError(err).Debug("read tail byte failed")
+			if err == io.EOF && f.flushPartial && f.d.Config.Mode != deliver.ModeRaw {
+				tail[0] = 0x28
+				return nil, &partialRequest{data: joinVideoPacket(proto, length, version, reserved, data, tail)}
 			}
+			return nil, err
+		}
+		if int(tail[0]) != 0x28 {
+			l.Debug("tail byte is not 0x28")
+			continue
 		}
 
-		reqData := []byte{}
-		reqData = append(reqData, proto[:]...)
-		reqData = append(reqData, length[:]...)
-		reqData = append(reqData, version[:]...)
-		reqData = append(reqData, reserved[:]...)
-		reqData = append(reqData, data[:]...)
-		reqData = append(reqData, tail[:]...)
-		log.Debugf("got a valid VideoPacket len %d, content %v", len(reqData), reqData)
+		reqData := joinVideoPacket(proto, length, version, reserved, data, tail)
+		l.WithFields(log.Fields{"len": len(reqData), "content": reqData}).Debug("got a valid frame")
 		return reqData, nil
 	}
 
 }
 
-func NewVideoPacketStreamFactory(d *deliver.Deliver) *VideoPacketStreamFactory {
+func joinVideoPacket(fields ...[]byte) []byte {
+	reqData := []byte{}
+	for _, field := range fields {
+		reqData = append(reqData, field...)
+	}
+	return reqData
+}
+
+// SkippedBytes returns the number of junk bytes skipped
+// before a valid header byte was found, a growing value
+// means the captured stream is noisy or out of sync.
+func (f *VideoPacketStreamFactory) SkippedBytes() uint64 {
+	return atomic.LoadUint64(&f.skippedBytes)
+}
+
+// NewVideoPacketStreamFactory creates a factory dropping frames
+// with more than maxFrameSize data bytes, default
+// VideoPacketMaxFrameSize. With flushPartial a frame missing
+// only its tail byte at the end of a stream is delivered with
+// the tail added.
+func NewVideoPacketStreamFactory(d *deliver.Deliver, maxFrameSize int, flushPartial bool) *VideoPacketStreamFactory {
+	if maxFrameSize <= 0 {
+		maxFrameSize = VideoPacketMaxFrameSize
+	}
 	return &VideoPacketStreamFactory{
-		d: d,
+		d:            d,
+		maxFrameSize: uint64(maxFrameSize),
+		flushPartial: flushPartial,
 	}
 }
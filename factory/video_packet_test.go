@@ -0,0 +1,221 @@
+package factory
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// chunkReader returns at most n bytes per Read, like a
+// tcpreader stream returns the bytes of one segment.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+// videoPacketFrame returns a frame of data.
+func videoPacketFrame(data []byte) []byte {
+	frame := []byte{0x26, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data))+VideoPacketOverhead)
+	frame = append(frame, make([]byte, 10)...)
+	frame = append(frame, data...)
+	return append(frame, 0x28)
+}
+
+func TestVideoPacketLargeFrameInSegments(t *testing.T) {
+	data := make([]byte, 4<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	frame := videoPacketFrame(data)
+	f := NewVideoPacketStreamFactory(newTestDeliver(t, nil), 0, false)
+	r := &chunkReader{r: bytes.NewReader(frame), n: 1460}
+	got, err := f.parseVideoPacketRequest(r, log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Fatalf("got a frame of %d bytes, want the %d bytes sent", len(got), len(frame))
+	}
+	if _, err := f.parseVideoPacketRequest(r, log.NewEntry(log.StandardLogger())); err != io.EOF {
+		t.Fatalf("got %v after the frame, want EOF", err)
+	}
+}
+
+func TestVideoPacketOversizedFrame(t *testing.T) {
+	m := metrics.NewSet()
+	d := newTestDeliver(t, &deliver.DeliverConfig{Sink: deliver.SinkDiscard, Metrics: m})
+	f := NewVideoPacketStreamFactory(d, 16, false)
+	// the data of the oversized frame holds the header byte,
+	// it is drained by its declared length, not resynced on
+	oversized := videoPacketFrame(bytes.Repeat([]byte{0x26}, 17))
+	valid := videoPacketFrame([]byte("0123456789abcdef"))
+	r := bytes.NewReader(append(oversized, valid...))
+	got, err := f.parseVideoPacketRequest(r, log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, valid) {
+		t.Fatalf("got %v after an oversized frame, want the next frame", got)
+	}
+	if n := m.OversizedFrames.Value(); n != 1 {
+		t.Fatalf("%d oversized frames counted, want 1", n)
+	}
+	if n := f.SkippedBytes(); n != 0 {
+		t.Fatalf("%d bytes skipped, want 0", n)
+	}
+}
+
+func TestVideoPacketPartialFrameAtEOF(t *testing.T) {
+	frame := videoPacketFrame([]byte("0123456789"))
+	// cut off before its tail
+	cut := frame[:len(frame)-1]
+	for _, flush := range []bool{true, false} {
+		f := NewVideoPacketStreamFactory(newTestDeliver(t, nil), 0, flush)
+		r := bytes.NewReader(cut)
+		_, err := f.parseVideoPacketRequest(r, log.NewEntry(log.StandardLogger()))
+		p, ok := err.(*partialRequest)
+		if flush && (!ok || !bytes.Equal(p.data, frame)) {
+			t.Fatalf("got %v for a frame cut off before its tail, want the frame", err)
+		}
+		if !flush && err != io.EOF {
+			t.Fatalf("got %v for a frame cut off before its tail without flush, want EOF", err)
+		}
+		if _, err := f.parseVideoPacketRequest(r, log.NewEntry(log.StandardLogger())); err != io.EOF {
+			t.Fatalf("got %v after the cut off frame, want EOF", err)
+		}
+	}
+	// cut off within its data, it is never flushed
+	f := NewVideoPacketStreamFactory(newTestDeliver(t, nil), 0, true)
+	_, err := f.parseVideoPacketRequest(bytes.NewReader(frame[:len(frame)-2]), log.NewEntry(log.StandardLogger()))
+	if _, ok := err.(*partialRequest); ok || err == nil {
+		t.Fatalf("got %v for a frame cut off within its data, want an error", err)
+	}
+}
+
+func TestVideoPacketFlushPartialDelivers(t *testing.T) {
+	first := videoPacketFrame([]byte("first"))
+	last := videoPacketFrame([]byte("last"))
+	for _, flush := range []bool{true, false} {
+		m := metrics.NewSet()
+		path := filepath.Join(t.TempDir(), "sink")
+		d := newTestDeliver(t, &deliver.DeliverConfig{Sink: deliver.SinkFile, SinkPath: path, Metrics: m})
+		feedStream(t, NewVideoPacketStreamFactory(d, 0, flush), first, last[:len(last)-1])
+		want := 1
+		if flush {
+			want = 2
+		}
+		parsed := m.RequestsParsed.With(ProtoVideoPacket.String())
+		deadline := time.Now().Add(2 * time.Second)
+		for parsed.Value() < uint64(want) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// nothing more is parsed
+		time.Sleep(50 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		err := d.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sunk := string(b)
+		if got := strings.Count(sunk, " len "); got != want {
+			t.Fatalf("flush %v sunk %d requests, want %d:\n%s", flush, got, want, sunk)
+		}
+		if got := strings.Contains(sunk, fmt.Sprintf("%q", last)); got != flush {
+			t.Fatalf("flush %v sunk the last frame with its tail %v:\n%s", flush, got, sunk)
+		}
+		if got := m.PartialFlushes.Value(); got != uint64(want-1) {
+			t.Fatalf("flush %v counted %d partial flushes", flush, got)
+		}
+	}
+}
+
+func TestVideoPacketFrameLength(t *testing.T) {
+	next := videoPacketFrame([]byte("next"))
+	for _, c := range []struct {
+		length uint32
+		valid  bool
+	}{
+		{0, false},
+		{VideoPacketOverhead - 1, false},
+		{VideoPacketOverhead, true},
+		{VideoPacketOverhead + 1, true},
+	} {
+		frame := []byte{0x26, 0, 0, 0, 0, 1}
+		binary.BigEndian.PutUint32(frame[1:], c.length)
+		frame = append(frame, make([]byte, 10)...)
+		if c.length > VideoPacketOverhead {
+			frame = append(frame, bytes.Repeat([]byte("x"), int(c.length-VideoPacketOverhead))...)
+		}
+		frame = append(frame, 0x28)
+		f := NewVideoPacketStreamFactory(newTestDeliver(t, nil), 0, false)
+		got, err := f.parseVideoPacketRequest(bytes.NewReader(append(frame, next...)), testLogger())
+		if err != nil {
+			t.Fatalf("length %d: %v", c.length, err)
+		}
+		// a rejected frame is skipped up to the next one
+		want := next
+		if c.valid {
+			want = frame
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("length %d: got %q, want %q", c.length, got, want)
+		}
+	}
+}
+
+// failingReader fails every Read with err.
+type failingReader struct {
+	err   error
+	reads int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return 0, r.err
+}
+
+func TestVideoPacketReadErrorGivesUp(t *testing.T) {
+	f := NewVideoPacketStreamFactory(newTestDeliver(t, nil), 0, false)
+	r := &failingReader{err: errors.New("connection reset")}
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.parseVideoPacketRequest(r, testLogger())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != r.err {
+			t.Fatalf("got %v, want the read error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("parser spins on a failing reader")
+	}
+	if r.reads != VideoPacketMaxReadRetries {
+		t.Fatalf("read %d times, want %d", r.reads, VideoPacketMaxReadRetries)
+	}
+}
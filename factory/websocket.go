@@ -0,0 +1,327 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// larger handshakes are taken as garbage
+	WebSocketMaxHandshakeSize int = 64 * 1024
+	// larger messages are skipped
+	WebSocketMaxMessageSize int64 = 16 * 1024 * 1024
+)
+
+// WebSocket opcodes
+const (
+	WebSocketContinuation byte = 0x0
+	WebSocketText         byte = 0x1
+	WebSocketBinary       byte = 0x2
+	WebSocketClose        byte = 0x8
+	WebSocketPing         byte = 0x9
+	WebSocketPong         byte = 0xA
+)
+
+const (
+	webSocketFin    byte = 0x80
+	webSocketRsv    byte = 0x70
+	webSocketOpcode byte = 0x0F
+	webSocketMask   byte = 0x80
+)
+
+// TCP -> WebSocket
+type WebSocketStreamFactory struct {
+	d *deliver.Deliver
+	// forward close, ping and pong frames too
+	control bool
+	streams
+}
+
+func init() {
+	Register(ProtoWebSocket.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewWebSocketStreamFactory(d, o.WebSocketControl), nil
+	})
+}
+
+func (f *WebSocketStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoWebSocket.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		l := s.logger().WithField("factory", "WebSocketStreamFactory")
+		handshake, ok := isWebSocketClient(r)
+		if !ok {
+			l.Debug("not a client stream, skip it")
+			drain(r)
+			return
+		}
+		c := &webSocketConn{f: f, r: r, l: l, handshake: handshake}
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, c.parse, "WebSocketStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, c.parse, "WebSocketStreamFactory")
+		}
+	})
+	return s
+}
+
+// isWebSocketClient tells client streams from server ones, a
+// client stream starts with the upgrade request, or with a
+// masked frame when the capture began after the handshake.
+func isWebSocketClient(r *bufio.Reader) (handshake bool, ok bool) {
+	head, err := r.Peek(4)
+	if err != nil {
+		return false, false
+	}
+	if string(head) == "GET " {
+		return true, true
+	}
+	// servers never mask their frames
+	op := head[0] & webSocketOpcode
+	masked := head[1]&webSocketMask != 0
+	return false, masked && (op == WebSocketContinuation || isWebSocketData(op) || isWebSocketControl(op))
+}
+
+// webSocketMessage is a fragmented message being assembled.
+type webSocketMessage struct {
+	// FIN, RSV and opcode of the first frame
+	head    byte
+	payload []byte
+	// too large, following fragments are dropped
+	skip bool
+}
+
+// webSocketConn is the client side state of a connection.
+type webSocketConn struct {
+	f *WebSocketStreamFactory
+	r *bufio.Reader
+	l *log.Entry
+	// the upgrade request is read first
+	handshake bool
+	msg       *webSocketMessage
+}
+
+// https://tools.ietf.org/html/rfc6455#section-5.2
+/*
+WebSocket frame:
++-+-+-+-+-------+-+-------------+-------------------------------+
+|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+|I|S|S|S|  (4)  |A|     (7)     |            (16/64)            |
+|N|V|V|V|       |S|             |  (if payload len==126/127)    |
+| |1|2|3|       |K|             |                               |
++-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+|  Masking-key, if MASK set     |          Payload Data         |
++-------------------------------+-------------------------------+
+A message is a data frame without FIN followed by continuation
+frames until FIN, control frames may come in between.
+*/
+// parse returns the upgrade request or a whole client message.
+// Messages are sent as one frame with a zero masking key, so
+// the payload is in the clear and still valid for servers.
+// Control frames are skipped unless control is set.
+// The r argument is the same reader as c.r.
+func (c *webSocketConn) parse(r io.Reader) ([]byte, error) {
+	if c.handshake {
+		c.handshake = false
+		return c.readHandshake()
+	}
+	for {
+		head, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		op := head & webSocketOpcode
+		switch {
+		case isWebSocketControl(op):
+			if !c.f.control {
+				c.l.WithField("opcode", op).Debug("skip control frame")
+				continue
+			}
+			return encodeWebSocketFrame(head, payload), nil
+		case op == WebSocketContinuation:
+			if c.msg == nil {
+				c.l.Debug("skip continuation without a message")
+				continue
+			}
+			if payload == nil {
+				c.msg.skip, c.msg.payload = true, nil
+			}
+			if !c.msg.skip {
+				c.msg.payload = append(c.msg.payload, payload...)
+				if int64(len(c.msg.payload)) > WebSocketMaxMessageSize {
+					c.l.Debugf("skip message larger than %d", WebSocketMaxMessageSize)
+					c.msg.skip, c.msg.payload = true, nil
+				}
+			}
+		case isWebSocketData(op):
+			if c.msg != nil {
+				c.l.Debug("drop unfinished message")
+			}
+			c.msg = &webSocketMessage{head: head, payload: payload, skip: payload == nil}
+		default:
+			return nil, fmt.Errorf("unknown opcode %#x", op)
+		}
+		if head&webSocketFin == 0 {
+			continue
+		}
+		msg := c.msg
+		c.msg = nil
+		if msg.skip {
+			continue
+		}
+		data := encodeWebSocketFrame(webSocketFin|msg.head&(webSocketRsv|webSocketOpcode), msg.payload)
+		c.l.WithFields(log.Fields{"len": len(msg.payload), "opcode": msg.head & webSocketOpcode}).Debug("got a valid message")
+		return data, nil
+	}
+}
+
+// readHandshake returns the upgrade request as captured, a
+// stream upgraded to something else is given up.
+func (c *webSocketConn) readHandshake() ([]byte, error) {
+	var raw []byte
+	for {
+		line, err := readLine(c.r)
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, line...)
+		if len(raw) > WebSocketMaxHandshakeSize {
+			return nil, fmt.Errorf("handshake larger than %d", WebSocketMaxHandshakeSize)
+		}
+		if string(line) == "\r\n" || string(line) == "\n" {
+			break
+		}
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("parse handshake failed: %v", err)
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("not a websocket upgrade request %s %s", req.Method, req.URL)
+	}
+	c.l.WithFields(log.Fields{"url": req.URL.String(), "len": len(raw)}).Debug("got handshake")
+	return raw, nil
+}
+
+// readFrame returns the first byte and the unmasked payload of
+// a frame, the payload is nil if it is discarded for its size.
+func (c *webSocketConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		c.l.WithError(err).Debug("read frame header failed")
+		return 0, nil, err
+	}
+	masked := header[1]&webSocketMask != 0
+	size := int64(header[1] &^ webSocketMask)
+	extra := 0
+	switch size {
+	case 126:
+		extra = 2
+	case 127:
+		extra = 8
+	}
+	if masked {
+		extra += 4
+	}
+	header = header[:2+extra]
+	if _, err := io.ReadFull(c.r, header[2:]); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	switch size {
+	case 126:
+		size = int64(binary.BigEndian.Uint16(header[2:]))
+	case 127:
+		size = int64(binary.BigEndian.Uint64(header[2:]))
+		if size < 0 {
+			// the most significant bit must be 0
+			return 0, nil, fmt.Errorf("frame len %d not valid", uint64(size))
+		}
+	}
+	op := header[0] & webSocketOpcode
+	if isWebSocketControl(op) && size > 125 {
+		return 0, nil, fmt.Errorf("control frame len %d not valid", size)
+	}
+	if size > WebSocketMaxMessageSize {
+		c.l.WithField("len", size).Debug("skip large frame")
+		if _, err := io.CopyN(ioutil.Discard, c.r, size); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		return header[0], nil, nil
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if masked {
+		key := header[len(header)-4:]
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return header[0], payload, nil
+}
+
+// encodeWebSocketFrame builds a masked client frame with a zero
+// masking key, which leaves the payload as it is.
+func encodeWebSocketFrame(head byte, payload []byte) []byte {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, head)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, webSocketMask|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, webSocketMask|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, webSocketMask|127)
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(n))
+		frame = append(frame, size[:]...)
+	}
+	frame = append(frame, 0, 0, 0, 0)
+	return append(frame, payload...)
+}
+
+func isWebSocketData(op byte) bool {
+	return op == WebSocketText || op == WebSocketBinary
+}
+
+func isWebSocketControl(op byte) bool {
+	return op == WebSocketClose || op == WebSocketPing || op == WebSocketPong
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func NewWebSocketStreamFactory(d *deliver.Deliver, control bool) *WebSocketStreamFactory {
+	return &WebSocketStreamFactory{
+		d:       d,
+		control: control,
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// xid and type
+	ZKRequestHeaderSize int = 8
+	// protocol version, last zxid seen, timeout, session id and
+	// a 16 bytes password, newer clients add a read only flag
+	ZKConnectRequestSize int = 44
+	// xid, zxid and error code
+	ZKReplyHeaderSize int = 16
+	// larger messages are taken as garbage, servers reject
+	// requests over 1MB unless jute.maxbuffer is raised
+	ZKMaxMessageSize int = 4 * 1024 * 1024
+)
+
+// special xids
+const (
+	ZKNotificationXid int32 = -1
+	ZKPingXid         int32 = -2
+	ZKAuthXid         int32 = -4
+	ZKSetWatchesXid   int32 = -8
+)
+
+// request types sent by clients
+var zkOpCodes = map[int32]bool{
+	1: true, 2: true, 3: true, 4: true, 5: true, 6: true, 7: true, 8: true, 9: true,
+	11: true, 12: true, 13: true, 14: true, 15: true, 16: true, 17: true, 18: true,
+	19: true, 20: true, 21: true, 22: true, 100: true, 101: true, 102: true, 103: true,
+	104: true, 105: true, 106: true, 107: true, -11: true,
+}
+
+// TCP -> ZooKeeper
+type ZooKeeperStreamFactory struct {
+	d *deliver.Deliver
+	// replay ping requests, sessions of replayed connections
+	// are kept alive by other requests only otherwise
+	pings bool
+	streams
+}
+
+func init() {
+	Register(ProtoZooKeeper.String(), func(d *deliver.Deliver, o *Options) (tcpassembly.StreamFactory, error) {
+		return NewZooKeeperStreamFactory(d, o.ZooKeeperPings), nil
+	})
+}
+
+func (f *ZooKeeperStreamFactory) New(l, r gopacket.Flow) tcpassembly.Stream {
+	s := newStream(l, r, ProtoZooKeeper.String())
+	f.start(f.d, s, func() {
+		r := bufio.NewReader(newContextReader(f.d.Ctx, s))
+		l := s.logger().WithField("factory", "ZooKeeperStreamFactory")
+		if !zkClientStream(r) {
+			l.Debug("not a client stream, skip it")
+			drain(r)
+			return
+		}
+		parse := f.zkParser(l)
+		if f.d.Config.Mode == deliver.ModeRaw {
+			relayRaw(f.d, s, r, parse, "ZooKeeperStreamFactory")
+		} else {
+			handleRequests(f.d, s, r, parse, "ZooKeeperStreamFactory")
+		}
+	})
+	return s
+}
+
+// zkParser returns the parseFunc of a stream, l logs its flow.
+func (f *ZooKeeperStreamFactory) zkParser(l *log.Entry) parseFunc {
+	return func(r io.Reader) ([]byte, error) {
+		return f.parseZKRequest(r, l)
+	}
+}
+
+// https://zookeeper.apache.org/doc/current/zookeeperInternals.html
+/*
+Request, all integers are big endian:
++--------+...+--------+--------+...+--------+--------+...+--------+...
+| length              | xid                 | type                | body
++--------+...+--------+--------+...+--------+--------+...+--------+...
+Connect request:
++--------+...+--------+--------+...+--------+--------+...+--------+--------+...+--------+...
+| length              | protocol version    | last zxid seen (8)  | timeout             | session id, password
++--------+...+--------+--------+...+--------+--------+...+--------+--------+...+--------+...
+Reply:
++--------+...+--------+--------+...+--------+--------+...+--------+--------+...+--------+...
+| length              | xid                 | zxid (8)            | error code          | body
++--------+...+--------+--------+...+--------+--------+...+--------+--------+...+--------+...
+length does not count itself. The connect request is the first
+message of a connection, its protocol version 0 is where other
+requests have their xid, which starts at 1.
+*/
+// parseZKRequest returns the whole message of a request, ping
+// requests are skipped unless pings is set.
+func (f *ZooKeeperStreamFactory) parseZKRequest(r io.Reader, l *log.Entry) ([]byte, error) {
+	for {
+		msg, err := readZKMessage(r, l)
+		if err != nil {
+			return nil, err
+		}
+		body := msg[4:]
+		if isZKConnect(body) {
+			l.WithField("len", len(msg)).Debug("got a connect request")
+			return msg, nil
+		}
+		if len(body) < ZKRequestHeaderSize {
+			return nil, fmt.Errorf("request len %d too short", len(body))
+		}
+		xid := int32(binary.BigEndian.Uint32(body))
+		typ := int32(binary.BigEndian.Uint32(body[4:]))
+		if !zkOpCodes[typ] {
+			return nil, fmt.Errorf("request type %d not valid", typ)
+		}
+		if xid == ZKPingXid && !f.pings {
+			l.Debug("skip ping request")
+			continue
+		}
+		l.WithFields(log.Fields{"len": len(msg), "xid": xid, "type": typ}).Debug("got a valid request")
+		return msg, nil
+	}
+}
+
+func readZKMessage(r io.Reader, l *log.Entry) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		l.WithError(err).Debug("read length failed")
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head)
+	if length > uint32(ZKMaxMessageSize) {
+		return nil, fmt.Errorf("message len %d longer than %d", length, ZKMaxMessageSize)
+	}
+	msg := make([]byte, 4+int(length))
+	copy(msg, head)
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		l.WithError(err).Debug("read message failed")
+		return nil, unexpectedEOF(err)
+	}
+	return msg, nil
+}
+
+func isZKConnect(body []byte) bool {
+	return len(body) >= ZKConnectRequestSize && binary.BigEndian.Uint32(body) == 0
+}
+
+// zkClientStream tells a client stream by its first message
+// without consuming it. A connect response is shorter than a
+// connect request, and replies carry an error code where most
+// requests have path bytes.
+func zkClientStream(r *bufio.Reader) bool {
+	head, err := r.Peek(4)
+	if err != nil {
+		return false
+	}
+	length := int(binary.BigEndian.Uint32(head))
+	if length < ZKRequestHeaderSize || length > ZKMaxMessageSize {
+		return false
+	}
+	n := length
+	if n > ZKReplyHeaderSize {
+		n = ZKReplyHeaderSize
+	}
+	b, err := r.Peek(4 + n)
+	if err != nil {
+		return false
+	}
+	body := b[4:]
+	switch int32(binary.BigEndian.Uint32(body)) {
+	case 0:
+		return length >= ZKConnectRequestSize
+	case ZKSetWatchesXid:
+		// the request starts with a zxid, its reply has no body
+		return length > ZKReplyHeaderSize
+	}
+	if n >= ZKReplyHeaderSize {
+		// error codes are 0 or small negative numbers
+		if code := int32(binary.BigEndian.Uint32(body[12:])); code <= 0 && code > -200 {
+			return false
+		}
+	}
+	return zkOpCodes[int32(binary.BigEndian.Uint32(body[4:]))]
+}
+
+func NewZooKeeperStreamFactory(d *deliver.Deliver, pings bool) *ZooKeeperStreamFactory {
+	return &ZooKeeperStreamFactory{
+		d:     d,
+		pings: pings,
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// what happens to a stream missing a segment
+const (
+	// skip the missing bytes once the assembler gives up on
+	// them, parsers see the data around the gap joined
+	GapSkip = "skip"
+	// buffer out of order data for up to GapTimeout waiting
+	// for the retransmit, then skip the gap
+	GapWait = "wait"
+	// close the stream at the gap, the rest of the connection
+	// is dropped
+	GapAbort = "abort"
+)
+
+// how long GapWait waits for a missing segment
+const DefaultGapTimeout = time.Second * 2
+
+// gapFilter wraps the streams of the factory to count the gaps
+// handed over by the assembler and to apply the policy.
+type gapFilter struct {
+	f     tcpassembly.StreamFactory
+	abort bool
+	m     *metrics.Set
+}
+
+func (g *gapFilter) New(l, r gopacket.Flow) tcpassembly.Stream {
+	src, dst := l.Endpoints()
+	sport, dport := r.Endpoints()
+	return &gapStream{
+		Stream: g.f.New(l, r),
+		flow:   fmt.Sprintf("%v:%v->%v:%v", src, sport, dst, dport),
+		abort:  g.abort,
+		m:      g.m,
+	}
+}
+
+// gapStream passes reassembled data to the wrapped stream up
+// to the first gap if abort is set. A skip of -1 marks a stream
+// captured after its start and is not a gap.
+type gapStream struct {
+	tcpassembly.Stream
+	flow    string
+	abort   bool
+	m       *metrics.Set
+	gaps    int
+	skipped int
+	// the wrapped stream was completed at a gap
+	aborted bool
+}
+
+func (s *gapStream) Reassembled(rs []tcpassembly.Reassembly) {
+	if s.aborted {
+		return
+	}
+	for i, r := range rs {
+		if r.Skip <= 0 {
+			continue
+		}
+		s.gaps++
+		s.skipped += r.Skip
+		s.m.Gaps.Inc()
+		if !s.abort {
+			continue
+		}
+		log.Warnf("stream %s missing %d bytes, abort it", s.flow, r.Skip)
+		s.m.GapAborts.Inc()
+		if i > 0 {
+			s.Stream.Reassembled(rs[:i])
+		}
+		s.aborted = true
+		s.Stream.ReassemblyComplete()
+		return
+	}
+	s.Stream.Reassembled(rs)
+}
+
+func (s *gapStream) ReassemblyComplete() {
+	s.m.StreamGaps.Observe(float64(s.gaps))
+	if s.gaps > 0 {
+		log.Infof("stream %s had %d gaps, %d bytes missing", s.flow, s.gaps, s.skipped)
+	}
+	if !s.aborted {
+		s.Stream.ReassemblyComplete()
+	}
+}
@@ -0,0 +1,142 @@
+package tcplayer
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// dataStream records the data reassembled for a stream.
+type dataStream struct {
+	mu        sync.Mutex
+	data      bytes.Buffer
+	completed int
+}
+
+func (s *dataStream) Reassembled(rs []tcpassembly.Reassembly) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range rs {
+		s.data.Write(r.Bytes)
+	}
+}
+
+func (s *dataStream) ReassemblyComplete() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed++
+}
+
+func (s *dataStream) state() (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.String(), s.completed
+}
+
+// clientFactory records the stream of the client, the stream
+// of the server is dropped.
+type clientFactory struct {
+	s *dataStream
+}
+
+func (f *clientFactory) New(_, tcp gopacket.Flow) tcpassembly.Stream {
+	if src, _ := tcp.Endpoints(); src.String() == "6379" {
+		return dropStream{}
+	}
+	return f.s
+}
+
+// gapConn assembles the handshake and a request in segments
+// "aaaa", "bbbb" and "cccc" of which "bbbb" is lost, then a
+// response 3 seconds later.
+func gapConn(a *assembly) {
+	client, seen := net.IPv4(10, 1, 0, 5), time.Unix(1500000000, 0)
+	assembleSegment(a, client, &layers.TCP{SrcPort: 40000, DstPort: 6379, Seq: 999, SYN: true, Window: 65535}, "", seen)
+	assembleSegment(a, client, &layers.TCP{SrcPort: 6379, DstPort: 40000, Seq: 4999, SYN: true, ACK: true, Window: 65535}, "", seen)
+	for i, payload := range []string{"aaaa", "", "cccc"} {
+		if payload == "" {
+			continue
+		}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 6379, Seq: 1000 + uint32(4*i), ACK: true, Window: 65535}
+		assembleSegment(a, client, tcp, payload, seen.Add(time.Duration(i)*time.Millisecond))
+	}
+	tcp := &layers.TCP{SrcPort: 6379, DstPort: 40000, Seq: 5000, ACK: true, Window: 65535}
+	assembleSegment(a, client, tcp, "+OK\r\n", seen.Add(3*time.Second))
+}
+
+func newGapAssembly(policy string, m *metrics.Set) (*assembly, *dataStream) {
+	s := &dataStream{}
+	perConn := DefaultMaxBufferedPagesPerConn
+	if policy == GapWait {
+		perConn = 0
+	}
+	f := &gapFilter{f: &clientFactory{s: s}, abort: policy == GapAbort, m: m}
+	return newAssembly(f, perConn, 0, DirectionBoth), s
+}
+
+func TestGapPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy    string
+		data      string
+		gaps      uint64
+		aborts    uint64
+		completed int
+	}{
+		// joined at the gap
+		{GapSkip, "aaaacccc", 1, 0, 1},
+		// ended at the gap
+		{GapAbort, "aaaa", 1, 1, 1},
+	} {
+		m := metrics.NewSet()
+		a, s := newGapAssembly(c.policy, m)
+		gapConn(a)
+		a.flushAll()
+		data, completed := s.state()
+		if data != c.data || completed != c.completed {
+			t.Errorf("%s got %q completed %d times, want %q completed %d times", c.policy, data, completed, c.data, c.completed)
+		}
+		if m.Gaps.Value() != c.gaps || m.GapAborts.Value() != c.aborts {
+			t.Errorf("%s counted %d gaps and %d aborts, want %d and %d",
+				c.policy, m.Gaps.Value(), m.GapAborts.Value(), c.gaps, c.aborts)
+		}
+	}
+}
+
+func TestGapWaitRetransmit(t *testing.T) {
+	m := metrics.NewSet()
+	a, s := newGapAssembly(GapWait, m)
+	gapConn(a)
+	if data, _ := s.state(); data != "aaaa" {
+		t.Fatalf("got %q before the retransmit, want %q", data, "aaaa")
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 6379, Seq: 1004, ACK: true, Window: 65535}
+	assembleSegment(a, net.IPv4(10, 1, 0, 5), tcp, "bbbb", time.Unix(1500000003, 0))
+	if data, _ := s.state(); data != "aaaabbbbcccc" {
+		t.Fatalf("got %q after the retransmit, want %q", data, "aaaabbbbcccc")
+	}
+	if m.Gaps.Value() != 0 {
+		t.Fatalf("counted %d gaps of a retransmitted segment", m.Gaps.Value())
+	}
+}
+
+func TestGapWaitTimeout(t *testing.T) {
+	m := metrics.NewSet()
+	a, s := newGapAssembly(GapWait, m)
+	gapConn(a)
+	// the response is captured after the timeout
+	a.skipGaps(DefaultGapTimeout)
+	data, completed := s.state()
+	if data != "aaaacccc" || completed != 0 {
+		t.Fatalf("got %q completed %d times, want %q still open", data, completed, "aaaacccc")
+	}
+	if m.Gaps.Value() != 1 {
+		t.Fatalf("counted %d gaps, want 1", m.Gaps.Value())
+	}
+}
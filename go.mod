@@ -5,4 +5,8 @@ go 1.12
 require (
 	github.com/google/gopacket v1.1.17
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
+	golang.org/x/sys v0.0.0-20190422165155-953cdadca894
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,145 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// idleFilter wraps the streams of the factory to complete those
+// which get no data for timeout, so their handler goroutines
+// stop reading. Unlike flushing it goes by wall time, it also
+// reaps streams when the capture stops.
+type idleFilter struct {
+	ctx     context.Context
+	f       tcpassembly.StreamFactory
+	timeout time.Duration
+	m       *metrics.Set
+}
+
+func (i *idleFilter) New(l, r gopacket.Flow) tcpassembly.Stream {
+	src, dst := l.Endpoints()
+	sport, dport := r.Endpoints()
+	s := &idleStream{
+		Stream: i.f.New(l, r),
+		flow:   fmt.Sprintf("%v:%v->%v:%v", src, sport, dst, dport),
+		m:      i.m,
+		last:   time.Now(),
+		closed: make(chan struct{}),
+	}
+	go s.watch(i.ctx, i.timeout)
+	return s
+}
+
+// idleStream passes data to the wrapped stream until it is
+// completed by the assembler or reaped. Reassembled blocks
+// while the handler consumes the data, such a stream is busy
+// and not idle.
+type idleStream struct {
+	tcpassembly.Stream
+	flow string
+	m    *metrics.Set
+
+	mu   sync.Mutex
+	busy bool
+	// end of the latest Reassembled
+	last time.Time
+	// the wrapped stream is completed, later data is dropped
+	done   bool
+	closed chan struct{}
+}
+
+func (s *idleStream) Reassembled(rs []tcpassembly.Reassembly) {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.busy = true
+	s.mu.Unlock()
+	s.Stream.Reassembled(rs)
+	s.mu.Lock()
+	s.busy = false
+	s.last = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *idleStream) ReassemblyComplete() {
+	if s.complete() {
+		s.Stream.ReassemblyComplete()
+	}
+}
+
+// complete marks s done, it reports false if s was done already.
+func (s *idleStream) complete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return false
+	}
+	s.done = true
+	close(s.closed)
+	return true
+}
+
+// reap marks s done if it got no data for timeout, in the same
+// critical section as the check so Reassembled cannot start in
+// between. It returns how long s was idle, 0 while busy.
+func (s *idleStream) reap(timeout time.Duration) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy || s.done {
+		return 0, false
+	}
+	idle := time.Since(s.last)
+	if idle < timeout {
+		return idle, false
+	}
+	s.done = true
+	close(s.closed)
+	return idle, true
+}
+
+// watch completes s once it is idle for timeout, until s is
+// completed or ctx is done.
+func (s *idleStream) watch(ctx context.Context, timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.closed:
+			return
+		case <-t.C:
+		}
+		idle, ok := s.reap(timeout)
+		if !ok {
+			t.Reset(timeout - idle)
+			continue
+		}
+		log.Infof("stream %s idle for %v, reap it", s.flow, idle)
+		s.m.StreamsReaped.Inc()
+		s.Stream.ReassemblyComplete()
+		return
+	}
+}
@@ -0,0 +1,133 @@
+package tcplayer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/metrics"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// testStream counts the completions of a stream and blocks
+// Reassembled until unblock is closed, like a handler which is
+// slow to read.
+type testStream struct {
+	mu        sync.Mutex
+	completed int
+	// Reassembled after completion
+	late    int
+	unblock chan struct{}
+}
+
+func (s *testStream) Reassembled([]tcpassembly.Reassembly) {
+	<-s.unblock
+	s.mu.Lock()
+	if s.completed > 0 {
+		s.late++
+	}
+	s.mu.Unlock()
+}
+
+func (s *testStream) ReassemblyComplete() {
+	s.mu.Lock()
+	s.completed++
+	s.mu.Unlock()
+}
+
+func (s *testStream) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completed, s.late
+}
+
+type testFactory struct {
+	s *testStream
+}
+
+func (f *testFactory) New(gopacket.Flow, gopacket.Flow) tcpassembly.Stream {
+	return f.s
+}
+
+func newIdleStream(t *testing.T, timeout time.Duration) (*idleStream, *testStream) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ts := &testStream{unblock: make(chan struct{})}
+	f := &idleFilter{ctx: ctx, f: &testFactory{s: ts}, timeout: timeout, m: metrics.NewSet()}
+	net := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	tcp := gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x9c, 0x40}, []byte{0x1f, 0x90})
+	return f.New(net, tcp).(*idleStream), ts
+}
+
+func TestIdleStreamReaped(t *testing.T) {
+	_, ts := newIdleStream(t, 50*time.Millisecond)
+	close(ts.unblock)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if completed, _ := ts.counts(); completed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle stream not reaped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBusyStreamNotReaped(t *testing.T) {
+	s, ts := newIdleStream(t, 50*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		s.Reassembled(nil)
+		close(done)
+	}()
+	// a handler reading slower than the timeout
+	time.Sleep(200 * time.Millisecond)
+	if completed, _ := ts.counts(); completed != 0 {
+		t.Fatal("busy stream reaped")
+	}
+	close(ts.unblock)
+	<-done
+	s.ReassemblyComplete()
+	if completed, late := ts.counts(); completed != 1 || late != 0 {
+		t.Fatalf("got %d completions and %d late reassemblies, want 1 and 0", completed, late)
+	}
+}
+
+func TestReapDropsLaterData(t *testing.T) {
+	// the watch never fires, reap is called by hand
+	s, ts := newIdleStream(t, time.Hour)
+	s.mu.Lock()
+	s.busy = true
+	s.last = time.Now().Add(-time.Minute)
+	s.mu.Unlock()
+	if _, ok := s.reap(time.Second); ok {
+		t.Fatal("busy stream reaped")
+	}
+	s.mu.Lock()
+	s.busy = false
+	s.mu.Unlock()
+	if _, ok := s.reap(time.Second); !ok {
+		t.Fatal("idle stream not reaped")
+	}
+	// Reassembled would block on unblock if it got to the
+	// wrapped stream
+	done := make(chan struct{})
+	go func() {
+		s.Reassembled(nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("data of a reaped stream passed on")
+	}
+	s.ReassemblyComplete()
+	if completed, _ := ts.counts(); completed != 0 {
+		t.Fatal("ReassemblyComplete passed on after reap")
+	}
+}
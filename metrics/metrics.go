@@ -0,0 +1,666 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Metrics of replayed traffic, exposed in the Prometheus text
+// format so they can be scraped without extra dependencies.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// same as the Prometheus client default buckets, in seconds
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// default buckets of request sizes, in bytes
+var DefSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// buckets of gaps per stream
+var DefGapBuckets = []float64{0, 1, 2, 5, 10, 50}
+
+// Set holds the metrics of one Player, so Players embedded in
+// one process are counted apart. A Set is written as a whole,
+// it has no label telling Players apart, each one is served by
+// itself. Sets of parts of a Player, like deliver pipelines,
+// are created by Sub and written with it.
+type Set struct {
+	RequestsParsed  *CounterVec
+	PipelineQueued  *CounterVec
+	PipelineDrops   *CounterVec
+	ParseErrors     *CounterVec
+	PartialFlushes  *Counter
+	Malformed       *CounterVec
+	Resyncs         *Counter
+	BytesSkipped    *Counter
+	BytesSent       *Counter
+	BytesReceived   *Counter
+	SendErrors      *Counter
+	SendTimeouts    *Counter
+	Reconnects      *Counter
+	TransformDrops  *Counter
+	OversizedFrames *Counter
+	DedupDrops      *Counter
+	BreakerOpens    *Counter
+	Redirects       *Counter
+	IntegrityErrors *Counter
+	Gaps            *Counter
+	GapAborts       *Counter
+	StreamsReaped   *Counter
+	ActiveStreams   *Gauge
+	ActiveConns     *Gauge
+	QueueDepth      *Gauge
+	MaxQPS          *Gauge
+	Paused          *Gauge
+	BreakerState    *GaugeVec
+	SendLatency     *Histogram
+	QueueWait       *Histogram
+	StreamGaps      *Histogram
+	RequestSize     *Histogram
+	RequestRate     *Rate
+
+	mu       sync.Mutex
+	registry []metric
+	// created by Sub, by their label
+	subs map[string]*Set
+}
+
+// Default is the Set of code not given one, like a Deliver
+// created without DeliverConfig.Metrics.
+var Default = NewSet()
+
+// NewSet creates a Set of all metrics at zero.
+func NewSet() *Set {
+	s := &Set{}
+	s.RequestsParsed = s.counterVec("tcplayer_requests_parsed_total", "Requests parsed from captured streams.", "proto")
+	s.PipelineQueued = s.counterVec("tcplayer_pipeline_requests_total", "Request copies queued to deliver pipelines.", "pipeline")
+	s.PipelineDrops = s.counterVec("tcplayer_pipeline_drops_total", "Request copies dropped by deliver pipelines with a full queue.", "pipeline")
+	s.ParseErrors = s.counterVec("tcplayer_parse_errors_total", "Streams given up on an invalid or truncated request.", "proto")
+	s.PartialFlushes = s.counter("tcplayer_partial_flushes_total", "Requests cut off by the end of their stream delivered as complete.")
+	s.Malformed = s.counterVec("tcplayer_malformed_total", "Malformed requests dropped by parsers which go on with the next one.", "proto")
+	s.Resyncs = s.counter("tcplayer_resyncs_total", "Valid messages found by parsers after skipping junk bytes.")
+	s.BytesSkipped = s.counter("tcplayer_bytes_skipped_total", "Junk bytes skipped by parsers while resyncing.")
+	s.BytesSent = s.counter("tcplayer_bytes_sent_total", "Bytes written to remote targets.")
+	s.BytesReceived = s.counter("tcplayer_bytes_received_total", "Response bytes read from remote targets.")
+	s.SendErrors = s.counter("tcplayer_send_errors_total", "Failed dials and writes to remote targets.")
+	s.SendTimeouts = s.counter("tcplayer_send_timeouts_total", "Writes to stalled remote targets timed out.")
+	s.Reconnects = s.counter("tcplayer_reconnects_total", "Long connections reestablished after failure.")
+	s.TransformDrops = s.counter("tcplayer_transform_drops_total", "Requests dropped by the transform hook.")
+	s.OversizedFrames = s.counter("tcplayer_oversized_frames_total", "Captured frames dropped for exceeding the max frame size.")
+	s.DedupDrops = s.counter("tcplayer_dedup_drops_total", "Duplicate requests dropped before delivery.")
+	s.BreakerOpens = s.counter("tcplayer_breaker_opens_total", "Circuits of remote targets opened after consecutive failures.")
+	s.Redirects = s.counter("tcplayer_redirects_total", "Redis Cluster MOVED and ASK redirects followed.")
+	s.IntegrityErrors = s.counter("tcplayer_integrity_errors_total", "Requests whose bytes changed between handoff to a sender and write.")
+	s.Gaps = s.counter("tcplayer_gaps_total", "Lost segments skipped in reassembled streams.")
+	s.GapAborts = s.counter("tcplayer_gap_aborts_total", "Streams ended at a lost segment by the abort gap policy.")
+	s.StreamsReaped = s.counter("tcplayer_streams_reaped_total", "Reassembled streams completed after getting no data for the idle timeout.")
+	s.ActiveStreams = s.gauge("tcplayer_active_streams", "Reassembled streams being parsed.")
+	s.ActiveConns = s.gauge("tcplayer_active_conns", "Open tcp connections to remote targets.")
+	s.QueueDepth = s.gauge("tcplayer_queue_depth", "Parsed requests waiting to be delivered.")
+	s.MaxQPS = s.gauge("tcplayer_max_qps", "Requests per second allowed to remote targets by the rate limit, 0 for unlimited.")
+	s.Paused = s.gauge("tcplayer_paused", "Delivers paused, they do not take requests from their queue.")
+	s.BreakerState = s.gaugeVec("tcplayer_breaker_state", "Circuit breaker state of remote targets, 0 closed, 1 open, 2 half open.", "target")
+	s.SendLatency = s.histogram("tcplayer_send_latency_seconds", "Time to write one request to a remote target.", DefBuckets)
+	s.QueueWait = s.histogram("tcplayer_queue_wait_seconds", "Time parsers are blocked on a full deliver queue.", DefBuckets)
+	s.StreamGaps = s.histogram("tcplayer_stream_gaps", "Lost segments of each completed reassembled stream.", DefGapBuckets)
+	s.RequestSize = s.histogram("tcplayer_request_size_bytes", "Length of requests parsed from captured streams.", DefSizeBuckets)
+	s.RequestRate = s.rate("tcplayer_request_rate", "Requests parsed per second of capture time, averaged over a minute.")
+	return s
+}
+
+// ObserveRequest records a request of proto parsed from
+// captured streams, seen is its capture time.
+func (s *Set) ObserveRequest(proto string, size int, seen time.Time) {
+	s.RequestsParsed.With(proto).Inc()
+	s.RequestSize.Observe(float64(size))
+	s.RequestRate.Mark(seen)
+}
+
+// Sub returns the Set of a part labeled label=value, e.g. a
+// deliver pipeline, created on first use. Its samples are
+// written by s with the label added.
+func (s *Set) Sub(label, value string) *Set {
+	key := fmt.Sprintf("%s=%q", label, value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, ok := s.subs[key]; ok {
+		return sub
+	}
+	if s.subs == nil {
+		s.subs = make(map[string]*Set)
+	}
+	sub := NewSet()
+	s.subs[key] = sub
+	return sub
+}
+
+func (s *Set) register(m metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registry = append(s.registry, m)
+}
+
+func (s *Set) counter(name, help string) *Counter {
+	c := NewCounter(name, help)
+	s.register(c)
+	return c
+}
+
+func (s *Set) counterVec(name, help, label string) *CounterVec {
+	v := NewCounterVec(name, help, label)
+	s.register(v)
+	return v
+}
+
+func (s *Set) gauge(name, help string) *Gauge {
+	g := NewGauge(name, help)
+	s.register(g)
+	return g
+}
+
+func (s *Set) gaugeVec(name, help, label string) *GaugeVec {
+	v := NewGaugeVec(name, help, label)
+	s.register(v)
+	return v
+}
+
+func (s *Set) histogram(name, help string, buckets []float64) *Histogram {
+	h := NewHistogram(name, help, buckets)
+	s.register(h)
+	return h
+}
+
+func (s *Set) rate(name, help string) *Rate {
+	r := NewRate(name, help)
+	s.register(r)
+	return r
+}
+
+type metric interface {
+	// families returns the samples of the metric, each one
+	// labeled by label if it is not empty
+	families(label string) []*family
+}
+
+// family is a metric family of the text format, samples of
+// all Sets are written after one header.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []string
+}
+
+func (f *family) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+	for _, s := range f.samples {
+		io.WriteString(w, s)
+	}
+}
+
+type desc struct {
+	name string
+	help string
+}
+
+func (d *desc) family(typ string, samples ...string) *family {
+	return &family{name: d.name, help: d.help, typ: typ, samples: samples}
+}
+
+// labels returns the label set of the non empty labels, empty
+// if there are none.
+func labels(ls ...string) string {
+	var set []string
+	for _, l := range ls {
+		if l != "" {
+			set = append(set, l)
+		}
+	}
+	if len(set) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(set, ",") + "}"
+}
+
+type Counter struct {
+	desc
+	v uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) families(label string) []*family {
+	return []*family{c.family("counter", fmt.Sprintf("%s%s %d\n", c.name, labels(label), c.Value()))}
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help}}
+	return c
+}
+
+// CounterVec is a family of counters split by one label.
+type CounterVec struct {
+	desc
+	label  string
+	mu     sync.RWMutex
+	values map[string]*Counter
+}
+
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.RLock()
+	c, ok := v.values[value]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.values[value]; !ok {
+		c = &Counter{}
+		v.values[value] = c
+	}
+	return c
+}
+
+// Values returns the current value of each label value.
+func (v *CounterVec) Values() map[string]uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	values := make(map[string]uint64, len(v.values))
+	for k, c := range v.values {
+		values[k] = c.Value()
+	}
+	return values
+}
+
+func (v *CounterVec) families(label string) []*family {
+	f := v.family("counter")
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		f.samples = append(f.samples, fmt.Sprintf("%s%s %d\n", v.name,
+			labels(label, fmt.Sprintf("%s=%q", v.label, k)), v.With(k).Value()))
+	}
+	return []*family{f}
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{
+		desc:   desc{name: name, help: help},
+		label:  label,
+		values: make(map[string]*Counter),
+	}
+	return v
+}
+
+type Gauge struct {
+	desc
+	v int64
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) families(label string) []*family {
+	return []*family{g.family("gauge", fmt.Sprintf("%s%s %d\n", g.name, labels(label), g.Value()))}
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help}}
+	return g
+}
+
+// GaugeVec is a family of gauges split by one label.
+type GaugeVec struct {
+	desc
+	label  string
+	mu     sync.RWMutex
+	values map[string]*Gauge
+}
+
+func (v *GaugeVec) With(value string) *Gauge {
+	v.mu.RLock()
+	g, ok := v.values[value]
+	v.mu.RUnlock()
+	if ok {
+		return g
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if g, ok = v.values[value]; !ok {
+		g = &Gauge{}
+		v.values[value] = g
+	}
+	return g
+}
+
+// Values returns the current value of each label value.
+func (v *GaugeVec) Values() map[string]int64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	values := make(map[string]int64, len(v.values))
+	for k, g := range v.values {
+		values[k] = g.Value()
+	}
+	return values
+}
+
+func (v *GaugeVec) families(label string) []*family {
+	f := v.family("gauge")
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		f.samples = append(f.samples, fmt.Sprintf("%s%s %d\n", v.name,
+			labels(label, fmt.Sprintf("%s=%q", v.label, k)), v.With(k).Value()))
+	}
+	return []*family{f}
+}
+
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	v := &GaugeVec{
+		desc:   desc{name: name, help: help},
+		label:  label,
+		values: make(map[string]*Gauge),
+	}
+	return v
+}
+
+type Histogram struct {
+	desc
+	mu      sync.Mutex
+	buckets []float64
+	// counts[i] observations in (buckets[i-1], buckets[i]],
+	// the last one for those above all buckets
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) families(label string) []*family {
+	f := h.family("histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i]
+		f.samples = append(f.samples, fmt.Sprintf("%s_bucket%s %d\n", h.name,
+			labels(label, fmt.Sprintf("le=%q", formatFloat(b))), cumulative))
+	}
+	f.samples = append(f.samples,
+		fmt.Sprintf("%s_bucket%s %d\n", h.name, labels(label, `le="+Inf"`), h.count),
+		fmt.Sprintf("%s_sum%s %s\n", h.name, labels(label), formatFloat(h.sum)),
+		fmt.Sprintf("%s_count%s %d\n", h.name, labels(label), h.count))
+	return []*family{f}
+}
+
+// HistogramValue is a snapshot of a Histogram, Counts[i] is the
+// cumulative count of observations up to Buckets[i].
+type HistogramValue struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
+
+func (h *Histogram) Value() *HistogramValue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := &HistogramValue{
+		Buckets: append([]float64{}, h.buckets...),
+		Counts:  make([]uint64, len(h.buckets)),
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+	var cumulative uint64
+	for i := range h.buckets {
+		cumulative += h.counts[i]
+		v.Counts[i] = cumulative
+	}
+	return v
+}
+
+// SetBuckets replaces the upper bounds of h and resets it, e.g.
+// for protocols of very different request sizes. The bounds
+// must be increasing.
+func (h *Histogram) SetBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("buckets of %s not increasing", h.name)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets = append([]float64{}, buckets...)
+	h.counts = make([]uint64, len(buckets)+1)
+	h.sum, h.count = 0, 0
+	return nil
+}
+
+// NewHistogram creates a histogram with sorted upper bounds.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+	return h
+}
+
+// weight of the latest second in the average of a minute
+var rateAlpha = 1 - math.Exp(-1.0/60)
+
+// Rate estimates the events per second as an exponentially
+// weighted moving average over a minute, like the load average.
+// Seconds are those of the event timestamps, so offline files
+// are measured like live traffic, and the rate does not decay
+// while no event comes. The busiest second is kept as the peak.
+type Rate struct {
+	desc
+	mu sync.Mutex
+	// unix second being counted, 0 before the first event
+	second int64
+	n      uint64
+	rate   float64
+	peak   uint64
+}
+
+// Mark records an event at t, a zero t is now. Events older
+// than the second being counted are counted in it.
+func (r *Rate) Mark(t time.Time) {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	sec := t.Unix()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.second == 0 {
+		r.second = sec
+	}
+	if sec > r.second {
+		r.tick(sec)
+	}
+	r.n++
+}
+
+// tick closes the counted second and the empty ones up to sec.
+func (r *Rate) tick(sec int64) {
+	r.rate += rateAlpha * (float64(r.n) - r.rate)
+	if r.n > r.peak {
+		r.peak = r.n
+	}
+	if idle := sec - r.second - 1; idle > 0 {
+		r.rate *= math.Pow(1-rateAlpha, float64(idle))
+	}
+	r.second, r.n = sec, 0
+}
+
+// Value returns the average rate and the peak per second.
+func (r *Rate) Value() (float64, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate, r.peak
+}
+
+func (r *Rate) families(label string) []*family {
+	rate, peak := r.Value()
+	return []*family{
+		r.family("gauge", fmt.Sprintf("%s%s %s\n", r.name, labels(label), formatFloat(rate))),
+		{
+			name:    r.name + "_peak",
+			help:    fmt.Sprintf("Busiest second of %s.", r.name),
+			typ:     "gauge",
+			samples: []string{fmt.Sprintf("%s_peak%s %d\n", r.name, labels(label), peak)},
+		},
+	}
+}
+
+func NewRate(name, help string) *Rate {
+	r := &Rate{desc: desc{name: name, help: help}}
+	return r
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Write writes all metrics of s and of its Subs in the
+// Prometheus text format.
+func (s *Set) Write(w io.Writer) {
+	fams := s.families("")
+	byName := make(map[string]*family, len(fams))
+	for _, f := range fams {
+		byName[f.name] = f
+	}
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.subs))
+	for k := range s.subs {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.mu.Lock()
+		sub := s.subs[k]
+		s.mu.Unlock()
+		for _, f := range sub.families(k) {
+			if own, ok := byName[f.name]; ok {
+				own.samples = append(own.samples, f.samples...)
+			}
+		}
+	}
+	for _, f := range fams {
+		f.write(w)
+	}
+}
+
+// families returns the families of the metrics of s, subs
+// excluded.
+func (s *Set) families(label string) []*family {
+	s.mu.Lock()
+	metrics := append([]metric{}, s.registry...)
+	s.mu.Unlock()
+	var fams []*family
+	for _, m := range metrics {
+		fams = append(fams, m.families(label)...)
+	}
+	return fams
+}
+
+func (s *Set) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		s.Write(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
+
+// Serve listens on addr and serves the metrics of s on
+// /metrics in background, it fails if addr can not be listened
+// on.
+func (s *Set) Serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen metrics address %s failed: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.Handler())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Errorf("serve metrics failed: %v", err)
+		}
+	}()
+	log.Infof("serve metrics on %s/metrics", ln.Addr())
+	return nil
+}
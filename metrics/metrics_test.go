@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSubWrittenWithLabel(t *testing.T) {
+	s := NewSet()
+	s.BytesSent.Add(10)
+	canary := s.Sub("pipeline", "canary")
+	canary.BytesSent.Add(5)
+	if s.Sub("pipeline", "canary") != canary {
+		t.Fatal("Sub created twice for the same label")
+	}
+	var buf bytes.Buffer
+	s.Write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"tcplayer_bytes_sent_total 10\n",
+		"tcplayer_bytes_sent_total{pipeline=\"canary\"} 5\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output misses %q", want)
+		}
+	}
+	if n := strings.Count(out, "# TYPE tcplayer_bytes_sent_total "); n != 1 {
+		t.Errorf("family header written %d times, want 1", n)
+	}
+}
@@ -0,0 +1,598 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tcplayer captures tcp traffic, parses requests of a
+// protocol and replays them to remote targets. A Player owns
+// the capture source, assembler, stream factory, deliver and
+// metrics, so several Players can run in one process without
+// sharing state.
+package tcplayer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/factory"
+	"github.com/feilengcui008/tcplayer/metrics"
+	"github.com/feilengcui008/tcplayer/source"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long to wait for pending requests to be delivered after
+// capturing stops
+const DefaultDrainTimeout = time.Second * 5
+
+// buffered pages of one connection in the assembler
+const DefaultMaxBufferedPagesPerConn = 6
+
+// log formats
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// how long the assembler waits for a missing segment before
+// skipping it, connections idle as long are closed
+const DefaultFlushInterval = time.Minute * 2
+
+type Config struct {
+	// protocol name of a registered stream factory, see factory.Names,
+	// with udp it is only the protocol label of metrics and logs
+	Protocol string
+	// deliver.TransportTCP or deliver.TransportUDP, default tcp.
+	// With udp each captured datagram is sent as one request
+	// without reassembly and parsing.
+	Transport string
+	// with udp only datagrams sent to this port are replayed,
+	// 0 for all, e.g. to skip DNS responses
+	UDPPort int
+	// options passed to the stream factory
+	Options factory.Options
+	// live source using libpcap, or offline source using pcap file
+	Source source.SourceConfig
+	// capture live from each of these interfaces instead of
+	// Source.Dev, all of them feed one assembler and deliver.
+	// Caplen, Promisc and Bpf are taken from Source unless an
+	// interface sets its own Bpf.
+	Interfaces []Interface
+	// also read pcap streams sent to this address, e.g. ":8000"
+	ListenAddr string
+	// replay a record file written with Deliver.ExportFile
+	// instead of capturing
+	ReplayFile string
+	Deliver    deliver.DeliverConfig
+	// default DefaultDrainTimeout
+	DrainTimeout time.Duration
+	// stuck or idle streams are flushed every FlushInterval,
+	// default DefaultFlushInterval, it should exceed the idle
+	// time of long connections
+	FlushInterval time.Duration
+	// out of order pages buffered by the assembler, default
+	// DefaultMaxBufferedPagesPerConn per connection and no total
+	// limit, the oldest gap is skipped once a limit is reached
+	MaxBufferedPagesPerConn int
+	MaxBufferedPagesTotal   int
+	// GapSkip, GapWait or GapAbort, default GapSkip. Skipping
+	// joins the data around a lost segment once a buffer limit
+	// or FlushInterval is reached. Waiting ignores the per
+	// connection limit and skips gaps older than GapTimeout,
+	// default DefaultGapTimeout. Aborting ends a stream at its
+	// first gap. Gaps are counted by metrics.Gaps either way.
+	GapPolicy  string
+	GapTimeout time.Duration
+	// streams getting no data for StreamIdleTimeout of wall time
+	// are completed so their parsers exit, e.g. connections
+	// opened and never used or closed. 0 leaves them to
+	// FlushInterval, which goes by capture time.
+	StreamIdleTimeout time.Duration
+	// only packets from an address within SourceCIDRs and to one
+	// within DestCIDRs are replayed, e.g. 10.1.0.0/16, checked
+	// after decoding and in addition to Bpf. An address without
+	// a mask is one host, a leading ! excludes a network. Empty
+	// lists match all. Responses come from the destination, so
+	// diff mode needs both directions to match.
+	SourceCIDRs []string
+	DestCIDRs   []string
+	// DirectionC2S or DirectionS2C only reassembles and parses
+	// streams of that direction, default DirectionBoth. Diff
+	// mode pairs requests with captured responses and needs
+	// both.
+	CaptureDirection string
+	// reassemble IPv4 fragments before tcp assembly, fragments
+	// are kept for at most FragmentTimeout
+	Defragment bool
+	// LogText or LogJSON, default LogText. LogLevel is a logrus
+	// level name like "debug", the level is kept if empty. Both
+	// apply to the global logrus logger.
+	LogFormat string
+	LogLevel  string
+	// also write captured packets to rotating pcap files if set
+	Archive *ArchiveConfig
+	// serve Stats as JSON on /stats of this address while
+	// running, e.g. ":9101", off if empty
+	AdminAddr string
+	// upper bounds in bytes of the request size histogram,
+	// default metrics.DefSizeBuckets
+	SizeBuckets []float64
+	// Run dials the targets before capturing and fails if none
+	// is reachable, unless SkipPreflight is set
+	SkipPreflight bool
+	// capture and parse without sending, requests go to the
+	// discard sink as fast as they are parsed and ParseSummary
+	// tells how parsing went, Deliver.RemoteAddrs is not needed
+	DryRun bool
+}
+
+// Interface is a device captured live with its own filter.
+type Interface struct {
+	Dev string
+	// overrides Source.Bpf if set
+	Bpf string
+}
+
+type Player struct {
+	Config      *Config
+	constructor factory.Constructor
+	// built from SourceCIDRs and DestCIDRs
+	addrs *addrFilter
+
+	// counters of this player, its deliver and stream factory
+	metrics *metrics.Set
+
+	mu sync.Mutex
+	d  *deliver.Deliver
+	// set if Config.Archive is set, closed once sources stop
+	archive *archive
+	sources sync.WaitGroup
+}
+
+// streamCounter is implemented by factories which track
+// their live streams
+type streamCounter interface {
+	ActiveStreams() uint64
+}
+
+func (c *Config) validate() error {
+	dc := &c.Deliver
+	// datagrams have no stream to relay
+	switch c.Transport {
+	case "", deliver.TransportTCP:
+	case deliver.TransportUDP:
+		if dc.Mode == deliver.ModeRaw {
+			return fmt.Errorf("udp transport does not support ModeRaw")
+		}
+	default:
+		return fmt.Errorf("unknown transport %q", c.Transport)
+	}
+	// HTTP 1.x only supports short connections and does not support ModeRaw
+	if c.Protocol == factory.ProtoHTTP.String() {
+		if dc.IsLong || dc.Mode == deliver.ModeRaw {
+			return fmt.Errorf("ProtoHTTP does not support long connection or ModeRaw")
+		}
+	}
+	// GRPC calls are sent as new HTTP/2 connections, raw mode
+	// relays whole connections over long ones
+	if c.Protocol == factory.ProtoGRPC.String() {
+		if dc.IsLong && dc.Mode == deliver.ModeRequest {
+			return fmt.Errorf("ProtoGRPC does not support long connection with ModeRequest")
+		}
+		if !dc.IsLong && dc.Mode == deliver.ModeRaw {
+			return fmt.Errorf("ProtoGRPC does not support short connection with ModeRaw")
+		}
+	}
+	// HTTP/2 requests are sent as new connections, raw mode
+	// relays whole connections
+	if c.Protocol == factory.ProtoHTTP2.String() {
+		if dc.IsLong && dc.Mode == deliver.ModeRequest {
+			return fmt.Errorf("ProtoHTTP2 does not support long connection with ModeRequest")
+		}
+	}
+	// WebSocket messages only make sense on an upgraded connection
+	if c.Protocol == factory.ProtoWebSocket.String() {
+		if !dc.IsLong {
+			return fmt.Errorf("ProtoWebSocket does not support short connection")
+		}
+	}
+	if err := c.Source.Validate(); err != nil {
+		return err
+	}
+	if len(c.Interfaces) > 0 && (c.Source.PcapFile != "" || c.ReplayFile != "") {
+		return fmt.Errorf("interfaces do not support pcap file or replay")
+	}
+	if dc.ExportFile != "" {
+		if dc.Mode == deliver.ModeRaw || dc.Diff || c.ReplayFile != "" {
+			return fmt.Errorf("export does not support ModeRaw, diff or replay")
+		}
+	}
+	if dc.Diff && c.Protocol != factory.ProtoHTTP.String() {
+		return fmt.Errorf("diff mode only supports ProtoHTTP")
+	}
+	if c.DryRun && (c.Transport == deliver.TransportUDP || c.ReplayFile != "") {
+		return fmt.Errorf("dry run needs tcp streams to parse, not udp or replay")
+	}
+	if dc.RedisCluster && c.Protocol != factory.ProtoRedis.String() {
+		return fmt.Errorf("redis cluster mode only supports ProtoRedis")
+	}
+	switch c.CaptureDirection {
+	case "", DirectionBoth:
+	case DirectionC2S, DirectionS2C:
+		if dc.Diff {
+			return fmt.Errorf("diff mode needs capture direction both")
+		}
+	default:
+		return fmt.Errorf("unknown capture direction %q", c.CaptureDirection)
+	}
+	switch c.GapPolicy {
+	case "", GapSkip, GapWait, GapAbort:
+	default:
+		return fmt.Errorf("unknown gap policy %q", c.GapPolicy)
+	}
+	if c.StreamIdleTimeout < 0 {
+		return fmt.Errorf("stream idle timeout %v negative", c.StreamIdleTimeout)
+	}
+	return nil
+}
+
+// setupLog configures the logrus logger by LogFormat and
+// LogLevel.
+func (c *Config) setupLog() error {
+	switch c.LogFormat {
+	case "", LogText:
+		log.SetFormatter(&log.TextFormatter{})
+	case LogJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", c.LogFormat)
+	}
+	if c.LogLevel != "" {
+		level, err := log.ParseLevel(c.LogLevel)
+		if err != nil {
+			return fmt.Errorf("parse log level failed: %v", err)
+		}
+		log.SetLevel(level)
+	}
+	return nil
+}
+
+// Run captures and replays traffic until ctx is done, or until
+// the pcap file or record file is consumed when ListenAddr is
+// not set. Pending requests are then delivered for at most
+// DrainTimeout. Run can be called only once.
+func (p *Player) Run(ctx context.Context) error {
+	c := p.Config
+	if c.AdminAddr != "" {
+		srv, err := p.serveAdmin(c.AdminAddr)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+	}
+	dlc := c.Deliver
+	dlc.Metrics = p.metrics
+	dlc.Proto = c.Protocol
+	dlc.Transport = c.Transport
+	if c.DryRun {
+		dlc = dryRunConfig(dlc)
+	}
+	if dlc.Diff && dlc.ResponseReader == nil {
+		dlc.ResponseReader = factory.ReadHTTPResponse
+	}
+	if !c.SkipPreflight {
+		if err := deliver.Preflight(&dlc); err != nil {
+			return fmt.Errorf("preflight failed: %v", err)
+		}
+	}
+	// capturing is stopped before deliver on exit, so that
+	// requests already read from the wire are drained, deliver
+	// outlives ctx for the same reason
+	deliverCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	captureCtx, stopCapture := context.WithCancel(ctx)
+	defer stopCapture()
+	d, err := deliver.NewDeliver(deliverCtx, &dlc)
+	if err != nil {
+		return fmt.Errorf("create deliver failed: %v", err)
+	}
+	p.mu.Lock()
+	p.d = d
+	p.mu.Unlock()
+
+	// closed when the pcap file or record file is consumed
+	consumed := make(chan struct{})
+	if c.ReplayFile != "" {
+		// requests of a record file need no capturing and parsing
+		go func() {
+			defer close(consumed)
+			if err := d.Replay(c.ReplayFile); err != nil {
+				log.Errorf("replay failed: %v", err)
+			}
+		}()
+	} else if err := p.capture(captureCtx, d, consumed); err != nil {
+		return err
+	}
+	if c.ListenAddr != "" {
+		consumed = nil
+	}
+	select {
+	case <-ctx.Done():
+	case <-consumed:
+	case <-d.Finished():
+	}
+	return p.shutdown(d, stopCapture)
+}
+
+// capture starts reading packets from the sources into a new
+// assembler, consumed is closed once the pcap source is drained.
+func (p *Player) capture(ctx context.Context, d *deliver.Deliver, consumed chan struct{}) error {
+	c := p.Config
+	handle := func(s *gopacket.PacketSource) {
+		p.handleUDPSource(ctx, d, s)
+	}
+	if c.Transport != deliver.TransportUDP {
+		f, err := p.constructor(d, &c.Options)
+		if err != nil {
+			return fmt.Errorf("create %s stream factory failed: %v", c.Protocol, err)
+		}
+		perConn := c.MaxBufferedPagesPerConn
+		if perConn <= 0 {
+			perConn = DefaultMaxBufferedPagesPerConn
+		}
+		interval := c.FlushInterval
+		if interval <= 0 {
+			interval = DefaultFlushInterval
+		}
+		var sf tcpassembly.StreamFactory = &gapFilter{f: f, abort: c.GapPolicy == GapAbort, m: p.metrics}
+		if c.StreamIdleTimeout > 0 {
+			sf = &idleFilter{ctx: ctx, f: sf, timeout: c.StreamIdleTimeout, m: p.metrics}
+		}
+		if p.addrs != nil {
+			sf = &cidrFilter{f: sf, addrs: p.addrs}
+		}
+		if c.GapPolicy == GapWait {
+			perConn = 0
+		}
+		a := newAssembly(sf, perConn, c.MaxBufferedPagesTotal, c.CaptureDirection)
+		go a.flushEvery(ctx, interval)
+		if c.GapPolicy == GapWait {
+			timeout := c.GapTimeout
+			if timeout <= 0 {
+				timeout = DefaultGapTimeout
+			}
+			go a.skipGapsEvery(ctx, timeout)
+		}
+		handle = func(s *gopacket.PacketSource) {
+			p.handleSource(ctx, a, s, f)
+		}
+	}
+	if c.Archive != nil {
+		a, err := newArchive(c.Archive)
+		if err != nil {
+			return err
+		}
+		p.archive = a
+	}
+	srcs, err := p.openSources()
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, s := range srcs {
+		p.sources.Add(1)
+		wg.Add(1)
+		go func(s *gopacket.PacketSource) {
+			defer p.sources.Done()
+			defer wg.Done()
+			handle(s)
+		}(s)
+	}
+	go func() {
+		wg.Wait()
+		close(consumed)
+	}()
+	// tcp source
+	if c.ListenAddr != "" {
+		tsc := &source.TcpSourceConfig{
+			Address: c.ListenAddr,
+		}
+		ch, err := source.NewTcpSource(ctx, tsc)
+		if err != nil {
+			return fmt.Errorf("create TcpSource failed: %v", err)
+		}
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case s := <-ch:
+					p.sources.Add(1)
+					go func() {
+						defer p.sources.Done()
+						handle(s)
+					}()
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// newSource opens a packet source of openSources, tests open
+// pcap files for Interfaces with it.
+var newSource = source.NewSource
+
+// openSources opens Source, or a live source for each of
+// Interfaces.
+func (p *Player) openSources() ([]*gopacket.PacketSource, error) {
+	c := p.Config
+	if len(c.Interfaces) == 0 {
+		sc := c.Source
+		s, err := newSource(&sc)
+		if err != nil {
+			return nil, fmt.Errorf("create source failed: %v", err)
+		}
+		return []*gopacket.PacketSource{s}, nil
+	}
+	srcs := make([]*gopacket.PacketSource, 0, len(c.Interfaces))
+	for _, i := range c.Interfaces {
+		sc := c.Source
+		sc.Dev = i.Dev
+		if i.Bpf != "" {
+			sc.Bpf = i.Bpf
+		}
+		s, err := newSource(&sc)
+		if err != nil {
+			return nil, fmt.Errorf("create source of %s failed: %v", i.Dev, err)
+		}
+		srcs = append(srcs, s)
+	}
+	return srcs, nil
+}
+
+// shutdown stops capturing and waits at most DrainTimeout for
+// deliver to send pending requests.
+func (p *Player) shutdown(d *deliver.Deliver, stopCapture context.CancelFunc) error {
+	stopCapture()
+	timeout := p.Config.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := d.Shutdown(ctx)
+	if p.archive != nil {
+		p.closeArchive(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("drain deliver failed: %v", err)
+	}
+	return nil
+}
+
+// closeArchive waits for sources to stop before closing the
+// archive, so their last packets are written. Sources stop soon
+// after capturing, unless the assembler is blocked on a stream
+// whose reader is gone, so the wait is bounded by ctx.
+func (p *Player) closeArchive(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		p.sources.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Warnf("sources not stopped on exit, archive may miss packets")
+	}
+	p.archive.close()
+}
+
+// Metrics returns the counters of p, e.g. to Serve them.
+func (p *Player) Metrics() *metrics.Set {
+	return p.metrics
+}
+
+// Deliver returns the deliver created by Run for its stats and
+// differ, nil before Run is called.
+func (p *Player) Deliver() *deliver.Deliver {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.d
+}
+
+func (p *Player) handleSource(ctx context.Context, a *assembly, pktSource *gopacket.PacketSource, f tcpassembly.StreamFactory) {
+	var (
+		totalCnt int64
+		preCnt   int64
+		preTime  = time.Now()
+		df       *defragmenter
+	)
+	if p.Config.Defragment {
+		df = newDefragmenter()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// close streams so buffered requests get delivered
+			log.Infof("stop capturing from source")
+			a.flushAll()
+			return
+		case packet, ok := <-pktSource.Packets():
+			if !ok {
+				// offline source drained, close remaining streams
+				log.Infof("source drained, total %d packets", totalCnt)
+				a.flushAll()
+				return
+			}
+			p.archive.write(packet)
+			if tcp := df.tcp(packet); tcp != nil {
+				totalCnt++
+				now := time.Now()
+				if now.After(preTime.Add(time.Second * 1)) {
+					log.Infof("total %d packets, %d packets/s", totalCnt, totalCnt-preCnt)
+					if sc, ok := f.(streamCounter); ok {
+						log.Infof("%d active streams", sc.ActiveStreams())
+					}
+					preCnt = totalCnt
+					preTime = now
+				}
+				// the addresses of a defragmented packet are
+				// those of its last fragment
+				var net gopacket.Flow
+				if n := packet.NetworkLayer(); n != nil {
+					net = n.NetworkFlow()
+				}
+				// capture timestamps are kept for timed replay
+				a.assemble(net, tcp, packet.Metadata().Timestamp)
+			}
+		}
+	}
+}
+
+// NewPlayer checks c and looks up the stream factory of
+// c.Protocol, nothing is started until Run.
+func NewPlayer(c *Config) (*Player, error) {
+	var constructor factory.Constructor
+	if c.Transport != deliver.TransportUDP {
+		var err error
+		if constructor, err = factory.Get(c.Protocol); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.setupLog(); err != nil {
+		return nil, err
+	}
+	addrs, err := newAddrFilter(c.SourceCIDRs, c.DestCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	m := metrics.NewSet()
+	if len(c.SizeBuckets) > 0 {
+		if err := m.RequestSize.SetBuckets(c.SizeBuckets); err != nil {
+			return nil, err
+		}
+	}
+	return &Player{
+		Config:      c,
+		constructor: constructor,
+		addrs:       addrs,
+		metrics:     m,
+	}, nil
+}
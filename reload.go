@@ -0,0 +1,83 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	log "github.com/sirupsen/logrus"
+)
+
+// fields of deliver.DeliverConfig applied by Reload
+var tunableFields = map[string]bool{
+	"MaxQPS":         true,
+	"MaxBytesPerSec": true,
+	"SampleRate":     true,
+	"Amplify":        true,
+	"DeliveryDelay":  true,
+	"DeliveryJitter": true,
+}
+
+// Reload applies the rate limits, sampling, amplify and delay
+// of c to the running deliver at once. Other settings of c
+// differing from Config need a restart, they are warned about
+// and ignored. Config is left unchanged.
+func (p *Player) Reload(c *Config) error {
+	d := p.Deliver()
+	if d == nil {
+		return fmt.Errorf("reload failed: player not running")
+	}
+	for _, name := range changedFields(p.Config, c) {
+		log.Warnf("config %s changed, restart to apply it", name)
+	}
+	dc := c.Deliver
+	return d.Tune(deliver.Tunables{
+		MaxQPS:         dc.MaxQPS,
+		MaxBytesPerSec: dc.MaxBytesPerSec,
+		SampleRate:     dc.SampleRate,
+		Amplify:        dc.Amplify,
+		DeliveryDelay:  dc.DeliveryDelay,
+		DeliveryJitter: dc.DeliveryJitter,
+	})
+}
+
+// changedFields returns the names of the fields of Config and
+// Config.Deliver differing between a and b which Reload can not
+// apply, funcs are not compared.
+func changedFields(a, b *Config) []string {
+	var names []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Name
+		if name == "Deliver" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			names = append(names, name)
+		}
+	}
+	da, db := va.FieldByName("Deliver"), vb.FieldByName("Deliver")
+	for i := 0; i < da.NumField(); i++ {
+		f := da.Type().Field(i)
+		if tunableFields[f.Name] || f.Type.Kind() == reflect.Func {
+			continue
+		}
+		if !reflect.DeepEqual(da.Field(i).Interface(), db.Field(i).Interface()) {
+			names = append(names, "Deliver."+f.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,105 @@
+package tcplayer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+)
+
+// lineCounter counts the lines read from all connections.
+type lineCounter struct {
+	net.Listener
+	lines int64
+}
+
+func newLineCounter(t *testing.T) *lineCounter {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := &lineCounter{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sc := bufio.NewScanner(conn)
+				for sc.Scan() {
+					atomic.AddInt64(&lc.lines, 1)
+				}
+			}()
+		}
+	}()
+	return lc
+}
+
+// send sends n requests through d and returns how long the
+// target takes to read them.
+func (lc *lineCounter) send(t *testing.T, d *deliver.Deliver, n int64) time.Duration {
+	t.Helper()
+	start, want := time.Now(), atomic.LoadInt64(&lc.lines)+n
+	for i := int64(0); i < n; i++ {
+		d.C <- deliver.NewRequest([]byte("0123456789\n"))
+	}
+	for atomic.LoadInt64(&lc.lines) < want {
+		if time.Since(start) > 3*time.Second {
+			t.Fatalf("target read %d lines, want %d", atomic.LoadInt64(&lc.lines), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return time.Since(start)
+}
+
+func TestReloadQPS(t *testing.T) {
+	lc := newLineCounter(t)
+	c := &Config{
+		Protocol: "redis",
+		Deliver: deliver.DeliverConfig{
+			RemoteAddrs: []string{lc.Addr().String()},
+			IsLong:      true,
+			Concurrency: 1,
+			QueueSize:   100,
+		},
+	}
+	d, err := deliver.NewDeliver(context.Background(), &c.Deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		d.Shutdown(ctx)
+	}()
+	p := &Player{Config: c, d: d}
+	if took := lc.send(t, d, 40); took > 500*time.Millisecond {
+		t.Fatalf("unlimited requests took %v", took)
+	}
+
+	reloaded := *c
+	reloaded.Deliver.MaxQPS = 20
+	// needs a restart, ignored
+	reloaded.Protocol = "http"
+	if err := p.Reload(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Tunables().MaxQPS; got != 20 {
+		t.Fatalf("reloaded MaxQPS %d, want 20", got)
+	}
+	if p.Config.Protocol != "redis" {
+		t.Fatalf("reload changed protocol to %s", p.Config.Protocol)
+	}
+	// a full bucket of 20, then 20 more at 20/s
+	if took := lc.send(t, d, 40); took < 800*time.Millisecond || took > 2*time.Second {
+		t.Fatalf("requests limited to 20/s took %v, want about 1s", took)
+	}
+}
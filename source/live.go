@@ -26,9 +26,14 @@ type LiveSourceConfig struct {
 }
 
 func NewLiveSource(c *LiveSourceConfig) (*gopacket.PacketSource, error) {
-	if handle, err := pcap.OpenLive(c.Dev, int32(c.Caplen), c.Promisc, pcap.BlockForever); err != nil {
+	caplen := c.Caplen
+	if caplen <= 0 {
+		caplen = DefaultCaplen
+	}
+	if handle, err := pcap.OpenLive(c.Dev, caplen, c.Promisc, pcap.BlockForever); err != nil {
 		return nil, err
-	} else if err := handle.SetBPFFilter(c.Bpf); err != nil {
+	} else if err := setBpfFilter(handle, c.Bpf); err != nil {
+		handle.Close()
 		return nil, err
 	} else {
 		pktSource := gopacket.NewPacketSource(handle, handle.LinkType())
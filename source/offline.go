@@ -26,7 +26,8 @@ type OfflineSourceConfig struct {
 func NewOfflineSource(c *OfflineSourceConfig) (*gopacket.PacketSource, error) {
 	if handle, err := pcap.OpenOffline(c.FilePath); err != nil {
 		return nil, err
-	} else if err := handle.SetBPFFilter(c.Bpf); err != nil {
+	} else if err := setBpfFilter(handle, c.Bpf); err != nil {
+		handle.Close()
 		return nil, err
 	} else {
 		pktSource := gopacket.NewPacketSource(handle, handle.LinkType())
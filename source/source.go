@@ -0,0 +1,83 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// default snapshot length of live capture, enough for jumbo
+// frames and segments of TSO/GRO capable NICs
+const DefaultCaplen int32 = 65535
+
+// SourceConfig selects the capture backend, packets are read
+// from the pcap/pcapng file if PcapFile is set, or captured
+// live from Dev otherwise. Both feed the same pipeline.
+type SourceConfig struct {
+	Dev string
+	// snapshot length of live capture, default DefaultCaplen.
+	// Packets are cut to Caplen bytes, a value below the largest
+	// segment silently corrupts reassembled payloads.
+	Caplen int32
+	// capture packets not addressed to Dev as well, e.g. from
+	// a mirror port
+	Promisc bool
+	// BPF filter applied by libpcap before packets reach the
+	// assembler, a tight filter like "tcp port 8080" together
+	// with a protocol factory saves reassembling and parsing
+	// unrelated streams on a busy host
+	Bpf      string
+	PcapFile string
+}
+
+func NewSource(c *SourceConfig) (*gopacket.PacketSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.PcapFile != "" {
+		return NewOfflineSource(&OfflineSourceConfig{
+			FilePath: c.PcapFile,
+			Bpf:      c.Bpf,
+		})
+	}
+	return NewLiveSource(&LiveSourceConfig{
+		Dev:     c.Dev,
+		Caplen:  c.Caplen,
+		Promisc: c.Promisc,
+		Bpf:     c.Bpf,
+	})
+}
+
+// Validate checks the options of c, a zero Caplen is valid.
+func (c *SourceConfig) Validate() error {
+	if c.Caplen < 0 {
+		return fmt.Errorf("caplen %d must be positive", c.Caplen)
+	}
+	return nil
+}
+
+// setBpfFilter compiles and applies expr to handle, an invalid
+// filter is reported with the expression so startup fails fast.
+func setBpfFilter(handle *pcap.Handle, expr string) error {
+	if expr == "" {
+		return nil
+	}
+	if err := handle.SetBPFFilter(expr); err != nil {
+		return fmt.Errorf("bpf filter %q not valid: %v", expr, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package tcplayer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/feilengcui008/tcplayer/source"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writeClientPcap writes a capture of a connection from client
+// sending each payload in a segment to port 6379 of testServer.
+func writeClientPcap(t *testing.T, path string, client net.IP, payloads ...string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	ts, seq := time.Unix(1500000000, 0), uint32(1000)
+	write := func(tcp *layers.TCP, payload string) {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: testServer}
+		tcp.SrcPort, tcp.DstPort, tcp.Seq, tcp.Window = 40000, 6379, seq, 65535
+		tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(time.Millisecond)
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+		if err := w.WritePacket(ci, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&layers.TCP{SYN: true}, "")
+	seq++
+	for _, p := range payloads {
+		write(&layers.TCP{ACK: true, PSH: true}, p)
+		seq += uint32(len(p))
+	}
+	write(&layers.TCP{ACK: true, FIN: true}, "")
+}
+
+func TestInterfacesShareAssembler(t *testing.T) {
+	dir := t.TempDir()
+	ping := "*1\r\n$4\r\nPING\r\n"
+	files := map[string]string{
+		"eth0": filepath.Join(dir, "eth0.pcap"),
+		"eth1": filepath.Join(dir, "eth1.pcap"),
+	}
+	writeClientPcap(t, files["eth0"], net.IPv4(10, 1, 0, 1), ping, ping, ping)
+	writeClientPcap(t, files["eth1"], net.IPv4(10, 1, 0, 2), ping, ping)
+	// each interface reads its own capture
+	defer func(open func(*source.SourceConfig) (*gopacket.PacketSource, error)) { newSource = open }(newSource)
+	newSource = func(sc *source.SourceConfig) (*gopacket.PacketSource, error) {
+		return source.NewSource(&source.SourceConfig{PcapFile: files[sc.Dev]})
+	}
+
+	var read int64
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					atomic.AddInt64(&read, int64(n))
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	p, err := NewPlayer(&Config{
+		Protocol:   "redis",
+		Interfaces: []Interface{{Dev: "eth0"}, {Dev: "eth1"}},
+		Deliver: deliver.DeliverConfig{
+			RemoteAddrs: []string{l.Addr().String()},
+			IsLong:      true,
+			Concurrency: 1,
+		},
+		LogLevel: "error",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.ReadStats().RequestsTotal; got != 5 {
+		t.Fatalf("parsed %d requests of both interfaces, want 5", got)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&read) < int64(5*len(ping)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&read); got != int64(5*len(ping)) {
+		t.Fatalf("target read %d bytes, want the %d of 5 requests", got, 5*len(ping))
+	}
+}
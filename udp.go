@@ -0,0 +1,91 @@
+// Copyright © 2017 feilengcui008 <feilengcui008@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the License);
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcplayer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/feilengcui008/tcplayer/deliver"
+	"github.com/google/gopacket"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleUDPSource sends each captured datagram as a request,
+// datagrams need no reassembly and no protocol parsing.
+func (p *Player) handleUDPSource(ctx context.Context, d *deliver.Deliver, pktSource *gopacket.PacketSource) {
+	var (
+		totalCnt int64
+		preCnt   int64
+		preTime  = time.Now()
+		df       *defragmenter
+	)
+	if p.Config.Defragment {
+		df = newDefragmenter()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infof("stop capturing from source")
+			return
+		case packet, ok := <-pktSource.Packets():
+			if !ok {
+				log.Infof("source drained, total %d datagrams", totalCnt)
+				return
+			}
+			p.archive.write(packet)
+			udp := df.udp(packet)
+			if udp == nil || len(udp.Payload) == 0 {
+				continue
+			}
+			if p.Config.UDPPort != 0 && int(udp.DstPort) != p.Config.UDPPort {
+				continue
+			}
+			n := packet.NetworkLayer()
+			if n != nil && !p.addrs.match(n.NetworkFlow()) {
+				continue
+			}
+			totalCnt++
+			now := time.Now()
+			if now.After(preTime.Add(time.Second * 1)) {
+				log.Infof("total %d datagrams, %d datagrams/s", totalCnt, totalCnt-preCnt)
+				preCnt = totalCnt
+				preTime = now
+			}
+			// symmetric like the hash of tcp streams
+			hash := udp.TransportFlow().FastHash()
+			var flow string
+			if n != nil {
+				hash += n.NetworkFlow().FastHash() * 31
+				src, dst := n.NetworkFlow().Endpoints()
+				flow = fmt.Sprintf("%v:%d->%v:%d", src, udp.SrcPort, dst, udp.DstPort)
+			}
+			d.Metrics.ObserveRequest(d.Config.Proto, len(udp.Payload), packet.Metadata().Timestamp)
+			if !d.SampleConn(hash) || !d.SampleRequest() {
+				continue
+			}
+			req := &deliver.Request{
+				Data:  append([]byte{}, udp.Payload...),
+				Time:  packet.Metadata().Timestamp,
+				Conn:  hash,
+				Proto: d.Config.Proto,
+				Flow:  flow,
+			}
+			if err := d.Enqueue(ctx, req); err != nil {
+				return
+			}
+		}
+	}
+}